@@ -16,6 +16,12 @@ func TestAllSpecs(t *testing.T) {
 	r.Parallel = false
 
 	r.AddSpec(S3SplitFileSpec)
+	r.AddSpec(CheckpointSpec)
+	r.AddSpec(ListCacheSpec)
+	r.AddSpec(SinceFileSpec)
+	r.AddSpec(ListingSnapshotSpec)
+	r.AddSpec(KeyTemplateSpec)
+	r.AddSpec(RunLockSpec)
 
 	gospec.MainGoTest(r, t)
 }
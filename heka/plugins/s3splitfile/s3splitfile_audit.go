@@ -0,0 +1,104 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An audit trail of the objects processed during a run. Each line is
+// tab-separated: "<key> <size> <bytes read> <sha256> <records> <timestamp>",
+// where the SHA256 covers the bytes actually read from the object (which is
+// less than the whole object when skipping headers or footers, or resuming
+// from a checkpoint).
+//
+// A local manifest is appended to as each object completes. A manifest
+// stored in S3 (given as "s3://bucket/key") is accumulated in memory and
+// uploaded when the manifest is closed.
+type AuditManifest struct {
+	sync.Mutex
+	w      io.Writer
+	file   *os.File
+	bucket *s3.Bucket
+	path   string
+	buf    bytes.Buffer
+}
+
+// Open an audit manifest at the given local path or S3 URL. Manifests in S3
+// are written using the connection settings of `s`.
+func NewAuditManifest(path string, s *s3.S3) (am *AuditManifest, err error) {
+	am = &AuditManifest{}
+	if strings.HasPrefix(path, "s3://") {
+		pieces := strings.SplitN(strings.TrimPrefix(path, "s3://"), "/", 2)
+		if len(pieces) != 2 || pieces[0] == "" || pieces[1] == "" {
+			return nil, fmt.Errorf("invalid S3 location %s, expected s3://bucket/key", path)
+		}
+		if s == nil {
+			return nil, fmt.Errorf("can't write %s without an S3 connection", path)
+		}
+		am.bucket = s.Bucket(pieces[0])
+		am.path = pieces[1]
+		am.w = &am.buf
+		return am, nil
+	}
+
+	am.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	am.w = am.file
+	return am, nil
+}
+
+// Record that the given object was processed.
+func (am *AuditManifest) Add(key s3.Key, bytesRead int64, sha256 string, records int64) error {
+	am.Lock()
+	defer am.Unlock()
+	_, err := fmt.Fprintf(am.w, "%s\t%d\t%d\t%s\t%d\t%s\n", key.Key, key.Size,
+		bytesRead, sha256, records, time.Now().UTC().Format(s3TimeFormat))
+	return err
+}
+
+// Switch to new credentials for uploading the manifest.
+func (am *AuditManifest) setAuth(auth aws.Auth) {
+	am.Lock()
+	defer am.Unlock()
+	if am.bucket != nil {
+		am.bucket = withAuth(am.bucket, auth)
+	}
+}
+
+// Finish writing the manifest, uploading it if it's stored in S3.
+func (am *AuditManifest) Close() error {
+	am.Lock()
+	defer am.Unlock()
+	if am.file != nil {
+		return am.file.Close()
+	}
+	return am.bucket.Put(am.path, am.buf.Bytes(), "text/plain", s3.BucketOwnerFull, s3.Options{})
+}
+
+// A hash that also counts how many bytes it has been given.
+type countingHash struct {
+	hash.Hash
+	n int64
+}
+
+func (h *countingHash) Write(p []byte) (n int, err error) {
+	n, err = h.Hash.Write(p)
+	h.n += int64(n)
+	return
+}
@@ -0,0 +1,138 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// One line of a catalog.
+type CatalogEntry struct {
+	Bucket  string `json:"bucket"`
+	Key     string `json:"key"`
+	Size    int64  `json:"size"`
+	Records int64  `json:"records"`
+	// The values of the schema dimensions in the key, by field name.
+	Partition map[string]string `json:"partition,omitempty"`
+	RunId     string            `json:"run_id"`
+}
+
+// A catalog of the objects processed during a run, as JSON lines, so other
+// systems can discover what was ingested without listing the bucket. It's
+// spooled to a local temporary file as the run goes, and stored in S3 when
+// published: written to a temporary key named after the run, then copied
+// over the final key, so a run that dies part way through never leaves a
+// partial catalog behind.
+type Catalog struct {
+	sync.Mutex
+	bucket *s3.Bucket
+	path   string
+	runId  string
+	file   *os.File
+	w      *bufio.Writer
+	size   int64
+}
+
+// Open a catalog at the given "s3://bucket/key" location, or at a plain key
+// in `bucket`. Catalogs in other buckets are written using the connection
+// settings of `bucket`.
+func NewCatalog(location string, bucket *s3.Bucket, runId string) (*Catalog, error) {
+	if bucket == nil {
+		return nil, fmt.Errorf("can't write %s without an S3 connection", location)
+	}
+	cat := &Catalog{bucket: bucket, path: location, runId: runId}
+	if strings.HasPrefix(location, "s3://") {
+		pieces := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+		if len(pieces) != 2 || pieces[0] == "" || pieces[1] == "" {
+			return nil, fmt.Errorf("invalid S3 location %s, expected s3://bucket/key", location)
+		}
+		cat.bucket = bucket.S3.Bucket(pieces[0])
+		cat.path = pieces[1]
+	}
+	if cat.path == "" {
+		return nil, fmt.Errorf("empty catalog key")
+	}
+	f, err := ioutil.TempFile("", "s3splitfile-catalog")
+	if err != nil {
+		return nil, err
+	}
+	cat.file = f
+	cat.w = bufio.NewWriter(f)
+	return cat, nil
+}
+
+// Record that the given object was processed.
+func (cat *Catalog) Add(entry CatalogEntry) error {
+	entry.RunId = cat.runId
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	cat.Lock()
+	defer cat.Unlock()
+	if cat.file == nil {
+		return fmt.Errorf("catalog is closed")
+	}
+	n, err := cat.w.Write(append(line, '\n'))
+	cat.size += int64(n)
+	return err
+}
+
+// Switch to new credentials for storing the catalog.
+func (cat *Catalog) setAuth(auth aws.Auth) {
+	cat.Lock()
+	defer cat.Unlock()
+	cat.bucket = withAuth(cat.bucket, auth)
+}
+
+// Store the catalog, replacing any previous one.
+func (cat *Catalog) Publish() error {
+	cat.Lock()
+	defer cat.Unlock()
+	if cat.file == nil {
+		return fmt.Errorf("catalog is closed")
+	}
+	if err := cat.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := cat.file.Seek(0, 0); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.tmp-%s", cat.path, cat.runId)
+	if err := cat.bucket.PutReader(tmp, cat.file, cat.size, "application/x-ndjson", s3.BucketOwnerFull, s3.Options{}); err != nil {
+		return err
+	}
+	if _, err := cat.bucket.PutCopy(cat.path, s3.BucketOwnerFull, s3.CopyOptions{}, cat.bucket.Name+"/"+tmp); err != nil {
+		return fmt.Errorf("copying %s into place: %s", tmp, err)
+	}
+	return cat.bucket.Del(tmp)
+}
+
+// Throw away the local copy of the catalog, whether or not it was
+// published.
+func (cat *Catalog) Close() error {
+	cat.Lock()
+	defer cat.Unlock()
+	if cat.file == nil {
+		return nil
+	}
+	name := cat.file.Name()
+	err := cat.file.Close()
+	cat.file = nil
+	if e := os.Remove(name); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,483 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	checkpointDone    = "done"
+	checkpointPartial = "partial"
+)
+
+// Position within a partially processed object.
+type CheckpointOffset struct {
+	ETag   string
+	Offset int64
+}
+
+// Records which objects have been completely processed, and how far we got in
+// any partially processed ones, so that a restarted input can pick up where it
+// left off. The checkpoint file is an append-only journal of tab-separated
+// lines of the form "<state> <etag> <size or offset> <key>", where the state is
+// either "done" or "partial" and the last line for a given key wins. Keys that
+// contain tabs or line breaks, or start with a double quote, are written
+// quoted, as Go string literals.
+type Checkpoint struct {
+	sync.Mutex
+	file    *os.File
+	done    map[string]string
+	partial map[string]CheckpointOffset
+	// With FlushEvery, entries waiting for the writer, which closes
+	// `flushed` once it has written them all, and the first error it hit.
+	// The writer can't take the main lock, since whoever's holding it may be
+	// waiting for room in the queue. Flush asks for an early sync on
+	// `flushNow`, and waits for the writer to close the channel it sends.
+	queue    chan string
+	flushed  chan struct{}
+	flushNow chan chan struct{}
+	errLock  sync.Mutex
+	writeErr error
+	// Set once the checkpoint is closed, after which nothing more can be
+	// recorded.
+	closed bool
+}
+
+// How many entries can be waiting for the writer before recording another
+// one blocks.
+const checkpointQueueSize = 1000
+
+// Load the checkpoint from the given file (if it exists), and open it for
+// appending further entries.
+func LoadCheckpoint(path string) (cp *Checkpoint, err error) {
+	cp = newCheckpoint()
+
+	f, err := os.Open(path)
+	if err == nil {
+		err = cp.load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error loading checkpoint %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cp.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func newCheckpoint() *Checkpoint {
+	return &Checkpoint{
+		done:    map[string]string{},
+		partial: map[string]CheckpointOffset{},
+	}
+}
+
+func (cp *Checkpoint) load(f *os.File) error {
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		pieces := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(pieces) != 4 {
+			return fmt.Errorf("invalid line %d. Expected 4 values, found %d.", lineNum, len(pieces))
+		}
+		state, etag, key := pieces[0], pieces[1], unquoteCheckpointKey(pieces[3])
+		n, err := strconv.ParseInt(pieces[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid line %d: %s", lineNum, err)
+		}
+		switch state {
+		case checkpointDone:
+			cp.done[key] = etag
+			delete(cp.partial, key)
+		case checkpointPartial:
+			cp.partial[key] = CheckpointOffset{etag, n}
+			delete(cp.done, key)
+		default:
+			return fmt.Errorf("invalid line %d: unknown state '%s'", lineNum, state)
+		}
+	}
+	return scanner.Err()
+}
+
+// Determine whether the given object has already been completely processed.
+// An object that has changed since then (according to its ETag) is not done.
+func (cp *Checkpoint) IsDone(key s3.Key) bool {
+	cp.Lock()
+	defer cp.Unlock()
+	etag, ok := cp.done[key.Key]
+	return ok && etag == key.ETag
+}
+
+// Get the offset at which to resume reading the given object. If the object
+// has changed since the offset was recorded, `changed` is true and the offset
+// is zero, since the object must be reprocessed from the start.
+func (cp *Checkpoint) Offset(key s3.Key) (offset int64, changed bool) {
+	cp.Lock()
+	defer cp.Unlock()
+	p, ok := cp.partial[key.Key]
+	if !ok {
+		return 0, false
+	}
+	if p.ETag != key.ETag {
+		return 0, true
+	}
+	return p.Offset, false
+}
+
+// Record that everything before `offset` in the given object has been
+// delivered.
+func (cp *Checkpoint) SetOffset(key s3.Key, offset int64) error {
+	cp.Lock()
+	defer cp.Unlock()
+	cp.partial[key.Key] = CheckpointOffset{key.ETag, offset}
+	return cp.write(checkpointPartial, key.ETag, offset, key.Key)
+}
+
+// Record that the given object has been completely processed.
+func (cp *Checkpoint) SetDone(key s3.Key) error {
+	cp.Lock()
+	defer cp.Unlock()
+	cp.done[key.Key] = key.ETag
+	delete(cp.partial, key.Key)
+	return cp.write(checkpointDone, key.ETag, key.Size, key.Key)
+}
+
+func (cp *Checkpoint) write(state string, etag string, n int64, key string) error {
+	if cp.closed {
+		return fmt.Errorf("checkpoint is closed")
+	}
+	line := fmt.Sprintf("%s\t%s\t%d\t%s\n", state, etag, n, quoteCheckpointKey(key))
+	if cp.queue != nil {
+		if err := cp.asyncErr(); err != nil {
+			return err
+		}
+		cp.queue <- line
+		return nil
+	}
+	_, err := cp.file.WriteString(line)
+	return err
+}
+
+// The key as written in a checkpoint line.
+func quoteCheckpointKey(key string) string {
+	if strings.ContainsAny(key, "\t\r\n") || strings.HasPrefix(key, "\"") {
+		return strconv.Quote(key)
+	}
+	return key
+}
+
+// The key written in a checkpoint line. Lines written before keys were
+// quoted may still have a key starting with a double quote, as it is.
+func unquoteCheckpointKey(s string) string {
+	if strings.HasPrefix(s, "\"") {
+		if key, err := strconv.Unquote(s); err == nil {
+			return key
+		}
+	}
+	return s
+}
+
+// Rather than writing each entry as it's recorded, hand entries to a writer
+// goroutine that writes them in batches, syncing the file every `interval`.
+// Entries recorded since the last sync may be lost if the host crashes, and
+// the objects they describe are then read again. Close writes whatever is
+// left.
+func (cp *Checkpoint) FlushEvery(interval time.Duration) {
+	cp.Lock()
+	defer cp.Unlock()
+	if cp.queue != nil {
+		return
+	}
+	cp.queue = make(chan string, checkpointQueueSize)
+	cp.flushed = make(chan struct{})
+	cp.flushNow = make(chan chan struct{})
+	go cp.writer(interval)
+}
+
+// Write and sync everything recorded so far, without waiting for the
+// writer's next sync.
+func (cp *Checkpoint) Flush() error {
+	cp.Lock()
+	defer cp.Unlock()
+	if cp.closed {
+		return fmt.Errorf("checkpoint is closed")
+	}
+	if cp.queue == nil {
+		return cp.file.Sync()
+	}
+	synced := make(chan struct{})
+	cp.flushNow <- synced
+	<-synced
+	return cp.asyncErr()
+}
+
+func (cp *Checkpoint) writer(interval time.Duration) {
+	defer close(cp.flushed)
+	w := bufio.NewWriter(cp.file)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var err error
+	flush := func() {
+		if err == nil {
+			if err = w.Flush(); err == nil {
+				err = cp.file.Sync()
+			}
+		}
+		if err != nil {
+			cp.errLock.Lock()
+			cp.writeErr = err
+			cp.errLock.Unlock()
+		}
+	}
+	for {
+		select {
+		case line, ok := <-cp.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if err == nil {
+				_, err = w.WriteString(line)
+			}
+		case synced := <-cp.flushNow:
+			// Everything Flush is waiting for is already queued, and
+			// nothing more can be while it holds the lock.
+			for queued := true; queued; {
+				select {
+				case line := <-cp.queue:
+					if err == nil {
+						_, err = w.WriteString(line)
+					}
+				default:
+					queued = false
+				}
+			}
+			flush()
+			close(synced)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// The first error the writer hit, if any.
+func (cp *Checkpoint) asyncErr() error {
+	cp.errLock.Lock()
+	defer cp.errLock.Unlock()
+	return cp.writeErr
+}
+
+func (cp *Checkpoint) Close() error {
+	cp.Lock()
+	defer cp.Unlock()
+	if cp.closed {
+		return nil
+	}
+	cp.closed = true
+	if cp.queue != nil {
+		close(cp.queue)
+		<-cp.flushed
+		if err := cp.asyncErr(); err != nil {
+			cp.file.Close()
+			return err
+		}
+	}
+	return cp.file.Close()
+}
+
+// Add the entries loaded from another checkpoint file for the keys `pick`
+// selects. The same key only appears in two files if the number of shards
+// has changed, and the files don't say which entry is newer. Entries from
+// the files keys are written to now are merged last, as `current`, and win;
+// otherwise an object done in either is done, whatever its ETag, and the
+// furthest offset is kept. Either way, an offset never undoes a done entry
+// for the same ETag.
+func (cp *Checkpoint) merge(other *Checkpoint, pick func(key string) bool, current bool) {
+	for key, etag := range other.done {
+		if !pick(key) {
+			continue
+		}
+		cp.done[key] = etag
+		delete(cp.partial, key)
+	}
+	for key, p := range other.partial {
+		if !pick(key) {
+			continue
+		}
+		if etag, ok := cp.done[key]; ok && (etag == p.ETag || !current) {
+			continue
+		}
+		if old, ok := cp.partial[key]; ok && old.ETag == p.ETag && old.Offset > p.Offset {
+			continue
+		}
+		cp.partial[key] = p
+		delete(cp.done, key)
+	}
+}
+
+// A checkpoint split over several files, each with its own lock, so that
+// many fetchers can record their progress without waiting on each other.
+// Each object belongs to one shard, by a hash of its key. With one shard the
+// checkpoint is the file at `path` itself; otherwise shards are "<path>.0",
+// "<path>.1", and so on.
+type ShardedCheckpoint struct {
+	shards []*Checkpoint
+}
+
+// Load the checkpoint at the given path, merging whatever shard files exist
+// whatever number of shards they were written with, and open `shards` files
+// for appending further entries.
+func LoadShardedCheckpoint(path string, shards int) (sc *ShardedCheckpoint, err error) {
+	paths, err := checkpointFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, shards)
+	for i := range names {
+		names[i] = path
+		if shards > 1 {
+			names[i] = fmt.Sprintf("%s.%d", path, i)
+		}
+	}
+	loaded := make([]*Checkpoint, len(paths))
+	for i, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		loaded[i] = newCheckpoint()
+		err = loaded[i].load(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error loading checkpoint %s: %s", p, err)
+		}
+	}
+	merged := newCheckpoint()
+	for _, current := range []bool{false, true} {
+		for i, p := range paths {
+			p := p
+			merged.merge(loaded[i], func(key string) bool {
+				return (names[shardIndex(key, shards)] == p) == current
+			}, current)
+		}
+	}
+
+	sc = &ShardedCheckpoint{}
+	for _, name := range names {
+		cp := newCheckpoint()
+		if cp.file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			sc.Close()
+			return nil, err
+		}
+		sc.shards = append(sc.shards, cp)
+	}
+	for key, etag := range merged.done {
+		sc.shard(key).done[key] = etag
+	}
+	for key, p := range merged.partial {
+		sc.shard(key).partial[key] = p
+	}
+	return sc, nil
+}
+
+// The existing files of the checkpoint at `path`: the file itself, then its
+// shards in order.
+func checkpointFiles(path string) (paths []string, err error) {
+	if _, err = os.Stat(path); err == nil {
+		paths = append(paths, path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	numbers := map[string]int{}
+	var shards []string
+	for _, m := range matches {
+		if n, e := strconv.Atoi(m[len(path)+1:]); e == nil && n >= 0 {
+			numbers[m] = n
+			shards = append(shards, m)
+		}
+	}
+	sort.Sort(byShardNumber{shards, numbers})
+	return append(paths, shards...), nil
+}
+
+type byShardNumber struct {
+	paths   []string
+	numbers map[string]int
+}
+
+func (s byShardNumber) Len() int           { return len(s.paths) }
+func (s byShardNumber) Swap(i, j int)      { s.paths[i], s.paths[j] = s.paths[j], s.paths[i] }
+func (s byShardNumber) Less(i, j int) bool { return s.numbers[s.paths[i]] < s.numbers[s.paths[j]] }
+
+func (sc *ShardedCheckpoint) shard(key string) *Checkpoint {
+	return sc.shards[shardIndex(key, len(sc.shards))]
+}
+
+// Which of `shards` shards the given key belongs to.
+func shardIndex(key string, shards int) int {
+	if shards == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// Write each shard's entries in the background, as for
+// Checkpoint.FlushEvery.
+func (sc *ShardedCheckpoint) FlushEvery(interval time.Duration) {
+	for _, cp := range sc.shards {
+		cp.FlushEvery(interval)
+	}
+}
+
+func (sc *ShardedCheckpoint) IsDone(key s3.Key) bool {
+	return sc.shard(key.Key).IsDone(key)
+}
+
+func (sc *ShardedCheckpoint) Offset(key s3.Key) (offset int64, changed bool) {
+	return sc.shard(key.Key).Offset(key)
+}
+
+func (sc *ShardedCheckpoint) SetOffset(key s3.Key, offset int64) error {
+	return sc.shard(key.Key).SetOffset(key, offset)
+}
+
+func (sc *ShardedCheckpoint) SetDone(key s3.Key) error {
+	return sc.shard(key.Key).SetDone(key)
+}
+
+// Close every shard, returning the first error.
+func (sc *ShardedCheckpoint) Close() (err error) {
+	for _, cp := range sc.shards {
+		if e := cp.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
@@ -0,0 +1,199 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func CheckpointSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "checkpoint-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "checkpoint")
+
+	done := s3.Key{Key: "a/b/done", ETag: "\"1\"", Size: 100}
+	partial := s3.Key{Key: "a/b/partial", ETag: "\"2\"", Size: 200}
+
+	c.Specify("Checkpoints survive a reload", func() {
+		cp, err := LoadCheckpoint(path)
+		c.Expect(err, gs.IsNil)
+		c.Expect(cp.IsDone(done), gs.IsFalse)
+		c.Expect(cp.SetOffset(done, 50), gs.IsNil)
+		c.Expect(cp.SetDone(done), gs.IsNil)
+		c.Expect(cp.SetOffset(partial, 75), gs.IsNil)
+		c.Expect(cp.Close(), gs.IsNil)
+
+		cp, err = LoadCheckpoint(path)
+		c.Expect(err, gs.IsNil)
+		c.Expect(cp.IsDone(done), gs.IsTrue)
+		c.Expect(cp.IsDone(partial), gs.IsFalse)
+
+		offset, changed := cp.Offset(partial)
+		c.Expect(offset, gs.Equals, int64(75))
+		c.Expect(changed, gs.IsFalse)
+
+		offset, changed = cp.Offset(done)
+		c.Expect(offset, gs.Equals, int64(0))
+		c.Expect(changed, gs.IsFalse)
+
+		// Objects with a different ETag have changed since the checkpoint.
+		modified := s3.Key{Key: partial.Key, ETag: "\"3\"", Size: 200}
+		offset, changed = cp.Offset(modified)
+		c.Expect(offset, gs.Equals, int64(0))
+		c.Expect(changed, gs.IsTrue)
+		c.Expect(cp.IsDone(s3.Key{Key: done.Key, ETag: "\"4\""}), gs.IsFalse)
+		c.Expect(cp.Close(), gs.IsNil)
+	})
+
+	c.Specify("Sharded checkpoints merge on load", func() {
+		keys := []s3.Key{done, partial}
+		for i := 0; i < 20; i++ {
+			keys = append(keys, s3.Key{Key: fmt.Sprintf("a/c/%d", i), ETag: "\"5\"", Size: 10})
+		}
+		sc, err := LoadShardedCheckpoint(path, 4)
+		c.Assume(err, gs.IsNil)
+		for _, k := range keys[2:] {
+			c.Expect(sc.SetDone(k), gs.IsNil)
+		}
+		c.Expect(sc.Close(), gs.IsNil)
+		for i := 0; i < 4; i++ {
+			_, err = os.Stat(fmt.Sprintf("%s.%d", path, i))
+			c.Expect(err, gs.IsNil)
+		}
+
+		// Entries from an unsharded run are picked up too.
+		cp, err := LoadCheckpoint(path)
+		c.Assume(err, gs.IsNil)
+		c.Expect(cp.SetDone(done), gs.IsNil)
+		c.Expect(cp.SetOffset(partial, 75), gs.IsNil)
+		c.Expect(cp.Close(), gs.IsNil)
+
+		for _, shards := range []int{2, 1, 4} {
+			sc, err = LoadShardedCheckpoint(path, shards)
+			c.Assume(err, gs.IsNil)
+			for _, k := range keys {
+				c.Expect(sc.IsDone(k) || k.Key == partial.Key, gs.IsTrue)
+			}
+			offset, _ := sc.Offset(partial)
+			c.Expect(offset, gs.Equals, int64(75))
+			c.Expect(sc.Close(), gs.IsNil)
+		}
+
+		// Having since finished the partial object in one shard, it's done
+		// whatever the others say.
+		sc, err = LoadShardedCheckpoint(path, 3)
+		c.Assume(err, gs.IsNil)
+		c.Expect(sc.SetDone(partial), gs.IsNil)
+		c.Expect(sc.Close(), gs.IsNil)
+		sc, err = LoadShardedCheckpoint(path, 1)
+		c.Assume(err, gs.IsNil)
+		c.Expect(sc.IsDone(partial), gs.IsTrue)
+		offset, _ := sc.Offset(partial)
+		c.Expect(offset, gs.Equals, int64(0))
+		c.Expect(sc.Close(), gs.IsNil)
+	})
+
+	c.Specify("Keys that would break a line are quoted", func() {
+		keys := []s3.Key{
+			{Key: "a/b/tab\tbed", ETag: "\"6\""},
+			{Key: "a/b/new\nline\r", ETag: "\"7\""},
+			{Key: "\"quoted\"", ETag: "\"8\""},
+		}
+		cp, err := LoadCheckpoint(path)
+		c.Assume(err, gs.IsNil)
+		for _, k := range keys {
+			c.Expect(cp.SetDone(k), gs.IsNil)
+		}
+		c.Expect(cp.SetOffset(partial, 75), gs.IsNil)
+		c.Expect(cp.Close(), gs.IsNil)
+
+		cp, err = LoadCheckpoint(path)
+		c.Assume(err, gs.IsNil)
+		for _, k := range keys {
+			c.Expect(cp.IsDone(k), gs.IsTrue)
+		}
+		offset, _ := cp.Offset(partial)
+		c.Expect(offset, gs.Equals, int64(75))
+		c.Expect(cp.Close(), gs.IsNil)
+
+		// As written before keys were quoted.
+		c.Expect(unquoteCheckpointKey("\"half"), gs.Equals, "\"half")
+	})
+
+	c.Specify("Stale entries from other shards don't win", func() {
+		// The key belongs in the first of two shards, and the second has an
+		// entry from when there were more. With three, it belongs in the
+		// third.
+		var key s3.Key
+		for i := 0; ; i++ {
+			key = s3.Key{Key: fmt.Sprintf("a/d/%d", i), ETag: "\"new\"", Size: 10}
+			if shardIndex(key.Key, 2) == 0 && shardIndex(key.Key, 3) == 2 {
+				break
+			}
+		}
+		current := fmt.Sprintf("done\t\"new\"\t10\t%s\n", key.Key)
+		stale := fmt.Sprintf("done\t\"old\"\t10\t%s\n", key.Key)
+		c.Assume(ioutil.WriteFile(path+".0", []byte(current), 0644), gs.IsNil)
+		c.Assume(ioutil.WriteFile(path+".1", []byte(stale), 0644), gs.IsNil)
+		sc, err := LoadShardedCheckpoint(path, 2)
+		c.Assume(err, gs.IsNil)
+		c.Expect(sc.IsDone(key), gs.IsTrue)
+		c.Expect(sc.Close(), gs.IsNil)
+
+		// Without an entry in its own shard, a done entry beats an offset.
+		c.Assume(ioutil.WriteFile(path+".0", []byte(stale), 0644), gs.IsNil)
+		c.Assume(ioutil.WriteFile(path+".1", []byte(fmt.Sprintf("partial\t\"new\"\t5\t%s\n", key.Key)), 0644), gs.IsNil)
+		sc, err = LoadShardedCheckpoint(path, 3)
+		c.Assume(err, gs.IsNil)
+		offset, changed := sc.Offset(key)
+		c.Expect(offset, gs.Equals, int64(0))
+		c.Expect(changed, gs.IsFalse)
+		c.Expect(sc.Close(), gs.IsNil)
+	})
+
+	c.Specify("Checkpoints can be written in the background", func() {
+		path := filepath.Join(tmpDir, "background")
+		cp, err := LoadCheckpoint(path)
+		c.Assume(err, gs.IsNil)
+		cp.FlushEvery(time.Hour)
+		c.Expect(cp.SetDone(done), gs.IsNil)
+		c.Expect(cp.IsDone(done), gs.IsTrue)
+		c.Expect(cp.Flush(), gs.IsNil)
+		data, err := ioutil.ReadFile(path)
+		c.Assume(err, gs.IsNil)
+		c.Expect(strings.HasPrefix(string(data), "done\t"), gs.IsTrue)
+
+		// Whatever hasn't been flushed yet is written on closing.
+		c.Expect(cp.SetOffset(partial, 75), gs.IsNil)
+		c.Expect(cp.Close(), gs.IsNil)
+		// Rather than sending to the writer that's gone.
+		c.Expect(cp.SetDone(partial), gs.Not(gs.IsNil))
+		c.Expect(cp.SetOffset(partial, 80), gs.Not(gs.IsNil))
+		c.Expect(cp.Flush(), gs.Not(gs.IsNil))
+		c.Expect(cp.Close(), gs.IsNil)
+		cp, err = LoadCheckpoint(path)
+		c.Assume(err, gs.IsNil)
+		offset, _ := cp.Offset(partial)
+		c.Expect(offset, gs.Equals, int64(75))
+		c.Expect(cp.Close(), gs.IsNil)
+	})
+
+	c.Specify("Corrupt checkpoints are rejected", func() {
+		err := ioutil.WriteFile(path, []byte("bogus line\n"), 0644)
+		c.Assume(err, gs.IsNil)
+		_, err = LoadCheckpoint(path)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
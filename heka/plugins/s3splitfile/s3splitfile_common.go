@@ -7,16 +7,34 @@
 package s3splitfile
 
 import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/gogoprotobuf/proto"
+	"compress/gzip"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"hash"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type PublishAttempt struct {
@@ -29,6 +47,12 @@ type Schema struct {
 	Fields       []string
 	FieldIndices map[string]int
 	Dims         map[string]DimensionChecker
+	// The prefix under which the schema's dimensions start, if the schema
+	// says.
+	Prefix string
+	// Time layouts (as for time.Parse) of dimensions whose values are dates
+	// that don't sort correctly as strings, such as "01-02-2006".
+	Formats map[string]string
 }
 
 // Determine whether a given value is acceptable for a given field, and if not
@@ -93,24 +117,85 @@ func (adc AnyDimensionChecker) IsAllowed(v string) bool {
 }
 
 // Accept a specific list of values, anything not in the list
-// will not be accepted
+// will not be accepted. Values containing glob characters ("*", "?", or
+// "[") are treated as patterns, as for path.Match, and are matched against
+// the sanitized value just as the plain ones are.
 type ListDimensionChecker struct {
 	// Use a map instead of a list internally for fast lookups.
-	allowed map[string]struct{}
+	allowed  map[string]struct{}
+	patterns []string
 }
 
 func (ldc ListDimensionChecker) IsAllowed(v string) bool {
-	_, ok := ldc.allowed[SanitizeDimension(v)]
-	return ok
+	if _, ok := ldc.allowed[SanitizeDimension(v)]; ok {
+		return true
+	}
+	for _, p := range ldc.patterns {
+		if matched, _ := path.Match(p, SanitizeDimension(v)); matched {
+			return true
+		}
+	}
+	return false
 }
 
 // Factory for creating a ListDimensionChecker using a list instead of a map
 func NewListDimensionChecker(allowed []string) *ListDimensionChecker {
 	dimMap := map[string]struct{}{}
+	patterns := []string{}
 	for _, a := range allowed {
-		dimMap[SanitizeDimension(a)] = struct{}{}
+		if isGlob(a) {
+			patterns = append(patterns, a)
+		} else {
+			dimMap[SanitizeDimension(a)] = struct{}{}
+		}
+	}
+	return &ListDimensionChecker{dimMap, patterns}
+}
+
+// Determine whether the given dimension value is a glob pattern.
+func isGlob(v string) bool {
+	return strings.ContainsAny(v, "*?[")
+}
+
+// Make sure the given value is a valid pattern, if it is one, and that it
+// can match something: keys only ever hold sanitized values, so a pattern
+// whose literal characters would be sanitized away matches no partitions.
+func checkGlob(v string) error {
+	if !isGlob(v) {
+		return nil
+	}
+	if _, err := path.Match(v, ""); err != nil {
+		return fmt.Errorf("Invalid pattern '%s': %s", v, err)
+	}
+	if literals := globLiterals(v); SanitizeDimension(literals) != literals {
+		return fmt.Errorf("Pattern '%s' can never match a sanitized value", v)
+	}
+	return nil
+}
+
+// The characters of a (valid) pattern that must appear as they are in
+// anything it matches, i.e. everything but wildcards and character classes.
+func globLiterals(pattern string) string {
+	literals := []byte{}
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+		case '[':
+			// Skip to the end of the class, minding escaped brackets.
+			for i++; i < len(pattern) && pattern[i] != ']'; i++ {
+				if pattern[i] == '\\' {
+					i++
+				}
+			}
+		case '\\':
+			if i++; i < len(pattern) {
+				literals = append(literals, pattern[i])
+			}
+		default:
+			literals = append(literals, pattern[i])
+		}
 	}
-	return &ListDimensionChecker{dimMap}
+	return string(literals)
 }
 
 // If both are specified, accept any value between `min` and `max` (inclusive).
@@ -136,6 +221,46 @@ func (rdc RangeDimensionChecker) IsAllowed(v string) bool {
 	return true
 }
 
+// Like RangeDimensionChecker, but for dates in the given layout, which are
+// compared chronologically. Values that aren't dates in that layout are not
+// accepted.
+type DateRangeDimensionChecker struct {
+	layout string
+	min    time.Time
+	max    time.Time
+	// The bounds as given, to parse again if the layout is changed.
+	bounds RangeDimensionChecker
+}
+
+func NewDateRangeDimensionChecker(layout string, min string, max string) (drdc *DateRangeDimensionChecker, err error) {
+	drdc = &DateRangeDimensionChecker{layout: layout, bounds: RangeDimensionChecker{min, max}}
+	if min != "" {
+		if drdc.min, err = time.Parse(layout, min); err != nil {
+			return nil, err
+		}
+	}
+	if max != "" {
+		if drdc.max, err = time.Parse(layout, max); err != nil {
+			return nil, err
+		}
+	}
+	return drdc, nil
+}
+
+func (drdc DateRangeDimensionChecker) IsAllowed(v string) bool {
+	t, err := time.Parse(drdc.layout, v)
+	if err != nil {
+		return false
+	}
+	if !drdc.min.IsZero() && t.Before(drdc.min) {
+		return false
+	}
+	if !drdc.max.IsZero() && t.After(drdc.max) {
+		return false
+	}
+	return true
+}
+
 // Pattern to use for sanitizing path/file components.
 var sanitizePattern = regexp.MustCompile("[^a-zA-Z0-9_/.]")
 
@@ -145,9 +270,112 @@ func SanitizeDimension(dim string) (cleaned string) {
 	return sanitizePattern.ReplaceAllString(dim, "_")
 }
 
+// Recover the dimension values of the given key, listed under `prefix`, in
+// the order of the schema's fields. This is the inverse of partitioning: the
+// first path segment after the prefix is the first dimension, and so on.
+func (s *Schema) ParseKey(prefix string, key string) (values []string, err error) {
+	if !strings.HasPrefix(key, prefix) {
+		return nil, fmt.Errorf("Key %s is not under %s", key, prefix)
+	}
+	pieces := strings.Split(key[len(prefix):], "/")
+	if len(pieces) != len(s.Fields)+1 {
+		return nil, fmt.Errorf("Key %s has %d path segments under %s, expected %d dimensions and a name", key, len(pieces), prefix, len(s.Fields))
+	}
+	return pieces[:len(s.Fields)], nil
+}
+
+// Determine whether the given key, listed under `prefix`, fits the schema:
+// it has a path segment for each dimension and then a name, and each segment
+// is allowed.
+func (s *Schema) MatchesKey(prefix string, key string) bool {
+	values, err := s.ParseKey(prefix, key)
+	if err != nil {
+		return false
+	}
+	for i, v := range values {
+		if !s.Dims[s.Fields[i]].IsAllowed(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// The index of the first of the schemas that the given key fits, or -1 if
+// it fits none of them.
+func MatchSchema(schemas []*Schema, prefix string, key string) int {
+	for i, s := range schemas {
+		if s.MatchesKey(prefix, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Treat the given field's values as dates in the given layout, both when
+// checking them against a range of allowed values and when deciding what
+// order to list them in.
+func (s *Schema) SetFormat(field string, layout string) error {
+	checker, ok := s.Dims[field]
+	if !ok {
+		return fmt.Errorf("No such field: '%s'", field)
+	}
+	// A range is compared as dates in the new layout, even if it was
+	// already dates in another one.
+	rdc, ok := checker.(RangeDimensionChecker)
+	if drdc, isDate := checker.(*DateRangeDimensionChecker); isDate {
+		rdc, ok = drdc.bounds, true
+	}
+	if ok {
+		drdc, err := NewDateRangeDimensionChecker(layout, rdc.min, rdc.max)
+		if err != nil {
+			return fmt.Errorf("Range for field '%s' doesn't match its format: %s", field, err)
+		}
+		s.Dims[field] = drdc
+	}
+	if s.Formats == nil {
+		s.Formats = map[string]string{}
+	}
+	s.Formats[field] = layout
+	return nil
+}
+
+// Reconcile the configured bucket prefix with the schema's own, which has
+// already been normalized the same way. The configured prefix takes
+// precedence, and the schema's is used if none was configured. If they
+// disagree, the configured prefix is returned along with an error describing
+// the mismatch, since listing from the wrong level of the hierarchy matches
+// nothing (or the wrong things).
+func (s *Schema) ResolvePrefix(configured string) (prefix string, mismatch error) {
+	if s.Prefix == "" || configured == s.Prefix {
+		return configured, nil
+	}
+	if configured == "" {
+		return s.Prefix, nil
+	}
+	if strings.HasPrefix(configured, s.Prefix) {
+		return configured, fmt.Errorf("Prefix '%s' is below the schema's prefix '%s', so the first dimension won't line up", configured, s.Prefix)
+	}
+	return configured, fmt.Errorf("Prefix '%s' doesn't match the schema's prefix '%s'", configured, s.Prefix)
+}
+
+// Accept any value for the given field, regardless of what the schema says.
+// This allows a single schema to be reused while selected dimensions are
+// wildcarded for a particular run.
+func (s *Schema) SetWildcard(field string) error {
+	if _, ok := s.Dims[field]; !ok {
+		return fmt.Errorf("No such field: '%s'", field)
+	}
+	s.Dims[field] = AnyDimensionChecker{}
+	return nil
+}
+
 // Load a schema from the given file name.  The file is expected to contain
 // valid JSON describing a hierarchy of dimensions, each of which specifies
-// what values are "allowed" for that dimension.
+// what values are "allowed" for that dimension. Allowed values other than
+// "*" may also be glob patterns of sanitized characters, such as "2015*" or
+// "beta_?". The optional "prefix" gives the location the first dimension is
+// found under, and a dimension's optional "format" gives a time layout for
+// date values that don't sort correctly as strings (see Schema.SetFormat).
 // Example schema:
 //   {
 //     "version": 1,
@@ -171,16 +399,33 @@ func SanitizeDimension(dim string) (cleaned string) {
 //     ]
 //   }
 func LoadSchema(schemaFileName string) (schema Schema, err error) {
+	schema, _, err = loadSchema(schemaFileName, true)
+	return
+}
+
+// Like LoadSchema, but rather than stopping at the first problem, carry on
+// through the rest of the file so an error reports every problem at once.
+// Entries in an 'allowed_values' list that aren't valid are skipped, with a
+// warning for each, and the dimension keeps its valid entries; any other
+// problem (or a list with no valid entries) is still an error.
+func LoadSchemaLenient(schemaFileName string) (schema Schema, warnings []string, err error) {
+	return loadSchema(schemaFileName, false)
+}
+
+func loadSchema(schemaFileName string, strict bool) (schema Schema, warnings []string, err error) {
 	// Placeholder for parsing JSON
 	type JSchemaDimension struct {
 		Field_name     string
 		Allowed_values interface{}
+		Format         string
 	}
 
-	// Placeholder for parsing JSON
+	// Placeholder for parsing JSON, one dimension at a time so a lenient
+	// load can report a problem with each.
 	type JSchema struct {
 		Version    int32
-		Dimensions []JSchemaDimension
+		Prefix     string
+		Dimensions []json.RawMessage
 	}
 
 	schemaBytes, err := ioutil.ReadFile(schemaFileName)
@@ -192,64 +437,137 @@ func LoadSchema(schemaFileName string) (schema Schema, err error) {
 
 	err = json.Unmarshal(schemaBytes, &js)
 	if err != nil {
+		if !strict {
+			err = jsonPositionError(schemaBytes, err)
+		}
 		return
 	}
 
 	fields := make([]string, len(js.Dimensions))
 	fieldIndices := map[string]int{}
 	dims := map[string]DimensionChecker{}
-	schema = Schema{fields, fieldIndices, dims}
+	schema = Schema{fields, fieldIndices, dims, js.Prefix, map[string]string{}}
 
-	for i, d := range js.Dimensions {
+	var errs []string
+	for i, raw := range js.Dimensions {
+		var d JSchemaDimension
+		if err = json.Unmarshal(raw, &d); err != nil {
+			if strict {
+				return
+			}
+			errs = append(errs, fmt.Sprintf("Dimension %d: %s", i+1, err))
+			continue
+		}
 		schema.Fields[i] = d.Field_name
 		schema.FieldIndices[d.Field_name] = i
-		switch d.Allowed_values.(type) {
-		case string:
-			if d.Allowed_values.(string) == "*" {
-				schema.Dims[d.Field_name] = AnyDimensionChecker{}
-			} else {
-				schema.Dims[d.Field_name] = NewListDimensionChecker([]string{d.Allowed_values.(string)})
+		checker, skipped, derr := dimensionChecker(d.Field_name, d.Allowed_values, strict)
+		warnings = append(warnings, skipped...)
+		if derr != nil {
+			if strict {
+				return schema, warnings, derr
 			}
-		case []interface{}:
-			allowed := make([]string, len(d.Allowed_values.([]interface{})))
-			for i, v := range d.Allowed_values.([]interface{}) {
-				allowedValue, ok := v.(string)
-				if !ok {
-					return schema, fmt.Errorf("Entries in 'allowed_values' for field '%s' must be strings", d.Field_name)
+			errs = append(errs, derr.Error())
+			continue
+		}
+		if checker != nil {
+			schema.Dims[d.Field_name] = checker
+		}
+		if d.Format != "" {
+			if err = schema.SetFormat(d.Field_name, d.Format); err != nil {
+				if strict {
+					return
 				}
-				allowed[i] = allowedValue
+				errs = append(errs, err.Error())
 			}
-			schema.Dims[d.Field_name] = NewListDimensionChecker(allowed)
-		case map[string]interface{}:
-			vrange := d.Allowed_values.(map[string]interface{})
-
-			vMin, okMin := vrange["min"]
-			vMax, okMax := vrange["max"]
+		}
+	}
+	err = nil
+	if len(errs) == 1 {
+		err = errors.New(errs[0])
+	} else if len(errs) > 1 {
+		err = fmt.Errorf("%d problems: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return
+}
 
-			if !okMin && !okMax {
-				return schema, fmt.Errorf("Range for field '%s' must have at least one of 'min' or 'max'", d.Field_name)
+// The checker for a dimension's 'allowed_values'. Unless `strict`, entries
+// in a list that aren't valid are skipped, and described in `skipped`.
+func dimensionChecker(field string, allowedValues interface{}, strict bool) (checker DimensionChecker, skipped []string, err error) {
+	switch allowedValues.(type) {
+	case string:
+		if allowedValues.(string) == "*" {
+			return AnyDimensionChecker{}, nil, nil
+		}
+		if err = checkGlob(allowedValues.(string)); err != nil {
+			return nil, nil, fmt.Errorf("Value of 'allowed_values' for field '%s': %s", field, err)
+		}
+		return NewListDimensionChecker([]string{allowedValues.(string)}), nil, nil
+	case []interface{}:
+		values := allowedValues.([]interface{})
+		allowed := make([]string, 0, len(values))
+		for i, v := range values {
+			allowedValue, ok := v.(string)
+			if !ok {
+				err = fmt.Errorf("Entries in 'allowed_values' for field '%s' must be strings", field)
+			} else if gerr := checkGlob(allowedValue); gerr != nil {
+				err = fmt.Errorf("Entries in 'allowed_values' for field '%s': %s", field, gerr)
 			}
-
-			ok := false
-			minStr := ""
-			if okMin {
-				minStr, ok = vMin.(string)
-				if !ok {
-					return schema, fmt.Errorf("Value of 'min' for field '%s' must be a string", d.Field_name)
+			if err != nil {
+				if strict {
+					return nil, skipped, err
 				}
+				skipped = append(skipped, fmt.Sprintf("Skipping entry %d (%v): %s", i+1, v, err))
+				err = nil
+				continue
+			}
+			allowed = append(allowed, allowedValue)
+		}
+		if len(allowed) == 0 && len(skipped) > 0 {
+			return nil, skipped, fmt.Errorf("No valid entries in 'allowed_values' for field '%s'", field)
+		}
+		return NewListDimensionChecker(allowed), skipped, nil
+	case map[string]interface{}:
+		vrange := allowedValues.(map[string]interface{})
+
+		vMin, okMin := vrange["min"]
+		vMax, okMax := vrange["max"]
+
+		if !okMin && !okMax {
+			return nil, nil, fmt.Errorf("Range for field '%s' must have at least one of 'min' or 'max'", field)
+		}
+
+		ok := false
+		minStr := ""
+		if okMin {
+			minStr, ok = vMin.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("Value of 'min' for field '%s' must be a string", field)
 			}
+		}
 
-			maxStr := ""
-			if okMax {
-				maxStr, ok = vMax.(string)
-				if !ok {
-					return schema, fmt.Errorf("Value of 'max' for field '%s' must be a string (it was %+v)", d.Field_name, vMax)
-				}
+		maxStr := ""
+		if okMax {
+			maxStr, ok = vMax.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("Value of 'max' for field '%s' must be a string (it was %+v)", field, vMax)
 			}
-			schema.Dims[d.Field_name] = RangeDimensionChecker{minStr, maxStr}
 		}
+		return RangeDimensionChecker{minStr, maxStr}, nil, nil
 	}
-	return
+	return nil, nil, nil
+}
+
+// Add the line and column to a JSON syntax error, which only has the
+// offset.
+func jsonPositionError(data []byte, err error) error {
+	syntax, ok := err.(*json.SyntaxError)
+	if !ok || syntax.Offset > int64(len(data)) {
+		return err
+	}
+	before := data[:syntax.Offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndex(before, []byte("\n"))
+	return fmt.Errorf("line %d, column %d: %s", line, col, err)
 }
 
 var suffixes = [...]string{"", "K", "M", "G", "T", "P"}
@@ -285,30 +603,303 @@ type S3ListResult struct {
 // List the contents of the given bucket, sending matching filenames to a
 // channel which can be read by the caller.
 func S3Iterator(bucket *s3.Bucket, prefix string, schema Schema) <-chan S3ListResult {
+	return S3IteratorWithOptions(bucket, prefix, schema, nil)
+}
+
+// Like S3Iterator, but with additional listing options.
+func S3IteratorWithOptions(bucket *s3.Bucket, prefix string, schema Schema, opts *ListOptions) <-chan S3ListResult {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
 	keyChannel := make(chan S3ListResult, listBatchSize)
-	go FilterS3(bucket, prefix, 0, schema, keyChannel)
+	go FilterS3(bucket, prefix, 0, schema, opts, keyChannel)
 	return keyChannel
 }
 
+// Optional settings for an S3 listing.
+type ListOptions struct {
+	// If non-nil, updated with per-dimension listing progress as we go.
+	Progress *ListProgress
+	// Only list keys after this one, skipping the listing of partitions that
+	// come entirely before it.
+	StartAfter string
+	// If non-nil, stop listing once this is closed.
+	Done <-chan struct{}
+	// What to do with keys that have fewer or more path segments than the
+	// schema has dimensions, one of the UnexpectedDepth* constants. Empty
+	// means UnexpectedDepthSkip.
+	UnexpectedDepth string
+	// Stop with a ListDepthError rather than list anything more than this
+	// many path segments below the prefix (a key matching the schema is
+	// len(schema.Fields)+1 segments down). 0 means no limit.
+	MaxDepth int
+	// If non-nil, each LIST request takes a slot from this.
+	Limiter *RequestLimiter
+	// If non-nil, keys are listed from their object versions, and this is
+	// called with each key and how many versions it has. Only the latest
+	// version of a key is listed, and keys whose latest version is a delete
+	// marker aren't listed at all.
+	KeyVersions func(key string, versions int)
+	// If non-nil, called for the bucket to send each request to, in place
+	// of the one the listing was started with, so a long listing picks up
+	// a client with refreshed credentials.
+	Bucket func() *s3.Bucket
+	// Set once MaxDepth has been exceeded, to stop the rest of the listing.
+	depthExceeded bool
+}
+
+const (
+	// Leave out keys that are shallower or deeper than the schema.
+	UnexpectedDepthSkip = "skip"
+	// List them anyway, though they can't be mapped back to partitions.
+	UnexpectedDepthDeliver = "deliver"
+	// Report each one as a listing error.
+	UnexpectedDepthFail = "fail"
+)
+
+// Listing error for a key (or, if it's too deep, the prefix it's under) that
+// doesn't have one path segment per schema dimension, with
+// UnexpectedDepthFail.
+type UnexpectedDepthError struct {
+	Key     string
+	Shallow bool
+}
+
+func (e *UnexpectedDepthError) Error() string {
+	if e.Shallow {
+		return fmt.Sprintf("key %s has fewer path segments than the schema has dimensions", e.Key)
+	}
+	return fmt.Sprintf("keys under %s have more path segments than the schema has dimensions", e.Key)
+}
+
+// Listing error when the listing would go deeper than ListOptions.MaxDepth.
+// It's the last result of the listing.
+type ListDepthError struct {
+	Key      string
+	Depth    int
+	MaxDepth int
+}
+
+func (e *ListDepthError) Error() string {
+	return fmt.Sprintf("listing %s would go %d levels deep, more than the maximum of %d", e.Key, e.Depth, e.MaxDepth)
+}
+
+// The bucket to send a listing's next request to.
+func listBucket(bucket *s3.Bucket, opts *ListOptions) *s3.Bucket {
+	if opts.Bucket != nil {
+		return opts.Bucket()
+	}
+	return bucket
+}
+
+// Stop the listing because it's gone too deep.
+func sendDepthExceeded(kc chan S3ListResult, opts *ListOptions, key string, depth int) {
+	opts.depthExceeded = true
+	sendListResult(kc, opts, S3ListResult{s3.Key{}, &ListDepthError{key, depth, opts.MaxDepth}})
+}
+
+// Deal with a key found above the schema's last dimension. Returns false if
+// the listing has been stopped.
+func sendShallowKey(kc chan S3ListResult, opts *ListOptions, k s3.Key) bool {
+	if opts.StartAfter != "" && k.Key <= opts.StartAfter {
+		return true
+	}
+	if opts.Progress != nil {
+		atomic.AddInt64(&opts.Progress.UnexpectedDepth, 1)
+	}
+	switch opts.UnexpectedDepth {
+	case UnexpectedDepthDeliver:
+		return sendListResult(kc, opts, S3ListResult{k, nil})
+	case UnexpectedDepthFail:
+		return sendListResult(kc, opts, S3ListResult{s3.Key{}, &UnexpectedDepthError{k.Key, true}})
+	}
+	return true
+}
+
+// Deal with a prefix found below the schema's last dimension, delivering
+// everything under it if need be. Returns false if the listing has been
+// stopped.
+func sendDeepPrefix(bucket *s3.Bucket, kc chan S3ListResult, opts *ListOptions, prefix string, depth int) bool {
+	if opts.StartAfter != "" && prefix <= opts.StartAfter && !strings.HasPrefix(opts.StartAfter, prefix) {
+		return true
+	}
+	if opts.Progress != nil {
+		atomic.AddInt64(&opts.Progress.UnexpectedDepth, 1)
+	}
+	switch opts.UnexpectedDepth {
+	case UnexpectedDepthDeliver:
+		marker := ""
+		if strings.HasPrefix(opts.StartAfter, prefix) {
+			marker = opts.StartAfter
+		}
+		for !listStopped(opts) {
+			// No delimiter, so we get every key however deep it is.
+			opts.Limiter.Acquire()
+			response, err := listBucket(bucket, opts).List(prefix, "", marker, listBatchSize)
+			opts.Limiter.Release()
+			if err != nil {
+				return sendListResult(kc, opts, S3ListResult{s3.Key{}, err})
+			}
+			for _, k := range response.Contents {
+				marker = k.Key
+				if d := depth + 1 + strings.Count(k.Key[len(prefix):], "/"); opts.MaxDepth > 0 && d > opts.MaxDepth {
+					sendDepthExceeded(kc, opts, k.Key, d)
+					return false
+				}
+				if !sendListResult(kc, opts, S3ListResult{k, nil}) {
+					return false
+				}
+			}
+			if !response.IsTruncated || len(response.Contents) == 0 {
+				return true
+			}
+		}
+		return false
+	case UnexpectedDepthFail:
+		return sendListResult(kc, opts, S3ListResult{s3.Key{}, &UnexpectedDepthError{prefix, false}})
+	}
+	return true
+}
+
+// Send a listing result, unless the listing has been stopped. Returns false
+// if it has.
+func sendListResult(kc chan S3ListResult, opts *ListOptions, r S3ListResult) bool {
+	if opts.Done == nil {
+		kc <- r
+		return true
+	}
+	select {
+	case kc <- r:
+		return true
+	case <-opts.Done:
+		return false
+	}
+}
+
+func listStopped(opts *ListOptions) bool {
+	if opts.depthExceeded {
+		return true
+	}
+	if opts.Done == nil {
+		return false
+	}
+	select {
+	case <-opts.Done:
+		return true
+	default:
+		return false
+	}
+}
+
+// The marker to start listing the given prefix from, so that only keys after
+// opts.StartAfter are found. A partition containing StartAfter is listed
+// again, since there may be more keys after it.
+func startMarker(prefix string, level int, schema Schema, opts *ListOptions) string {
+	if opts.StartAfter == "" || !strings.HasPrefix(opts.StartAfter, prefix) {
+		return ""
+	}
+	if level >= len(schema.Fields) {
+		return opts.StartAfter
+	}
+	rest := opts.StartAfter[len(prefix):]
+	if i := strings.Index(rest, "/"); i >= 0 {
+		return prefix + rest[:i]
+	}
+	return opts.StartAfter
+}
+
+// Get one page of the schema-filtered listing of `prefix`: up to `max` keys
+// after `token` (or from the start, if it's empty), along with the token for
+// the next page, which is empty after the last page. This lets a caller list
+// in increments, e.g. processing and checkpointing each page in turn. Pages
+// follow key order, so schemas with date formats aren't supported.
+func ListPage(bucket *s3.Bucket, prefix string, schema Schema, token string, max int) (keys []s3.Key, next string, err error) {
+	if len(schema.Formats) > 0 {
+		return nil, "", fmt.Errorf("can't list pages of a schema with date formats")
+	}
+	if max < 1 {
+		return nil, "", fmt.Errorf("page size must be greater than 0")
+	}
+	done := make(chan struct{})
+	defer close(done)
+	for r := range S3IteratorWithOptions(bucket, prefix, schema, &ListOptions{StartAfter: token, Done: done}) {
+		if r.Err != nil {
+			// Resume after the last key we got, so nothing is missed.
+			next = token
+			if len(keys) > 0 {
+				next = keys[len(keys)-1].Key
+			}
+			return keys, next, r.Err
+		}
+		if len(keys) == max {
+			// There's at least one more.
+			return keys, keys[len(keys)-1].Key, nil
+		}
+		keys = append(keys, r.Key)
+	}
+	return keys, "", nil
+}
+
+// Tracks how many partitions at each schema dimension have been found, and how
+// many of those have been completely listed. For a date/channel/os schema,
+// `Completed[0]` of `Total[0]` tells us how many days we've finished. `Seen`
+// counts every key and prefix S3 returned, before any schema filtering.
+// `UnexpectedDepth` counts the keys above the schema's last dimension, and
+// the prefixes below it (see ListOptions.UnexpectedDepth).
+type ListProgress struct {
+	Total           []int64
+	Completed       []int64
+	Seen            int64
+	UnexpectedDepth int64
+}
+
+func NewListProgress(schema Schema) *ListProgress {
+	return &ListProgress{
+		Total:     make([]int64, len(schema.Fields)),
+		Completed: make([]int64, len(schema.Fields)),
+	}
+}
+
 // Recursively descend into an S3 directory tree, filtering based on the given
 // schema, and sending results on the given channel. The `level` parameter
 // indicates how far down the tree we are, and is used to determine which schema
 // field we use for filtering.
-func FilterS3(bucket *s3.Bucket, prefix string, level int, schema Schema, kc chan S3ListResult) {
+func FilterS3(bucket *s3.Bucket, prefix string, level int, schema Schema, opts *ListOptions, kc chan S3ListResult) {
 	// Update the marker as we encounter keys / prefixes. If a response is
 	// truncated, the next `List` request will start from the next item after
 	// the marker.
-	marker := ""
+	marker := startMarker(prefix, level, schema, opts)
+
+	if level == 0 && opts.MaxDepth > 0 && len(schema.Fields)+1 > opts.MaxDepth {
+		// The schema alone takes us too deep.
+		sendDepthExceeded(kc, opts, prefix, len(schema.Fields)+1)
+		close(kc)
+		return
+	}
+
+	// Partitions of a dimension with a date format are sorted by date before
+	// descending into them, which means listing all of them first.
+	layout := ""
+	if level < len(schema.Fields) {
+		layout = schema.Formats[schema.Fields[level]]
+	}
+	var sorted []string
 
 	// Keep listing if the response is incomplete (there are more than
 	// `listBatchSize` entries or prefixes)
 	done := false
-	for !done {
-		response, err := bucket.List(prefix, "/", marker, listBatchSize)
+	if level >= len(schema.Fields) && opts.KeyVersions != nil {
+		listLatestVersions(bucket, prefix, marker, level, opts, kc)
+		done = true
+	}
+	for !done && !listStopped(opts) {
+		opts.Limiter.Acquire()
+		response, err := listBucket(bucket, opts).List(prefix, "/", marker, listBatchSize)
+		opts.Limiter.Release()
 		if err != nil {
 			fmt.Printf("Error listing: %s\n", err)
 			// TODO: retry?
-			kc <- S3ListResult{s3.Key{}, err}
+			sendListResult(kc, opts, S3ListResult{s3.Key{}, err})
 			break
 		}
 
@@ -317,29 +908,77 @@ func FilterS3(bucket *s3.Bucket, prefix string, level int, schema Schema, kc cha
 			done = true
 		}
 
+		if opts.Progress != nil {
+			atomic.AddInt64(&opts.Progress.Seen, int64(len(response.Contents)+len(response.CommonPrefixes)))
+		}
+
 		if level >= len(schema.Fields) {
 			// We are past all the dimensions - encountered items are now
-			// S3 key names. We ignore any further prefixes and assume that the
-			// specified schema is correct/complete.
+			// S3 key names. Any further prefixes don't fit the schema.
 			for _, k := range response.Contents {
-				marker = k.Key
-				kc <- S3ListResult{k, nil}
+				if k.Key > marker {
+					marker = k.Key
+				}
+				if opts.StartAfter != "" && k.Key <= opts.StartAfter {
+					continue
+				}
+				if !sendListResult(kc, opts, S3ListResult{k, nil}) {
+					done = true
+					break
+				}
+			}
+			for _, pf := range response.CommonPrefixes {
+				if done {
+					break
+				}
+				if pf > marker {
+					marker = pf
+				}
+				if !sendDeepPrefix(bucket, kc, opts, pf, level+1) {
+					done = true
+				}
 			}
 		} else {
+			// Keys up here don't fit the schema.
+			for _, k := range response.Contents {
+				if k.Key > marker {
+					marker = k.Key
+				}
+				if !sendShallowKey(kc, opts, k) {
+					done = true
+					break
+				}
+			}
 			// We are still looking at prefixes. Recursively list each one that
 			// matches the specified schema's allowed values.
+			allowed := make([]string, 0, len(response.CommonPrefixes))
 			for _, pf := range response.CommonPrefixes {
 				// Get just the last piece of the prefix to check it as a
 				// dimension. If we have '/foo/bar/baz', we just want 'baz'.
 				stripped := pf[len(prefix) : len(pf)-1]
-				allowed := schema.Dims[schema.Fields[level]].IsAllowed(stripped)
-				marker = pf
-				if allowed {
-					FilterS3(bucket, pf, level+1, schema, kc)
+				if schema.Dims[schema.Fields[level]].IsAllowed(stripped) {
+					allowed = append(allowed, pf)
 				}
+				if pf > marker {
+					marker = pf
+				}
+			}
+			// Count the whole batch before descending, so progress totals
+			// are known ahead of the completed counts.
+			if opts.Progress != nil {
+				atomic.AddInt64(&opts.Progress.Total[level], int64(len(allowed)))
+			}
+			if layout != "" {
+				sorted = append(sorted, allowed...)
+				continue
 			}
+			filterPartitions(bucket, allowed, level, schema, opts, kc)
 		}
 	}
+	if layout != "" {
+		SortPartitions(sorted, len(prefix), layout)
+		filterPartitions(bucket, sorted, level, schema, opts, kc)
+	}
 
 	if level == 0 {
 		// We traverse the tree in depth-first order, so once we've reached the
@@ -352,69 +991,750 @@ func FilterS3(bucket *s3.Bucket, prefix string, level int, schema Schema, kc cha
 	return
 }
 
-// Encapsulates a single record within an S3 file, allowing detection of errors
-// along the way.
-type S3Record struct {
-	Key       string
-	Offset    uint64
-	BytesRead int
-	Record    []byte
-	Err       error
+// List the keys under a prefix past the schema's last dimension from their
+// object versions, sending the latest version of each key after `marker`.
+func listLatestVersions(bucket *s3.Bucket, prefix string, marker string, level int, opts *ListOptions, kc chan S3ListResult) {
+	keyMarker, versionMarker := marker, ""
+	var tally versionTally
+	// Returns false if the listing has been stopped.
+	finish := func(t versionTally) bool {
+		if t.versions == 0 || (opts.StartAfter != "" && t.key <= opts.StartAfter) {
+			return true
+		}
+		opts.KeyVersions(t.key, t.versions)
+		if t.latest == nil {
+			return true
+		}
+		return sendListResult(kc, opts, S3ListResult{*t.latest, nil})
+	}
+	for !listStopped(opts) {
+		opts.Limiter.Acquire()
+		response, err := listBucket(bucket, opts).Versions(prefix, "/", keyMarker, versionMarker, listBatchSize)
+		opts.Limiter.Release()
+		if err != nil {
+			sendListResult(kc, opts, S3ListResult{s3.Key{}, err})
+			return
+		}
+		if opts.Progress != nil {
+			atomic.AddInt64(&opts.Progress.Seen, int64(len(response.Versions)+len(response.CommonPrefixes)))
+		}
+		for _, v := range response.Versions {
+			if prev, ok := tally.add(v); ok && !finish(prev) {
+				return
+			}
+		}
+		for _, pf := range response.CommonPrefixes {
+			if !sendDeepPrefix(bucket, kc, opts, pf, level+1) {
+				return
+			}
+		}
+		if !response.IsTruncated {
+			break
+		}
+		keyMarker, versionMarker = response.NextKeyMarker, response.NextVersionIdMarker
+	}
+	finish(tally.finish())
 }
 
-// List the contents of the given bucket, sending matching filenames to a
-// channel which can be read by the caller.
-func S3FileIterator(bucket *s3.Bucket, s3Key string) <-chan S3Record {
-	recordChannel := make(chan S3Record, fileBatchSize)
-	go ReadS3File(bucket, s3Key, recordChannel)
-	return recordChannel
+// Tallies a versions listing, in which each key's versions come together,
+// the latest first.
+type versionTally struct {
+	key      string
+	versions int
+	// The key's latest version, or nil if it's been deleted (goamz leaves
+	// delete markers out of versions listings, so a deleted key has only
+	// older versions).
+	latest *s3.Key
 }
 
-func makeS3Record(s3Key string, offset uint64, bytesRead int, data []byte, err error) (result S3Record) {
-	r := S3Record{}
-	r.BytesRead = bytesRead
-	r.Err = err
-	r.Key = s3Key
-	r.Offset = offset
-	r.Record = make([]byte, len(data))
-	copy(r.Record, data)
-	return r
+// Count the next version in the listing. If it's the first of another key,
+// returns the tally for the key before it.
+func (t *versionTally) add(v s3.Version) (prev versionTally, ok bool) {
+	if t.versions == 0 || v.Key != t.key {
+		prev, ok = *t, t.versions > 0
+		*t = versionTally{key: v.Key}
+	}
+	t.versions++
+	if v.IsLatest {
+		t.latest = &s3.Key{
+			Key:          v.Key,
+			LastModified: v.LastModified,
+			Size:         v.Size,
+			ETag:         v.ETag,
+			StorageClass: v.StorageClass,
+			Owner:        v.Owner,
+		}
+	}
+	return
 }
 
-// TODO: duplicated from heka-cat
-func makeSplitterRunner() (SplitterRunner, error) {
-	splitter := &HekaFramingSplitter{}
-	config := splitter.ConfigStruct()
-	err := splitter.Init(config)
-	if err != nil {
-		return nil, fmt.Errorf("Error initializing HekaFramingSplitter: %s", err)
+// The tally for the last key, once the listing is over.
+func (t *versionTally) finish() versionTally {
+	last := *t
+	*t = versionTally{}
+	return last
+}
+
+// Descend into each of the given prefixes in turn.
+func filterPartitions(bucket *s3.Bucket, prefixes []string, level int, schema Schema, opts *ListOptions, kc chan S3ListResult) {
+	for _, pf := range prefixes {
+		if listStopped(opts) {
+			return
+		}
+		FilterS3(bucket, pf, level+1, schema, opts, kc)
+		if opts.Progress != nil {
+			atomic.AddInt64(&opts.Progress.Completed[level], 1)
+		}
 	}
-	srConfig := CommonSplitterConfig{}
-	sRunner := NewSplitterRunner("HekaFramingSplitter", splitter, srConfig)
-	return sRunner, nil
+}
+
+// Sorts prefixes by the date in the last path segment, which starts at
+// `offset` and is in the given time layout. Prefixes without a valid date
+// go last, in their original order.
+type partitionsByDate struct {
+	prefixes []string
+	dates    []time.Time
+	valid    []bool
+}
+
+func (p partitionsByDate) Len() int { return len(p.prefixes) }
+
+func (p partitionsByDate) Less(i, j int) bool {
+	if p.valid[i] != p.valid[j] {
+		return p.valid[i]
+	}
+	return p.valid[i] && p.dates[i].Before(p.dates[j])
+}
+
+func (p partitionsByDate) Swap(i, j int) {
+	p.prefixes[i], p.prefixes[j] = p.prefixes[j], p.prefixes[i]
+	p.dates[i], p.dates[j] = p.dates[j], p.dates[i]
+	p.valid[i], p.valid[j] = p.valid[j], p.valid[i]
+}
+
+// Sort the given prefixes (each ending in "/") chronologically by their last
+// path segment, which starts at `offset`.
+func SortPartitions(prefixes []string, offset int, layout string) {
+	p := partitionsByDate{prefixes, make([]time.Time, len(prefixes)), make([]bool, len(prefixes))}
+	for i, pf := range prefixes {
+		t, err := time.Parse(layout, strings.TrimSuffix(pf[offset:], "/"))
+		p.dates[i], p.valid[i] = t, err == nil
+	}
+	sort.Stable(p)
+}
+
+// Format of the LastModified timestamps in S3 listings.
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// Read S3 key names (one per line) from the given manifest file, sending them
+// to a channel which can be read by the caller in the same order they appear in
+// the manifest. Since we aren't listing, each key's metadata is fetched with a
+// HEAD request.
+func S3ManifestIterator(bucket *s3.Bucket, manifestFile string) <-chan S3ListResult {
+	keyChannel := make(chan S3ListResult, listBatchSize)
+	go readManifest(bucket, manifestFile, keyChannel)
+	return keyChannel
+}
+
+func readManifest(bucket *s3.Bucket, manifestFile string, kc chan S3ListResult) {
+	defer close(kc)
+	f, err := os.Open(manifestFile)
+	if err != nil {
+		kc <- S3ListResult{s3.Key{}, err}
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+		key, err := headS3Key(bucket, name)
+		kc <- S3ListResult{key, err}
+	}
+	if err = scanner.Err(); err != nil {
+		kc <- S3ListResult{s3.Key{}, err}
+	}
+}
+
+// Get the metadata for a single key, as it would appear in a listing.
+func headS3Key(bucket *s3.Bucket, name string) (key s3.Key, err error) {
+	resp, err := bucket.Head(name, nil)
+	if err != nil {
+		return s3.Key{Key: name}, fmt.Errorf("Error getting metadata for %s: %s", name, err)
+	}
+	resp.Body.Close()
+
+	key = s3.Key{
+		Key:  name,
+		Size: resp.ContentLength,
+		ETag: resp.Header.Get("ETag"),
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		key.LastModified = lastModified.UTC().Format(s3TimeFormat)
+	}
+	return key, nil
+}
+
+// Encapsulates a single record within an S3 file, allowing detection of errors
+// along the way.
+type S3Record struct {
+	Key string
+	// Where the record starts in the object (after decompression and
+	// transforms), or for an error, how far the splitter had got.
+	Offset    uint64
+	BytesRead int
+	Record    []byte
+	Err       error
+}
+
+// List the contents of the given bucket, sending matching filenames to a
+// channel which can be read by the caller.
+func S3FileIterator(bucket *s3.Bucket, s3Key string) <-chan S3Record {
+	recordChannel := make(chan S3Record, fileBatchSize)
+	go ReadS3File(bucket, s3Key, recordChannel)
+	return recordChannel
+}
+
+func makeS3Record(s3Key string, offset uint64, bytesRead int, data []byte, err error) (result S3Record) {
+	r := S3Record{}
+	r.BytesRead = bytesRead
+	r.Err = err
+	r.Key = s3Key
+	r.Offset = offset
+	r.Record = make([]byte, len(data))
+	copy(r.Record, data)
+	return r
+}
+
+// TODO: duplicated from heka-cat
+func makeSplitterRunner() (SplitterRunner, error) {
+	return makeDelimitedSplitterRunner("")
+}
+
+// Make a splitter runner that splits records on the given delimiter, which
+// remains at the end of each record. With no delimiter, records are expected
+// to use Heka's stream framing.
+func makeDelimitedSplitterRunner(delimiter string) (SplitterRunner, error) {
+	splitter, name, err := newDelimitedSplitter(delimiter)
+	if err != nil {
+		return nil, err
+	}
+	return NewSplitterRunner(name, splitter, CommonSplitterConfig{}), nil
+}
+
+// As makeDelimitedSplitterRunner, also returning a count of the bytes the
+// splitter consumes.
+func makeCountingSplitterRunner(delimiter string) (SplitterRunner, *countingSplitter, error) {
+	splitter, name, err := newDelimitedSplitter(delimiter)
+	if err != nil {
+		return nil, nil, err
+	}
+	counter := &countingSplitter{Splitter: splitter}
+	return NewSplitterRunner(name, counter, CommonSplitterConfig{}), counter, nil
+}
+
+// Counts the bytes its splitter has consumed, both records and whatever it
+// skipped between them, so that we know where each record starts however
+// much the runner has buffered. Only for splitting, since the runner can't
+// see through it to unframe records.
+type countingSplitter struct {
+	Splitter
+	consumed uint64
+}
+
+func (s *countingSplitter) FindRecord(buf []byte) (int, []byte) {
+	n, record := s.Splitter.FindRecord(buf)
+	s.consumed += uint64(n)
+	return n, record
+}
+
+// Where the given record, the last one found, starts in the stream: the
+// splitter has consumed everything up to its end.
+func (s *countingSplitter) recordStart(record []byte) uint64 {
+	return s.consumed - uint64(len(record))
+}
+
+// The splitter for makeDelimitedSplitterRunner, and its name.
+func newDelimitedSplitter(delimiter string) (splitter Splitter, name string, err error) {
+	switch len(delimiter) {
+	case 0:
+		s := &HekaFramingSplitter{}
+		splitter, name = s, "HekaFramingSplitter"
+		err = s.Init(s.ConfigStruct())
+	case 1:
+		s := &TokenSplitter{}
+		splitter, name = s, "TokenSplitter"
+		config := s.ConfigStruct().(*TokenSplitterConfig)
+		config.Count = 1
+		config.Delimiter = delimiter
+		err = s.Init(config)
+	default:
+		// TokenSplitter only handles single byte delimiters.
+		s := &RegexSplitter{}
+		splitter, name = s, "RegexSplitter"
+		config := s.ConfigStruct().(*RegexSplitterConfig)
+		config.Delimiter = regexp.QuoteMeta(delimiter)
+		config.DelimiterEOL = true
+		err = s.Init(config)
+	}
+	if err != nil {
+		return nil, name, fmt.Errorf("Error initializing %s: %s", name, err)
+	}
+	return splitter, name, nil
+}
+
+// Optional settings for reading an S3 file.
+type ReadOptions struct {
+	// If non-nil, each GET is signed as of the time this gives rather than
+	// the host's clock, by way of an X-Amz-Date header. Only SigV4 signing
+	// honors it.
+	Clock func() time.Time
+	// Only read the bytes in the range [Start, End) of the object. An End less
+	// than zero means read to the end of the object. Record offsets are still
+	// relative to the start of the object.
+	Start int64
+	End   int64
+	// If non-nil, every byte read from the object is also written to Hash. It
+	// is complete once the record channel has been closed.
+	Hash hash.Hash
+	// If greater than zero, read up to this many bytes ahead of the splitter
+	// in a separate goroutine.
+	ReadAheadBytes int
+	// How to decompress the object, one of the Decompress* constants. Start
+	// and record offsets then refer to the decompressed data, and End is not
+	// supported. Hash still sees the compressed bytes.
+	Decompress string
+	// If greater than zero, decompress in a separate goroutine, up to this
+	// many decompressed bytes ahead of the splitter, so that decompressing
+	// and splitting can happen on different CPUs.
+	DecompressAheadBytes int
+	// If non-nil, the time spent decompressing (in nanoseconds, including
+	// any time spent waiting for compressed data) is added to this.
+	DecompressTime *int64
+	// Split records on this delimiter rather than using Heka's stream
+	// framing.
+	Delimiter string
+	// If greater than zero, don't split the object at all: the rest of it
+	// (after any decompression) is sent as a single record, or an error if
+	// it's larger than this many bytes. Delimiter is ignored.
+	WholeObjectMaxBytes int64
+	// If greater than zero, give up on reading the object after this long,
+	// with a TimeoutError.
+	Timeout time.Duration
+	// If non-nil, give up on reading the object once this is closed.
+	Stop <-chan bool
+	// If non-nil, the object is only read if this accepts its Content-Type.
+	// Otherwise reading stops with a ContentTypeError.
+	ContentType func(contentType string) bool
+	// With DecompressAuto, how to decide whether an object is compressed,
+	// one of the Compression* constants. Empty means CompressionTrustSuffix.
+	CompressionPolicy string
+	// If non-nil, called when an object's name and content disagree about
+	// whether it's compressed (as far as we can tell without extra requests),
+	// with whether it's being decompressed anyway.
+	CompressionMismatch func(decompressing bool)
+	// If non-empty, only read the object if its ETag is still this, failing
+	// with S3's "PreconditionFailed" error otherwise.
+	IfMatch string
+	// Fail with a TruncatedError if a response ends before its
+	// Content-Length, rather than taking what arrived for the whole object.
+	CheckLength bool
+	// If greater than zero, and the object's Size is known, fetch the object
+	// in chunks of this many bytes, RangeConcurrency of them at a time, and
+	// reassemble them in order before splitting.
+	RangeChunkBytes  int64
+	RangeConcurrency int
+	// The object's size according to the listing, or 0 if unknown.
+	Size int64
+	// If non-nil, each GET request for the object takes a slot from this,
+	// and holds it until the response has been read.
+	Limiter *RequestLimiter
+	// If non-nil, called once a compressed object has been read to the end,
+	// with the codec and the number of bytes before and after decompression.
+	Compression func(codec string, compressed int64, decompressed int64)
+	// If non-nil, applied to the object's stream after any decompression and
+	// before splitting. Start and record offsets then refer to the
+	// transformed data, so the object is always fetched from the start, and
+	// End can't be used.
+	Transform StreamTransform
+}
+
+// Returned when ReadOptions.ContentType doesn't accept an object's
+// Content-Type.
+type ContentTypeError struct {
+	ContentType string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("unexpected Content-Type '%s'", e.ContentType)
+}
+
+// Returned for a line of newline-delimited JSON that doesn't parse, with an
+// ndjson_error_policy of "fail".
+type MalformedLineError struct {
+	Offset uint64
+}
+
+func (e *MalformedLineError) Error() string {
+	return fmt.Sprintf("malformed JSON line at offset %d", e.Offset)
+}
+
+// Determine whether the given line (with or without its trailing newline) is
+// a single valid JSON value.
+func ValidJSONLine(line []byte) bool {
+	var v json.RawMessage
+	return json.Unmarshal(line, &v) == nil
+}
+
+// Determine whether the given line holds nothing but whitespace, such as
+// the blank lines some producers leave between (or after) JSON lines.
+func BlankLine(line []byte) bool {
+	return len(bytes.TrimSpace(line)) == 0
+}
+
+// Read error for a response that ended before its Content-Length, as when
+// the connection drops partway through.
+type TruncatedError struct {
+	Expected int64
+	Got      int64
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("download truncated after %d of %d bytes", e.Got, e.Expected)
+}
+
+// Fails with a TruncatedError if the body it reads ends before `expected`
+// bytes.
+type lengthCheckedReader struct {
+	io.ReadCloser
+	expected int64
+	n        int64
+}
+
+// Check that `body` has `expected` bytes, unless the length is unknown
+// (less than zero).
+func checkLength(body io.ReadCloser, expected int64) io.ReadCloser {
+	if expected < 0 {
+		return body
+	}
+	return &lengthCheckedReader{ReadCloser: body, expected: expected}
+}
+
+func (r *lengthCheckedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if (err == io.EOF || err == io.ErrUnexpectedEOF) && r.n < r.expected {
+		err = &TruncatedError{r.expected, r.n}
+	}
+	return n, err
+}
+
+// Returned when reading an object takes longer than ReadOptions.Timeout.
+type TimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("gave up reading the object after %s", e.Timeout)
+}
+
+const (
+	DecompressNone = "none"
+	DecompressGzip = "gzip"
+	// Decompress objects whose keys end in GzipSuffix.
+	DecompressAuto = "auto"
+
+	GzipSuffix = ".gz"
+
+	// With DecompressAuto, decompress objects named with GzipSuffix.
+	CompressionTrustSuffix = "trust_suffix"
+	// Decompress objects that start with the gzip magic bytes, whatever
+	// they're named.
+	CompressionTrustContent = "trust_content"
+	// Decompress objects named with GzipSuffix, and any others that start
+	// with the gzip magic bytes.
+	CompressionSniff = "sniff"
+)
+
+// The first bytes of any gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Determine whether the given object starts with the gzip magic bytes,
+// without fetching the rest of it.
+func sniffGzip(bucket *s3.Bucket, s3Key string, limiter *RequestLimiter, clock func() time.Time) (bool, error) {
+	resp, err := limitedGet(bucket, s3Key, map[string][]string{
+		"Range": []string{makeRangeHeader(0, int64(len(gzipMagic)))},
+	}, limiter, clock)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	magic, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, gzipMagic), nil
+}
+
+// Determine whether the given object should be decompressed.
+func isCompressed(s3Key string, decompress string) bool {
+	switch decompress {
+	case DecompressGzip:
+		return true
+	case DecompressAuto:
+		return strings.HasSuffix(s3Key, GzipSuffix)
+	}
+	return false
+}
+
+// Like S3FileIterator, but with additional read options.
+func S3FileIteratorWithOptions(bucket *s3.Bucket, s3Key string, opts *ReadOptions) <-chan S3Record {
+	if opts == nil {
+		opts = &ReadOptions{End: -1}
+	}
+	recordChannel := make(chan S3Record, fileBatchSize)
+	go readS3FileWithOptions(bucket, s3Key, opts, recordChannel)
+	return recordChannel
 }
 
 func ReadS3File(bucket *s3.Bucket, s3Key string, recordChan chan S3Record) {
+	readS3FileWithOptions(bucket, s3Key, &ReadOptions{End: -1}, recordChan)
+}
+
+func readS3FileWithOptions(bucket *s3.Bucket, s3Key string, opts *ReadOptions, recordChan chan S3Record) {
 	defer close(recordChan)
-	sRunner, err := makeSplitterRunner()
+	start, end := opts.Start, opts.End
+	sRunner, counter, err := makeCountingSplitterRunner(opts.Delimiter)
 	if err != nil {
 		recordChan <- S3Record{s3Key, 0, 0, []byte{}, err}
 		return
 	}
-	reader, err := bucket.GetReader(s3Key)
-	if err != nil {
-		recordChan <- S3Record{s3Key, 0, 0, []byte{}, err}
+
+	compressed := isCompressed(s3Key, opts.Decompress)
+	suffixed := compressed
+	// Whether the content, rather than the name, may decide.
+	sniffing := opts.Decompress == DecompressAuto &&
+		(opts.CompressionPolicy == CompressionTrustContent ||
+			(opts.CompressionPolicy == CompressionSniff && !suffixed))
+	if sniffing && (start > 0 || end >= 0) {
+		// We won't see the start of the object, so take a look at it first.
+		gz, err := sniffGzip(bucket, s3Key, opts.Limiter, opts.Clock)
+		if err != nil {
+			recordChan <- S3Record{s3Key, 0, 0, []byte{}, err}
+			return
+		}
+		compressed, sniffing = gz, false
+		if gz != suffixed && opts.CompressionMismatch != nil {
+			opts.CompressionMismatch(compressed)
+		}
+	}
+	if compressed && end >= 0 {
+		recordChan <- S3Record{s3Key, 0, 0, []byte{}, fmt.Errorf("can't read part of a compressed object")}
+		return
+	}
+	transformed := opts.Transform != nil
+	if transformed && end >= 0 {
+		recordChan <- S3Record{s3Key, 0, 0, []byte{}, fmt.Errorf("can't read part of a transformed object")}
 		return
 	}
+
+	var (
+		reader io.ReadCloser
+		header http.Header
+	)
+	headers := map[string][]string{}
+	if opts.IfMatch != "" {
+		headers["If-Match"] = []string{opts.IfMatch}
+	}
+	// Compressed and transformed objects are always read from the start.
+	rangeStart, rangeEnd := start, opts.Size
+	if compressed || transformed {
+		rangeStart = 0
+	} else if end >= 0 {
+		rangeEnd = end
+	}
+	if opts.RangeChunkBytes > 0 && rangeEnd-rangeStart > opts.RangeChunkBytes {
+		fetch := func(chunkStart int64, chunkEnd int64) ([]byte, http.Header, error) {
+			chunkHeaders := map[string][]string{
+				"Range": []string{makeRangeHeader(chunkStart, chunkEnd)},
+			}
+			if opts.IfMatch != "" {
+				chunkHeaders["If-Match"] = []string{opts.IfMatch}
+			}
+			resp, err := limitedGet(bucket, s3Key, chunkHeaders, opts.Limiter, opts.Clock)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer resp.Body.Close()
+			body := resp.Body
+			if opts.CheckLength {
+				body = checkLength(body, resp.ContentLength)
+			}
+			data, err := ioutil.ReadAll(body)
+			return data, resp.Header, err
+		}
+		rr, h, err := newRangedReader(fetch, rangeStart, rangeEnd, opts.RangeChunkBytes, opts.RangeConcurrency)
+		if err != nil {
+			recordChan <- S3Record{s3Key, uint64(rangeStart), 0, []byte{}, err}
+			return
+		}
+		reader, header = rr, h
+	} else if (start > 0 || end >= 0) && !compressed && !transformed {
+		headers["Range"] = []string{makeRangeHeader(start, end)}
+		resp, err := limitedGet(bucket, s3Key, headers, opts.Limiter, opts.Clock)
+		if err != nil {
+			recordChan <- S3Record{s3Key, uint64(start), 0, []byte{}, err}
+			return
+		}
+		reader, header = resp.Body, resp.Header
+		if opts.CheckLength {
+			reader = checkLength(reader, resp.ContentLength)
+		}
+	} else {
+		resp, err := limitedGet(bucket, s3Key, headers, opts.Limiter, opts.Clock)
+		if err != nil {
+			recordChan <- S3Record{s3Key, 0, 0, []byte{}, err}
+			return
+		}
+		reader, header = resp.Body, resp.Header
+		if opts.CheckLength {
+			reader = checkLength(reader, resp.ContentLength)
+		}
+	}
 	defer reader.Close()
+	if opts.ContentType != nil {
+		if contentType := header.Get("Content-Type"); !opts.ContentType(contentType) {
+			recordChan <- S3Record{s3Key, uint64(start), 0, []byte{}, &ContentTypeError{contentType}}
+			return
+		}
+	}
+
+	// There's no way to cancel a read in progress, other than by closing the
+	// connection out from under it.
+	var timedOut int32
+	if opts.Timeout > 0 {
+		timer := time.AfterFunc(opts.Timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			reader.Close()
+		})
+		defer timer.Stop()
+	}
+	if opts.Stop != nil {
+		reading := make(chan struct{})
+		defer close(reading)
+		go func() {
+			select {
+			case <-opts.Stop:
+				reader.Close()
+			case <-reading:
+			}
+		}()
+	}
+
+	var stream io.Reader = reader
+	if opts.Hash != nil {
+		stream = io.TeeReader(reader, opts.Hash)
+	}
+	if opts.ReadAheadBytes > 0 {
+		readAhead := newReadAheadReader(stream, opts.ReadAheadBytes)
+		defer readAhead.Close()
+		stream = readAhead
+	}
+	if opts.Decompress == DecompressAuto && start == 0 && end < 0 {
+		br := bufio.NewReader(stream)
+		magic, _ := br.Peek(len(gzipMagic))
+		gz := bytes.Equal(magic, gzipMagic)
+		if sniffing {
+			compressed = gz
+		}
+		if gz != suffixed && opts.CompressionMismatch != nil {
+			opts.CompressionMismatch(compressed)
+		}
+		stream = br
+	}
+	// Once the object has been read to the end, report how well it was
+	// compressed.
+	finished := func() {}
+	if compressed {
+		var rawCount, decompressedCount *countingReader
+		if opts.Compression != nil {
+			rawCount = &countingReader{r: stream}
+			stream = rawCount
+		}
+		gz, err := gzip.NewReader(stream)
+		if err != nil {
+			recordChan <- S3Record{s3Key, 0, 0, []byte{}, fmt.Errorf("Error decompressing: %s", err)}
+			return
+		}
+		defer gz.Close()
+		var decompressed io.Reader = gz
+		if opts.DecompressTime != nil {
+			decompressed = &timedReader{gz, opts.DecompressTime}
+		}
+		if opts.Compression != nil {
+			decompressedCount = &countingReader{r: decompressed}
+			decompressed = decompressedCount
+			finished = func() {
+				opts.Compression(DecompressGzip, rawCount.n, decompressedCount.n)
+			}
+		}
+		// We can't seek within compressed data, so skip ahead by reading
+		// (after transforming, if need be).
+		if !transformed {
+			if _, err = io.CopyN(ioutil.Discard, decompressed, start); err != nil {
+				recordChan <- S3Record{s3Key, uint64(start), 0, []byte{}, fmt.Errorf("Error decompressing: %s", err)}
+				return
+			}
+		}
+		if opts.DecompressAheadBytes > 0 {
+			decompressAhead := newReadAheadReader(decompressed, opts.DecompressAheadBytes)
+			defer decompressAhead.Close()
+			decompressed = decompressAhead
+		}
+		stream = decompressed
+	}
+	if transformed {
+		t, err := opts.Transform(stream)
+		if err != nil {
+			recordChan <- S3Record{s3Key, 0, 0, []byte{}, fmt.Errorf("Error transforming: %s", err)}
+			return
+		}
+		if _, err = io.CopyN(ioutil.Discard, t, start); err != nil {
+			recordChan <- S3Record{s3Key, uint64(start), 0, []byte{}, fmt.Errorf("Error transforming: %s", err)}
+			return
+		}
+		stream = t
+	}
 
-	var size, offset uint64
+	if opts.WholeObjectMaxBytes > 0 {
+		record, err := ioutil.ReadAll(io.LimitReader(stream, opts.WholeObjectMaxBytes+1))
+		if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+			err = &TimeoutError{opts.Timeout}
+		}
+		if err == nil && int64(len(record)) > opts.WholeObjectMaxBytes {
+			err = fmt.Errorf("object exceeded %d bytes", opts.WholeObjectMaxBytes)
+		}
+		if err != nil {
+			recordChan <- S3Record{s3Key, uint64(start), 0, []byte{}, err}
+			return
+		}
+		finished()
+		if len(record) > 0 {
+			recordChan <- S3Record{s3Key, uint64(start), len(record), record, nil}
+		}
+		return
+	}
 
 	done := false
 	for !done {
-		n, record, err := sRunner.GetRecordFromStream(reader)
-		offset = size
-		size += uint64(n)
+		n, record, err := sRunner.GetRecordFromStream(stream)
+		offset := uint64(start) + counter.recordStart(record)
+		if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+			err = &TimeoutError{opts.Timeout}
+		}
 
 		if err != nil {
 			if err == io.EOF {
@@ -425,6 +1745,7 @@ func ReadS3File(bucket *s3.Bucket, s3Key string, recordChan chan S3Record) {
 					fmt.Printf("At EOF, len(remaining data) was %d\n", lenRemaining)
 				}
 
+				finished()
 				done = true
 			} else if err == io.ErrShortBuffer {
 				recordChan <- makeS3Record(s3Key, offset, n, record, fmt.Errorf("record exceeded MAX_RECORD_SIZE %d", message.MAX_RECORD_SIZE))
@@ -450,10 +1771,1073 @@ func ReadS3File(bucket *s3.Bucket, s3Key string, recordChan chan S3Record) {
 	return
 }
 
-func CleanBucketPrefix(prefix string) (cleaned string) {
-	cleaned = strings.Trim(prefix, "/")
-	if cleaned != "" {
-		cleaned += "/"
+// Check whether buf begins with a well-formed Heka stream frame, returning the
+// length of that frame if so. A frame is a record separator, a one-byte header
+// length, a header that decodes, a unit separator, and exactly as many message
+// bytes as the header claims. Heka headers carry no checksum (only an optional
+// HMAC, which we can't check without the signer keys), so we additionally
+// require the message bytes to decode as a Message.
+func parseHekaFrame(buf []byte) (frameLen int, ok bool) {
+	frameLen, _, ok = decodeHekaFrame(buf)
+	return
+}
+
+// As parseHekaFrame, also returning the decoded message.
+func decodeHekaFrame(buf []byte) (frameLen int, msg *message.Message, ok bool) {
+	if len(buf) < message.HEADER_FRAMING_SIZE || buf[0] != message.RECORD_SEPARATOR {
+		return 0, nil, false
+	}
+	headerLen := int(buf[1])
+	headerEnd := headerLen + message.HEADER_FRAMING_SIZE
+	if len(buf) < headerEnd || buf[headerEnd-1] != message.UNIT_SEPARATOR {
+		return 0, nil, false
+	}
+	header := &message.Header{}
+	if err := proto.Unmarshal(buf[2:headerEnd-1], header); err != nil {
+		return 0, nil, false
+	}
+	frameLen = headerEnd + int(header.GetMessageLength())
+	if header.GetMessageLength() == 0 || len(buf) < frameLen {
+		return 0, nil, false
+	}
+	msg = &message.Message{}
+	if err := proto.Unmarshal(buf[headerEnd:frameLen], msg); err != nil {
+		return 0, nil, false
+	}
+	return frameLen, msg, true
+}
+
+// Find the first of the named fields that the Heka message framed by the
+// given record lacks, or has only an empty value for. "Type", "Logger",
+// "Hostname", "Payload" and "EnvVersion" name the message's headers, and
+// anything else one of its fields. Records that aren't a frame that decodes
+// are left for the decoder to deal with.
+func RecordMissingField(record []byte, names []string) (string, bool) {
+	if len(names) == 0 {
+		return "", false
+	}
+	frameLen, msg, ok := decodeHekaFrame(record)
+	if !ok || frameLen != len(record) {
+		return "", false
+	}
+	return MissingField(msg, names)
+}
+
+// Find the first of the named fields (as for RecordMissingField) that the
+// message lacks, or has only an empty value for.
+func MissingField(msg *message.Message, names []string) (string, bool) {
+	for _, name := range names {
+		var present bool
+		switch name {
+		case "Type":
+			present = msg.GetType() != ""
+		case "Logger":
+			present = msg.GetLogger() != ""
+		case "Hostname":
+			present = msg.GetHostname() != ""
+		case "Payload":
+			present = msg.GetPayload() != ""
+		case "EnvVersion":
+			present = msg.GetEnvVersion() != ""
+		default:
+			value, ok := msg.GetFieldValue(name)
+			switch v := value.(type) {
+			case string:
+				present = v != ""
+			case []byte:
+				present = len(v) > 0
+			default:
+				present = ok
+			}
+		}
+		if !present {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// Determine whether the given record is exactly one valid Heka stream frame.
+func ValidHekaFrame(record []byte) bool {
+	frameLen, ok := parseHekaFrame(record)
+	return ok && frameLen == len(record)
+}
+
+// Paces delivery for replaying archived data against a test downstream:
+// either at a steady `rate` of records per second, or at `speed` times the
+// pace of the records' own timestamps, so that a day's data replayed at a
+// speed of 24 takes an hour. Records are paced from the first one, and
+// records timestamped earlier than one already delivered (or not at all)
+// aren't held back. Safe for concurrent use.
+type ReplayPacer struct {
+	lock  sync.Mutex
+	rate  float64
+	speed float64
+	// The wall time of the first record, and its timestamp (in ns).
+	start time.Time
+	first int64
+	count int64
+}
+
+func NewReplayPacer(rate float64, speed float64) *ReplayPacer {
+	return &ReplayPacer{rate: rate, speed: speed}
+}
+
+// How long to wait, as of `now`, before delivering the next record, whose
+// timestamp (in ns) is `ts`, or 0 if it doesn't have one.
+func (p *ReplayPacer) Delay(now time.Time, ts int64) time.Duration {
+	if p == nil {
+		return 0
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var due time.Time
+	if p.rate > 0 {
+		if p.count == 0 {
+			p.start = now
+		}
+		due = p.start.Add(time.Duration(float64(p.count) / p.rate * float64(time.Second)))
+		p.count++
+	} else {
+		if ts == 0 {
+			return 0
+		}
+		if p.count == 0 {
+			p.start, p.first = now, ts
+		}
+		p.count++
+		due = p.start.Add(time.Duration(float64(ts-p.first) / p.speed))
+	}
+	if d := due.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Find a record's timestamp (in ns): the first subexpression of `re` (or its
+// whole match) parsed with `layout`, or with no regex, the Timestamp of the
+// Heka message the record frames.
+func RecordTimestamp(record []byte, re *regexp.Regexp, layout string) (int64, bool) {
+	if re == nil {
+		if _, msg, ok := decodeHekaFrame(record); ok {
+			return msg.GetTimestamp(), true
+		}
+		return 0, false
+	}
+	m := re.FindSubmatch(record)
+	if m == nil {
+		return 0, false
+	}
+	if len(m) > 1 {
+		m = m[1:]
+	}
+	t, err := time.Parse(layout, string(m[0]))
+	if err != nil {
+		return 0, false
+	}
+	return t.UnixNano(), true
+}
+
+// Spots records that are the same as the one before, by their SHA256.
+type RepeatFilter struct {
+	last [sha256.Size]byte
+	seen bool
+}
+
+// Determine whether the given record is the same as the previous one.
+func (rf *RepeatFilter) Repeated(record []byte) bool {
+	h := sha256.Sum256(record)
+	repeated := rf.seen && h == rf.last
+	rf.last, rf.seen = h, true
+	return repeated
+}
+
+// Counts how often each key has been put back on the queue because it was
+// listed but couldn't be fetched yet. Safe for concurrent use.
+type ConsistencyRetries struct {
+	lock     sync.Mutex
+	attempts map[string]uint32
+}
+
+func NewConsistencyRetries() *ConsistencyRetries {
+	return &ConsistencyRetries{attempts: map[string]uint32{}}
+}
+
+// Count another retry of the named key, returning which retry it is, or
+// false if it's already been retried `limit` times.
+func (cr *ConsistencyRetries) Retry(name string, limit uint32) (uint32, bool) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.attempts[name] >= limit {
+		delete(cr.attempts, name)
+		return 0, false
+	}
+	cr.attempts[name]++
+	return cr.attempts[name], true
+}
+
+// Forget about the named key once it's been fetched or given up on.
+func (cr *ConsistencyRetries) Forget(name string) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	delete(cr.attempts, name)
+}
+
+// Cut a record down to the part that's wanted: the first match of `re` (or
+// its first subexpression, if it has one), then at most `maxBytes` of that.
+// Returns false if there's a regex and it doesn't match. A `maxBytes` of 0
+// and a nil `re` leave the record as is.
+func TrimRecord(record []byte, maxBytes int, re *regexp.Regexp) ([]byte, bool) {
+	if re != nil {
+		m := re.FindSubmatchIndex(record)
+		if m == nil {
+			return nil, false
+		}
+		if len(m) > 2 {
+			m = m[2:]
+		}
+		if m[0] < 0 {
+			// The subexpression didn't take part in the match.
+			return record[:0], true
+		}
+		record = record[m[0]:m[1]]
+	}
+	if maxBytes > 0 && len(record) > maxBytes {
+		record = record[:maxBytes]
+	}
+	return record, true
+}
+
+// Scan an invalid record for any valid Heka frames embedded within it. This
+// recovers the records that follow a corrupted length prefix, which would
+// otherwise be swallowed whole by the bad frame. Along with the frames, returns
+// where each starts in the record.
+func ResyncHekaFrames(record []byte) (frames [][]byte, offsets []int) {
+	pos := 1
+	for pos < len(record) {
+		idx := bytes.IndexByte(record[pos:], message.RECORD_SEPARATOR)
+		if idx < 0 {
+			break
+		}
+		pos += idx
+		if frameLen, ok := parseHekaFrame(record[pos:]); ok {
+			frames = append(frames, record[pos:pos+frameLen])
+			offsets = append(offsets, pos)
+			pos += frameLen
+		} else {
+			pos++
+		}
+	}
+	return frames, offsets
+}
+
+// Caps how many S3 requests are in progress at once, among everything
+// sharing it. A nil limiter doesn't limit anything.
+type RequestLimiter struct {
+	slots chan struct{}
+	// Nanoseconds spent waiting for a slot.
+	waitTime int64
+}
+
+func NewRequestLimiter(max int) *RequestLimiter {
+	return &RequestLimiter{slots: make(chan struct{}, max)}
+}
+
+// Wait for a slot.
+func (l *RequestLimiter) Acquire() {
+	if l == nil {
+		return
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return
+	default:
+	}
+	start := time.Now()
+	l.slots <- struct{}{}
+	atomic.AddInt64(&l.waitTime, int64(time.Since(start)))
+}
+
+// Give back a slot taken by Acquire.
+func (l *RequestLimiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// How many requests are in progress.
+func (l *RequestLimiter) InUse() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+// The total time spent waiting for a slot.
+func (l *RequestLimiter) WaitTime() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&l.waitTime))
+}
+
+// Fetch an object (with the given request headers, if any), holding one of
+// the limiter's slots until the response body is closed. If `clock` is
+// non-nil, the request is signed as of the time it gives, see
+// ReadOptions.Clock.
+func limitedGet(bucket *s3.Bucket, s3Key string, headers map[string][]string, limiter *RequestLimiter, clock func() time.Time) (resp *http.Response, err error) {
+	if clock != nil {
+		headers = requestTimeHeaders(headers, clock())
+	}
+	limiter.Acquire()
+	if len(headers) > 0 {
+		resp, err = bucket.GetResponseWithHeaders(s3Key, headers)
+	} else {
+		resp, err = bucket.GetResponse(s3Key)
+	}
+	if err != nil {
+		limiter.Release()
+		return nil, err
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, limiter: limiter}
+	return resp, nil
+}
+
+// The layout of the X-Amz-Date header.
+const amzDateFormat = "20060102T150405Z"
+
+// A copy of the request headers that has the request signed as of `t`.
+// goamz's SigV4 signer takes the request time from an X-Amz-Date header if
+// there is one, and S3 checks that rather than the Date header.
+func requestTimeHeaders(headers map[string][]string, t time.Time) map[string][]string {
+	signed := map[string][]string{}
+	for k, v := range headers {
+		signed[k] = v
+	}
+	signed["X-Amz-Date"] = []string{t.UTC().Format(amzDateFormat)}
+	return signed
+}
+
+// A response body that gives back its limiter slot when it's closed.
+type limitedBody struct {
+	io.ReadCloser
+	limiter *RequestLimiter
+	once    sync.Once
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.limiter.Release)
+	return err
+}
+
+// Counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return
+}
+
+// Adds the time spent in each Read to *elapsed (in nanoseconds).
+type timedReader struct {
+	r       io.Reader
+	elapsed *int64
+}
+
+func (t *timedReader) Read(p []byte) (n int, err error) {
+	start := time.Now()
+	n, err = t.r.Read(p)
+	atomic.AddInt64(t.elapsed, int64(time.Since(start)))
+	return
+}
+
+// Size of the individual reads done by a readAheadReader.
+const readAheadChunkSize = 32 * 1024
+
+type readAheadChunk struct {
+	data []byte
+	err  error
+}
+
+// Reads ahead from an underlying reader in a separate goroutine, buffering up
+// to roughly `size` bytes, so that a bursty network connection doesn't stall
+// the consumer.
+type readAheadReader struct {
+	chunks  chan readAheadChunk
+	current []byte
+	err     error
+	done    chan struct{}
+}
+
+func newReadAheadReader(r io.Reader, size int) *readAheadReader {
+	chunkSize := readAheadChunkSize
+	if size < chunkSize {
+		chunkSize = size
+	}
+	ra := &readAheadReader{
+		chunks: make(chan readAheadChunk, size/chunkSize),
+		done:   make(chan struct{}),
+	}
+	go ra.fill(r, chunkSize)
+	return ra
+}
+
+func (ra *readAheadReader) fill(r io.Reader, chunkSize int) {
+	defer close(ra.chunks)
+	for {
+		buf := make([]byte, chunkSize)
+		n, err := r.Read(buf)
+		select {
+		case ra.chunks <- readAheadChunk{buf[:n], err}:
+		case <-ra.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ra *readAheadReader) Read(p []byte) (n int, err error) {
+	for len(ra.current) == 0 {
+		if ra.err != nil {
+			return 0, ra.err
+		}
+		chunk, ok := <-ra.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		ra.current, ra.err = chunk.data, chunk.err
+	}
+	n = copy(p, ra.current)
+	ra.current = ra.current[n:]
+	return n, nil
+}
+
+// Stop reading ahead. This should be called before closing the underlying
+// reader.
+func (ra *readAheadReader) Close() {
+	close(ra.done)
+}
+
+// Determine how long ago the given object was last modified, if S3 told us.
+func ObjectAge(key s3.Key, now time.Time) (age time.Duration, ok bool) {
+	lastModified, err := time.Parse(s3TimeFormat, key.LastModified)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(lastModified), true
+}
+
+// Determine how many parts the given object was uploaded in, from its ETag.
+// The ETag of a multipart upload is the MD5 of its parts' MD5s, followed by
+// "-<number of parts>", so unlike other ETags it isn't the object's MD5.
+func MultipartParts(key s3.Key) (parts int, ok bool) {
+	etag := normalizeETag(key.ETag)
+	dash := strings.LastIndex(etag, "-")
+	if dash < 0 {
+		return 0, false
+	}
+	parts, err := strconv.Atoi(etag[dash+1:])
+	if err != nil || parts < 1 {
+		return 0, false
+	}
+	return parts, true
+}
+
+// Upper bounds (exclusive) of the object size histogram buckets, and their
+// names. Anything larger goes in a final "Over1GB" bucket.
+var sizeBuckets = []struct {
+	limit int64
+	name  string
+}{
+	{1 << 10, "Under1KB"},
+	{1 << 20, "Under1MB"},
+	{16 << 20, "Under16MB"},
+	{128 << 20, "Under128MB"},
+	{1 << 30, "Under1GB"},
+}
+
+// How well each codec has compressed the objects read with it.
+type CompressionStats struct {
+	sync.Mutex
+	codecs map[string]*codecStats
+}
+
+type codecStats struct {
+	Objects, Compressed, Decompressed int64
+	// The sum of each object's ratio, for the average.
+	ratios float64
+}
+
+func NewCompressionStats() *CompressionStats {
+	return &CompressionStats{codecs: map[string]*codecStats{}}
+}
+
+// Count an object that was `compressed` bytes in S3, and `decompressed`
+// bytes once decompressed.
+func (s *CompressionStats) Add(codec string, compressed int64, decompressed int64) {
+	s.Lock()
+	defer s.Unlock()
+	cs, ok := s.codecs[codec]
+	if !ok {
+		cs = &codecStats{}
+		s.codecs[codec] = cs
+	}
+	cs.Objects++
+	cs.Compressed += compressed
+	cs.Decompressed += decompressed
+	if compressed > 0 {
+		cs.ratios += float64(decompressed) / float64(compressed)
+	}
+}
+
+// Add the statistics to the given message: the ratio of decompressed to
+// compressed bytes over all objects (CompressionRatio), the average of each
+// object's ratio (CompressionRatioAvg), and the same for each codec, with
+// field names beginning with "<codec>.".
+func (s *CompressionStats) Report(msg *message.Message) {
+	s.Lock()
+	defer s.Unlock()
+	var total codecStats
+	codecs := make([]string, 0, len(s.codecs))
+	for codec, cs := range s.codecs {
+		codecs = append(codecs, codec)
+		total.Objects += cs.Objects
+		total.Compressed += cs.Compressed
+		total.Decompressed += cs.Decompressed
+		total.ratios += cs.ratios
+	}
+	sort.Strings(codecs)
+	total.report(msg, "")
+	for _, codec := range codecs {
+		s.codecs[codec].report(msg, codec+".")
+	}
+}
+
+// The ratio of decompressed to compressed bytes.
+func (cs *codecStats) ratio() float64 {
+	if cs.Compressed == 0 {
+		return 0
+	}
+	return float64(cs.Decompressed) / float64(cs.Compressed)
+}
+
+// The average of each object's ratio.
+func (cs *codecStats) averageRatio() float64 {
+	if cs.Objects == 0 {
+		return 0
+	}
+	return cs.ratios / float64(cs.Objects)
+}
+
+func (cs *codecStats) report(msg *message.Message, prefix string) {
+	message.NewInt64Field(msg, prefix+"CompressedObjects", cs.Objects, "count")
+	message.NewInt64Field(msg, prefix+"CompressedBytes", cs.Compressed, "B")
+	message.NewInt64Field(msg, prefix+"DecompressedBytes", cs.Decompressed, "B")
+	for _, f := range []struct {
+		name  string
+		value float64
+	}{{"CompressionRatio", cs.ratio()}, {"CompressionRatioAvg", cs.averageRatio()}} {
+		if field, err := message.NewField(prefix+f.name, f.value, "ratio"); err == nil {
+			msg.AddField(field)
+		}
+	}
+}
+
+// Summary statistics for a set of object sizes.
+type SizeStats struct {
+	sync.Mutex
+	Count, Total, Min, Max int64
+	// Counts for each of sizeBuckets, plus one for larger objects.
+	Buckets []int64
+}
+
+func NewSizeStats() *SizeStats {
+	return &SizeStats{Buckets: make([]int64, len(sizeBuckets)+1)}
+}
+
+func (s *SizeStats) Add(size int64) {
+	s.Lock()
+	defer s.Unlock()
+	if s.Count == 0 || size < s.Min {
+		s.Min = size
+	}
+	if size > s.Max {
+		s.Max = size
+	}
+	s.Count++
+	s.Total += size
+	i := 0
+	for i < len(sizeBuckets) && size >= sizeBuckets[i].limit {
+		i++
+	}
+	s.Buckets[i]++
+}
+
+// Record counts for each partition (the schema dimensions' values, joined
+// with "/").
+type PartitionCounts struct {
+	sync.Mutex
+	counts map[string]int64
+}
+
+func NewPartitionCounts() *PartitionCounts {
+	return &PartitionCounts{counts: map[string]int64{}}
+}
+
+func (p *PartitionCounts) Add(values []string, records int64) {
+	p.Lock()
+	defer p.Unlock()
+	p.counts[strings.Join(values, "/")] += records
+}
+
+// A copy of the counts so far.
+func (p *PartitionCounts) Counts() map[string]int64 {
+	p.Lock()
+	defer p.Unlock()
+	counts := make(map[string]int64, len(p.counts))
+	for partition, n := range p.counts {
+		counts[partition] = n
+	}
+	return counts
+}
+
+// Failure counts for each partition (a directory of a bucket), so that one
+// that keeps failing can be given up on while the others carry on. A nil
+// *PartitionFailures never gives up on anything.
+type PartitionFailures struct {
+	sync.Mutex
+	max      int64
+	failures map[string]int64
+}
+
+// Give up on a partition once `max` of its objects have failed.
+func NewPartitionFailures(max int64) *PartitionFailures {
+	return &PartitionFailures{max: max, failures: map[string]int64{}}
+}
+
+// Count a failure in the given partition, returning the number so far and
+// whether this is the one that has us give up on it.
+func (p *PartitionFailures) Add(partition string) (failures int64, failed bool) {
+	if p == nil {
+		return 0, false
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.failures[partition]++
+	failures = p.failures[partition]
+	return failures, failures == p.max
+}
+
+// Determine whether we've given up on the given partition.
+func (p *PartitionFailures) IsFailed(partition string) bool {
+	if p == nil {
+		return false
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.failures[partition] >= p.max
+}
+
+// The partitions we've given up on, in order.
+func (p *PartitionFailures) Failed() (partitions []string) {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	for partition, n := range p.failures {
+		if n >= p.max {
+			partitions = append(partitions, partition)
+		}
+	}
+	sort.Strings(partitions)
+	return
+}
+
+// Add the statistics to the given message, with field names beginning with
+// `prefix`.
+func (s *SizeStats) Report(msg *message.Message, prefix string) {
+	s.Lock()
+	defer s.Unlock()
+	var avg int64
+	if s.Count > 0 {
+		avg = s.Total / s.Count
+	}
+	message.NewInt64Field(msg, prefix+"Min", s.Min, "B")
+	message.NewInt64Field(msg, prefix+"Max", s.Max, "B")
+	message.NewInt64Field(msg, prefix+"Avg", avg, "B")
+	for i, b := range sizeBuckets {
+		message.NewInt64Field(msg, prefix+b.name, s.Buckets[i], "count")
+	}
+	message.NewInt64Field(msg, prefix+"Over1GB", s.Buckets[len(sizeBuckets)], "count")
+}
+
+// Regions that offer a FIPS 140-2 validated S3 endpoint.
+var fipsRegions = map[string]bool{
+	"us-east-1":     true,
+	"us-east-2":     true,
+	"us-west-1":     true,
+	"us-west-2":     true,
+	"ca-central-1":  true,
+	"us-gov-west-1": true,
+	"us-gov-east-1": true,
+}
+
+// Regions that only accept Signature Version 4 requests.
+var v4OnlyRegions = map[string]bool{
+	"eu-central-1":   true,
+	"eu-west-2":      true,
+	"eu-west-3":      true,
+	"eu-north-1":     true,
+	"ap-northeast-2": true,
+	"ap-northeast-3": true,
+	"ap-south-1":     true,
+	"ap-east-1":      true,
+	"ca-central-1":   true,
+	"us-east-2":      true,
+	"us-gov-east-1":  true,
+	"cn-north-1":     true,
+	"cn-northwest-1": true,
+	"me-south-1":     true,
+}
+
+// Determine the goamz signature to use for the given signing_version ("v2"
+// or "v4") against the given region. Returns false for an empty version,
+// meaning goamz's default. SigV2 is refused for regions, and FIPS endpoints,
+// that would reject it with a 403.
+func SigningVersion(version string, region aws.Region, fips bool) (signature int, set bool, err error) {
+	switch version {
+	case "":
+		return 0, false, nil
+	case "v4":
+		return aws.V4Signature, true, nil
+	case "v2":
+		if fips {
+			return 0, false, fmt.Errorf("FIPS endpoints only accept v4 signing")
+		}
+		if v4OnlyRegions[region.Name] {
+			return 0, false, fmt.Errorf("AWS region '%s' only accepts v4 signing", region.Name)
+		}
+		return aws.V2Signature, true, nil
+	}
+	return 0, false, fmt.Errorf("unknown signing version '%s'", version)
+}
+
+// Look up the named AWS region. If `fips` is set, the region's S3 endpoint is
+// replaced with its FIPS endpoint, and regions that goamz doesn't know about
+// (such as newer GovCloud regions) are constructed as long as they have one.
+func ResolveRegion(name string, fips bool) (region aws.Region, err error) {
+	region, ok := aws.Regions[name]
+	if !fips {
+		if !ok {
+			err = fmt.Errorf("unknown AWS region '%s'", name)
+		}
+		return
+	}
+	if !fipsRegions[name] {
+		return region, fmt.Errorf("AWS region '%s' has no FIPS S3 endpoint", name)
+	}
+	if !ok {
+		region = aws.Region{
+			Name:                 name,
+			S3LocationConstraint: true,
+			S3LowercaseBucket:    true,
+		}
+	}
+	region.S3Endpoint = fmt.Sprintf("https://s3-fips.%s.amazonaws.com", name)
+	// Always use path-style requests against the FIPS endpoint.
+	region.S3BucketEndpoint = ""
+	return
+}
+
+// The same bucket, but reached through S3 Transfer Acceleration's global
+// endpoint. Requests are still signed for the bucket's own region.
+func AccelerateBucket(bucket *s3.Bucket) *s3.Bucket {
+	s := *bucket.S3
+	s.Region.S3Endpoint = "https://s3-accelerate.amazonaws.com"
+	s.Region.S3BucketEndpoint = "https://${bucket}.s3-accelerate.amazonaws.com"
+	return s.Bucket(bucket.Name)
+}
+
+// Check that the named bucket can use transfer acceleration, which needs a
+// DNS-compatible name without dots.
+func checkAccelerateBucketName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return fmt.Errorf("bucket name '%s' isn't 3 to 63 characters long", name)
+	}
+	for i, c := range name {
+		ok := c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' && i > 0 && i < len(name)-1
+		if !ok {
+			return fmt.Errorf("bucket name '%s' may only contain lowercase letters, digits, and inner hyphens", name)
+		}
+	}
+	return nil
+}
+
+// Determine whether the given error means the bucket doesn't allow transfer
+// acceleration.
+func isAccelerateError(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		return s3err.Code == "InvalidRequest" && strings.Contains(s3err.Message, "Acceleration")
+	}
+	return false
+}
+
+// Which of `workers` fetchers gets the objects in the given partition, with
+// partition_affinity.
+func affinityWorker(partition string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(partition))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// Determine whether the given object is among the `rate` of objects that
+// sample_rate selects. The choice depends only on the seed, bucket and key,
+// so it's the same whatever order the buckets' listings arrive in.
+func sampled(seed int64, bucket string, key string, rate float64) bool {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d/%s/%s", seed, bucket, key)
+	return float64(h.Sum64())/(1<<64) < rate
+}
+
+// Determine whether the given error means S3 is asking us to slow down.
+func isThrottleError(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		return s3err.StatusCode == 503 || s3err.Code == "SlowDown"
+	}
+	return false
+}
+
+// Determine whether the given error means the object doesn't exist.
+func isNotFound(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		return s3err.StatusCode == 404 || s3err.Code == "NoSuchKey"
+	}
+	return false
+}
+
+// Determine whether the given error means an object didn't match the
+// ReadOptions.IfMatch ETag.
+func isPreconditionFailed(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		return s3err.StatusCode == 412 || s3err.Code == "PreconditionFailed"
+	}
+	return false
+}
+
+// Strip the quotes that S3 puts around ETags.
+func normalizeETag(etag string) string {
+	return strings.Trim(etag, "\"")
+}
+
+// The rate at which `bytes` were read in the given time, in MB (2^20 bytes)
+// per second.
+func throughputMBps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / float64(1<<20) / elapsed.Seconds()
+}
+
+// How many fetchers should be active `elapsed` into a ramp-up from `start`
+// to `target` that lasts `duration`, increasing evenly.
+func RampWorkers(start, target uint32, elapsed, duration time.Duration) uint32 {
+	if elapsed >= duration || start >= target {
+		return target
+	}
+	if elapsed < 0 {
+		return start
+	}
+	return start + uint32(int64(target-start)*int64(elapsed)/int64(duration))
+}
+
+// How long to allow for reading an object of the given size: `base`, plus
+// as long as the object takes to read at `bytesPerSecond`.
+func AdaptiveTimeout(base time.Duration, size int64, bytesPerSecond int64) time.Duration {
+	if bytesPerSecond <= 0 || size <= 0 {
+		return base
+	}
+	return base + time.Duration(float64(size)/float64(bytesPerSecond)*float64(time.Second))
+}
+
+// How long to wait before the given attempt (counting from 1) after being
+// throttled: `base`, doubling with each attempt, but never more than `max`.
+func throttleBackoff(attempt uint32, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := uint32(1); i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// A random delay of up to `max`, chosen using `seed`.
+func startupJitter(max time.Duration, seed int64) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.New(rand.NewSource(seed)).Int63n(int64(max) + 1))
+}
+
+// Determine whether the given error means our credentials aren't (or are no
+// longer) allowed to do what we asked.
+func isAuthError(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		switch s3err.Code {
+		case "AccessDenied", "InvalidAccessKeyId", "ExpiredToken", "InvalidToken":
+			return true
+		}
+	}
+	return false
+}
+
+// Determine whether the given error means S3 rejected a request because our
+// clock is too far from its own for the request's signature to be valid.
+func isClockSkewError(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		return s3err.Code == "RequestTimeTooSkewed"
+	}
+	return false
+}
+
+// How far S3's clock is ahead of ours (negative if it's behind), from the
+// Date header of an unsigned request to the given endpoint. goamz signs each
+// request with our own clock, and doesn't keep the headers of error
+// responses, so this takes a request of its own.
+func MeasureClockSkew(endpoint string, timeout time.Duration) (time.Duration, error) {
+	client := &http.Client{Timeout: timeout}
+	sent := time.Now()
+	resp, err := client.Head(endpoint)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return clockSkew(resp.Header, sent, time.Now())
+}
+
+// The skew given by a response's Date header, taking the server's time to be
+// halfway between when the request was sent and the response received.
+func clockSkew(header http.Header, sent time.Time, received time.Time) (time.Duration, error) {
+	date, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no usable Date header: %s", err)
+	}
+	local := sent.Add(received.Sub(sent) / 2)
+	// Date only has a resolution of a second.
+	return date.Sub(local.Truncate(time.Second)), nil
+}
+
+// Determine whether the given error means the bucket is in another region.
+func isRedirectError(err error) bool {
+	if s3err, ok := err.(*s3.Error); ok {
+		return s3err.StatusCode == 301 || s3err.Code == "PermanentRedirect"
+	}
+	return false
+}
+
+// Find the name of the region the given bucket lives in.
+func bucketRegion(bucket *s3.Bucket) (string, error) {
+	location, err := bucket.Location()
+	if err != nil {
+		return "", err
+	}
+	// Older regions have their own special location constraints.
+	switch location {
+	case "":
+		return "us-east-1", nil
+	case "EU":
+		return "eu-west-1", nil
+	}
+	return location, nil
+}
+
+// Classify the given error for reporting: the S3 error code if S3 gave us
+// one, or a generic "ReadError" otherwise.
+func errorType(err error) string {
+	if isThrottleError(err) {
+		return "SlowDown"
+	}
+	if _, ok := err.(*TimeoutError); ok {
+		return "Timeout"
+	}
+	if _, ok := err.(*TruncatedError); ok {
+		return "Truncated"
+	}
+	if _, ok := err.(*ContentTypeError); ok {
+		return "ContentType"
+	}
+	if _, ok := err.(*MalformedLineError); ok {
+		return "MalformedLine"
+	}
+	if _, ok := err.(*GroupRolledBackError); ok {
+		return "GroupRolledBack"
+	}
+	if s3err, ok := err.(*s3.Error); ok && s3err.Code != "" {
+		return s3err.Code
+	}
+	return "ReadError"
+}
+
+// Build the value of an HTTP "Range" header for the bytes in [start, end). An
+// `end` less than zero gives an open-ended range.
+func makeRangeHeader(start int64, end int64) string {
+	if end < 0 {
+		return fmt.Sprintf("bytes=%d-", start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", start, end-1)
+}
+
+// Options controlling how NormalizeBucketPrefix treats a bucket prefix. The
+// zero value gives the standard CleanBucketPrefix behaviour.
+type PrefixNormalization struct {
+	// Keep any leading slashes, for buckets whose keys really do begin with
+	// "/".
+	KeepLeadingSlash bool
+	// Leave the end of the prefix exactly as given, rather than ensuring it
+	// ends with a single slash. This allows a prefix to match part of a path
+	// segment (e.g. "logs/2015-"). Note that when listing with a schema, the
+	// rest of that segment is then what gets checked against the first
+	// dimension.
+	NoTrailingSlash bool
+}
+
+// Normalize a bucket prefix. By default, this:
+//   - removes all leading slashes,
+//   - replaces any trailing slashes with exactly one slash, and
+//   - appends a slash if there wasn't one (unless the prefix is empty).
+// Slashes within the prefix are never changed.
+func NormalizeBucketPrefix(prefix string, opts PrefixNormalization) (cleaned string) {
+	cleaned = prefix
+	if !opts.KeepLeadingSlash {
+		cleaned = strings.TrimLeft(cleaned, "/")
+	}
+	if opts.NoTrailingSlash {
+		return
+	}
+	trimmed := strings.TrimRight(cleaned, "/")
+	if trimmed != "" {
+		cleaned = trimmed + "/"
+	} else if !opts.KeepLeadingSlash {
+		cleaned = ""
+	} else if cleaned != "" {
+		// The prefix was nothing but slashes, and we're keeping them.
+		cleaned = "/"
 	}
 	return
 }
+
+// Remove any excess path separators from a bucket prefix, leaving either an
+// empty prefix or one that ends with exactly one slash.
+func CleanBucketPrefix(prefix string) (cleaned string) {
+	return NormalizeBucketPrefix(prefix, PrefixNormalization{})
+}
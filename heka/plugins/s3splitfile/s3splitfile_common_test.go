@@ -7,10 +7,70 @@
 package s3splitfile
 
 import (
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"code.google.com/p/gogoprotobuf/proto"
+	"encoding/json"
+	"fmt"
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/mozilla-services/heka/message"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// A Heka stream frame holding the given message.
+func testHekaFrame(c gs.Context, msg *message.Message) []byte {
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	body, err := proto.Marshal(msg)
+	c.Assume(err, gs.IsNil)
+	header, err := proto.Marshal(&message.Header{MessageLength: proto.Uint32(uint32(len(body)))})
+	c.Assume(err, gs.IsNil)
+	frame := append([]byte{message.RECORD_SEPARATOR, byte(len(header))}, header...)
+	frame = append(frame, message.UNIT_SEPARATOR)
+	return append(frame, body...)
+}
+
+// Finds Heka frames, skipping anything before them, as the Heka framing
+// splitter does.
+type frameSplitter struct{}
+
+func (frameSplitter) FindRecord(buf []byte) (int, []byte) {
+	start := bytes.IndexByte(buf, message.RECORD_SEPARATOR)
+	if start < 0 {
+		return len(buf), nil
+	}
+	n, ok := parseHekaFrame(buf[start:])
+	if !ok {
+		return start, nil
+	}
+	return start + n, buf[start : start+n]
+}
+
+// Splits lines, skipping any '#'s before them, as the Heka framing splitter
+// skips garbage between frames.
+type garbageSplitter struct{}
+
+func (garbageSplitter) FindRecord(buf []byte) (int, []byte) {
+	skipped := len(buf) - len(bytes.TrimLeft(buf, "#"))
+	end := bytes.IndexByte(buf, '\n')
+	if end < 0 {
+		return skipped, nil
+	}
+	return end + 1, buf[skipped : end+1]
+}
+
 func testFieldVal(c gs.Context, schema Schema, field string, actual string, expected string) {
 	sVal, err := schema.GetValue(field, actual)
 	c.Expect(err, gs.IsNil)
@@ -24,6 +84,58 @@ func S3SplitFileSpec(c gs.Context) {
 		c.Expect("___________________________", gs.Equals, SanitizeDimension("!@#$%^&*(){}[]|+=-`~'\",<>?\x02"))
 	})
 
+	c.Specify("Catalog", func() {
+		bucket := s3.New(aws.Auth{}, aws.Regions["us-west-2"]).Bucket("data")
+		cat, err := NewCatalog("s3://catalogs/telemetry/latest.json", bucket, "run1")
+		c.Assume(err, gs.IsNil)
+		c.Expect(cat.bucket.Name, gs.Equals, "catalogs")
+		c.Expect(cat.path, gs.Equals, "telemetry/latest.json")
+		c.Expect(cat.Add(CatalogEntry{Bucket: "data", Key: "a/b", Size: 10, Records: 2, Partition: map[string]string{"day": "a"}}), gs.IsNil)
+		c.Expect(cat.Add(CatalogEntry{Bucket: "data", Key: "c", Size: 5}), gs.IsNil)
+		c.Assume(cat.w.Flush(), gs.IsNil)
+		spooled, err := ioutil.ReadFile(cat.file.Name())
+		c.Assume(err, gs.IsNil)
+		c.Expect(string(spooled), gs.Equals, `{"bucket":"data","key":"a/b","size":10,"records":2,"partition":{"day":"a"},"run_id":"run1"}
+{"bucket":"data","key":"c","size":5,"records":0,"run_id":"run1"}
+`)
+		c.Expect(cat.size, gs.Equals, int64(len(spooled)))
+		name := cat.file.Name()
+		c.Expect(cat.Close(), gs.IsNil)
+		_, err = os.Stat(name)
+		c.Expect(os.IsNotExist(err), gs.IsTrue)
+		c.Expect(cat.Add(CatalogEntry{Key: "d"}), gs.Not(gs.IsNil))
+
+		cat, err = NewCatalog("catalog.json", bucket, "run1")
+		c.Assume(err, gs.IsNil)
+		c.Expect(cat.bucket, gs.Equals, bucket)
+		c.Expect(cat.Close(), gs.IsNil)
+		_, err = NewCatalog("s3://catalogs", bucket, "run1")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = NewCatalog("catalog.json", nil, "run1")
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Lenient schemas", func() {
+		path := filepath.Join(".", "testsupport", "schema_lenient.json")
+		_, err := LoadSchema(path)
+		c.Expect(err.Error(), gs.Equals, "Entries in 'allowed_values' for field 'list' must be strings")
+
+		schema, warnings, err := LoadSchemaLenient(path)
+		c.Expect(len(warnings), gs.Equals, 4)
+		c.Expect(warnings[0], gs.Equals, "Skipping entry 2 (3): Entries in 'allowed_values' for field 'list' must be strings")
+		c.Expect(err.Error(), gs.Equals, "2 problems: Range for field 'range' must have at least one of 'min' or 'max'; No valid entries in 'allowed_values' for field 'none'")
+		testFieldVal(c, schema, "list", "foo", "foo")
+		testFieldVal(c, schema, "list", "rc1", "OTHER")
+
+		dir, err := ioutil.TempDir("", "s3splitfile-schema")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		path = filepath.Join(dir, "schema.json")
+		c.Assume(ioutil.WriteFile(path, []byte("{\n  \"dimensions\": [\n    { \"field_name\": \"a\" },,\n  ]\n}\n"), 0644), gs.IsNil)
+		_, _, err = LoadSchemaLenient(path)
+		c.Expect(err.Error(), gs.Equals, "line 3, column 28: invalid character ',' looking for beginning of value")
+	})
+
 	c.Specify("JSON Schema", func() {
 		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema.json"))
 		c.Expect(err, gs.IsNil)
@@ -66,4 +178,1317 @@ func S3SplitFileSpec(c gs.Context) {
 		testFieldVal(c, schema, "range", "bbc", "OTHER")
 		testFieldVal(c, schema, "range", "ccc", "OTHER")
 	})
+	c.Specify("Glob dimensions", func() {
+		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema_glob.json"))
+		c.Expect(err, gs.IsNil)
+
+		testFieldVal(c, schema, "single", "20150101", "20150101")
+		testFieldVal(c, schema, "single", "20141231", "OTHER")
+
+		testFieldVal(c, schema, "list", "foo", "foo")
+		testFieldVal(c, schema, "list", "beta_1", "beta_1")
+		testFieldVal(c, schema, "list", "beta-1", "beta-1")
+		testFieldVal(c, schema, "list", "beta_10", "OTHER")
+		testFieldVal(c, schema, "list", "rc3", "rc3")
+		testFieldVal(c, schema, "list", "rcx", "OTHER")
+
+		c.Expect(schema.SetWildcard("list"), gs.IsNil)
+		testFieldVal(c, schema, "list", "anything", "anything")
+		c.Expect(schema.SetWildcard("bogus"), gs.Not(gs.IsNil))
+
+		c.Expect(checkGlob("rc[0-9"), gs.Not(gs.IsNil))
+		c.Expect(checkGlob("plain"), gs.IsNil)
+		// Keys never hold "-", so these could never match anything.
+		c.Expect(checkGlob("beta-?"), gs.Not(gs.IsNil))
+		c.Expect(checkGlob("rc\\-*"), gs.Not(gs.IsNil))
+		c.Expect(checkGlob("rc[_.]*"), gs.IsNil)
+	})
+
+	c.Specify("Listing start markers", func() {
+		schema := Schema{Fields: []string{"date", "channel"}}
+		opts := &ListOptions{StartAfter: "p/20150101/beta/file.log"}
+
+		c.Expect(startMarker("p/", 0, schema, opts), gs.Equals, "p/20150101")
+		c.Expect(startMarker("p/20150101/", 1, schema, opts), gs.Equals, "p/20150101/beta")
+		c.Expect(startMarker("p/20150101/beta/", 2, schema, opts), gs.Equals, "p/20150101/beta/file.log")
+		// Later partitions are listed from the start.
+		c.Expect(startMarker("p/20150102/", 1, schema, opts), gs.Equals, "")
+		c.Expect(startMarker("p/", 0, schema, &ListOptions{}), gs.Equals, "")
+
+		_, _, err := ListPage(nil, "p/", Schema{Formats: map[string]string{"date": "2006"}}, "", 10)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Keys of unexpected depth", func() {
+		shallow := s3.Key{Key: "data/stray.log"}
+		results := func(policy string, send func(kc chan S3ListResult, opts *ListOptions) bool) (rs []S3ListResult, unexpected int64) {
+			kc := make(chan S3ListResult, 10)
+			opts := &ListOptions{Progress: &ListProgress{}, UnexpectedDepth: policy}
+			c.Expect(send(kc, opts), gs.IsTrue)
+			close(kc)
+			for r := range kc {
+				rs = append(rs, r)
+			}
+			return rs, opts.Progress.UnexpectedDepth
+		}
+		sendShallow := func(kc chan S3ListResult, opts *ListOptions) bool {
+			return sendShallowKey(kc, opts, shallow)
+		}
+		sendDeep := func(kc chan S3ListResult, opts *ListOptions) bool {
+			return sendDeepPrefix(nil, kc, opts, "data/a/foo/m/c/bar/extra/", 6)
+		}
+
+		c.Specify("too-shallow keys", func() {
+			rs, n := results("", sendShallow)
+			c.Expect(len(rs), gs.Equals, 0)
+			c.Expect(n, gs.Equals, int64(1))
+
+			rs, n = results(UnexpectedDepthDeliver, sendShallow)
+			c.Expect(len(rs), gs.Equals, 1)
+			c.Expect(rs[0].Key.Key, gs.Equals, "data/stray.log")
+			c.Expect(rs[0].Err, gs.IsNil)
+
+			rs, n = results(UnexpectedDepthFail, sendShallow)
+			c.Expect(len(rs), gs.Equals, 1)
+			depthErr, ok := rs[0].Err.(*UnexpectedDepthError)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(depthErr.Key, gs.Equals, "data/stray.log")
+			c.Expect(depthErr.Shallow, gs.IsTrue)
+		})
+
+		c.Specify("too-deep keys", func() {
+			rs, n := results(UnexpectedDepthSkip, sendDeep)
+			c.Expect(len(rs), gs.Equals, 0)
+			c.Expect(n, gs.Equals, int64(1))
+
+			rs, _ = results(UnexpectedDepthFail, sendDeep)
+			c.Expect(len(rs), gs.Equals, 1)
+			depthErr, ok := rs[0].Err.(*UnexpectedDepthError)
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(depthErr.Key, gs.Equals, "data/a/foo/m/c/bar/extra/")
+			c.Expect(depthErr.Shallow, gs.IsFalse)
+		})
+
+		c.Specify("before the start marker", func() {
+			rs, n := results(UnexpectedDepthFail, func(kc chan S3ListResult, opts *ListOptions) bool {
+				opts.StartAfter = "data/z"
+				return sendShallowKey(kc, opts, shallow) && sendDeepPrefix(nil, kc, opts, "data/a/foo/m/c/bar/extra/", 6)
+			})
+			c.Expect(len(rs), gs.Equals, 0)
+			c.Expect(n, gs.Equals, int64(0))
+		})
+	})
+
+	c.Specify("Maximum listing depth", func() {
+		schema := Schema{Fields: []string{"date", "channel"}}
+		list := func(opts *ListOptions) (rs []S3ListResult) {
+			kc := make(chan S3ListResult, 10)
+			FilterS3(nil, "p/", 0, schema, opts, kc)
+			for r := range kc {
+				rs = append(rs, r)
+			}
+			return
+		}
+		// The schema's keys are 3 levels down, so this stops before
+		// listing anything.
+		opts := &ListOptions{MaxDepth: 2}
+		rs := list(opts)
+		c.Expect(len(rs), gs.Equals, 1)
+		depthErr, ok := rs[0].Err.(*ListDepthError)
+		c.Assume(ok, gs.IsTrue)
+		c.Expect(depthErr.Key, gs.Equals, "p/")
+		c.Expect(depthErr.Depth, gs.Equals, 3)
+		c.Expect(depthErr.MaxDepth, gs.Equals, 2)
+		c.Expect(listStopped(opts), gs.IsTrue)
+	})
+
+	c.Specify("Keys to dimensions", func() {
+		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema.json"))
+		c.Assume(err, gs.IsNil)
+
+		values, err := schema.ParseKey("data/", "data/a/foo/m/c/bar/20150101.log")
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(values), gs.Equals, 5)
+		c.Expect(values[0], gs.Equals, "a")
+		c.Expect(values[4], gs.Equals, "bar")
+
+		_, err = schema.ParseKey("data/", "data/a/foo/m/20150101.log")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = schema.ParseKey("data/", "data/a/foo/m/c/bar/extra/20150101.log")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = schema.ParseKey("data/", "data/20150101.log")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = schema.ParseKey("other/", "data/a/foo/m/c/bar/20150101.log")
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Date dimensions", func() {
+		schema, err := LoadSchema(filepath.Join(".", "testsupport", "schema_dates.json"))
+		c.Expect(err, gs.IsNil)
+		c.Expect(schema.Formats["date"], gs.Equals, "01-02-2006")
+
+		testFieldVal(c, schema, "date", "12-30-2014", "12-30-2014")
+		testFieldVal(c, schema, "date", "01-01-2015", "01-01-2015")
+		testFieldVal(c, schema, "date", "01-02-2015", "01-02-2015")
+		testFieldVal(c, schema, "date", "12-29-2014", "OTHER")
+		testFieldVal(c, schema, "date", "01-03-2015", "OTHER")
+		testFieldVal(c, schema, "date", "20150101", "OTHER")
+
+		c.Expect(schema.SetFormat("bogus", "2006"), gs.Not(gs.IsNil))
+
+		// Overriding the format reparses the range in the new layout.
+		c.Expect(schema.SetFormat("date", "1-2-2006"), gs.IsNil)
+		testFieldVal(c, schema, "date", "1-1-2015", "1-1-2015")
+		testFieldVal(c, schema, "date", "12-29-2014", "OTHER")
+		testFieldVal(c, schema, "date", "1-3-2015", "OTHER")
+		c.Expect(schema.SetFormat("date", "2006"), gs.Not(gs.IsNil))
+		c.Assume(schema.SetFormat("date", "01-02-2006"), gs.IsNil)
+
+		prefixes := []string{"p/01-01-2015/", "p/bad/", "p/12-31-2014/", "p/01-02-2014/"}
+		SortPartitions(prefixes, len("p/"), "01-02-2006")
+		c.Expect(prefixes[0], gs.Equals, "p/01-02-2014/")
+		c.Expect(prefixes[1], gs.Equals, "p/12-31-2014/")
+		c.Expect(prefixes[2], gs.Equals, "p/01-01-2015/")
+		c.Expect(prefixes[3], gs.Equals, "p/bad/")
+	})
+
+	c.Specify("Schema prefixes", func() {
+		schema := Schema{Prefix: "telemetry/v2/"}
+
+		prefix, err := schema.ResolvePrefix("")
+		c.Expect(err, gs.IsNil)
+		c.Expect(prefix, gs.Equals, "telemetry/v2/")
+
+		prefix, err = schema.ResolvePrefix("telemetry/v2/")
+		c.Expect(err, gs.IsNil)
+		c.Expect(prefix, gs.Equals, "telemetry/v2/")
+
+		prefix, err = schema.ResolvePrefix("telemetry/v2/20150101/")
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(prefix, gs.Equals, "telemetry/v2/20150101/")
+
+		prefix, err = schema.ResolvePrefix("telemetry/v3/")
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(prefix, gs.Equals, "telemetry/v3/")
+
+		schema.Prefix = ""
+		prefix, err = schema.ResolvePrefix("anything/")
+		c.Expect(err, gs.IsNil)
+		c.Expect(prefix, gs.Equals, "anything/")
+	})
+
+	c.Specify("Bucket prefixes", func() {
+		c.Expect(CleanBucketPrefix(""), gs.Equals, "")
+		c.Expect(CleanBucketPrefix("/"), gs.Equals, "")
+		c.Expect(CleanBucketPrefix("///"), gs.Equals, "")
+		c.Expect(CleanBucketPrefix("foo"), gs.Equals, "foo/")
+		c.Expect(CleanBucketPrefix("/foo/"), gs.Equals, "foo/")
+		c.Expect(CleanBucketPrefix("//foo//bar//"), gs.Equals, "foo//bar/")
+
+		keepLeading := PrefixNormalization{KeepLeadingSlash: true}
+		c.Expect(NormalizeBucketPrefix("", keepLeading), gs.Equals, "")
+		c.Expect(NormalizeBucketPrefix("///", keepLeading), gs.Equals, "/")
+		c.Expect(NormalizeBucketPrefix("/foo", keepLeading), gs.Equals, "/foo/")
+		c.Expect(NormalizeBucketPrefix("//foo//", keepLeading), gs.Equals, "//foo/")
+
+		noTrailing := PrefixNormalization{NoTrailingSlash: true}
+		c.Expect(NormalizeBucketPrefix("", noTrailing), gs.Equals, "")
+		c.Expect(NormalizeBucketPrefix("/logs/2015-", noTrailing), gs.Equals, "logs/2015-")
+		c.Expect(NormalizeBucketPrefix("/logs//", noTrailing), gs.Equals, "logs//")
+
+		both := PrefixNormalization{KeepLeadingSlash: true, NoTrailingSlash: true}
+		c.Expect(NormalizeBucketPrefix("//logs/2015-", both), gs.Equals, "//logs/2015-")
+	})
+
+	c.Specify("Object ages", func() {
+		now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+		age, ok := ObjectAge(s3.Key{LastModified: "2015-06-01T11:59:30.000Z"}, now)
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(age, gs.Equals, 30*time.Second)
+
+		_, ok = ObjectAge(s3.Key{}, now)
+		c.Expect(ok, gs.IsFalse)
+	})
+
+	c.Specify("Multipart ETags", func() {
+		parts, ok := MultipartParts(s3.Key{ETag: "\"d41d8cd98f00b204e9800998ecf8427e-12\""})
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(parts, gs.Equals, 12)
+
+		_, ok = MultipartParts(s3.Key{ETag: "\"d41d8cd98f00b204e9800998ecf8427e\""})
+		c.Expect(ok, gs.IsFalse)
+		_, ok = MultipartParts(s3.Key{ETag: "d41d8cd98f00b204e9800998ecf8427e-x"})
+		c.Expect(ok, gs.IsFalse)
+	})
+
+	c.Specify("ETag matching", func() {
+		c.Expect(normalizeETag("\"d41d8cd98f00b204e9800998ecf8427e\""), gs.Equals, "d41d8cd98f00b204e9800998ecf8427e")
+		c.Expect(normalizeETag("d41d8cd98f00b204e9800998ecf8427e"), gs.Equals, "d41d8cd98f00b204e9800998ecf8427e")
+		c.Expect(isPreconditionFailed(&s3.Error{StatusCode: 412, Code: "PreconditionFailed"}), gs.IsTrue)
+		c.Expect(isPreconditionFailed(&s3.Error{StatusCode: 404, Code: "NoSuchKey"}), gs.IsFalse)
+		c.Expect(isPreconditionFailed(fmt.Errorf("PreconditionFailed")), gs.IsFalse)
+	})
+
+	c.Specify("Throttle backoff", func() {
+		c.Expect(throttleBackoff(1, time.Second, 10*time.Second), gs.Equals, time.Second)
+		c.Expect(throttleBackoff(2, time.Second, 10*time.Second), gs.Equals, 2*time.Second)
+		c.Expect(throttleBackoff(4, time.Second, 10*time.Second), gs.Equals, 8*time.Second)
+		c.Expect(throttleBackoff(5, time.Second, 10*time.Second), gs.Equals, 10*time.Second)
+		c.Expect(throttleBackoff(100, time.Second, 10*time.Second), gs.Equals, 10*time.Second)
+		c.Expect(throttleBackoff(3, 0, 10*time.Second), gs.Equals, time.Duration(0))
+	})
+
+	c.Specify("Startup jitter", func() {
+		c.Expect(startupJitter(0, 1), gs.Equals, time.Duration(0))
+		for seed := int64(0); seed < 100; seed++ {
+			jitter := startupJitter(time.Minute, seed)
+			c.Expect(jitter >= 0 && jitter <= time.Minute, gs.IsTrue)
+		}
+		c.Expect(startupJitter(time.Minute, 7), gs.Equals, startupJitter(time.Minute, 7))
+		c.Expect(startupJitter(time.Minute, 7) != startupJitter(time.Minute, 8), gs.IsTrue)
+	})
+
+	c.Specify("NDJSON lines", func() {
+		c.Expect(ValidJSONLine([]byte(`{"a":1,"b":[true,null]}`+"\n")), gs.IsTrue)
+		c.Expect(ValidJSONLine([]byte(`{"a":1}`)), gs.IsTrue)
+		c.Expect(ValidJSONLine([]byte(`"just a string"`+"\r\n")), gs.IsTrue)
+		c.Expect(ValidJSONLine([]byte(`{"a":1`+"\n")), gs.IsFalse)
+		c.Expect(ValidJSONLine([]byte(`{"a":1}{"b":2}`+"\n")), gs.IsFalse)
+		c.Expect(ValidJSONLine([]byte("\n")), gs.IsFalse)
+		// Which are skipped rather than counted as malformed.
+		c.Expect(BlankLine([]byte("\n")), gs.IsTrue)
+		c.Expect(BlankLine([]byte(" \t\r\n")), gs.IsTrue)
+		c.Expect(BlankLine([]byte(`{}`+"\n")), gs.IsFalse)
+
+		err := &MalformedLineError{42}
+		c.Expect(err.Error(), gs.Equals, "malformed JSON line at offset 42")
+		c.Expect(errorType(err), gs.Equals, "MalformedLine")
+	})
+
+	c.Specify("Request limiter", func() {
+		var unlimited *RequestLimiter
+		unlimited.Acquire()
+		unlimited.Release()
+		c.Expect(unlimited.InUse(), gs.Equals, 0)
+
+		limiter := NewRequestLimiter(2)
+		limiter.Acquire()
+		limiter.Acquire()
+		c.Expect(limiter.InUse(), gs.Equals, 2)
+		acquired := make(chan struct{})
+		go func() {
+			limiter.Acquire()
+			close(acquired)
+		}()
+		select {
+		case <-acquired:
+			c.Expect("a third request", gs.Equals, "kept waiting")
+		case <-time.After(20 * time.Millisecond):
+		}
+		limiter.Release()
+		<-acquired
+		c.Expect(limiter.InUse(), gs.Equals, 2)
+		c.Expect(limiter.WaitTime() > 0, gs.IsTrue)
+
+		// Closing a body more than once only gives its slot back once.
+		body := &limitedBody{ReadCloser: ioutil.NopCloser(strings.NewReader("")), limiter: limiter}
+		c.Expect(body.Close(), gs.IsNil)
+		c.Expect(body.Close(), gs.IsNil)
+		c.Expect(limiter.InUse(), gs.Equals, 1)
+	})
+
+	c.Specify("Mixed schemas", func() {
+		v1 := &Schema{
+			Fields: []string{"date"},
+			Dims:   map[string]DimensionChecker{"date": AnyDimensionChecker{}},
+		}
+		v2 := &Schema{
+			Fields: []string{"date", "channel"},
+			Dims: map[string]DimensionChecker{
+				"date":    AnyDimensionChecker{},
+				"channel": NewListDimensionChecker([]string{"release", "beta"}),
+			},
+		}
+		schemas := []*Schema{v1, v2}
+		c.Expect(MatchSchema(schemas, "p/", "p/20150301/x"), gs.Equals, 0)
+		c.Expect(MatchSchema(schemas, "p/", "p/20150301/beta/x"), gs.Equals, 1)
+		c.Expect(MatchSchema(schemas, "p/", "p/20150301/nightly/x"), gs.Equals, -1)
+		c.Expect(MatchSchema(schemas, "p/", "p/20150301/beta/extra/x"), gs.Equals, -1)
+		c.Expect(MatchSchema(schemas, "p/", "other/20150301/x"), gs.Equals, -1)
+		c.Expect(v2.MatchesKey("p/", "p/20150301/release/x"), gs.IsTrue)
+	})
+
+	c.Specify("Atomic groups", func() {
+		schema := Schema{Fields: []string{"date", "channel"}}
+		c.Expect(groupName(schema, "p/", "b", "p/20150301/release/x", 1), gs.Equals, "b/20150301/")
+		c.Expect(groupName(schema, "p/", "b", "p/20150301/release/x", 2), gs.Equals, "b/20150301/release/")
+		c.Expect(groupName(schema, "p/", "b", "p/stray", 1), gs.Equals, "b/p/stray")
+
+		gt := newGroupTracker()
+		gt.Add("g1")
+		gt.Add("g1")
+		g := gt.Get("g1")
+		g.add([]byte("one"), nil, 0)
+		c.Expect(gt.Finish("g1", groupMember{key: s3.Key{Key: "a"}}, nil), gs.IsNil)
+		c.Expect(gt.Close("g1"), gs.IsNil)
+		record := []byte("two")
+		g.add(record, nil, 0)
+		// The group keeps its own copy of each record.
+		record[0] = 'X'
+		c.Expect(gt.Finish("g1", groupMember{key: s3.Key{Key: "b"}}, nil), gs.Equals, g)
+		c.Expect(g.err, gs.IsNil)
+		c.Expect(len(g.done), gs.Equals, 2)
+		c.Expect(string(g.records[1].record), gs.Equals, "two")
+		c.Expect(gt.Open(), gs.Equals, 0)
+
+		// If any object fails, the group's records are dropped.
+		gt.Add("g2")
+		gt.Add("g2")
+		g = gt.Get("g2")
+		g.add([]byte("one"), nil, 0)
+		gt.Finish("g2", groupMember{key: s3.Key{Key: "a"}}, fmt.Errorf("oops"))
+		c.Expect(gt.Close("g2"), gs.IsNil)
+		c.Expect(gt.Finish("g2", groupMember{key: s3.Key{Key: "b"}}, nil), gs.Equals, g)
+		c.Expect(g.err.Error(), gs.Equals, "a failed: oops")
+		c.Expect(len(g.records), gs.Equals, 0)
+		// The object that was read is dead-lettered as rolled back.
+		c.Expect(len(g.done), gs.Equals, 1)
+		rolledBack := &GroupRolledBackError{g.name, g.err}
+		c.Expect(rolledBack.Error(), gs.Equals, "group g2 wasn't delivered: a failed: oops")
+		c.Expect(errorType(rolledBack), gs.Equals, "GroupRolledBack")
+
+		// As does holding too much.
+		gt.Add("g3")
+		g = gt.Get("g3")
+		g.add([]byte("12345"), nil, 8)
+		c.Expect(g.err, gs.IsNil)
+		g.add([]byte("6789"), nil, 8)
+		c.Expect(g.err, gs.Not(gs.IsNil))
+		c.Expect(len(g.records), gs.Equals, 0)
+		c.Expect(gt.Open(), gs.Equals, 1)
+
+		// An object skipped on purpose isn't delivered, but doesn't fail
+		// its group.
+		gt.Add("g6")
+		gt.Add("g6")
+		gt.Close("g6")
+		gt.Finish("g6", groupMember{key: s3.Key{Key: "a"}, skipped: true}, nil)
+		g = gt.Finish("g6", groupMember{key: s3.Key{Key: "b"}}, nil)
+		c.Assume(g, gs.Not(gs.IsNil))
+		c.Expect(g.err, gs.IsNil)
+		c.Expect(len(g.done), gs.Equals, 1)
+		c.Expect(g.done[0].key.Key, gs.Equals, "b")
+
+		// Starting another group waits for room.
+		gt.WaitForRoom(2, nil)
+		gt.Add("g4")
+		waited := make(chan bool)
+		go func() {
+			gt.WaitForRoom(2, nil)
+			waited <- true
+		}()
+		select {
+		case <-waited:
+			c.Expect("waited", gs.Equals, "not")
+		case <-time.After(10 * time.Millisecond):
+		}
+		gt.Close("g4")
+		c.Expect(gt.Finish("g4", groupMember{key: s3.Key{Key: "c"}}, nil), gs.Not(gs.IsNil))
+		<-waited
+		stop := make(chan bool)
+		close(stop)
+		gt.Add("g5")
+		gt.WaitForRoom(2, stop)
+	})
+
+	c.Specify("Expected partitions", func() {
+		schema := Schema{
+			Fields: []string{"date", "channel"},
+			Dims: map[string]DimensionChecker{
+				"date":    RangeDimensionChecker{"20150130", "20150202"},
+				"channel": NewListDimensionChecker([]string{"release", "beta"}),
+			},
+		}
+		expected, err := ExpectedPartitions(schema)
+		c.Assume(err, gs.IsNil)
+		c.Expect(strings.Join(expected, " "), gs.Equals,
+			"20150130/beta 20150130/release 20150131/beta 20150131/release "+
+				"20150201/beta 20150201/release 20150202/beta 20150202/release")
+
+		missing := MissingPartitions(expected, map[string]int64{
+			"20150130/beta": 3, "20150130/release": 1, "20150131/beta": 0,
+			"20150131/release": 2, "20150201/release": 5, "20150202/beta": 1,
+			"20150202/release": 9, "20150203/release": 4,
+		})
+		c.Expect(strings.Join(missing, " "), gs.Equals, "20150131/beta 20150201/beta")
+		c.Expect(describeMissingPartitions(missing, len(expected)), gs.Equals,
+			"2 of 8 expected partitions have no records: 20150131/beta, 20150201/beta")
+
+		dated := Schema{Fields: []string{"date"}, Dims: map[string]DimensionChecker{
+			"date": RangeDimensionChecker{"2015-12-31", "2016-01-01"},
+		}}
+		c.Assume(dated.SetFormat("date", "2006-01-02"), gs.IsNil)
+		expected, err = ExpectedPartitions(dated)
+		c.Expect(err, gs.IsNil)
+		c.Expect(strings.Join(expected, " "), gs.Equals, "2015-12-31 2016-01-01")
+
+		for _, dc := range []DimensionChecker{
+			AnyDimensionChecker{},
+			NewListDimensionChecker([]string{"release", "beta*"}),
+			RangeDimensionChecker{"20150101", ""},
+			RangeDimensionChecker{"a", "z"},
+		} {
+			_, err = ExpectedPartitions(Schema{Fields: []string{"f"}, Dims: map[string]DimensionChecker{"f": dc}})
+			c.Expect(err, gs.Not(gs.IsNil))
+		}
+		hourly := Schema{Fields: []string{"hour"}, Dims: map[string]DimensionChecker{
+			"hour": RangeDimensionChecker{"2015010100", "2015010123"},
+		}}
+		c.Assume(hourly.SetFormat("hour", "2006010215"), gs.IsNil)
+		_, err = ExpectedPartitions(hourly)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("On file complete", func() {
+		c.Expect(movedKey("data/", "done", "data/20150101/a.log"), gs.Equals, "done/20150101/a.log")
+		c.Expect(movedKey("", "/done/", "20150101/a.log"), gs.Equals, "done/20150101/a.log")
+
+		conf := &S3SplitFileInputConfig{S3BucketPrefix: "data/", OnFileCompleteMarkerSuffix: ".done"}
+		c.Expect(checkFileCompleteActions(conf), gs.IsNil)
+		conf.OnFileComplete = []string{"marker", "event"}
+		c.Expect(checkFileCompleteActions(conf), gs.IsNil)
+		conf.OnFileComplete = []string{"tag"}
+		c.Expect(checkFileCompleteActions(conf), gs.Not(gs.IsNil))
+		conf.OnFileComplete = []string{"event", "event"}
+		c.Expect(checkFileCompleteActions(conf), gs.Not(gs.IsNil))
+
+		conf.OnFileComplete = []string{"move"}
+		c.Expect(checkFileCompleteActions(conf), gs.Not(gs.IsNil))
+		conf.OnFileCompleteMovePrefix = "data/done"
+		c.Expect(checkFileCompleteActions(conf), gs.Not(gs.IsNil))
+		conf.OnFileCompleteMovePrefix = "done"
+		c.Expect(checkFileCompleteActions(conf), gs.IsNil)
+		conf.S3BucketPrefix = ""
+		c.Expect(checkFileCompleteActions(conf), gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Truncated downloads", func() {
+		body := checkLength(ioutil.NopCloser(strings.NewReader("0123456789")), 10)
+		data, err := ioutil.ReadAll(body)
+		c.Expect(err, gs.IsNil)
+		c.Expect(string(data), gs.Equals, "0123456789")
+
+		body = checkLength(ioutil.NopCloser(strings.NewReader("01234")), 10)
+		data, err = ioutil.ReadAll(body)
+		c.Expect(string(data), gs.Equals, "01234")
+		truncated, ok := err.(*TruncatedError)
+		c.Assume(ok, gs.IsTrue)
+		c.Expect(truncated.Got, gs.Equals, int64(5))
+		c.Expect(truncated.Expected, gs.Equals, int64(10))
+		c.Expect(errorType(err), gs.Equals, "Truncated")
+
+		// Without a Content-Length there's nothing to check.
+		body = checkLength(ioutil.NopCloser(strings.NewReader("01234")), -1)
+		_, err = ioutil.ReadAll(body)
+		c.Expect(err, gs.IsNil)
+	})
+
+	c.Specify("Sampling", func() {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("20150301/%d.log", i)
+			s := sampled(7, "bucket", key, 0.25)
+			c.Expect(sampled(7, "bucket", key, 0.25), gs.Equals, s)
+			if s {
+				n++
+			}
+			c.Expect(sampled(7, "bucket", key, 1), gs.IsTrue)
+		}
+		c.Expect(n > 200 && n < 300, gs.IsTrue)
+	})
+
+	c.Specify("Partition affinity", func() {
+		seen := map[int]bool{}
+		for i := 0; i < 100; i++ {
+			partition := fmt.Sprintf("bucket/20150301/channel%d/", i)
+			w := affinityWorker(partition, 4)
+			c.Expect(w >= 0 && w < 4, gs.IsTrue)
+			c.Expect(affinityWorker(partition, 4), gs.Equals, w)
+			seen[w] = true
+		}
+		c.Expect(len(seen), gs.Equals, 4)
+		c.Expect(affinityWorker("bucket/x/", 1), gs.Equals, 0)
+	})
+
+	c.Specify("Transfer acceleration", func() {
+		c.Expect(checkAccelerateBucketName("my-bucket2"), gs.IsNil)
+		c.Expect(checkAccelerateBucketName("my.bucket"), gs.Not(gs.IsNil))
+		c.Expect(checkAccelerateBucketName("-bucket"), gs.Not(gs.IsNil))
+		c.Expect(checkAccelerateBucketName("MyBucket"), gs.Not(gs.IsNil))
+		c.Expect(checkAccelerateBucketName("ab"), gs.Not(gs.IsNil))
+
+		bucket := s3.New(aws.Auth{}, aws.Regions["us-west-2"]).Bucket("my-bucket")
+		accelerated := AccelerateBucket(bucket)
+		c.Expect(accelerated.Name, gs.Equals, "my-bucket")
+		c.Expect(accelerated.Region.Name, gs.Equals, "us-west-2")
+		c.Expect(accelerated.Region.S3BucketEndpoint, gs.Equals, "https://${bucket}.s3-accelerate.amazonaws.com")
+		c.Expect(bucket.Region.S3Endpoint == accelerated.Region.S3Endpoint, gs.IsFalse)
+
+		c.Expect(isAccelerateError(&s3.Error{StatusCode: 400, Code: "InvalidRequest", Message: "S3 Transfer Acceleration is not configured on this bucket"}), gs.IsTrue)
+		c.Expect(isAccelerateError(&s3.Error{StatusCode: 400, Code: "InvalidRequest", Message: "Something else"}), gs.IsFalse)
+	})
+
+	c.Specify("Required fields", func() {
+		empty := &message.Message{}
+		missing, ok := MissingField(empty, []string{"Type", "Payload"})
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(missing, gs.Equals, "Type")
+		_, ok = MissingField(empty, nil)
+		c.Expect(ok, gs.IsFalse)
+		// What isn't a Heka frame is left to the decoder.
+		_, ok = RecordMissingField([]byte("not a frame"), []string{"Type"})
+		c.Expect(ok, gs.IsFalse)
+
+		// Of a stream of encoded frames, only the one lacking a field is
+		// the one injected as invalid.
+		complete := &message.Message{}
+		complete.SetType("telemetry")
+		message.NewStringField(complete, "docType", "main")
+		incomplete := &message.Message{}
+		incomplete.SetType("telemetry")
+		message.NewStringField(incomplete, "docType", "")
+		untyped := &message.Message{}
+		message.NewStringField(untyped, "docType", "main")
+		stream := append(testHekaFrame(c, complete), testHekaFrame(c, incomplete)...)
+		stream = append(stream, testHekaFrame(c, untyped)...)
+		var invalid []string
+		for len(stream) > 0 {
+			n, record := frameSplitter{}.FindRecord(stream)
+			c.Assume(record, gs.Not(gs.IsNil))
+			if missing, ok := RecordMissingField(record, []string{"Type", "docType"}); ok {
+				invalid = append(invalid, missing)
+			}
+			stream = stream[n:]
+		}
+		c.Expect(invalid, gs.Equals, []string{"docType", "Type"})
+	})
+
+	c.Specify("Heka frames", func() {
+		msg := &message.Message{}
+		msg.SetType("test")
+		frame := testHekaFrame(c, msg)
+		headerEnd := int(frame[1]) + message.HEADER_FRAMING_SIZE
+
+		frameLen, ok := parseHekaFrame(frame)
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(frameLen, gs.Equals, len(frame))
+		c.Expect(ValidHekaFrame(frame), gs.IsTrue)
+		// A frame followed by more data is parsed, but isn't a valid record.
+		frameLen, ok = parseHekaFrame(append(append([]byte{}, frame...), "more"...))
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(frameLen, gs.Equals, len(frame))
+		c.Expect(ValidHekaFrame(append(append([]byte{}, frame...), "more"...)), gs.IsFalse)
+
+		// Truncated.
+		for _, n := range []int{1, 2, headerEnd - 1, headerEnd, len(frame) - 1} {
+			_, ok = parseHekaFrame(frame[:n])
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(ValidHekaFrame(frame[:n]), gs.IsFalse)
+		}
+
+		// Bad separators.
+		badRecord := append([]byte{}, frame...)
+		badRecord[0] = 'x'
+		c.Expect(ValidHekaFrame(badRecord), gs.IsFalse)
+		badUnit := append([]byte{}, frame...)
+		badUnit[headerEnd-1] = 'x'
+		_, ok = parseHekaFrame(badUnit)
+		c.Expect(ok, gs.IsFalse)
+
+		// Resynchronizing finds the frames after the bad one and any garbage,
+		// including stray record separators, and where each starts.
+		var record []byte
+		record = append(record, badUnit...)
+		record = append(record, "garbage\x1e\x05junk"...)
+		first := len(record)
+		record = append(record, frame...)
+		record = append(record, frame...)
+		record = append(record, "trailing"...)
+		c.Expect(ValidHekaFrame(record), gs.IsFalse)
+		frames, offsets := ResyncHekaFrames(record)
+		c.Expect(len(frames), gs.Equals, 2)
+		c.Expect(len(offsets), gs.Equals, 2)
+		for i, f := range frames {
+			c.Expect(bytes.Equal(f, frame), gs.IsTrue)
+			c.Expect(offsets[i], gs.Equals, first+i*len(frame))
+		}
+		frames, _ = ResyncHekaFrames([]byte("nothing to see"))
+		c.Expect(len(frames), gs.Equals, 0)
+	})
+
+	c.Specify("Record offsets count skipped bytes", func() {
+		counter := &countingSplitter{Splitter: garbageSplitter{}}
+		buf := []byte("##one\n###two\n")
+		n, record := counter.FindRecord(buf)
+		c.Expect(string(record), gs.Equals, "one\n")
+		c.Expect(counter.recordStart(record), gs.Equals, uint64(2))
+		_, record = counter.FindRecord(buf[n:])
+		c.Expect(string(record), gs.Equals, "two\n")
+		c.Expect(counter.recordStart(record), gs.Equals, uint64(9))
+		// Nothing found yet, but the garbage is still consumed.
+		n, record = counter.FindRecord([]byte("##"))
+		c.Expect(record == nil, gs.IsTrue)
+		c.Expect(counter.consumed, gs.Equals, uint64(15))
+	})
+
+	c.Specify("Request time headers", func() {
+		headers := map[string][]string{"Range": []string{"bytes=0-1"}}
+		signed := requestTimeHeaders(headers, time.Date(2015, 1, 2, 3, 4, 5, 0, time.FixedZone("X", 3600)))
+		c.Expect(signed["X-Amz-Date"][0], gs.Equals, "20150102T020405Z")
+		c.Expect(signed["Range"][0], gs.Equals, "bytes=0-1")
+		_, changed := headers["X-Amz-Date"]
+		c.Expect(changed, gs.IsFalse)
+		c.Expect(requestTimeHeaders(nil, time.Unix(0, 0))["X-Amz-Date"][0], gs.Equals, "19700101T000000Z")
+	})
+
+	c.Specify("Clock skew", func() {
+		c.Expect(isClockSkewError(&s3.Error{StatusCode: 403, Code: "RequestTimeTooSkewed"}), gs.IsTrue)
+		c.Expect(isClockSkewError(&s3.Error{StatusCode: 403, Code: "AccessDenied"}), gs.IsFalse)
+
+		sent := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+		header := http.Header{}
+		header.Set("Date", "Sun, 01 Mar 2015 12:15:00 GMT")
+		skew, err := clockSkew(header, sent, sent.Add(time.Second))
+		c.Expect(err, gs.IsNil)
+		c.Expect(skew, gs.Equals, 15*time.Minute)
+		header.Set("Date", "Sun, 01 Mar 2015 11:50:00 GMT")
+		skew, err = clockSkew(header, sent, sent)
+		c.Expect(err, gs.IsNil)
+		c.Expect(skew, gs.Equals, -10*time.Minute)
+		_, err = clockSkew(http.Header{}, sent, sent)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Lineage fields", func() {
+		input := &S3SplitFileInput{S3SplitFileInputConfig: &S3SplitFileInputConfig{Lineage: true, RunId: "run1"}}
+		b := &inputBucket{name: "bucket"}
+		fields := input.recordFields(input.objectFields(nil, b, s3.Key{Key: "a/b", ETag: "\"e1\""}), []byte("record"), 42)
+		values := map[string]interface{}{}
+		for _, f := range fields {
+			values[f.name] = f.value
+		}
+		c.Expect(values["SourceBucket"], gs.Equals, "bucket")
+		c.Expect(values["SourceKey"], gs.Equals, "a/b")
+		c.Expect(values["SourceETag"], gs.Equals, "e1")
+		c.Expect(values["SourceOffset"], gs.Equals, int64(42))
+		c.Expect(values["RunId"], gs.Equals, "run1")
+
+		input.Lineage = false
+		c.Expect(len(input.recordFields(input.objectFields(nil, b, s3.Key{Key: "a/b"}), []byte("record"), 42)), gs.Equals, 0)
+
+		// A frame's offset counts the garbage the splitter skipped before it.
+		input.Lineage = true
+		frame := testHekaFrame(c, &message.Message{})
+		buf := append([]byte("garbage"), frame...)
+		buf = append(buf, "more garbage"...)
+		buf = append(buf, frame...)
+		counter := &countingSplitter{Splitter: frameSplitter{}}
+		offset := func(record []byte) interface{} {
+			for _, f := range input.recordFields(nil, record, int64(counter.recordStart(record))) {
+				if f.name == "SourceOffset" {
+					return f.value
+				}
+			}
+			return nil
+		}
+		n, record := counter.FindRecord(buf)
+		c.Expect(bytes.Equal(record, frame), gs.IsTrue)
+		c.Expect(offset(record), gs.Equals, int64(7))
+		_, record = counter.FindRecord(buf[n:])
+		c.Expect(bytes.Equal(record, frame), gs.IsTrue)
+		c.Expect(offset(record), gs.Equals, int64(7+len(frame)+12))
+	})
+
+	c.Specify("Credential refresh", func() {
+		oregon := aws.Regions["us-west-2"]
+		old := s3.New(aws.Auth{AccessKey: "old"}, oregon).Bucket("data")
+		b := &inputBucket{name: "data", bucket: old, accelerated: AccelerateBucket(old)}
+		input := &S3SplitFileInput{S3SplitFileInputConfig: &S3SplitFileInputConfig{}}
+		input.buckets = []*inputBucket{b}
+
+		input.setAuth(aws.Auth{AccessKey: "new"})
+		// Requests already under way keep the client they started with.
+		c.Expect(old.Auth.AccessKey, gs.Equals, "old")
+		c.Expect(input.client(b).Auth.AccessKey, gs.Equals, "new")
+		c.Expect(input.client(b).Name, gs.Equals, "data")
+		fetch, _ := input.fetchBucket(b, "a/b")
+		c.Expect(fetch.Auth.AccessKey, gs.Equals, "new")
+		c.Expect(fetch.Region.S3BucketEndpoint, gs.Equals, b.accelerated.Region.S3BucketEndpoint)
+
+		done := make(chan struct{})
+		finished := make(chan bool)
+		provider := func() (string, string, string, time.Time, error) {
+			return "k", "s", "", time.Now().Add(time.Hour), nil
+		}
+		go func() {
+			refreshCredentials(provider, time.Now().Add(time.Hour), input.setAuth, func(error) {}, make(chan bool), done)
+			finished <- true
+		}()
+		close(done)
+		select {
+		case <-finished:
+		case <-time.After(time.Second):
+			c.Expect("refreshCredentials didn't return", gs.Equals, "")
+		}
+	})
+
+	c.Specify("Region map", func() {
+		oregon := aws.Regions["us-west-2"]
+		ireland := aws.Regions["eu-west-1"]
+		input := &S3SplitFileInput{S3SplitFileInputConfig: &S3SplitFileInputConfig{Lineage: true}}
+		input.regionClients = []*regionClient{
+			{prefix: "data/eu/", bucket: "", region: ireland, s3: s3.New(aws.Auth{}, ireland)},
+			{prefix: "data/", bucket: "data-oregon", region: oregon, s3: s3.New(aws.Auth{}, oregon)},
+		}
+		sort.Sort(regionClientsByPrefix(input.regionClients))
+		b := &inputBucket{name: "data-main", bucket: s3.New(aws.Auth{}, oregon).Bucket("data-main"), region: aws.Regions["us-gov-west-1"]}
+
+		bucket, region := input.fetchBucket(b, "data/eu/20150101/x")
+		c.Expect(bucket.Name, gs.Equals, "data-main")
+		c.Expect(region.Name, gs.Equals, "eu-west-1")
+		bucket, region = input.fetchBucket(b, "data/us/20150101/x")
+		c.Expect(bucket.Name, gs.Equals, "data-oregon")
+		c.Expect(region.Name, gs.Equals, "us-west-2")
+		bucket, region = input.fetchBucket(b, "other/x")
+		c.Expect(bucket, gs.Equals, b.bucket)
+		c.Expect(region.Name, gs.Equals, "us-gov-west-1")
+
+		input.setAuth(aws.Auth{AccessKey: "new"})
+		c.Expect(input.regionClients[0].s3.Auth.AccessKey, gs.Equals, "new")
+
+		var sourceRegion interface{}
+		for _, f := range input.objectFields(nil, b, s3.Key{Key: "data/eu/x"}) {
+			if f.name == "SourceRegion" {
+				sourceRegion = f.value
+			}
+		}
+		c.Expect(sourceRegion, gs.Equals, "eu-west-1")
+	})
+
+	c.Specify("Version tallies", func() {
+		versions := []s3.Version{
+			{Key: "a", VersionId: "3", IsLatest: true, ETag: "\"3\""},
+			{Key: "a", VersionId: "2"},
+			{Key: "a", VersionId: "1"},
+			{Key: "b", VersionId: "1", IsLatest: true, Size: 10},
+			{Key: "c", VersionId: "2"},
+			{Key: "c", VersionId: "1"},
+		}
+		var tally versionTally
+		var tallies []versionTally
+		for _, v := range versions {
+			if prev, ok := tally.add(v); ok {
+				tallies = append(tallies, prev)
+			}
+		}
+		tallies = append(tallies, tally.finish())
+		c.Assume(len(tallies), gs.Equals, 3)
+		c.Expect(tallies[0].key, gs.Equals, "a")
+		c.Expect(tallies[0].versions, gs.Equals, 3)
+		c.Expect(tallies[0].latest.ETag, gs.Equals, "\"3\"")
+		c.Expect(tallies[1].versions, gs.Equals, 1)
+		c.Expect(tallies[1].latest.Size, gs.Equals, int64(10))
+		// Only older versions: the key was deleted.
+		c.Expect(tallies[2].versions, gs.Equals, 2)
+		c.Expect(tallies[2].latest == nil, gs.IsTrue)
+		c.Expect(tally.finish().versions, gs.Equals, 0)
+	})
+
+	c.Specify("Stream transforms", func() {
+		transformed := func(names []string, in string) (string, error) {
+			t, err := chainStreamTransforms(names)
+			if err != nil {
+				return "", err
+			}
+			r, err := t(strings.NewReader(in))
+			if err != nil {
+				return "", err
+			}
+			out, err := ioutil.ReadAll(r)
+			return string(out), err
+		}
+		out, err := transformed([]string{"base64"}, "aGVsbG8s\nIHdvcmxk\n")
+		c.Expect(err, gs.IsNil)
+		c.Expect(out, gs.Equals, "hello, world")
+		out, err = transformed([]string{"hex"}, "68656c6c6f\n2c20776f726c64\n")
+		c.Expect(err, gs.IsNil)
+		c.Expect(out, gs.Equals, "hello, world")
+		// Applied in order.
+		out, err = transformed([]string{"hex", "base64"}, "614756736247383d")
+		c.Expect(err, gs.IsNil)
+		c.Expect(out, gs.Equals, "hello")
+
+		_, err = transformed([]string{"hex"}, "686")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = transformed([]string{"hex"}, "zz")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = transformed([]string{"rot13"}, "")
+		c.Expect(err, gs.Not(gs.IsNil))
+
+		RegisterStreamTransform("test-upper", func(r io.Reader) (io.Reader, error) {
+			data, err := ioutil.ReadAll(r)
+			return bytes.NewReader(bytes.ToUpper(data)), err
+		})
+		out, err = transformed([]string{"base64", "test-upper"}, "aGVsbG8=")
+		c.Expect(err, gs.IsNil)
+		c.Expect(out, gs.Equals, "HELLO")
+	})
+
+	c.Specify("Replay pacing", func() {
+		now := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+		p := NewReplayPacer(4, 0)
+		c.Expect(p.Delay(now, 0), gs.Equals, time.Duration(0))
+		c.Expect(p.Delay(now, 0), gs.Equals, 250*time.Millisecond)
+		c.Expect(p.Delay(now.Add(time.Second), 0), gs.Equals, time.Duration(0))
+
+		p = NewReplayPacer(0, 2)
+		ts := now.Add(-24 * time.Hour).UnixNano()
+		c.Expect(p.Delay(now, ts), gs.Equals, time.Duration(0))
+		c.Expect(p.Delay(now, ts+int64(10*time.Second)), gs.Equals, 5*time.Second)
+		c.Expect(p.Delay(now.Add(time.Second), ts+int64(4*time.Second)), gs.Equals, time.Second)
+		// Records out of order or without timestamps go straight through.
+		c.Expect(p.Delay(now, ts-int64(time.Hour)), gs.Equals, time.Duration(0))
+		c.Expect(p.Delay(now, 0), gs.Equals, time.Duration(0))
+
+		var none *ReplayPacer
+		c.Expect(none.Delay(now, ts), gs.Equals, time.Duration(0))
+
+		re := regexp.MustCompile(`"ts":"([^"]+)"`)
+		got, ok := RecordTimestamp([]byte(`{"ts":"2015-03-01T12:00:00Z","x":1}`), re, time.RFC3339Nano)
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(got, gs.Equals, now.UnixNano())
+		_, ok = RecordTimestamp([]byte(`{"ts":"yesterday"}`), re, time.RFC3339Nano)
+		c.Expect(ok, gs.IsFalse)
+		_, ok = RecordTimestamp([]byte(`{"x":1}`), re, time.RFC3339Nano)
+		c.Expect(ok, gs.IsFalse)
+	})
+
+	c.Specify("Worker ramp-up", func() {
+		minute := time.Minute
+		c.Expect(RampWorkers(1, 10, 0, minute), gs.Equals, uint32(1))
+		c.Expect(RampWorkers(1, 10, 20*time.Second, minute), gs.Equals, uint32(4))
+		c.Expect(RampWorkers(1, 10, 59*time.Second, minute), gs.Equals, uint32(9))
+		c.Expect(RampWorkers(1, 10, minute, minute), gs.Equals, uint32(10))
+		c.Expect(RampWorkers(1, 10, 2*minute, minute), gs.Equals, uint32(10))
+		c.Expect(RampWorkers(5, 5, 0, minute), gs.Equals, uint32(5))
+	})
+
+	c.Specify("Adaptive timeouts", func() {
+		base := 30 * time.Second
+		c.Expect(AdaptiveTimeout(base, 0, 1<<20), gs.Equals, base)
+		c.Expect(AdaptiveTimeout(base, 100<<20, 1<<20), gs.Equals, 130*time.Second)
+		c.Expect(AdaptiveTimeout(base, 1<<19, 1<<20), gs.Equals, base+500*time.Millisecond)
+		c.Expect(AdaptiveTimeout(base, 100<<20, 0), gs.Equals, base)
+	})
+
+	c.Specify("Signing versions", func() {
+		oregon := aws.Region{Name: "us-west-2"}
+		_, set, err := SigningVersion("", oregon, false)
+		c.Expect(err, gs.IsNil)
+		c.Expect(set, gs.IsFalse)
+		sig, set, err := SigningVersion("v4", oregon, true)
+		c.Expect(err, gs.IsNil)
+		c.Expect(set, gs.IsTrue)
+		c.Expect(sig, gs.Equals, aws.V4Signature)
+		sig, _, err = SigningVersion("v2", oregon, false)
+		c.Expect(err, gs.IsNil)
+		c.Expect(sig, gs.Equals, aws.V2Signature)
+
+		_, _, err = SigningVersion("v2", aws.Region{Name: "eu-central-1"}, false)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, _, err = SigningVersion("v2", oregon, true)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, _, err = SigningVersion("v3", oregon, false)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Repeated records", func() {
+		var rf RepeatFilter
+		var kept []string
+		for _, r := range []string{"a", "a", "b", "a", "b", "b", "b", "c"} {
+			if !rf.Repeated([]byte(r)) {
+				kept = append(kept, r)
+			}
+		}
+		c.Expect(strings.Join(kept, ""), gs.Equals, "ababc")
+		var empty RepeatFilter
+		c.Expect(empty.Repeated([]byte{}), gs.IsFalse)
+		c.Expect(empty.Repeated([]byte{}), gs.IsTrue)
+	})
+
+	c.Specify("Consistency retries", func() {
+		cr := NewConsistencyRetries()
+		retry, ok := cr.Retry("a", 2)
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(retry, gs.Equals, uint32(1))
+		retry, ok = cr.Retry("a", 2)
+		c.Expect(retry, gs.Equals, uint32(2))
+		_, ok = cr.Retry("a", 2)
+		c.Expect(ok, gs.IsFalse)
+		// Giving up starts the count again.
+		retry, ok = cr.Retry("a", 2)
+		c.Expect(retry, gs.Equals, uint32(1))
+		cr.Retry("b", 2)
+		cr.Forget("b")
+		retry, _ = cr.Retry("b", 2)
+		c.Expect(retry, gs.Equals, uint32(1))
+		c.Expect(isNotFound(&s3.Error{StatusCode: 404}), gs.IsTrue)
+		c.Expect(isNotFound(&s3.Error{Code: "NoSuchKey"}), gs.IsTrue)
+		c.Expect(isNotFound(&s3.Error{StatusCode: 403}), gs.IsFalse)
+	})
+
+	c.Specify("Record trimming", func() {
+		record := []byte(`{"id":"abc","payload":"0123456789"}` + "\n")
+		trimmed, ok := TrimRecord(record, 0, nil)
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(string(trimmed), gs.Equals, string(record))
+		trimmed, ok = TrimRecord(record, 11, nil)
+		c.Expect(string(trimmed), gs.Equals, `{"id":"abc"`)
+		trimmed, ok = TrimRecord(record, 100, nil)
+		c.Expect(string(trimmed), gs.Equals, string(record))
+
+		trimmed, ok = TrimRecord(record, 0, regexp.MustCompile(`"id":"[^"]*"`))
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(string(trimmed), gs.Equals, `"id":"abc"`)
+		trimmed, ok = TrimRecord(record, 0, regexp.MustCompile(`"id":"([^"]*)"`))
+		c.Expect(string(trimmed), gs.Equals, "abc")
+		trimmed, ok = TrimRecord(record, 2, regexp.MustCompile(`"id":"([^"]*)"`))
+		c.Expect(string(trimmed), gs.Equals, "ab")
+		trimmed, ok = TrimRecord(record, 0, regexp.MustCompile(`"id":"(x)?`))
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(len(trimmed), gs.Equals, 0)
+		_, ok = TrimRecord(record, 0, regexp.MustCompile(`"missing"`))
+		c.Expect(ok, gs.IsFalse)
+	})
+
+	c.Specify("Job file overrides", func() {
+		conf := &S3SplitFileInputConfig{}
+		c.Expect(checkJobOverrides(map[string]interface{}{}, conf), gs.IsNil)
+		c.Expect(checkJobOverrides(map[string]interface{}{
+			"schema_file":      "backfill.json",
+			"s3_bucket_prefix": "/backfill",
+			"s3_worker_count":  int64(32),
+		}, conf), gs.IsNil)
+		err := checkJobOverrides(map[string]interface{}{
+			"s3_worker_count": int64(32),
+			"s3_wroker_count": int64(32),
+			"job_file":        "other.toml",
+		}, conf)
+		c.Assume(err, gs.Not(gs.IsNil))
+		c.Expect(err.Error(), gs.Equals, "can't override job_file, s3_wroker_count")
+	})
+
+	c.Specify("Metrics export", func() {
+		counters := map[string]interface{}{
+			"ProcessFileCount":     int64(3),
+			"bucket-1.ProcessFile": int64(2),
+			"AWSRegion":            "us-west-2",
+		}
+
+		packets := statsdPackets("s3", counters)
+		c.Expect(len(packets), gs.Equals, 1)
+		c.Expect(string(packets[0]), gs.Equals, "s3.ProcessFileCount:3|g\ns3.bucket-1.ProcessFile:2|g")
+
+		var b bytes.Buffer
+		c.Expect(writePrometheus(&b, "s3", counters), gs.IsNil)
+		c.Expect(b.String(), gs.Equals, "# TYPE s3_ProcessFileCount gauge\ns3_ProcessFileCount 3\n"+
+			"# TYPE s3_bucket_1_ProcessFile gauge\ns3_bucket_1_ProcessFile 2\n")
+
+		many := map[string]interface{}{}
+		for i := 0; i < 100; i++ {
+			many[fmt.Sprintf("Counter%03d", i)] = int64(i)
+		}
+		packets = statsdPackets("s3splitfile", many)
+		c.Expect(len(packets) > 1, gs.IsTrue)
+		for _, p := range packets {
+			c.Expect(len(p) <= statsdPacketSize, gs.IsTrue)
+		}
+	})
+
+	c.Specify("Metrics snapshots", func() {
+		start := time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)
+		counters := map[string]interface{}{
+			"ListKeysQueued":      int64(10),
+			"ProcessFileCount":    int64(4),
+			"ProcessMessageBytes": int64(2000),
+			"AWSRegion":           "us-west-2",
+		}
+		s := newMetricsSnapshot(counters, start, start.Add(20*time.Second), false)
+		c.Expect(s.ElapsedSeconds, gs.Equals, 20.0)
+		c.Expect(s.ListingDone, gs.IsFalse)
+		c.Expect(s.KeysQueued, gs.Equals, int64(10))
+		c.Expect(s.KeysRemaining, gs.Equals, int64(6))
+		c.Expect(s.ObjectsPerSecond, gs.Equals, 0.2)
+		c.Expect(s.BytesPerSecond, gs.Equals, 100.0)
+
+		// Nothing is left once everything has been processed, even if some
+		// objects were fetched twice.
+		counters["ProcessFileCount"] = int64(12)
+		s = newMetricsSnapshot(counters, start, start, true)
+		c.Expect(s.KeysRemaining, gs.Equals, int64(0))
+		c.Expect(s.ObjectsPerSecond, gs.Equals, 0.0)
+
+		dir, err := ioutil.TempDir("", "s3splitfile-metrics")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "progress.json")
+		c.Expect(writeJSONFile(path, s), gs.IsNil)
+		var read MetricsSnapshot
+		data, err := ioutil.ReadFile(path)
+		c.Assume(err, gs.IsNil)
+		c.Expect(json.Unmarshal(data, &read), gs.IsNil)
+		c.Expect(read.KeysQueued, gs.Equals, int64(10))
+		c.Expect(read.ListingDone, gs.IsTrue)
+	})
+
+	c.Specify("Size stats", func() {
+		s := NewSizeStats()
+		for _, size := range []int64{100, 2000, 3000, 2 << 30} {
+			s.Add(size)
+		}
+		c.Expect(s.Count, gs.Equals, int64(4))
+		c.Expect(s.Min, gs.Equals, int64(100))
+		c.Expect(s.Max, gs.Equals, int64(2<<30))
+		c.Expect(s.Buckets[0], gs.Equals, int64(1))
+		c.Expect(s.Buckets[1], gs.Equals, int64(2))
+		c.Expect(s.Buckets[len(s.Buckets)-1], gs.Equals, int64(1))
+	})
+
+	c.Specify("Compression ratios", func() {
+		s := NewCompressionStats()
+		s.Add("gzip", 100, 1000)
+		s.Add("gzip", 100, 200)
+		s.Add("zstd", 0, 0)
+		gz := s.codecs["gzip"]
+		c.Expect(gz.Objects, gs.Equals, int64(2))
+		c.Expect(gz.Compressed, gs.Equals, int64(200))
+		c.Expect(gz.Decompressed, gs.Equals, int64(1200))
+		c.Expect(gz.ratio(), gs.Equals, 6.0)
+		c.Expect(gz.averageRatio(), gs.Equals, 6.0)
+		empty := s.codecs["zstd"]
+		c.Expect(empty.ratio(), gs.Equals, 0.0)
+		c.Expect(empty.averageRatio(), gs.Equals, 0.0)
+		s.Report(&message.Message{})
+
+		counter := &countingReader{r: strings.NewReader("twelve bytes")}
+		ioutil.ReadAll(counter)
+		c.Expect(counter.n, gs.Equals, int64(12))
+	})
+
+	c.Specify("Partition counts", func() {
+		p := NewPartitionCounts()
+		p.Add([]string{"20150101", "release"}, 10)
+		p.Add([]string{"20150101", "beta"}, 2)
+		p.Add([]string{"20150101", "release"}, 5)
+		counts := p.Counts()
+		c.Expect(len(counts), gs.Equals, 2)
+		c.Expect(counts["20150101/release"], gs.Equals, int64(15))
+		c.Expect(counts["20150101/beta"], gs.Equals, int64(2))
+		counts["20150101/beta"] = 100
+		c.Expect(p.Counts()["20150101/beta"], gs.Equals, int64(2))
+	})
+
+	c.Specify("Partition failures", func() {
+		b := &inputBucket{name: "bucket"}
+		bad := b.partition("prefix/20150101/bad/obj1")
+		good := b.partition("prefix/20150101/good/obj1")
+		c.Expect(bad, gs.Equals, "bucket/prefix/20150101/bad/")
+
+		p := NewPartitionFailures(2)
+		failures, failed := p.Add(bad)
+		c.Expect(failures, gs.Equals, int64(1))
+		c.Expect(failed, gs.IsFalse)
+		c.Expect(p.IsFailed(bad), gs.IsFalse)
+		p.Add(good)
+		failures, failed = p.Add(bad)
+		c.Expect(failures, gs.Equals, int64(2))
+		c.Expect(failed, gs.IsTrue)
+		// Only the one partition is given up on, and only once.
+		c.Expect(p.IsFailed(bad), gs.IsTrue)
+		c.Expect(p.IsFailed(good), gs.IsFalse)
+		_, failed = p.Add(bad)
+		c.Expect(failed, gs.IsFalse)
+		c.Expect(p.Failed(), gs.Equals, []string{bad})
+
+		var none *PartitionFailures
+		_, failed = none.Add(bad)
+		c.Expect(failed, gs.IsFalse)
+		c.Expect(none.IsFailed(bad), gs.IsFalse)
+		c.Expect(len(none.Failed()), gs.Equals, 0)
+	})
+
+	c.Specify("Credentials providers", func() {
+		RegisterCredentialsProvider("test", func() (string, string, string, time.Time, error) {
+			return "key", "secret", "token", time.Time{}, nil
+		})
+		provider, ok := getCredentialsProvider("test")
+		c.Expect(ok, gs.IsTrue)
+		auth, err := providedAuth(provider)
+		c.Expect(err, gs.IsNil)
+		c.Expect(auth.AccessKey, gs.Equals, "key")
+		c.Expect(auth.Token(), gs.Equals, "token")
+
+		_, ok = getCredentialsProvider("missing")
+		c.Expect(ok, gs.IsFalse)
+
+		now := time.Now()
+		c.Expect(credentialsRefreshDelay(now.Add(time.Hour), now), gs.Equals, 55*time.Minute)
+		c.Expect(credentialsRefreshDelay(now.Add(4*time.Minute), now), gs.Equals, 2*time.Minute)
+		c.Expect(credentialsRefreshDelay(now.Add(-time.Minute), now), gs.Equals, time.Duration(0))
+	})
+
+	c.Specify("AWS regions", func() {
+		region, err := ResolveRegion("us-west-2", false)
+		c.Expect(err, gs.IsNil)
+		c.Expect(region.Name, gs.Equals, "us-west-2")
+
+		_, err = ResolveRegion("us-nowhere-1", false)
+		c.Expect(err, gs.Not(gs.IsNil))
+
+		region, err = ResolveRegion("us-gov-west-1", true)
+		c.Expect(err, gs.IsNil)
+		c.Expect(region.S3Endpoint, gs.Equals, "https://s3-fips.us-gov-west-1.amazonaws.com")
+
+		// Not in aws.Regions, but has a FIPS endpoint.
+		region, err = ResolveRegion("us-gov-east-1", true)
+		c.Expect(err, gs.IsNil)
+		c.Expect(region.Name, gs.Equals, "us-gov-east-1")
+		c.Expect(region.S3Endpoint, gs.Equals, "https://s3-fips.us-gov-east-1.amazonaws.com")
+
+		_, err = ResolveRegion("eu-west-1", true)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Range headers", func() {
+		c.Expect(makeRangeHeader(0, 100), gs.Equals, "bytes=0-99")
+		c.Expect(makeRangeHeader(16, 100), gs.Equals, "bytes=16-99")
+		c.Expect(makeRangeHeader(16, -1), gs.Equals, "bytes=16-")
+	})
+
+	c.Specify("Read-ahead reader", func() {
+		data := bytes.Repeat([]byte("0123456789"), 10000)
+		for _, size := range []int{1, 100, readAheadChunkSize, 4 * readAheadChunkSize} {
+			ra := newReadAheadReader(bytes.NewReader(data), size)
+			read, err := ioutil.ReadAll(ra)
+			ra.Close()
+			c.Expect(err, gs.IsNil)
+			c.Expect(bytes.Equal(read, data), gs.IsTrue)
+		}
+	})
+
+	c.Specify("Ranged reader", func() {
+		data := bytes.Repeat([]byte("0123456789"), 1000)
+		var (
+			lock     sync.Mutex
+			requests []string
+		)
+		fetch := func(etags map[int64]string) rangeFetcher {
+			return func(start int64, end int64) ([]byte, http.Header, error) {
+				lock.Lock()
+				requests = append(requests, makeRangeHeader(start, end))
+				lock.Unlock()
+				etag, ok := etags[start]
+				if !ok {
+					etag = "\"abc\""
+				}
+				return data[start:end], http.Header{"Etag": []string{etag}, "Content-Type": []string{"text/plain"}}, nil
+			}
+		}
+
+		rr, header, err := newRangedReader(fetch(nil), 16, int64(len(data)), 1000, 3)
+		c.Assume(err, gs.IsNil)
+		c.Expect(header.Get("Content-Type"), gs.Equals, "text/plain")
+		read, err := ioutil.ReadAll(rr)
+		c.Expect(err, gs.IsNil)
+		c.Expect(bytes.Equal(read, data[16:]), gs.IsTrue)
+		c.Expect(len(requests), gs.Equals, 10)
+		// They're fetched concurrently, so they may be requested in any order.
+		sort.Strings(requests)
+		c.Expect(requests[0], gs.Equals, "bytes=1016-2015")
+		c.Expect(requests[1], gs.Equals, "bytes=16-1015")
+		c.Expect(requests[9], gs.Equals, "bytes=9016-9999")
+
+		rr, _, err = newRangedReader(fetch(map[int64]string{2016: "\"def\""}), 16, int64(len(data)), 1000, 3)
+		c.Assume(err, gs.IsNil)
+		_, err = ioutil.ReadAll(rr)
+		c.Expect(err, gs.Not(gs.IsNil))
+
+		rr, _, err = newRangedReader(fetch(nil), 0, int64(len(data)), 1000, 2)
+		c.Assume(err, gs.IsNil)
+		rr.Close()
+		_, err = ioutil.ReadAll(rr)
+		c.Expect(err, gs.Equals, errRangedReaderClosed)
+	})
+
+	c.Specify("Timed reader", func() {
+		var elapsed int64
+		data := bytes.Repeat([]byte("0123456789"), 1000)
+		read, err := ioutil.ReadAll(&timedReader{bytes.NewReader(data), &elapsed})
+		c.Expect(err, gs.IsNil)
+		c.Expect(bytes.Equal(read, data), gs.IsTrue)
+		c.Expect(elapsed > 0, gs.IsTrue)
+	})
+
+	c.Specify("Compaction plans", func() {
+		keys := []s3.Key{
+			{Key: "a/1", Size: 10},
+			{Key: "a/2", Size: 10},
+			{Key: "a/3.gz", Size: 10},
+			{Key: "a/4.gz", Size: 10},
+			{Key: "a/big", Size: 100},
+			{Key: "a/5", Size: 30},
+			{Key: "a/6", Size: 30},
+			{Key: "a/7", Size: 30},
+			{Key: "b/1", Size: 10},
+			{Key: "c/1", Size: 10},
+			{Key: "c/2", Size: 10},
+		}
+		names := func(groups [][]s3.Key) (result []string) {
+			for _, g := range groups {
+				group := []string{}
+				for _, k := range g {
+					group = append(group, k.Key)
+				}
+				result = append(result, strings.Join(group, ","))
+			}
+			return
+		}
+		c.Expect(strings.Join(names(planCompaction(keys, 50, ".gz")), " "), gs.Equals, "a/1,a/2 a/3.gz,a/4.gz c/1,c/2")
+		c.Expect(strings.Join(names(planCompaction(keys, 70, ".gz")), " "), gs.Equals, "a/1,a/2 a/3.gz,a/4.gz a/5,a/6 c/1,c/2")
+		// Compressed objects are kept apart even when we aren't compressing.
+		c.Expect(strings.Join(names(planCompaction(keys, 70, "")), " "), gs.Equals, "a/1,a/2 a/3.gz,a/4.gz a/5,a/6 c/1,c/2")
+		c.Expect(strings.Join(names(planCompaction(keys, 70, ".gzip")), " "), gs.Equals, "a/1,a/2 a/3.gz,a/4.gz a/5,a/6 c/1,c/2")
+	})
+
+	c.Specify("Shuffled keys", func() {
+		shuffled := func(seed int64) []string {
+			keys := []bucketKey{}
+			for i := 0; i < 20; i++ {
+				keys = append(keys, bucketKey{nil, s3.Key{Key: fmt.Sprintf("key%02d", i)}})
+			}
+			shuffleKeys(keys, rand.New(rand.NewSource(seed)))
+			names := []string{}
+			for _, k := range keys {
+				names = append(names, k.key.Key)
+			}
+			return names
+		}
+		names := shuffled(42)
+		c.Expect(strings.Join(names, ","), gs.Equals, strings.Join(shuffled(42), ","))
+		c.Expect(sort.StringsAreSorted(names), gs.IsFalse)
+		sort.Strings(names)
+		for i, name := range names {
+			c.Expect(name, gs.Equals, fmt.Sprintf("key%02d", i))
+		}
+	})
 }
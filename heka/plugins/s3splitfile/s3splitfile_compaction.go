@@ -0,0 +1,192 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Subdirectory of Path where compacted objects are assembled before being
+// uploaded.
+const stdCompactingDir = "compacting"
+
+// Group the given keys (in listing order) into sets to be merged into one
+// object each. Only objects smaller than `target` bytes are merged, and only
+// with others in the same directory and with the same gzip suffix, `suffix`
+// or GzipSuffix, whether or not we're compressing our output, so compressed
+// and uncompressed objects are never mixed. Each set holds at least two
+// objects, totalling no more than `target` bytes.
+func planCompaction(keys []s3.Key, target int64, suffix string) (groups [][]s3.Key) {
+	var (
+		group      []s3.Key
+		groupSize  int64
+		groupClass string
+	)
+	flush := func() {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+		group, groupSize = nil, 0
+	}
+	for _, k := range keys {
+		if k.Size >= target {
+			continue
+		}
+		class := k.Key[:strings.LastIndex(k.Key, "/")+1] + compressedSuffix(k.Key, suffix)
+		if class != groupClass || groupSize+k.Size > target {
+			flush()
+			groupClass = class
+		}
+		group = append(group, k)
+		groupSize += k.Size
+	}
+	flush()
+	return
+}
+
+// The gzip suffix the given key ends in, if any: `suffix` or GzipSuffix.
+func compressedSuffix(key string, suffix string) string {
+	for _, s := range []string{suffix, GzipSuffix} {
+		if s != "" && strings.HasSuffix(key, s) {
+			return s
+		}
+	}
+	return ""
+}
+
+// Runs in a separate goroutine, compacting the published objects every
+// compaction_interval until we're shutting down.
+func (o *S3SplitFileOutput) compactor(or OutputRunner, wg *sync.WaitGroup) {
+	defer wg.Done()
+	interval := time.Duration(o.CompactionInterval) * time.Second
+	for {
+		select {
+		case <-o.compactStop:
+			return
+		case <-time.After(interval):
+		}
+		if err := o.compactAll(or, interval); err != nil {
+			atomic.AddInt64(&o.compactionFailures, 1)
+			or.LogError(fmt.Errorf("Error compacting: %s", err))
+		}
+	}
+}
+
+// Merge the small objects under our prefix that are at least `minAge` old.
+func (o *S3SplitFileOutput) compactAll(or OutputRunner, minAge time.Duration) error {
+	prefix := strings.TrimPrefix(o.S3BucketPrefix, "/") + "/"
+	var keys []s3.Key
+	now := time.Now()
+	for r := range S3Iterator(o.bucket, prefix, o.schema) {
+		if r.Err != nil {
+			// Don't merge anything on the strength of an incomplete listing.
+			return fmt.Errorf("Error listing s3://%s/%s: %s", o.S3Bucket, prefix, r.Err)
+		}
+		if age, ok := ObjectAge(r.Key, now); ok && age >= minAge {
+			keys = append(keys, r.Key)
+		}
+	}
+	suffix := o.OutputCompressionSuffix
+	for _, group := range planCompaction(keys, int64(o.CompactionTargetSize), suffix) {
+		select {
+		case <-o.compactStop:
+			return nil
+		default:
+		}
+		if err := o.compactGroup(or, group, suffix); err != nil {
+			atomic.AddInt64(&o.compactionFailures, 1)
+			or.LogError(err)
+		}
+	}
+	return nil
+}
+
+// Merge the given objects into a new one alongside them, and then delete
+// them. The new object is written in full and checked before anything is
+// deleted, so a failure at any point leaves every record in S3 (though if we
+// stop between writing the new object and deleting the old ones, some records
+// will be in both).
+func (o *S3SplitFileOutput) compactGroup(or OutputRunner, group []s3.Key, suffix string) (err error) {
+	first := group[0].Key
+	dir := first[:strings.LastIndex(first, "/")+1]
+	destKey := fmt.Sprintf("%s%s_compacted", dir, o.getNewFilename())
+	// Concatenated gzip streams are a valid gzip stream, and
+	// S3SplitFileInput reads them as one.
+	destKey += compressedSuffix(first, suffix)
+
+	tmpDir := filepath.Join(o.Path, stdCompactingDir)
+	if err = os.MkdirAll(tmpDir, o.folderPerm); err != nil {
+		return fmt.Errorf("S3SplitFileOutput can't create the compaction path %s: %s", tmpDir, err)
+	}
+	tmpPath := filepath.Join(tmpDir, filepath.Base(destKey))
+	defer os.Remove(tmpPath)
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, o.perm)
+	if err != nil {
+		return fmt.Errorf("Error creating %s: %s", tmpPath, err)
+	}
+	defer tmp.Close()
+
+	// Fetch the objects to merge.
+	hash := md5.New()
+	w := io.MultiWriter(tmp, hash)
+	var size int64
+	for _, k := range group {
+		reader, err := o.bucket.GetReader(k.Key)
+		if err != nil {
+			return fmt.Errorf("Error fetching %s for compaction: %s", k.Key, err)
+		}
+		n, err := io.Copy(w, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("Error fetching %s for compaction: %s", k.Key, err)
+		}
+		if n != k.Size {
+			return fmt.Errorf("Error fetching %s for compaction: read %d bytes, expected %d", k.Key, n, k.Size)
+		}
+		size += n
+	}
+
+	// Upload the merged object, and make sure S3 has exactly what we sent.
+	if _, err = tmp.Seek(0, 0); err != nil {
+		return fmt.Errorf("Error rewinding %s: %s", tmpPath, err)
+	}
+	if err = o.bucket.PutReader(destKey, tmp, size, "binary/octet-stream", s3.BucketOwnerFull, s3.Options{}); err != nil {
+		return fmt.Errorf("Error publishing compacted object s3://%s/%s: %s", o.S3Bucket, destKey, err)
+	}
+	resp, err := o.bucket.Head(destKey, nil)
+	if err != nil {
+		return fmt.Errorf("Error checking compacted object s3://%s/%s: %s", o.S3Bucket, destKey, err)
+	}
+	resp.Body.Close()
+	etag := normalizeETag(resp.Header.Get("ETag"))
+	length, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if sum := fmt.Sprintf("%x", hash.Sum(nil)); etag != sum || length != size {
+		return fmt.Errorf("Compacted object s3://%s/%s doesn't match what was written (ETag %s, %d bytes; expected %s, %d bytes), keeping the originals", o.S3Bucket, destKey, etag, length, sum, size)
+	}
+
+	// Only now is it safe to remove the originals.
+	for _, k := range group {
+		if err = o.bucket.Del(k.Key); err != nil {
+			return fmt.Errorf("Error removing %s after compacting it into %s, its records are now in both: %s", k.Key, destKey, err)
+		}
+	}
+	atomic.AddInt64(&o.compactionObjects, 1)
+	atomic.AddInt64(&o.compactedObjects, int64(len(group)))
+	or.LogMessage(fmt.Sprintf("Compacted %d objects (%d bytes) into %s", len(group), size, destKey))
+	return nil
+}
@@ -0,0 +1,121 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The on_file_complete actions, in the order they're carried out.
+const (
+	// Write an empty object named after the processed one, plus
+	// on_file_complete_marker_suffix.
+	FileCompleteMarker = "marker"
+	// Inject a message of type on_file_complete_event_type.
+	FileCompleteEvent = "event"
+	// Copy the object to on_file_complete_move_prefix, then delete it.
+	FileCompleteMove = "move"
+)
+
+// The largest object S3 will copy in a single request.
+const maxCopySize = 5 << 30
+
+// Check the on_file_complete actions, and those settings they need.
+func checkFileCompleteActions(conf *S3SplitFileInputConfig) error {
+	seen := map[string]bool{}
+	for _, action := range conf.OnFileComplete {
+		switch action {
+		case FileCompleteMarker, FileCompleteEvent, FileCompleteMove:
+		default:
+			return fmt.Errorf("Parameter 'on_file_complete' must only contain 'marker', 'event', or 'move'")
+		}
+		if seen[action] {
+			return fmt.Errorf("Parameter 'on_file_complete' must not repeat '%s'", action)
+		}
+		seen[action] = true
+	}
+	if len(seen) > 0 && conf.ValidateOnly {
+		return fmt.Errorf("Parameter 'on_file_complete' can't be used with 'validate_only'")
+	}
+	if seen[FileCompleteMarker] && conf.OnFileCompleteMarkerSuffix == "" {
+		return fmt.Errorf("Parameter 'on_file_complete_marker_suffix' must not be empty")
+	}
+	if seen[FileCompleteMove] {
+		dest := CleanBucketPrefix(conf.OnFileCompleteMovePrefix)
+		if dest == "" || strings.HasPrefix(dest, conf.S3BucketPrefix) || strings.HasPrefix(conf.S3BucketPrefix, dest) {
+			// Objects moved under the prefix we list would be read again.
+			return fmt.Errorf("Parameter 'on_file_complete_move_prefix' must be set, and not overlap 's3_bucket_prefix'")
+		}
+	}
+	return nil
+}
+
+// Where the given object goes when it's moved: the same path under
+// `movePrefix` as it had under `prefix`.
+func movedKey(prefix string, movePrefix string, key string) string {
+	return CleanBucketPrefix(movePrefix) + strings.TrimPrefix(key, prefix)
+}
+
+// Carry out the on_file_complete actions for an object that was read
+// successfully. A failed action is logged and counted, and stops any later
+// ones, so an object isn't moved away if its marker couldn't be written.
+func (input *S3SplitFileInput) fileComplete(runner pipeline.InputRunner, helper pipeline.PluginHelper, b *inputBucket, key s3.Key, result ProcessResult) {
+	for _, action := range []string{FileCompleteMarker, FileCompleteEvent, FileCompleteMove} {
+		if !input.fileCompleteActions[action] {
+			continue
+		}
+		var err error
+		bucket := input.client(b)
+		switch action {
+		case FileCompleteMarker:
+			err = bucket.Put(key.Key+input.OnFileCompleteMarkerSuffix, []byte{}, "binary/octet-stream", s3.BucketOwnerFull, s3.Options{})
+		case FileCompleteEvent:
+			err = input.injectFileCompleteEvent(runner, helper, b, key, result)
+		case FileCompleteMove:
+			dest := movedKey(input.S3BucketPrefix, input.OnFileCompleteMovePrefix, key.Key)
+			if key.Size > maxCopySize {
+				err = fmt.Errorf("can't move an object of %d bytes, S3 copies at most %d in one request", key.Size, int64(maxCopySize))
+			} else if _, err = bucket.PutCopy(dest, s3.BucketOwnerFull, s3.CopyOptions{}, b.name+"/"+key.Key); err == nil {
+				err = bucket.Del(key.Key)
+			}
+		}
+		if err != nil {
+			atomic.AddInt64(&input.fileCompleteFailures, 1)
+			runner.LogError(fmt.Errorf("Error carrying out on_file_complete '%s' for %s: %s", action, key.Key, err))
+			return
+		}
+	}
+}
+
+func (input *S3SplitFileInput) injectFileCompleteEvent(runner pipeline.InputRunner, helper pipeline.PluginHelper, b *inputBucket, key s3.Key, result ProcessResult) error {
+	pack, err := helper.PipelinePack(0)
+	if err != nil {
+		return err
+	}
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType(input.OnFileCompleteEventType)
+	msg.SetLogger(runner.Name())
+	msg.SetSeverity(6)
+	msg.SetPayload(fmt.Sprintf("s3://%s/%s", b.name, key.Key))
+	message.NewStringField(msg, "Bucket", b.name)
+	message.NewStringField(msg, "Key", key.Key)
+	message.NewStringField(msg, "ETag", normalizeETag(key.ETag))
+	message.NewInt64Field(msg, "Size", key.Size, "B")
+	message.NewInt64Field(msg, "Records", result.Records, "count")
+	message.NewInt64Field(msg, "BytesRead", result.Bytes, "B")
+	message.NewInt64Field(msg, "Attempts", int64(result.Attempts), "count")
+	return runner.Inject(pack)
+}
@@ -0,0 +1,118 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The most partitions ExpectedPartitions will list, so that a schema with a
+// wide date range and several long lists doesn't use up all our memory.
+const maxExpectedPartitions = 100000
+
+// Date layout assumed for the bounds of a range that has no dimension format,
+// as for Telemetry's submission dates.
+const defaultRangeLayout = "20060102"
+
+// List every partition ("<value>/<value>/...", in schema field order) that
+// the schema expects to find. Each dimension must have a known set of values:
+// a list without patterns, or a date range with both bounds, which expects a
+// partition for each day. A range without a dimension format counts as a date
+// range if both its bounds are dates like "20150131".
+func ExpectedPartitions(schema Schema) (partitions []string, err error) {
+	partitions = []string{""}
+	for i, field := range schema.Fields {
+		values, ok := dimensionValues(schema.Dims[field])
+		if !ok {
+			return nil, fmt.Errorf("can't tell which values to expect for '%s', it needs a list of values or a date range with both bounds", field)
+		}
+		if len(partitions)*len(values) > maxExpectedPartitions {
+			return nil, fmt.Errorf("the schema expects more than %d partitions", maxExpectedPartitions)
+		}
+		next := make([]string, 0, len(partitions)*len(values))
+		for _, p := range partitions {
+			for _, v := range values {
+				if i > 0 {
+					next = append(next, p+"/"+v)
+				} else {
+					next = append(next, v)
+				}
+			}
+		}
+		partitions = next
+	}
+	return partitions, nil
+}
+
+// The values a dimension accepts, if there are a known number of them.
+func dimensionValues(checker DimensionChecker) (values []string, ok bool) {
+	switch dc := checker.(type) {
+	case *ListDimensionChecker:
+		if len(dc.patterns) > 0 {
+			return nil, false
+		}
+		for v := range dc.allowed {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+		return values, true
+	case *DateRangeDimensionChecker:
+		return dateValues(dc.layout, dc.min, dc.max)
+	case RangeDimensionChecker:
+		min, minErr := time.Parse(defaultRangeLayout, dc.min)
+		max, maxErr := time.Parse(defaultRangeLayout, dc.max)
+		if minErr != nil || maxErr != nil {
+			return nil, false
+		}
+		return dateValues(defaultRangeLayout, min, max)
+	}
+	return nil, false
+}
+
+// Each day from `min` to `max` (inclusive), in the given layout. Layouts
+// that name the hour or anything finer have more than one partition a day,
+// and aren't supported.
+func dateValues(layout string, min time.Time, max time.Time) (values []string, ok bool) {
+	if min.IsZero() || max.IsZero() {
+		return nil, false
+	}
+	if min.Format(layout) != min.Add(time.Hour).Format(layout) {
+		return nil, false
+	}
+	for day := min; !day.After(max); day = day.AddDate(0, 0, 1) {
+		if len(values) == maxExpectedPartitions {
+			return nil, false
+		}
+		values = append(values, day.Format(layout))
+	}
+	return values, true
+}
+
+// The expected partitions that yielded no records, by PartitionCounts.
+func MissingPartitions(expected []string, counts map[string]int64) (missing []string) {
+	for _, p := range expected {
+		if counts[p] == 0 {
+			missing = append(missing, p)
+		}
+	}
+	return
+}
+
+// Sum up the missing partitions for a log message, naming the first few.
+func describeMissingPartitions(missing []string, expected int) string {
+	const shown = 10
+	names := missing
+	more := ""
+	if len(names) > shown {
+		names = names[:shown]
+		more = fmt.Sprintf(" and %d more", len(missing)-shown)
+	}
+	return fmt.Sprintf("%d of %d expected partitions have no records: %s%s", len(missing), expected, strings.Join(names, ", "), more)
+}
@@ -0,0 +1,109 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"sync"
+	"time"
+)
+
+// Obtains AWS credentials from somewhere aws.GetAuth doesn't know about (e.g.
+// Vault, or a custom STS broker). A zero expiry means the credentials never
+// need refreshing.
+type CredentialsProvider func() (key, secret, token string, expiry time.Time, err error)
+
+var (
+	credentialsProvidersLock sync.Mutex
+	credentialsProviders     = map[string]CredentialsProvider{}
+)
+
+// Make a credentials provider available by name, for use with the
+// `credentials_provider` setting. Call this from an init function in the
+// package that implements the provider.
+func RegisterCredentialsProvider(name string, provider CredentialsProvider) {
+	credentialsProvidersLock.Lock()
+	defer credentialsProvidersLock.Unlock()
+	credentialsProviders[name] = provider
+}
+
+func getCredentialsProvider(name string) (provider CredentialsProvider, ok bool) {
+	credentialsProvidersLock.Lock()
+	defer credentialsProvidersLock.Unlock()
+	provider, ok = credentialsProviders[name]
+	return
+}
+
+// Fetch credentials from the given provider.
+func providedAuth(provider CredentialsProvider) (auth aws.Auth, err error) {
+	key, secret, token, expiry, err := provider()
+	if err != nil {
+		return
+	}
+	return *aws.NewAuth(key, secret, token, expiry), nil
+}
+
+const (
+	// Refresh credentials this long before they expire.
+	credentialsRefreshMargin = 5 * time.Minute
+	// How long to wait before trying again when a refresh fails.
+	credentialsRetryInterval = time.Minute
+)
+
+// A copy of the bucket's client that signs with `auth`. goamz reads a
+// client's credentials without any locking as it signs each request, so
+// rather than change them in place we swap in a new client.
+func withAuth(bucket *s3.Bucket, auth aws.Auth) *s3.Bucket {
+	s := *bucket.S3
+	s.Auth = auth
+	return s.Bucket(bucket.Name)
+}
+
+// How long to wait before refreshing credentials that expire at `expiry`.
+func credentialsRefreshDelay(expiry time.Time, now time.Time) time.Duration {
+	remaining := expiry.Sub(now)
+	if remaining > 2*credentialsRefreshMargin {
+		return remaining - credentialsRefreshMargin
+	}
+	// Short-lived credentials: refresh once half their lifetime is up.
+	if remaining > 0 {
+		return remaining / 2
+	}
+	return 0
+}
+
+// Keep the credentials current until `stop` or `done` is closed. Each
+// refresh calls `update` with the new credentials, and failures are passed
+// to `logError`.
+func refreshCredentials(provider CredentialsProvider, expiry time.Time, update func(aws.Auth), logError func(error), stop chan bool, done <-chan struct{}) {
+	if expiry.IsZero() {
+		return
+	}
+	delay := credentialsRefreshDelay(expiry, time.Now())
+	for {
+		select {
+		case <-stop:
+			return
+		case <-done:
+			return
+		case <-time.After(delay):
+		}
+		auth, err := providedAuth(provider)
+		if err != nil {
+			logError(fmt.Errorf("Error refreshing credentials: %s", err))
+			delay = credentialsRetryInterval
+			continue
+		}
+		update(auth)
+		if auth.Expiration().IsZero() {
+			return
+		}
+		delay = credentialsRefreshDelay(auth.Expiration(), time.Now())
+	}
+}
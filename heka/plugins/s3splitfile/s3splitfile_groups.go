@@ -0,0 +1,229 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"github.com/mozilla-services/heka/pipeline"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Objects in the same partition group (the same values for the first
+// atomic_group_depth dimensions of the schema) whose records are held back
+// until every object in the group has been read, then delivered together.
+// If any of them fails, none of the group's records are delivered.
+type atomicGroup struct {
+	name string
+	lock sync.Mutex
+	// Objects queued in the group, and how many of them have been read.
+	members  int
+	finished int
+	// Set once the listing has moved past the group, so no more objects
+	// will join it.
+	closed  bool
+	records []groupRecord
+	bytes   int64
+	// The objects read so far, to be checkpointed once the group is
+	// delivered.
+	done []groupMember
+	// Why the group can't be delivered, if it can't.
+	err error
+}
+
+type groupRecord struct {
+	record []byte
+	fields []recordField
+}
+
+type groupMember struct {
+	b      *inputBucket
+	key    s3.Key
+	result ProcessResult
+	// Set if the object was skipped on purpose, so isn't part of what's
+	// delivered.
+	skipped bool
+}
+
+// Why an object that was read wasn't delivered: its group failed.
+type GroupRolledBackError struct {
+	Group string
+	Err   error
+}
+
+func (e *GroupRolledBackError) Error() string {
+	return fmt.Sprintf("group %s wasn't delivered: %s", e.Group, e.Err)
+}
+
+// Hold on to a record until the group is delivered. The splitter reuses its
+// buffer, so the record is copied. Once the group holds more than `maxBytes`
+// of records it fails, rather than running us out of memory.
+func (g *atomicGroup) add(record []byte, fields []recordField, maxBytes int64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.err != nil {
+		return
+	}
+	if maxBytes > 0 && g.bytes+int64(len(record)) > maxBytes {
+		g.err = fmt.Errorf("more than %d bytes of records", maxBytes)
+		g.records = nil
+		return
+	}
+	g.bytes += int64(len(record))
+	g.records = append(g.records, groupRecord{append([]byte(nil), record...), fields})
+}
+
+// Whether every object in the group has been read, and no more will join.
+func (g *atomicGroup) complete() bool {
+	return g.closed && g.finished == g.members
+}
+
+// Keeps track of the open groups, by name. Safe for concurrent use.
+type groupTracker struct {
+	lock   sync.Mutex
+	groups map[string]*atomicGroup
+	// Signalled whenever a group stops being tracked.
+	taken chan struct{}
+}
+
+func newGroupTracker() *groupTracker {
+	return &groupTracker{groups: map[string]*atomicGroup{}, taken: make(chan struct{}, 1)}
+}
+
+// Wait until fewer than `max` groups are open, or `stop` is closed.
+func (gt *groupTracker) WaitForRoom(max int, stop <-chan bool) {
+	for gt.Open() >= max {
+		select {
+		case <-gt.taken:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Count another object in the named group.
+func (gt *groupTracker) Add(name string) {
+	gt.lock.Lock()
+	defer gt.lock.Unlock()
+	g, ok := gt.groups[name]
+	if !ok {
+		g = &atomicGroup{name: name}
+		gt.groups[name] = g
+	}
+	g.members++
+}
+
+// The named group, or nil if it isn't open.
+func (gt *groupTracker) Get(name string) *atomicGroup {
+	gt.lock.Lock()
+	defer gt.lock.Unlock()
+	return gt.groups[name]
+}
+
+// Note that no more objects will join the named group. Returns the group if
+// it's now complete, and no longer tracked.
+func (gt *groupTracker) Close(name string) *atomicGroup {
+	gt.lock.Lock()
+	defer gt.lock.Unlock()
+	g, ok := gt.groups[name]
+	if !ok {
+		return nil
+	}
+	g.closed = true
+	return gt.take(g)
+}
+
+// Note that an object in the named group has been read, or failed with
+// `err`. Returns the group if it's now complete, and no longer tracked.
+func (gt *groupTracker) Finish(name string, m groupMember, err error) *atomicGroup {
+	gt.lock.Lock()
+	defer gt.lock.Unlock()
+	g, ok := gt.groups[name]
+	if !ok {
+		return nil
+	}
+	g.lock.Lock()
+	g.finished++
+	if err != nil && g.err == nil {
+		g.err = fmt.Errorf("%s failed: %s", m.key.Key, err)
+		g.records = nil
+	} else if err == nil && !m.skipped {
+		g.done = append(g.done, m)
+	}
+	g.lock.Unlock()
+	return gt.take(g)
+}
+
+func (gt *groupTracker) take(g *atomicGroup) *atomicGroup {
+	if !g.complete() {
+		return nil
+	}
+	delete(gt.groups, g.name)
+	select {
+	case gt.taken <- struct{}{}:
+	default:
+	}
+	return g
+}
+
+// How many groups are still open.
+func (gt *groupTracker) Open() int {
+	gt.lock.Lock()
+	defer gt.lock.Unlock()
+	return len(gt.groups)
+}
+
+// The group an object belongs to: its bucket and first `depth` dimension
+// values. An object that doesn't fit the schema is a group of its own.
+func groupName(schema Schema, prefix string, bucket string, key string, depth int) string {
+	values, err := schema.ParseKey(prefix, key)
+	if err != nil || len(values) < depth {
+		return bucket + "/" + key
+	}
+	return bucket + "/" + strings.Join(values[:depth], "/") + "/"
+}
+
+func (input *S3SplitFileInput) objectGroup(b *inputBucket, key s3.Key) string {
+	return groupName(input.schema, input.S3BucketPrefix, b.name, key.Key, int(input.AtomicGroupDepth))
+}
+
+// Deliver a complete group's records and mark its objects done, or if any
+// of them failed, drop its records. Objects in a failed group aren't
+// checkpointed, so a later run with the same checkpoint reads the whole group
+// again, and with error_events, those that were read are dead-lettered along
+// with the one that failed.
+func (input *S3SplitFileInput) commitGroup(runner pipeline.InputRunner, helper pipeline.PluginHelper, sink *recordSink, g *atomicGroup) {
+	if g.err != nil {
+		atomic.AddInt64(&input.atomicGroupsRolledBack, 1)
+		runner.LogError(fmt.Errorf("Not delivering group %s (%d objects): %s", g.name, g.members, g.err))
+		if input.ErrorEvents {
+			err := &GroupRolledBackError{g.name, g.err}
+			for _, m := range g.done {
+				input.injectErrorEvent(runner, helper, m.b, m.key, err, m.result.Attempts, m.result.Bytes)
+			}
+		}
+		return
+	}
+	var pending sync.WaitGroup
+	for _, r := range g.records {
+		if input.deliverChan != nil {
+			pending.Add(1)
+			input.deliverChan <- queuedRecord{r.record, r.fields, &pending}
+		} else {
+			sink.deliver(r.record, r.fields)
+		}
+	}
+	pending.Wait()
+	for _, m := range g.done {
+		input.objectDone(runner, helper, m.b, m.key, m.result)
+		input.countSuccess(runner)
+	}
+	atomic.AddInt64(&input.atomicGroupsDelivered, 1)
+	runner.LogMessage(fmt.Sprintf("Delivered group %s (%d objects, %d records)", g.name, g.members, len(g.records)))
+}
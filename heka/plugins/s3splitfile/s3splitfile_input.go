@@ -7,13 +7,24 @@
 package s3splitfile
 
 import (
+	"code.google.com/p/go-uuid/uuid"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/AdRoll/goamz/aws"
 	"github.com/AdRoll/goamz/s3"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
+	"github.com/mreid-moz/golang-lru"
+	"hash"
+	"hash/crc32"
 	"io"
+	"math/rand"
+	"mime"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -21,19 +32,287 @@ import (
 )
 
 type S3SplitFileInput struct {
-	processFileCount          int64
-	processFileFailures       int64
-	processFileDiscardedBytes int64
-	processMessageCount       int64
-	processMessageFailures    int64
-	processMessageBytes       int64
+	processFileCount               int64
+	processFileFailures            int64
+	processFileDiscardedBytes      int64
+	processMessageCount            int64
+	processMessageFailures         int64
+	processMessageBytes            int64
+	processFrameResyncs            int64
+	processMessageMalformed        int64
+	processMessageRepeats          int64
+	processFileSuccesses           int64
+	processFileDuplicates          int64
+	processThrottles               int64
+	processFileMultipart           int64
+	processFileCompressionMismatch int64
+	decompressTime                 int64
+	processFileBadContentType      int64
+	processFileTruncated           int64
+	processMessageTrimMisses       int64
+	processMessageInvalid          int64
+	listErrors                     int64
+	listDropped                    int64
+	listKeysListed                 int64
+	listKeysQueued                 int64
+	listDelivered                  int64
+	listOlderVersions              int64
+	versionAnomalies               int64
+	consistencyRetries             int64
+	atomicGroupsDelivered          int64
+	atomicGroupsRolledBack         int64
+	fileCompleteFailures           int64
+	authErrors                     int64
+	clockSkewErrors                int64
+	activeWorkers                  uint32
+	rampingUp                      int32
+	runState                       int32
+	startTime                      int64
+	lastActivity                   int64
 
 	*S3SplitFileInputConfig
-	objectMatch *regexp.Regexp
-	bucket      *s3.Bucket
-	schema      Schema
-	stop        chan bool
-	listChan    chan string
+	objectMatch   *regexp.Regexp
+	objectExclude *regexp.Regexp
+	// The allowed_etags, without their quotes, or nil to allow any.
+	allowedETags map[string]bool
+	inProgress   *regexp.Regexp
+	recordTrim   *regexp.Regexp
+	replay       *ReplayPacer
+	transform    StreamTransform
+	replayTime   *regexp.Regexp
+	// The on_file_complete actions.
+	fileCompleteActions map[string]bool
+	buckets             []*inputBucket
+	region              aws.Region
+	schema              Schema
+	// Clients for region_map's prefixes, longest prefix first, and how
+	// many objects have been fetched from each region.
+	regionClients []*regionClient
+	regionFetches map[string]*int64
+	// Guards the bucket clients, which setAuth replaces.
+	authLock sync.RWMutex
+	runLock  *RunLock
+	// With extra_schema_files, every schema (the main one first), its name,
+	// and how many listed keys have fit it.
+	schemas       []*Schema
+	schemaNames   []string
+	schemaMatches []int64
+	progress      *ListProgress
+	sizes         *SizeStats
+	compression   *CompressionStats
+	partitions    *PartitionCounts
+	limiter       *RequestLimiter
+	// With partition_max_file_failures, the failures in each partition.
+	partitionFailures *PartitionFailures
+	// With partition_coverage, the partitions the schema expects.
+	expectedPartitions []string
+	// Parsed message_type_template and message_logger_template, if set.
+	typeTemplate   *KeyTemplate
+	loggerTemplate *KeyTemplate
+	credentials    CredentialsProvider
+	checkpoint     *ShardedCheckpoint
+	since          *SinceFile
+	snapshot       *ListingSnapshot
+	listCache      *ListCache
+	audit          *AuditManifest
+	catalog        *Catalog
+	dedupCache     *lru.Cache
+	dedupLock      sync.Mutex
+	checksumTable  *crc32.Table
+	checksumField  string
+	stop           chan bool
+	stopOnce       sync.Once
+	listDone       chan struct{}
+	listChan       chan bucketKey
+	smallChan      chan bucketKey
+	// With partition_affinity, each fetcher's queue, instead of listChan.
+	affinityChans []chan bucketKey
+	// Keys that 404'd since they were listed, and the lock that keeps them
+	// from being put back on the queue after it's closed.
+	consistency *ConsistencyRetries
+	requeueLock sync.RWMutex
+	listClosed  bool
+	groups      *groupTracker
+	// Set when too many access denied errors stop the run.
+	authErr error
+	// Set once a clock skew error has been reported.
+	clockSkewReported int32
+	// With tolerate_clock_skew, how far S3's clock was last measured to be
+	// ahead of ours, in nanoseconds.
+	clockOffset int64
+	// In tail mode, the ETag of every key queued and not since failed or
+	// gone from the listing, so that later passes only pick up new or
+	// changed objects.
+	tailKeys map[string]string
+	tailLock sync.Mutex
+	// With stop_after_first_record, set once a record has been delivered,
+	// along with where it came from.
+	firstRecord    int32
+	firstRecordKey string
+	workerStats    []workerStats
+	// Logged once we're running, since Init can't.
+	warnings    []string
+	deliverChan chan queuedRecord
+}
+
+// One of the buckets we're reading from, along with its own counters.
+type inputBucket struct {
+	processFileCount    int64
+	processFileFailures int64
+	processMessageCount int64
+	processMessageBytes int64
+	// Set once the bucket has had bucket_max_file_failures failures.
+	failed int32
+
+	name   string
+	region aws.Region
+	// Once we're running, these are replaced whenever the credentials are
+	// refreshed, so they're read with client() and fetchBucket().
+	bucket *s3.Bucket
+	// With s3_accelerate, the bucket through its transfer acceleration
+	// endpoint.
+	accelerated *s3.Bucket
+}
+
+// The bucket to list and update objects in.
+func (input *S3SplitFileInput) client(b *inputBucket) *s3.Bucket {
+	input.authLock.RLock()
+	defer input.authLock.RUnlock()
+	return b.bucket
+}
+
+type regionClientsByPrefix []*regionClient
+
+func (r regionClientsByPrefix) Len() int           { return len(r) }
+func (r regionClientsByPrefix) Less(i, j int) bool { return len(r[i].prefix) > len(r[j].prefix) }
+func (r regionClientsByPrefix) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// The bucket to fetch an object listed in `b` from, and its region: that of
+// the longest region_map prefix the key starts with, if any.
+func (input *S3SplitFileInput) fetchBucket(b *inputBucket, key string) (*s3.Bucket, aws.Region) {
+	input.authLock.RLock()
+	defer input.authLock.RUnlock()
+	for _, rc := range input.regionClients {
+		if strings.HasPrefix(key, rc.prefix) {
+			name := rc.bucket
+			if name == "" {
+				name = b.name
+			}
+			return rc.s3.Bucket(name), rc.region
+		}
+	}
+	if b.accelerated != nil {
+		return b.accelerated, b.region
+	}
+	return b.bucket, b.region
+}
+
+// Determine whether we've given up on the bucket.
+func (b *inputBucket) isFailed() bool {
+	return atomic.LoadInt32(&b.failed) == 1
+}
+
+// The partition (the bucket's directory) the given key is in.
+func (b *inputBucket) partition(key string) string {
+	return b.name + "/" + key[:strings.LastIndex(key, "/")+1]
+}
+
+// An object waiting to be read, and where to read it from.
+type bucketKey struct {
+	*inputBucket
+	key s3.Key
+}
+
+// A record waiting to be delivered, and the object it came from, which is
+// waiting for all of its records to be delivered.
+type queuedRecord struct {
+	record  []byte
+	fields  []recordField
+	pending *sync.WaitGroup
+}
+
+// A field to add to a record's message. Header fields set the message's
+// Type or Logger instead.
+type recordField struct {
+	name   string
+	value  interface{}
+	header bool
+}
+
+// How much a fetcher has read, and how long it spent doing so.
+type workerStats struct {
+	bytes    int64
+	busyTime int64
+}
+
+// Where records are delivered: a deliverer, and a splitter runner whose pack
+// decorator adds the fields for the record being delivered. Fields are added
+// before the record is decoded, so decoders that replace the whole message
+// (such as ProtobufDecoder) discard them.
+type recordSink struct {
+	deliverer pipeline.Deliverer
+	splitter  pipeline.SplitterRunner
+	fields    []recordField
+	// With atomic_group_depth, the group whose records are held back.
+	group *atomicGroup
+}
+
+func newRecordSink(runner pipeline.InputRunner, name string) *recordSink {
+	s := &recordSink{
+		deliverer: runner.NewDeliverer(name),
+		splitter:  runner.NewSplitterRunner(name),
+	}
+	s.splitter.SetPackDecorator(s.decorate)
+	return s
+}
+
+func (s *recordSink) deliver(record []byte, fields []recordField) {
+	s.fields = fields
+	s.splitter.DeliverRecord(record, s.deliverer)
+}
+
+func (s *recordSink) decorate(pack *pipeline.PipelinePack) {
+	for _, rf := range s.fields {
+		if rf.header {
+			switch rf.name {
+			case "Type":
+				pack.Message.SetType(rf.value.(string))
+			case "Logger":
+				pack.Message.SetLogger(rf.value.(string))
+			}
+			continue
+		}
+		if f, err := message.NewField(rf.name, rf.value, ""); err == nil {
+			pack.Message.AddField(f)
+		}
+	}
+}
+
+func (s *recordSink) Done() {
+	s.deliverer.Done()
+}
+
+// Additional bucket to read from, see s3_buckets.
+type S3BucketConfig struct {
+	Name string `toml:"name"`
+	// Defaults to aws_region.
+	Region string `toml:"region"`
+}
+
+// Where to fetch objects under a key prefix from, see region_map.
+type RegionMapEntry struct {
+	Prefix string `toml:"prefix"`
+	Region string `toml:"region"`
+	// Defaults to the bucket the key was listed in.
+	Bucket string `toml:"bucket"`
+}
+
+// A client for one of region_map's regions.
+type regionClient struct {
+	prefix string
+	bucket string
+	region aws.Region
+	s3     *s3.S3
 }
 
 type S3SplitFileInputConfig struct {
@@ -42,61 +321,923 @@ type S3SplitFileInputConfig struct {
 	// So we can default to using HekaFramingSplitter.
 	Splitter string
 
-	SchemaFile         string `toml:"schema_file"`
+	SchemaFile string `toml:"schema_file"`
+	// With false, a schema file (or extra schema file) with problems is
+	// reported with all of them at once rather than just the first, and
+	// entries in an 'allowed_values' list that aren't valid are skipped,
+	// with a warning, rather than failing the load.
+	SchemaStrict bool `toml:"schema_strict"`
+	// A TOML file of settings to merge over these ones, so a one-off run
+	// (such as a backfill) can keep its own schema_file, prefix or worker
+	// count without editing the main config.
+	JobFile            string `toml:"job_file"`
 	AWSKey             string `toml:"aws_key"`
 	AWSSecretKey       string `toml:"aws_secret_key"`
 	AWSRegion          string `toml:"aws_region"`
 	S3Bucket           string `toml:"s3_bucket"`
 	S3BucketPrefix     string `toml:"s3_bucket_prefix"`
 	S3ObjectMatchRegex string `toml:"s3_object_match_regex"`
-	S3Retries          uint32 `toml:"s3_retries"`
-	S3ConnectTimeout   uint32 `toml:"s3_connect_timeout"`
-	S3ReadTimeout      uint32 `toml:"s3_read_timeout"`
-	S3WorkerCount      uint32 `toml:"s3_worker_count"`
+	// Objects whose names match this are never processed, even if they also
+	// match s3_object_match_regex.
+	S3ObjectExcludeRegex string `toml:"s3_object_exclude_regex"`
+	// Only process objects with one of these ETags (with or without their
+	// quotes), to reprocess exactly the content that was audited. Each object
+	// is fetched only if its ETag still matches, so one that's overwritten
+	// after being listed fails rather than being read. goamz can list object
+	// versions but not fetch a particular one, so overwritten objects can't
+	// be read as they were.
+	AllowedETags []string `toml:"allowed_etags"`
+	// For versioned buckets, where re-uploads leave older versions behind:
+	// "latest" lists object versions rather than objects, reads only the
+	// latest version of each key, and counts the older versions passed over
+	// as ListOlderVersions. "report" does the same, and also logs each key
+	// with more than version_report_threshold versions (a likely duplicate
+	// upload), counted as VersionAnomalies. "" (the default) lists objects,
+	// which only ever sees the latest versions, without counting the rest.
+	VersionPolicy          string `toml:"version_policy"`
+	VersionReportThreshold uint32 `toml:"version_report_threshold"`
+	// By default s3_bucket_prefix has its leading slashes removed and ends
+	// with exactly one slash. Keep the leading slashes for keys that really
+	// begin with "/", or leave the end untouched to match part of a path
+	// segment (e.g. "logs/2015-"). See NormalizeBucketPrefix.
+	PrefixKeepLeadingSlash bool `toml:"prefix_keep_leading_slash"`
+	PrefixNoTrailingSlash  bool `toml:"prefix_no_trailing_slash"`
+	// Use the region's FIPS S3 endpoint (only available in some US regions).
+	AWSUseFIPS bool `toml:"aws_use_fips"`
+	// Fetch objects through S3 Transfer Acceleration's endpoint, which can be
+	// much faster across continents (listing still uses the region's). Each
+	// bucket must have acceleration enabled, which is checked at startup,
+	// and a name without dots. Accelerated transfers cost extra.
+	S3Accelerate bool `toml:"s3_accelerate"`
+	// Sign requests with this version of AWS's signing process, "v2" or
+	// "v4", rather than goamz's default. v2 is refused for regions (and
+	// FIPS endpoints) that only accept v4, rather than failing every request
+	// with a 403.
+	SigningVersion string `toml:"signing_version"`
+	S3Retries      uint32 `toml:"s3_retries"`
+	// When S3 rejects a GET because this host's clock is too far off
+	// (RequestTimeTooSkewed), measure how far from S3's Date header, then
+	// sign object GETs from then on with the corrected time and retry.
+	// Needs signing_version = "v4", since the corrected time is given as an
+	// X-Amz-Date header, which only SigV4 signs. Listing requests are still
+	// signed with the host's clock (goamz takes no headers for them), so a
+	// badly skewed host will need manifest_file to get its keys.
+	TolerateClockSkew bool `toml:"tolerate_clock_skew"`
+	// When S3 throttles us, wait this many milliseconds before retrying,
+	// doubling the wait for each further attempt up to
+	// throttle_backoff_max_ms. This is the only backoff there is: Retry-After
+	// is not honoured. S3's SlowDown responses don't send one, and goamz
+	// drops the headers of error responses, building a new HTTP transport
+	// for each request that can't be wrapped to see them.
+	ThrottleBackoffMs    uint32 `toml:"throttle_backoff_ms"`
+	ThrottleBackoffMaxMs uint32 `toml:"throttle_backoff_max_ms"`
+	// Stop the run with an error after this many objects in a row fail
+	// because access was denied (e.g. the credentials were revoked), rather
+	// than failing every remaining object. Such errors aren't retried. 0 (the
+	// default) means never stop, and retry them like any other error.
+	AuthErrorThreshold int64 `toml:"auth_error_threshold"`
+	// Wait a random time of up to this many seconds before listing, so that
+	// many instances started together (e.g. by a deploy) don't all list S3
+	// at once.
+	StartupJitter    uint32 `toml:"startup_jitter"`
+	S3ConnectTimeout uint32 `toml:"s3_connect_timeout"`
+	S3ReadTimeout    uint32 `toml:"s3_read_timeout"`
+	S3WorkerCount    uint32 `toml:"s3_worker_count"`
+	// The most GET and LIST requests to have in progress at once, however
+	// many fetchers there are and however many requests each makes (e.g.
+	// with range_chunk_bytes), to stay under the account's request limits.
+	// A GET counts until its response has been read. 0 (the default) means
+	// no limit.
+	MaxConcurrentRequests uint32 `toml:"max_concurrent_requests"`
+	// Scale the number of active fetchers between s3_worker_count_min and
+	// s3_worker_count_max, starting at s3_worker_count, based on how many keys
+	// are waiting to be fetched and whether S3 is throttling us.
+	S3WorkerAutoscale bool   `toml:"s3_worker_autoscale"`
+	S3WorkerCountMin  uint32 `toml:"s3_worker_count_min"`
+	S3WorkerCountMax  uint32 `toml:"s3_worker_count_max"`
+	// Rather than starting every fetcher at once, start with one (or
+	// s3_worker_count_min, with s3_worker_autoscale) and add more evenly
+	// over this many seconds until s3_worker_count are active, giving S3
+	// time to scale a cold prefix before we hit it with every request and
+	// are throttled. The reported WorkerCount is the number active. 0 means
+	// start them all at once.
+	WorkerRampupDuration uint32 `toml:"worker_rampup_duration"`
+	// Fetch objects smaller than this many bytes (such as metadata or control
+	// files) ahead of any larger ones that are waiting to be fetched. Only
+	// objects that have already been listed can be reordered. 0 means fetch
+	// objects in the order they're listed.
+	SmallObjectBytes int64 `toml:"small_object_bytes"`
+	// How many listed keys may wait for a fetcher (in each lane, with
+	// small_object_bytes). There's no separate cap on outstanding keys, so
+	// this is what bounds how far the listing runs ahead of the fetchers.
+	// When it's full, the lister waits ("block"), or with list_full_policy =
+	// "drop", which needs tail, leaves the key to be listed again on a later
+	// pass (counted as ListDropped). Dropping keeps a pass from stalling
+	// behind slow fetchers, at the cost of listing those keys twice.
+	ListChanBuffer int    `toml:"list_chan_buffer"`
+	ListFullPolicy string `toml:"list_full_policy"`
+	// Deliver records from a separate pool of this many goroutines, so that
+	// fetching continues while delivery is backed up. Zero means each fetcher
+	// delivers its own records.
+	DeliverWorkerCount uint32 `toml:"deliver_worker_count"`
+	// Send every object in a partition (a directory of the bucket) to the
+	// same fetcher, chosen by hashing the partition, so each partition's
+	// records are split and decoded by one goroutine, in listing order. Each
+	// fetcher then has its own queue, holding its share of list_chan_buffer.
+	// When a few partitions hold most of the data, their fetchers do most of
+	// the work while the rest sit idle, and a full queue holds up the
+	// listing for everyone. Can't be used with deliver_worker_count,
+	// s3_worker_autoscale, or small_object_bytes.
+	PartitionAffinity bool `toml:"partition_affinity"`
+	// Fraction of listed objects to process, chosen at random (default 1.0,
+	// i.e. process everything).
+	SampleRate float64 `toml:"sample_rate"`
+	// Seed for the sampling, so that a given seed always selects the same
+	// objects, whatever order they're listed in.
+	SampleSeed int64 `toml:"sample_seed"`
+	// Fetch the objects from each listing in a random order rather than in
+	// key order, so that requests are spread across S3's key-space partitions
+	// instead of all landing on one. The whole listing is read before any
+	// objects are fetched, and records arrive in no particular order. A
+	// non-zero shuffle_seed always gives the same order for the same listing.
+	Shuffle     bool  `toml:"shuffle"`
+	ShuffleSeed int64 `toml:"shuffle_seed"`
+	// Verify each Heka frame before delivering it, and on an invalid frame
+	// scan forward for the next valid one.
+	StrictFraming bool `toml:"strict_framing"`
+	// Number of bytes to skip at the start and end of each object, for
+	// producers that wrap the record stream in a fixed-size header or footer.
+	SkipHeaderBytes int64 `toml:"skip_header_bytes"`
+	SkipFooterBytes int64 `toml:"skip_footer_bytes"`
+	// File in which to record processed objects (and our position within
+	// partially processed ones), so that a restart can resume where we left
+	// off. Disabled if empty.
+	CheckpointFile string `toml:"checkpoint_file"`
+	// How many bytes to deliver from an object between checkpoints of our
+	// position within it.
+	CheckpointIntervalBytes int64 `toml:"checkpoint_interval_bytes"`
+	// Split the checkpoint over this many files (see ShardedCheckpoint), so
+	// that many fetchers aren't all waiting to write to one. Shards written
+	// by earlier runs are merged when the checkpoint is loaded, so this can
+	// be changed between runs.
+	CheckpointShards uint32 `toml:"checkpoint_shards"`
+	// Rather than writing each checkpoint entry as it's recorded, write them
+	// in the background and sync them to disk every checkpoint_flush_interval
+	// seconds (see Checkpoint.FlushEvery), so fetchers don't wait on the
+	// file. Anything not yet synced is written when the input stops. 0 means
+	// write each entry straight away.
+	CheckpointFlushInterval uint32 `toml:"checkpoint_flush_interval"`
+	// Hold a lock at this local path or "s3://bucket/key" location while
+	// running, and refuse to start if another run holds it, so the same job
+	// can't be run twice at once over one checkpoint. A lock left by a run
+	// that died must be removed by hand.
+	RunLockPath string `toml:"run_lock_path"`
+	// File holding the newest LastModified timestamp processed by an earlier
+	// run. Only objects modified after it are processed, and it's advanced
+	// once a run has processed everything it listed without errors. This is
+	// a lightweight alternative to checkpoint_file for append-only buckets.
+	SinceFile string `toml:"since_file"`
+	// File holding the listing (keys and ETags) from an earlier run. Only
+	// objects that are new or have changed since then are processed, and the
+	// file is replaced with the current listing once a run has processed
+	// everything it listed without errors. Objects that were skipped (say,
+	// by min_object_age) or failed aren't part of the saved listing, so
+	// they're still new to the next run.
+	ListingSnapshot string `toml:"listing_snapshot"`
+	// Stop cleanly once this many objects have been processed successfully.
+	// Objects already being read when the limit is reached are still
+	// finished. A value of 0 means no limit.
+	MaxObjects int64 `toml:"max_objects"`
+	// Stop the run as soon as a record has been delivered, as a quick check
+	// of credentials, decompression, framing, and downstream connectivity.
+	// The object it came from is logged and given as the run summary's
+	// first_record_key. Only that one record is delivered, and the other
+	// objects being read are given up on. If the run ends without
+	// delivering a record, it fails.
+	StopAfterFirstRecord bool `toml:"stop_after_first_record"`
+	// Skip objects whose content is identical to one already seen during
+	// this run. This hashes every byte, and holds each object's records in
+	// memory until the whole object has been read, so it is off by default.
+	ContentDedup bool `toml:"content_dedup"`
+	// Maximum number of content hashes to remember for deduplication.
+	ContentDedupCacheSize int `toml:"content_dedup_cache_size"`
+	// Drop a record that's identical (by SHA256) to the one just before it
+	// in the same object, for producers that sometimes write a record
+	// twice. Only the previous record's hash is kept, so this costs no
+	// memory, but repeats further apart are delivered. Dropped records are
+	// counted as ProcessMessageRepeats.
+	DropRepeatedRecords bool `toml:"drop_repeated_records"`
+	// Add a checksum ("crc32c" or "crc32") field to each record's message, so
+	// that downstream systems can detect corruption introduced after
+	// ingestion. With a checksum_granularity of "record", the "RecordCRC32C"
+	// (or "RecordCRC32") field covers the record itself. With "object", the
+	// "ObjectCRC32C" field covers all the records read from the object, in
+	// order, which means holding each object's records in memory until it has
+	// been read, as for content_dedup. The fields are added before decoding,
+	// so they're lost with decoders that replace the whole message.
+	Checksum            string `toml:"checksum"`
+	ChecksumGranularity string `toml:"checksum_granularity"`
+	// Treat a listing that yields no objects to process as an error, rather
+	// than just logging a warning.
+	FailOnEmptyListing bool `toml:"fail_on_empty_listing"`
+	// How many bytes to read ahead of the splitter for each object, to
+	// smooth out throughput on bursty connections. 0 disables read-ahead.
+	ReadBufferBytes int `toml:"read_buffer_bytes"`
+	// Download objects larger than range_chunk_bytes as a series of ranged
+	// GETs, range_concurrency at a time, reassembling them in order for the
+	// splitter. This speeds up reading a few large objects over a network
+	// where each connection is slower than the link, at the cost of up to
+	// range_chunk_bytes * (range_concurrency + 1) of memory per fetcher: the
+	// chunk being read, and those being fetched after it. Splitting is
+	// unchanged. 0 disables ranged reads.
+	RangeChunkBytes  int64  `toml:"range_chunk_bytes"`
+	RangeConcurrency uint32 `toml:"range_concurrency"`
+	// Read and check every record without delivering anything, to audit a
+	// bucket's integrity. Failure and trailing data metrics are still
+	// updated.
+	ValidateOnly bool `toml:"validate_only"`
+	// Read the S3 keys to process from this file (one per line) instead of
+	// listing the bucket.
+	ManifestFile string `toml:"manifest_file"`
+	// Fetch the keys in exactly the order they appear in the manifest. This
+	// uses a single fetcher, so expect it to be slow.
+	ManifestOrdered bool `toml:"manifest_ordered"`
+	// Record each processed object, with its size, SHA256, and record count,
+	// to this local file or "s3://bucket/key" location.
+	AuditManifest string `toml:"audit_manifest"`
+	// Once the run is complete, write a catalog of the objects processed
+	// (JSON lines of bucket, key, size, record count, partition values and
+	// run ID, see CatalogEntry) to this key in s3_bucket, or to an
+	// "s3://bucket/key" location, replacing any earlier catalog there. A run
+	// that fails or is stopped early leaves the earlier catalog alone. The
+	// catalog is kept in a local temporary file until then. The run ID is
+	// run_id, or a random one logged as the run starts. Can't be used with
+	// tail, whose runs never complete.
+	CatalogS3Key string `toml:"catalog_s3_key"`
+	// Save the listing to this local file, and reuse it instead of listing S3
+	// again for list_cache_ttl seconds, unless list_cache_refresh is set.
+	ListCacheFile    string `toml:"list_cache_file"`
+	ListCacheTTL     uint32 `toml:"list_cache_ttl"`
+	ListCacheRefresh bool   `toml:"list_cache_refresh"`
+	// Inject a message of type error_event_type for each object that can't
+	// be read after s3_retries attempts, describing the object and the error,
+	// and with atomic_group_depth, for each object that was read but whose
+	// group wasn't delivered (ErrorType "GroupRolledBack").
+	ErrorEvents    bool   `toml:"error_events"`
+	ErrorEventType string `toml:"error_event_type"`
+	// Don't fetch the objects listed, but inject a message of type
+	// list_only_event_type for each one, for another system (such as a work
+	// queue) to share out. The message has Bucket, Key, Size, ETag and
+	// LastModified fields, plus the partition fields with partition_fields,
+	// and its Payload is the object's "s3://bucket/key" location. With
+	// checkpoint_file, each dispatched object is checkpointed as done.
+	ListOnlyDeliver   bool   `toml:"list_only_deliver"`
+	ListOnlyEventType string `toml:"list_only_event_type"`
+	// Don't deliver Heka records whose messages lack any of these fields (or
+	// have only an empty value for one), to catch records that decode but
+	// say nothing. "Type", "Logger", "Hostname", "Payload" and "EnvVersion"
+	// are the message's headers, other names its fields. Each such record is
+	// counted as ProcessMessageInvalid and injected as a message of type
+	// required_fields_event_type, with Bucket, Key, Offset and MissingField
+	// fields and the record itself as its Record field, for a dead-letter
+	// output to keep. Frames that don't decode are delivered as usual.
+	RequiredFields          []string `toml:"required_fields"`
+	RequiredFieldsEventType string   `toml:"required_fields_event_type"`
+	// What to do with each object once it's been read successfully (and all
+	// of its records delivered), for workflows that keep track of what's
+	// done in S3 itself: write an empty "marker" object named after it plus
+	// on_file_complete_marker_suffix, inject an "event" of type
+	// on_file_complete_event_type, and/or "move" it to the same path under
+	// on_file_complete_move_prefix, in the same bucket. Moving needs
+	// permission to delete the original, and fails for objects over 5 GB,
+	// which S3 can't copy in one request (goamz has no multipart copy), so
+	// they're left where they are. Markers are written alongside the
+	// objects, so use s3_object_exclude_regex to keep later runs from
+	// reading them. goamz has no support for object tagging, so objects
+	// can't be tagged.
+	OnFileComplete             []string `toml:"on_file_complete"`
+	OnFileCompleteMarkerSuffix string   `toml:"on_file_complete_marker_suffix"`
+	OnFileCompleteEventType    string   `toml:"on_file_complete_event_type"`
+	OnFileCompleteMovePrefix   string   `toml:"on_file_complete_move_prefix"`
+	// Further buckets to read from, alongside s3_bucket, using the same
+	// prefix and schema. Keys from all buckets are fed to the same pool of
+	// fetchers.
+	S3Buckets []S3BucketConfig `toml:"s3_buckets"`
+	// Report metrics for each bucket individually as well as in total.
+	PerBucketMetrics bool `toml:"per_bucket_metrics"`
+	// For a dataset spread across regions with the region encoded in its
+	// keys: fetch objects whose keys start with an entry's prefix (the
+	// longest that matches) from that entry's region, and bucket if it
+	// names one, rather than from the bucket they were listed in. Keys are
+	// still listed from s3_bucket and s3_buckets. The number of objects
+	// fetched from each region is reported as RegionFetches.<region>, and
+	// with lineage each record gets a SourceRegion field.
+	RegionMap []RegionMapEntry `toml:"region_map"`
+	// Give up on a bucket once this many of its objects have failed, skipping
+	// the rest of its listing and objects, while the other buckets carry on.
+	// The run still counts as failed. 0 means never give up on a bucket.
+	BucketMaxFileFailures int64 `toml:"bucket_max_file_failures"`
+	// Likewise, give up on a partition (a directory of the bucket, such as
+	// one listed prefix's data for a day) once this many of its objects have
+	// failed, while the bucket's other partitions carry on. The partitions
+	// given up on are listed in the status's failed_partitions, and counted
+	// as FailedPartitions. 0 means never give up on a partition.
+	PartitionMaxFileFailures int64 `toml:"partition_max_file_failures"`
+	// Rather than stopping after one listing, list again every tail_interval
+	// seconds and process any objects that are new or have changed.
+	Tail         bool   `toml:"tail"`
+	TailInterval uint32 `toml:"tail_interval"`
+	// Leave objects modified less than this many seconds ago until a later
+	// listing pass, in case they're still being written.
+	MinObjectAge uint32 `toml:"min_object_age"`
+	// In tail mode, objects that may still be written to are left until
+	// they're finalized. Objects whose names match in_progress_regex are
+	// never processed (e.g. "^latest" or "\\.tmp$"), and with
+	// defer_newest_object the most recently modified object in each
+	// directory is left for a later listing pass.
+	InProgressRegex   string `toml:"in_progress_regex"`
+	DeferNewestObject bool   `toml:"defer_newest_object"`
+	// In tail mode, a key we've only just listed can briefly 404 until S3
+	// catches up. Put such keys back on the queue to be fetched again after
+	// consistency_retry_delay seconds, up to consistency_retry_attempts
+	// times, before counting them as failed. 0 attempts treats a 404 like
+	// any other error.
+	ConsistencyRetryDelay    uint32 `toml:"consistency_retry_delay"`
+	ConsistencyRetryAttempts uint32 `toml:"consistency_retry_attempts"`
+	// Get AWS credentials from the named provider (see
+	// RegisterCredentialsProvider) instead of aws_key and aws_secret_key, and
+	// refresh them before they expire.
+	CredentialsProvider string `toml:"credentials_provider"`
+	// What to do when listing fails: "continue" with whatever else can be
+	// listed, or "stop" the input with an error, since the listing may be
+	// incomplete.
+	ListErrorPolicy string `toml:"list_error_policy"`
+	// What to do when s3_bucket_prefix disagrees with the schema's "prefix":
+	// "warn" and use s3_bucket_prefix, "error" out, or use the "schema"'s.
+	// When s3_bucket_prefix is empty, the schema's prefix is used.
+	SchemaPrefixPolicy string `toml:"schema_prefix_policy"`
+	// What to do with keys that have fewer or more path segments than the
+	// schema has dimensions (e.g. a stray object at the top of the prefix):
+	// "skip" them, "deliver" them anyway (without partition fields, and
+	// listing everything under a too-deep prefix), or "fail", reporting each
+	// as a listing error subject to list_error_policy. They're counted as
+	// ListUnexpectedDepth either way.
+	UnexpectedDepth string `toml:"unexpected_depth"`
+	// Refuse to list more than this many path segments below the prefix, as
+	// a guard against a misconfigured prefix or schema listing far more of
+	// the bucket than intended. Keys matching the schema are one segment
+	// deeper than its number of dimensions, and with unexpected_depth =
+	// "deliver", deeper keys are checked as they're found. Going too deep
+	// stops the input whatever the list_error_policy. 0 (the default) means
+	// no limit.
+	MaxListingDepth uint32 `toml:"max_listing_depth"`
+	// Deliver the objects in each partition group (those with the same values
+	// for the first atomic_group_depth dimensions of the schema) together or
+	// not at all: their records are held in memory until every object in the
+	// group has been read, and dropped if any of them fails or the group
+	// holds more than atomic_group_max_bytes of records. Objects in a group
+	// that isn't delivered aren't checkpointed, so rerunning with the same
+	// checkpoint reads the whole group again. Keys must be listed in order,
+	// so this can't be used with tail, shuffle, manifest_file,
+	// extra_schema_files (whose listings are interleaved with the main
+	// schema's), or defer_newest_object. 0 means deliver records as they're
+	// read. At most atomic_group_max_open groups are held at once (at least
+	// one per bucket), and the listing waits for one to be delivered or
+	// dropped before starting another.
+	AtomicGroupDepth    uint32 `toml:"atomic_group_depth"`
+	AtomicGroupMaxBytes int64  `toml:"atomic_group_max_bytes"`
+	AtomicGroupMaxOpen  uint32 `toml:"atomic_group_max_open"`
+	// Expect objects to have this Content-Type (e.g.
+	// "application/octet-stream"), ignoring any parameters, to catch error
+	// pages that were stored as objects. Objects that don't are logged and
+	// read anyway ("warn"), skipped without counting as failures ("skip"),
+	// or failed without being retried ("fail").
+	ExpectedContentType string `toml:"expected_content_type"`
+	ContentTypePolicy   string `toml:"content_type_policy"`
+	// Split objects into records on this delimiter (e.g. "\n" or "\u0000")
+	// instead of Heka's stream framing. Each record keeps its trailing
+	// delimiter. Since the records aren't Heka messages, use a splitter that
+	// doesn't expect them to be (e.g. "NullSplitter") and a suitable decoder.
+	// As with framed records, any record longer than Heka's maximum record
+	// size (message.MAX_RECORD_SIZE) is counted as a failure and skipped.
+	RecordDelimiter string `toml:"record_delimiter"`
+	// Check that each line of newline-delimited JSON (with record_delimiter
+	// = "\n") parses before delivering it. A malformed line is either
+	// skipped ("skip"), so that one bad line doesn't cost the rest of the
+	// object, or fails the object without retrying it ("fail"). Skipped
+	// lines are logged per object and counted as ProcessMessageMalformed.
+	// Blank lines are skipped either way, without being counted. Empty (the
+	// default) delivers lines unchecked.
+	NDJSONErrorPolicy string `toml:"ndjson_error_policy"`
+	// Deliver each object as a single record, without splitting it, for
+	// self-contained container formats such as Avro or Parquet files. The
+	// record is the rest of the object after skip_header_bytes, decompressed
+	// if need be, and objects larger than whole_object_max_bytes (once
+	// decompressed) are failed rather than read into memory. Use a splitter
+	// that passes records through untouched (e.g. "NullSplitter", with
+	// use_message_bytes = true so that the object arrives in the pack's
+	// MsgBytes rather than its Payload) and a decoder that understands the
+	// format. The decoder is handed the whole container, and is expected to
+	// iterate over the records inside it, returning a pack for each one (or
+	// none, for an empty container) and an error only if the container can't
+	// be read. Record fields (checksums, partition fields, and so on) are
+	// added to the pack the decoder is given, so the decoder must copy them
+	// to its packs if they're wanted.
+	WholeObject         bool  `toml:"whole_object"`
+	WholeObjectMaxBytes int64 `toml:"whole_object_max_bytes"`
+	// Deliver only part of each record, for cheap scans of just the
+	// metadata at the start of large records: the first record_trim_bytes
+	// bytes, and/or what record_trim_regex matches (its first
+	// subexpression, if it has one), with the regex applied first. Records
+	// the regex doesn't match are skipped, and counted as
+	// ProcessMessageTrimMisses. Checksums and other record fields are still
+	// computed from the whole record. Since a trimmed Heka frame can't be
+	// decoded, this needs record_delimiter or whole_object. 0 and "" (the
+	// defaults) deliver records whole.
+	RecordTrimBytes int    `toml:"record_trim_bytes"`
+	RecordTrimRegex string `toml:"record_trim_regex"`
+	// Pace delivery, to replay archived data against a test downstream
+	// (see ReplayPacer): at replay_rate records per second, or at
+	// replay_speed times the pace of the records' own timestamps. A Heka
+	// record's timestamp is its message's; other records need
+	// replay_timestamp_regex, whose first subexpression (or whole match) is
+	// parsed with replay_timestamp_layout. Fetchers deliver at the same time,
+	// so records only replay in order with s3_worker_count = 1.
+	ReplayRate            float64 `toml:"replay_rate"`
+	ReplaySpeed           float64 `toml:"replay_speed"`
+	ReplayTimestampRegex  string  `toml:"replay_timestamp_regex"`
+	ReplayTimestampLayout string  `toml:"replay_timestamp_layout"`
+	// If a bucket turns out to be in a different region than configured,
+	// switch to that region rather than failing with an error naming it.
+	FollowRegionRedirects bool `toml:"follow_region_redirects"`
+	// Give up on an attempt to read an object after this many seconds in
+	// total, however steadily data is arriving (unlike s3_read_timeout, which
+	// applies to each read). The object is then retried as for any other
+	// error. 0 means no limit.
+	PerObjectTimeout uint32 `toml:"per_object_timeout"`
+	// Treat a response that ends before its Content-Length (a dropped
+	// connection) as a failed read, counted as ProcessFileTruncated and
+	// retried, rather than as the end of the object.
+	CheckContentLength bool `toml:"check_content_length"`
+	// Rather than per_object_timeout and s3_read_timeout, allow
+	// adaptive_timeout_base seconds to read an object, plus as long as it
+	// takes at adaptive_timeout_throughput bytes per second given its listed
+	// size, so large objects have the time they need while stalls on small
+	// ones are still caught. s3_read_timeout bounds the whole of a
+	// connection's life rather than each read, so it's not used, and LISTs
+	// then have no read timeout.
+	AdaptiveTimeout           bool   `toml:"adaptive_timeout"`
+	AdaptiveTimeoutBase       uint32 `toml:"adaptive_timeout_base"`
+	AdaptiveTimeoutThroughput int64  `toml:"adaptive_timeout_throughput"`
+	// Write a JSON summary of the run (see RunSummary) to this file when the
+	// input finishes.
+	SummaryPath string `toml:"summary_path"`
+	// Schema fields to accept any value for in this run, whatever the schema
+	// file allows.
+	WildcardDimensions []string `toml:"wildcard_dimensions"`
+	// Other schemas that keys under s3_bucket_prefix may follow, such as
+	// while a producer moves to a new layout. Each key is read with the first
+	// of schema_file and these whose dimensions it fits, and counted in
+	// SchemaMatches.<file name> when it's queued (so once per change to the
+	// object with tail). Each schema is listed separately, so this
+	// costs a listing per schema. The extra schemas' own prefixes,
+	// wildcard_dimensions, and dimension_formats aren't used, and
+	// unexpected_depth can't be "fail", since a key that's too deep for one
+	// schema may fit another.
+	ExtraSchemaFiles []string `toml:"extra_schema_files"`
+	// Time layouts for schema fields whose values are dates that don't sort
+	// as strings (e.g. { submissionDate = "01-02-2006" }), overriding any
+	// "format" given in the schema.
+	DimensionFormats map[string]string `toml:"dimension_formats"`
+	// Add a field to each record's message for each schema dimension, whose
+	// value is taken from the object's key. As with checksums, these are
+	// lost with decoders that replace the whole message.
+	PartitionFields bool `toml:"partition_fields"`
+	// Add fields to each record's message recording where it came from:
+	// SourceBucket, SourceKey, SourceETag (without its quotes),
+	// SourceOffset (the byte offset where the record starts in the object,
+	// after decompression and transforms, including anything skipped before
+	// it), SourceRegion (the region the object was fetched from), and
+	// RunId, which is run_id or, if that's empty, a random ID generated for
+	// the run and logged as it starts. As with partition_fields, these are
+	// lost with decoders that replace the whole message.
+	Lineage bool   `toml:"lineage"`
+	RunId   string `toml:"run_id"`
+	// Count the records read from each partition (the values of the schema
+	// dimensions in their objects' keys), and report the counts once the run
+	// is complete, both in the run summary and as a message of type
+	// partition_counts_event_type whose payload is a JSON object mapping each
+	// partition (e.g. "20150101/release") to its count. Objects whose keys
+	// don't fit the schema aren't counted.
+	PartitionCounts          bool   `toml:"partition_counts"`
+	PartitionCountsEventType string `toml:"partition_counts_event_type"`
+	// With partition_counts, check that every partition the schema expects
+	// (every combination of its listed values, and each day of its date
+	// ranges) yielded records, to catch a producer outage that left a day
+	// or a channel missing. The gaps are logged, listed in the run
+	// summary, and counted in the partition counts message's
+	// MissingPartitions field. Every dimension needs a known set of values.
+	PartitionCoverage bool `toml:"partition_coverage"`
+	// Templates for each record's message Type and Logger, in Go's
+	// text/template syntax (e.g. "s3.{{.appUpdateChannel}}"), so that routing
+	// can depend on where records came from. They may use the object's
+	// {{.Bucket}}, {{.Key}}, and {{.Name}} (the last segment of its key), and
+	// each schema dimension by field name, which is empty if the key doesn't
+	// fit the schema. As with partition fields, these are lost with decoders
+	// that replace the whole message.
+	MessageTypeTemplate   string `toml:"message_type_template"`
+	MessageLoggerTemplate string `toml:"message_logger_template"`
+	// Also export our counters to "statsd" (sent as gauges to the UDP
+	// metrics_addr every metrics_interval seconds) or "prometheus" (served at
+	// http://<metrics_addr>/metrics), for monitoring without Heka's
+	// dashboard. Metric names start with metrics_prefix.
+	MetricsSink     string `toml:"metrics_sink"`
+	MetricsAddr     string `toml:"metrics_addr"`
+	MetricsInterval uint32 `toml:"metrics_interval"`
+	MetricsPrefix   string `toml:"metrics_prefix"`
+	// Every metrics_flush_interval seconds, write the counters, listing
+	// progress, and throughput as JSON (see MetricsSnapshot) to
+	// metrics_flush_path. 0 means never.
+	MetricsFlushInterval uint32 `toml:"metrics_flush_interval"`
+	MetricsFlushPath     string `toml:"metrics_flush_path"`
+	// Decompress objects: "none", "gzip" (every object), or "auto" (objects
+	// whose keys end in ".gz"). Compressed objects are always fetched in
+	// full, so skip_footer_bytes can't be used with them.
+	Decompress string `toml:"decompress"`
+	// Undo an encoding applied to whole objects, after decompressing and
+	// before splitting: the named transforms (see RegisterStreamTransform)
+	// are applied in order. "base64" and "hex" are built in. Transformed
+	// objects are always fetched in full, so skip_footer_bytes can't be used
+	// with them.
+	Transforms []string `toml:"transforms"`
+	// Decompress each object in its own goroutine, up to this many bytes
+	// ahead of the splitter, so that decompressing and splitting can use
+	// separate CPUs (as can reading from the network, with
+	// read_buffer_bytes). Worthwhile when a backfill of compressed objects is
+	// limited by CPU rather than the network. 0 decompresses as the splitter
+	// reads. The time spent decompressing is reported as DecompressTime.
+	DecompressBufferBytes int `toml:"decompress_buffer_bytes"`
+	// With decompress = "auto", how to treat objects whose names and
+	// contents disagree: "trust_suffix" (decompress objects named ".gz"),
+	// "trust_content" (decompress objects that start with the gzip magic
+	// bytes), or "sniff" (decompress both). Objects that aren't read from the
+	// start cost an extra request to check their content.
+	CompressionPolicy string `toml:"compression_policy"`
 }
 
 func (input *S3SplitFileInput) ConfigStruct() interface{} {
 	return &S3SplitFileInputConfig{
-		Decoder:            "ProtobufDecoder",
-		Splitter:           "HekaFramingSplitter",
-		AWSKey:             "",
-		AWSSecretKey:       "",
-		AWSRegion:          "us-west-2",
-		S3Bucket:           "",
-		S3BucketPrefix:     "",
-		S3ObjectMatchRegex: "",
-		S3Retries:          5,
-		S3ConnectTimeout:   60,
-		S3ReadTimeout:      60,
-		S3WorkerCount:      10,
+		Decoder:                    "ProtobufDecoder",
+		Splitter:                   "HekaFramingSplitter",
+		SchemaStrict:               true,
+		JobFile:                    "",
+		AWSKey:                     "",
+		AWSSecretKey:               "",
+		AWSRegion:                  "us-west-2",
+		AWSUseFIPS:                 false,
+		S3Accelerate:               false,
+		SigningVersion:             "",
+		TolerateClockSkew:          false,
+		S3Bucket:                   "",
+		S3Buckets:                  nil,
+		PerBucketMetrics:           false,
+		RegionMap:                  nil,
+		BucketMaxFileFailures:      0,
+		PartitionMaxFileFailures:   0,
+		Tail:                       false,
+		TailInterval:               60,
+		MinObjectAge:               0,
+		InProgressRegex:            "",
+		DeferNewestObject:          false,
+		ConsistencyRetryDelay:      5,
+		ConsistencyRetryAttempts:   0,
+		CredentialsProvider:        "",
+		ListErrorPolicy:            "continue",
+		SchemaPrefixPolicy:         "warn",
+		UnexpectedDepth:            UnexpectedDepthSkip,
+		MaxListingDepth:            0,
+		AtomicGroupDepth:           0,
+		AtomicGroupMaxBytes:        256 << 20,
+		AtomicGroupMaxOpen:         8,
+		ExpectedContentType:        "",
+		ContentTypePolicy:          "warn",
+		RecordDelimiter:            "",
+		NDJSONErrorPolicy:          "",
+		RecordTrimBytes:            0,
+		RecordTrimRegex:            "",
+		ReplayRate:                 0,
+		ReplaySpeed:                0,
+		ReplayTimestampRegex:       "",
+		ReplayTimestampLayout:      time.RFC3339Nano,
+		WholeObject:                false,
+		WholeObjectMaxBytes:        64 * 1024 * 1024,
+		FollowRegionRedirects:      false,
+		PerObjectTimeout:           0,
+		CheckContentLength:         true,
+		AdaptiveTimeout:            false,
+		AdaptiveTimeoutBase:        30,
+		AdaptiveTimeoutThroughput:  1 << 20,
+		SummaryPath:                "",
+		WildcardDimensions:         nil,
+		ExtraSchemaFiles:           nil,
+		DimensionFormats:           nil,
+		PartitionFields:            false,
+		Lineage:                    false,
+		RunId:                      "",
+		PartitionCounts:            false,
+		PartitionCountsEventType:   "heka.s3splitfile.partition_counts",
+		PartitionCoverage:          false,
+		MessageTypeTemplate:        "",
+		MessageLoggerTemplate:      "",
+		MetricsSink:                MetricsSinkNone,
+		MetricsAddr:                "",
+		MetricsInterval:            10,
+		MetricsPrefix:              "s3splitfile",
+		MetricsFlushInterval:       0,
+		MetricsFlushPath:           "",
+		Decompress:                 DecompressNone,
+		Transforms:                 nil,
+		DecompressBufferBytes:      0,
+		CompressionPolicy:          CompressionTrustSuffix,
+		S3BucketPrefix:             "",
+		PrefixKeepLeadingSlash:     false,
+		PrefixNoTrailingSlash:      false,
+		S3ObjectMatchRegex:         "",
+		S3ObjectExcludeRegex:       "",
+		AllowedETags:               nil,
+		VersionPolicy:              "",
+		VersionReportThreshold:     1,
+		S3Retries:                  5,
+		ThrottleBackoffMs:          500,
+		ThrottleBackoffMaxMs:       30000,
+		AuthErrorThreshold:         0,
+		StartupJitter:              0,
+		S3ConnectTimeout:           60,
+		S3ReadTimeout:              60,
+		S3WorkerCount:              10,
+		MaxConcurrentRequests:      0,
+		S3WorkerAutoscale:          false,
+		S3WorkerCountMin:           1,
+		S3WorkerCountMax:           50,
+		WorkerRampupDuration:       0,
+		DeliverWorkerCount:         0,
+		PartitionAffinity:          false,
+		ListChanBuffer:             1000,
+		ListFullPolicy:             "block",
+		SmallObjectBytes:           0,
+		SampleRate:                 1.0,
+		SampleSeed:                 0,
+		Shuffle:                    false,
+		ShuffleSeed:                0,
+		StrictFraming:              false,
+		SkipHeaderBytes:            0,
+		SkipFooterBytes:            0,
+		CheckpointFile:             "",
+		RunLockPath:                "",
+		SinceFile:                  "",
+		ListingSnapshot:            "",
+		CheckpointIntervalBytes:    64 * 1024 * 1024,
+		CheckpointShards:           1,
+		CheckpointFlushInterval:    0,
+		MaxObjects:                 0,
+		StopAfterFirstRecord:       false,
+		ContentDedup:               false,
+		ContentDedupCacheSize:      100000,
+		DropRepeatedRecords:        false,
+		Checksum:                   "",
+		ChecksumGranularity:        "record",
+		FailOnEmptyListing:         false,
+		ReadBufferBytes:            64 * 1024,
+		RangeChunkBytes:            0,
+		RangeConcurrency:           4,
+		ValidateOnly:               false,
+		ManifestFile:               "",
+		ManifestOrdered:            false,
+		AuditManifest:              "",
+		CatalogS3Key:               "",
+		ListCacheFile:              "",
+		ListCacheTTL:               3600,
+		ListCacheRefresh:           false,
+		ErrorEvents:                false,
+		ErrorEventType:             "heka.s3splitfile.error",
+		ListOnlyDeliver:            false,
+		ListOnlyEventType:          "heka.s3splitfile.key",
+		RequiredFields:             nil,
+		RequiredFieldsEventType:    "heka.s3splitfile.invalid",
+		OnFileComplete:             nil,
+		OnFileCompleteMarkerSuffix: ".done",
+		OnFileCompleteEventType:    "heka.s3splitfile.file_complete",
+		OnFileCompleteMovePrefix:   "",
 	}
 }
 
 func (input *S3SplitFileInput) Init(config interface{}) (err error) {
 	conf := config.(*S3SplitFileInputConfig)
+	if conf.JobFile != "" {
+		if err = applyJobFile(conf, conf.JobFile); err != nil {
+			return fmt.Errorf("Parameter 'job_file' must be a valid TOML file of settings: %s", err)
+		}
+	}
 	input.S3SplitFileInputConfig = conf
 
-	input.schema, err = LoadSchema(conf.SchemaFile)
+	loadSchema := func(path string) (Schema, error) {
+		if conf.SchemaStrict {
+			return LoadSchema(path)
+		}
+		schema, skipped, err := LoadSchemaLenient(path)
+		for _, w := range skipped {
+			input.warnings = append(input.warnings, fmt.Sprintf("%s: %s", path, w))
+		}
+		return schema, err
+	}
+	input.schema, err = loadSchema(conf.SchemaFile)
 	if err != nil {
 		return fmt.Errorf("Parameter 'schema_file' must be a valid JSON file: %s", err)
 	}
+	for _, field := range conf.WildcardDimensions {
+		if err = input.schema.SetWildcard(field); err != nil {
+			return fmt.Errorf("Parameter 'wildcard_dimensions' must only contain schema fields: %s", err)
+		}
+	}
+	for field, layout := range conf.DimensionFormats {
+		if err = input.schema.SetFormat(field, layout); err != nil {
+			return fmt.Errorf("Parameter 'dimension_formats' must only contain schema fields with valid formats: %s", err)
+		}
+	}
+	input.schemas, input.schemaNames, input.schemaMatches = nil, nil, nil
+	if len(conf.ExtraSchemaFiles) > 0 {
+		if conf.UnexpectedDepth == UnexpectedDepthFail || conf.ListCacheFile != "" {
+			return fmt.Errorf("Parameter 'extra_schema_files' can't be used with unexpected_depth = \"fail\" or 'list_cache_file'")
+		}
+		input.schemas = []*Schema{&input.schema}
+		input.schemaNames = []string{filepath.Base(conf.SchemaFile)}
+		for _, path := range conf.ExtraSchemaFiles {
+			extra, err := loadSchema(path)
+			if err != nil {
+				return fmt.Errorf("Parameter 'extra_schema_files' must only contain valid JSON files: %s", err)
+			}
+			input.schemas = append(input.schemas, &extra)
+			input.schemaNames = append(input.schemaNames, filepath.Base(path))
+		}
+		input.schemaMatches = make([]int64, len(input.schemas))
+	}
+	input.progress = NewListProgress(input.schema)
+	input.sizes = NewSizeStats()
+	input.compression = NewCompressionStats()
+	input.partitions = nil
+	if conf.PartitionCounts {
+		input.partitions = NewPartitionCounts()
+	}
+	input.limiter = nil
+	if conf.MaxConcurrentRequests > 0 {
+		input.limiter = NewRequestLimiter(int(conf.MaxConcurrentRequests))
+	}
+	input.partitionFailures = nil
+	if conf.PartitionMaxFileFailures > 0 {
+		input.partitionFailures = NewPartitionFailures(conf.PartitionMaxFileFailures)
+	}
+	input.expectedPartitions = nil
+	if conf.PartitionCoverage {
+		if !conf.PartitionCounts || conf.Tail {
+			return fmt.Errorf("Parameter 'partition_coverage' requires 'partition_counts', and can't be used with 'tail'")
+		}
+		if input.expectedPartitions, err = ExpectedPartitions(input.schema); err != nil {
+			return fmt.Errorf("Parameter 'partition_coverage' needs a schema whose partitions can be listed: %s", err)
+		}
+	}
+	if (conf.Lineage || conf.CatalogS3Key != "") && conf.RunId == "" {
+		conf.RunId = uuid.NewRandom().String()
+	}
+	templateVars := append([]string{"Bucket", "Key", "Name"}, input.schema.Fields...)
+	for _, s := range input.schemas {
+		templateVars = append(templateVars, s.Fields...)
+	}
+	input.typeTemplate, input.loggerTemplate = nil, nil
+	if conf.MessageTypeTemplate != "" {
+		if input.typeTemplate, err = ParseKeyTemplate("message_type_template", conf.MessageTypeTemplate, templateVars); err != nil {
+			return fmt.Errorf("Parameter 'message_type_template' must be a valid template: %s", err)
+		}
+	}
+	if conf.MessageLoggerTemplate != "" {
+		if input.loggerTemplate, err = ParseKeyTemplate("message_logger_template", conf.MessageLoggerTemplate, templateVars); err != nil {
+			return fmt.Errorf("Parameter 'message_logger_template' must be a valid template: %s", err)
+		}
+	}
 
+	if conf.TolerateClockSkew && conf.SigningVersion != "v4" {
+		return fmt.Errorf("Parameter 'tolerate_clock_skew' requires signing_version = \"v4\"")
+	}
+	bucketConfs := conf.S3Buckets
 	if conf.S3Bucket != "" {
-		auth, err := aws.GetAuth(conf.AWSKey, conf.AWSSecretKey, "", time.Now())
+		bucketConfs = append([]S3BucketConfig{{Name: conf.S3Bucket}}, bucketConfs...)
+	}
+	if len(bucketConfs) > 0 {
+		var auth aws.Auth
+		if conf.CredentialsProvider != "" {
+			provider, ok := getCredentialsProvider(conf.CredentialsProvider)
+			if !ok {
+				return fmt.Errorf("Parameter 'credentials_provider' must be the name of a registered provider")
+			}
+			input.credentials = provider
+			auth, err = providedAuth(provider)
+		} else {
+			auth, err = aws.GetAuth(conf.AWSKey, conf.AWSSecretKey, "", time.Now())
+		}
 		if err != nil {
 			return fmt.Errorf("Authentication error: %s\n", err)
 		}
-		region, ok := aws.Regions[conf.AWSRegion]
-		if !ok {
-			return fmt.Errorf("Parameter 'aws_region' must be a valid AWS Region")
+		// `param` names the parameter the region came from.
+		newS3 := func(regionName, param string) (*s3.S3, aws.Region, error) {
+			region, err := ResolveRegion(regionName, conf.AWSUseFIPS)
+			if err != nil {
+				return nil, region, fmt.Errorf("Parameter '%s' must be a valid AWS Region: %s", param, err)
+			}
+			signature, setSignature, err := SigningVersion(conf.SigningVersion, region, conf.AWSUseFIPS)
+			if err != nil {
+				return nil, region, fmt.Errorf("Parameter 'signing_version' must be 'v2' or 'v4', and suit the region: %s", err)
+			}
+			s := s3.New(auth, region)
+			if setSignature {
+				s.Signature = signature
+			}
+			s.ConnectTimeout = time.Duration(conf.S3ConnectTimeout) * time.Second
+			if !conf.AdaptiveTimeout {
+				s.ReadTimeout = time.Duration(conf.S3ReadTimeout) * time.Second
+			}
+			return s, region, nil
+		}
+		input.buckets = make([]*inputBucket, 0, len(bucketConfs))
+		seen := map[string]bool{}
+		for _, bc := range bucketConfs {
+			if bc.Name == "" || seen[bc.Name] {
+				return fmt.Errorf("Parameter 's3_buckets' must contain distinct, non-empty bucket names")
+			}
+			seen[bc.Name] = true
+			if conf.S3Accelerate {
+				if conf.AWSUseFIPS {
+					return fmt.Errorf("Parameter 's3_accelerate' can't be used with 'aws_use_fips'")
+				}
+				if err := checkAccelerateBucketName(bc.Name); err != nil {
+					return fmt.Errorf("Parameter 's3_accelerate' can't be used with this bucket: %s", err)
+				}
+			}
+			if bc.Region == "" {
+				bc.Region = conf.AWSRegion
+			}
+			s, region, err := newS3(bc.Region, "aws_region")
+			if err != nil {
+				return err
+			}
+			// TODO: ensure we can read from the bucket.
+			input.buckets = append(input.buckets, &inputBucket{
+				name:   bc.Name,
+				bucket: s.Bucket(bc.Name),
+				region: region,
+			})
+		}
+		input.region = input.buckets[0].region
+		input.regionClients = nil
+		input.regionFetches = nil
+		if len(conf.RegionMap) > 0 && conf.S3Accelerate {
+			return fmt.Errorf("Parameter 'region_map' can't be used with 's3_accelerate'")
 		}
-		s := s3.New(auth, region)
-		s.ConnectTimeout = time.Duration(conf.S3ConnectTimeout) * time.Second
-		s.ReadTimeout = time.Duration(conf.S3ReadTimeout) * time.Second
-		// TODO: ensure we can read from the bucket.
-		input.bucket = s.Bucket(conf.S3Bucket)
+		prefixes := map[string]bool{}
+		for _, rm := range conf.RegionMap {
+			if rm.Prefix == "" || prefixes[rm.Prefix] {
+				return fmt.Errorf("Parameter 'region_map' must contain distinct, non-empty prefixes")
+			}
+			prefixes[rm.Prefix] = true
+			if rm.Region == "" {
+				return fmt.Errorf("Parameter 'region_map' must give a region for prefix '%s'", rm.Prefix)
+			}
+			s, region, err := newS3(rm.Region, "region_map")
+			if err != nil {
+				return err
+			}
+			input.regionClients = append(input.regionClients, &regionClient{
+				prefix: rm.Prefix,
+				bucket: rm.Bucket,
+				region: region,
+				s3:     s,
+			})
+		}
+		if len(input.regionClients) > 0 {
+			// Objects outside the mapped prefixes are fetched from their
+			// buckets' regions.
+			input.regionFetches = map[string]*int64{}
+			for _, b := range input.buckets {
+				input.regionFetches[b.region.Name] = new(int64)
+			}
+			for _, rc := range input.regionClients {
+				input.regionFetches[rc.region.Name] = new(int64)
+			}
+		}
+		sort.Sort(regionClientsByPrefix(input.regionClients))
 	} else {
-		input.bucket = nil
+		input.buckets = []*inputBucket{{}}
+	}
+	if len(input.buckets) > 1 && conf.ManifestFile != "" {
+		return fmt.Errorf("Parameter 'manifest_file' can only be used with a single bucket")
 	}
 
 	if conf.S3ObjectMatchRegex != "" {
@@ -108,155 +1249,2386 @@ func (input *S3SplitFileInput) Init(config interface{}) (err error) {
 		input.objectMatch = nil
 	}
 
-	// Remove any excess path separators from the bucket prefix.
-	conf.S3BucketPrefix = CleanBucketPrefix(conf.S3BucketPrefix)
+	if conf.S3ObjectExcludeRegex != "" {
+		if input.objectExclude, err = regexp.Compile(conf.S3ObjectExcludeRegex); err != nil {
+			err = fmt.Errorf("S3SplitFileInput: %s", err)
+			return
+		}
+	} else {
+		input.objectExclude = nil
+	}
+	input.allowedETags = nil
+	if len(conf.AllowedETags) > 0 {
+		if conf.ManifestFile != "" {
+			return fmt.Errorf("Parameter 'allowed_etags' can't be used with 'manifest_file'")
+		}
+		input.allowedETags = map[string]bool{}
+		for _, etag := range conf.AllowedETags {
+			input.allowedETags[normalizeETag(etag)] = true
+		}
+	}
 
-	input.stop = make(chan bool)
-	input.listChan = make(chan string, 1000)
+	if conf.ManifestOrdered {
+		if conf.ManifestFile == "" {
+			return fmt.Errorf("Parameter 'manifest_ordered' requires 'manifest_file'")
+		}
+		if conf.Shuffle {
+			return fmt.Errorf("Parameter 'shuffle' can't be used with 'manifest_ordered'")
+		}
+		if conf.DeliverWorkerCount > 0 {
+			return fmt.Errorf("Parameter 'deliver_worker_count' can't be used with 'manifest_ordered'")
+		}
+		if conf.SmallObjectBytes > 0 {
+			return fmt.Errorf("Parameter 'small_object_bytes' can't be used with 'manifest_ordered'")
+		}
+		// More than one fetcher would deliver the keys out of order.
+		conf.S3WorkerCount = 1
+		conf.S3WorkerAutoscale = false
+	}
 
-	return nil
-}
+	if conf.S3WorkerAutoscale {
+		if conf.S3WorkerCountMin < 1 || conf.S3WorkerCountMin > conf.S3WorkerCountMax {
+			return fmt.Errorf("Parameter 's3_worker_count_min' must be at least 1 and no more than 's3_worker_count_max'")
+		}
+		if conf.S3WorkerCount < conf.S3WorkerCountMin {
+			conf.S3WorkerCount = conf.S3WorkerCountMin
+		} else if conf.S3WorkerCount > conf.S3WorkerCountMax {
+			conf.S3WorkerCount = conf.S3WorkerCountMax
+		}
+	}
+	input.activeWorkers = conf.S3WorkerCount
+	if conf.WorkerRampupDuration > 0 && conf.PartitionAffinity {
+		return fmt.Errorf("Parameter 'worker_rampup_duration' can't be used with 'partition_affinity'")
+	}
 
-func (input *S3SplitFileInput) Stop() {
-	close(input.stop)
-}
+	if conf.SampleRate <= 0 || conf.SampleRate > 1 {
+		return fmt.Errorf("Parameter 'sample_rate' must be greater than 0 and at most 1")
+	}
 
-func (input *S3SplitFileInput) Run(runner pipeline.InputRunner, helper pipeline.PluginHelper) error {
-	// Begin listing the files (either straight from S3 or from a cache)
-	// Write matching filenames on a "lister" channel
-	// Read from the lister channel:
-	//   - fetch the filename
-	//   - read records from it
-	//   - write them to a "reader" channel
+	if conf.SkipHeaderBytes < 0 || conf.SkipFooterBytes < 0 {
+		return fmt.Errorf("Parameters 'skip_header_bytes' and 'skip_footer_bytes' must not be negative")
+	}
 
-	var (
-		wg sync.WaitGroup
-		i  uint32
-	)
+	if conf.RangeChunkBytes < 0 {
+		return fmt.Errorf("Parameter 'range_chunk_bytes' must not be negative")
+	}
+	if conf.RangeChunkBytes > 0 && conf.RangeConcurrency < 1 {
+		return fmt.Errorf("Parameter 'range_concurrency' must be greater than 0")
+	}
+	if conf.ReadBufferBytes < 0 {
+		return fmt.Errorf("Parameter 'read_buffer_bytes' must not be negative")
+	}
 
-	wg.Add(1)
-	go func() {
-		runner.LogMessage("Starting S3 list")
-	iteratorLoop:
-		for r := range S3Iterator(input.bucket, input.S3BucketPrefix, input.schema) {
-			select {
-			case <-input.stop:
-				runner.LogMessage("Stopping S3 list")
-				break iteratorLoop
-			default:
-			}
-			if r.Err != nil {
-				runner.LogError(fmt.Errorf("Error getting S3 list: %s", r.Err))
-			} else {
-				basename := r.Key.Key[strings.LastIndex(r.Key.Key, "/")+1:]
-				if input.objectMatch == nil || input.objectMatch.MatchString(basename) {
-					runner.LogMessage(fmt.Sprintf("Found: %s", r.Key.Key))
-					input.listChan <- r.Key.Key
-				} else {
-					runner.LogMessage(fmt.Sprintf("Skipping: %s", r.Key.Key))
-				}
-			}
+	if conf.MaxObjects < 0 {
+		return fmt.Errorf("Parameter 'max_objects' must not be negative")
+	}
+	if conf.StopAfterFirstRecord && (conf.ValidateOnly || conf.AtomicGroupDepth > 0) {
+		return fmt.Errorf("Parameter 'stop_after_first_record' can't be used with 'validate_only' or 'atomic_group_depth'")
+	}
+
+	if conf.ContentDedup {
+		if conf.ContentDedupCacheSize < 1 {
+			return fmt.Errorf("Parameter 'content_dedup_cache_size' must be greater than 0")
 		}
-		// All done listing, close the channel
-		runner.LogMessage("All done listing. Closing channel")
-		close(input.listChan)
-		wg.Done()
-	}()
+		if input.dedupCache, err = lru.New(conf.ContentDedupCacheSize); err != nil {
+			return
+		}
+	} else {
+		input.dedupCache = nil
+	}
 
-	// Run a pool of concurrent readers.
-	for i = 0; i < input.S3WorkerCount; i++ {
-		wg.Add(1)
-		go input.fetcher(runner, &wg, i)
+	switch conf.Checksum {
+	case "":
+		input.checksumTable = nil
+	case "crc32c":
+		input.checksumTable = crc32.MakeTable(crc32.Castagnoli)
+	case "crc32":
+		input.checksumTable = crc32.IEEETable
+	default:
+		return fmt.Errorf("Parameter 'checksum' must be 'crc32c' or 'crc32'")
+	}
+	switch conf.ChecksumGranularity {
+	case "record":
+		input.checksumField = "Record" + strings.ToUpper(conf.Checksum)
+	case "object":
+		input.checksumField = "Object" + strings.ToUpper(conf.Checksum)
+	default:
+		return fmt.Errorf("Parameter 'checksum_granularity' must be 'record' or 'object'")
 	}
-	wg.Wait()
 
-	return nil
-}
+	if conf.CheckpointFile != "" {
+		if conf.ValidateOnly {
+			return fmt.Errorf("Parameter 'checkpoint_file' can't be used with 'validate_only'")
+		}
+		if conf.CheckpointShards < 1 {
+			return fmt.Errorf("Parameter 'checkpoint_shards' must be greater than 0")
+		}
+		if input.checkpoint, err = LoadShardedCheckpoint(conf.CheckpointFile, int(conf.CheckpointShards)); err != nil {
+			return fmt.Errorf("Parameter 'checkpoint_file' must be a valid checkpoint file: %s", err)
+		}
+	} else {
+		input.checkpoint = nil
+	}
 
-// TODO: handle "no such file"
-func (input *S3SplitFileInput) readS3File(runner pipeline.InputRunner, d *pipeline.Deliverer, sr *pipeline.SplitterRunner, s3Key string) (err error) {
-	runner.LogMessage(fmt.Sprintf("Preparing to read: %s", s3Key))
-	if input.bucket == nil {
-		runner.LogMessage(fmt.Sprintf("Dude, where's my bucket: %s", s3Key))
-		return
+	if conf.SinceFile != "" {
+		if input.since, err = LoadSinceFile(conf.SinceFile); err != nil {
+			return fmt.Errorf("Parameter 'since_file' must be a valid since file: %s", err)
+		}
+	} else {
+		input.since = nil
 	}
-	for r := range S3FileIterator(input.bucket, s3Key) {
-		record := r.Record
-		err := r.Err
 
-		if err != nil && err != io.EOF {
-			runner.LogError(fmt.Errorf("Error reading %s: %s", s3Key, err))
-			atomic.AddInt64(&input.processMessageFailures, 1)
-			return err
+	if conf.ListingSnapshot != "" {
+		if input.snapshot, err = LoadListingSnapshot(conf.ListingSnapshot); err != nil {
+			return fmt.Errorf("Parameter 'listing_snapshot' must be a valid listing snapshot: %s", err)
 		}
-		if len(record) > 0 {
-			atomic.AddInt64(&input.processMessageCount, 1)
-			atomic.AddInt64(&input.processMessageBytes, int64(len(record)))
-			(*sr).DeliverRecord(record, *d)
+	} else {
+		input.snapshot = nil
+	}
+
+	switch conf.Decompress {
+	case DecompressNone, DecompressGzip, DecompressAuto:
+	default:
+		return fmt.Errorf("Parameter 'decompress' must be one of 'none', 'gzip', or 'auto'")
+	}
+	switch conf.CompressionPolicy {
+	case CompressionTrustSuffix, CompressionTrustContent, CompressionSniff:
+	default:
+		return fmt.Errorf("Parameter 'compression_policy' must be one of 'trust_suffix', 'trust_content', or 'sniff'")
+	}
+	if conf.DecompressBufferBytes < 0 {
+		return fmt.Errorf("Parameter 'decompress_buffer_bytes' must not be negative")
+	}
+	if conf.Decompress != DecompressNone && conf.SkipFooterBytes > 0 {
+		return fmt.Errorf("Parameter 'skip_footer_bytes' can't be used with 'decompress'")
+	}
+	input.transform = nil
+	if len(conf.Transforms) > 0 {
+		if conf.SkipFooterBytes > 0 {
+			return fmt.Errorf("Parameter 'skip_footer_bytes' can't be used with 'transforms'")
+		}
+		if input.transform, err = chainStreamTransforms(conf.Transforms); err != nil {
+			return fmt.Errorf("Parameter 'transforms' must only name registered transforms: %s", err)
 		}
 	}
 
-	return
-}
+	if conf.ListErrorPolicy != "continue" && conf.ListErrorPolicy != "stop" {
+		return fmt.Errorf("Parameter 'list_error_policy' must be 'continue' or 'stop'")
+	}
+	if conf.ContentTypePolicy != "warn" && conf.ContentTypePolicy != "skip" && conf.ContentTypePolicy != "fail" {
+		return fmt.Errorf("Parameter 'content_type_policy' must be 'warn', 'skip', or 'fail'")
+	}
+	switch conf.MetricsSink {
+	case MetricsSinkNone:
+	case MetricsSinkStatsd, MetricsSinkPrometheus:
+		if conf.MetricsAddr == "" {
+			return fmt.Errorf("Parameter 'metrics_addr' must be set when using 'metrics_sink'")
+		}
+		if conf.MetricsInterval < 1 {
+			return fmt.Errorf("Parameter 'metrics_interval' must be greater than 0")
+		}
+	default:
+		return fmt.Errorf("Parameter 'metrics_sink' must be 'statsd' or 'prometheus'")
+	}
+	if (conf.MetricsFlushInterval > 0) != (conf.MetricsFlushPath != "") {
+		return fmt.Errorf("Parameters 'metrics_flush_interval' and 'metrics_flush_path' must be set together")
+	}
+	if conf.SmallObjectBytes < 0 {
+		return fmt.Errorf("Parameter 'small_object_bytes' must not be negative")
+	}
+	if conf.PartitionAffinity && (conf.DeliverWorkerCount > 0 || conf.S3WorkerAutoscale || conf.SmallObjectBytes > 0) {
+		return fmt.Errorf("Parameter 'partition_affinity' can't be used with 'deliver_worker_count', 's3_worker_autoscale', or 'small_object_bytes'")
+	}
+	if conf.PartitionAffinity && conf.S3WorkerCount < 1 {
+		return fmt.Errorf("Parameter 'partition_affinity' needs 's3_worker_count' to be greater than 0")
+	}
+	if conf.BucketMaxFileFailures < 0 {
+		return fmt.Errorf("Parameter 'bucket_max_file_failures' must not be negative")
+	}
+	if conf.PartitionMaxFileFailures < 0 {
+		return fmt.Errorf("Parameter 'partition_max_file_failures' must not be negative")
+	}
+	if conf.ListOnlyDeliver && conf.ValidateOnly {
+		return fmt.Errorf("Parameter 'list_only_deliver' can't be used with 'validate_only'")
+	}
+	if conf.ListChanBuffer < 0 {
+		return fmt.Errorf("Parameter 'list_chan_buffer' must not be negative")
+	}
+	if conf.ListFullPolicy != "block" && conf.ListFullPolicy != "drop" {
+		return fmt.Errorf("Parameter 'list_full_policy' must be 'block' or 'drop'")
+	}
+	if conf.ListFullPolicy == "drop" && !conf.Tail {
+		return fmt.Errorf("Parameter 'list_full_policy' can only be 'drop' with 'tail', since dropped keys are left for a later listing pass")
+	}
+	if conf.AuthErrorThreshold < 0 {
+		return fmt.Errorf("Parameter 'auth_error_threshold' must not be negative")
+	}
+	if conf.ThrottleBackoffMaxMs < conf.ThrottleBackoffMs {
+		return fmt.Errorf("Parameter 'throttle_backoff_max_ms' must be at least 'throttle_backoff_ms'")
+	}
+	if conf.AdaptiveTimeout {
+		if conf.PerObjectTimeout > 0 {
+			return fmt.Errorf("Parameters 'adaptive_timeout' and 'per_object_timeout' can't be used together")
+		}
+		if conf.AdaptiveTimeoutBase < 1 || conf.AdaptiveTimeoutThroughput < 1 {
+			return fmt.Errorf("Parameters 'adaptive_timeout_base' and 'adaptive_timeout_throughput' must be greater than 0")
+		}
+	}
+	if conf.SchemaPrefixPolicy != "warn" && conf.SchemaPrefixPolicy != "error" && conf.SchemaPrefixPolicy != "schema" {
+		return fmt.Errorf("Parameter 'schema_prefix_policy' must be 'warn', 'error', or 'schema'")
+	}
+	switch conf.UnexpectedDepth {
+	case UnexpectedDepthSkip, UnexpectedDepthDeliver, UnexpectedDepthFail:
+	default:
+		return fmt.Errorf("Parameter 'unexpected_depth' must be 'skip', 'deliver', or 'fail'")
+	}
+	for _, s := range append([]*Schema{&input.schema}, input.schemas...) {
+		if conf.MaxListingDepth > 0 && conf.ManifestFile == "" && len(s.Fields)+1 > int(conf.MaxListingDepth) {
+			return fmt.Errorf("Parameter 'max_listing_depth' must be at least %d, since the schema's keys are that deep", len(s.Fields)+1)
+		}
+		if int(conf.AtomicGroupDepth) > len(s.Fields) {
+			return fmt.Errorf("Parameter 'atomic_group_depth' must be at most %d, the number of schema dimensions", len(s.Fields))
+		}
+	}
+	if conf.AtomicGroupDepth > 0 {
+		if conf.Tail || conf.Shuffle || conf.ManifestFile != "" || conf.DeferNewestObject || conf.ListOnlyDeliver {
+			return fmt.Errorf("Parameter 'atomic_group_depth' can't be used with 'tail', 'shuffle', 'manifest_file', 'defer_newest_object', or 'list_only_deliver'")
+		}
+		if len(conf.ExtraSchemaFiles) > 0 {
+			return fmt.Errorf("Parameter 'atomic_group_depth' can't be used with 'extra_schema_files', whose keys are listed alongside the main schema's rather than in order")
+		}
+		if conf.AtomicGroupMaxBytes < 0 {
+			return fmt.Errorf("Parameter 'atomic_group_max_bytes' must not be negative")
+		}
+		if int(conf.AtomicGroupMaxOpen) < len(input.buckets) {
+			// Each bucket's listing holds a group open, so with fewer the
+			// listing could wait forever.
+			return fmt.Errorf("Parameter 'atomic_group_max_open' must be at least the number of buckets, %d", len(input.buckets))
+		}
+		input.groups = newGroupTracker()
+	}
 
-func (input *S3SplitFileInput) fetcher(runner pipeline.InputRunner, wg *sync.WaitGroup, workerId uint32) {
-	var (
-		s3Key     string
-		startTime time.Time
-		duration  float64
-	)
+	switch conf.NDJSONErrorPolicy {
+	case "":
+	case "skip", "fail":
+		if conf.RecordDelimiter != "\n" {
+			return fmt.Errorf("Parameter 'ndjson_error_policy' requires record_delimiter = \"\\n\"")
+		}
+	default:
+		return fmt.Errorf("Parameter 'ndjson_error_policy' must be 'skip' or 'fail'")
+	}
 
-	fetcherName := fmt.Sprintf("S3Reader%d", workerId)
-	deliverer := runner.NewDeliverer(fetcherName)
-	defer deliverer.Done()
-	splitterRunner := runner.NewSplitterRunner(fetcherName)
+	if conf.RecordDelimiter != "" {
+		if conf.Splitter == "HekaFramingSplitter" || conf.Decoder == "ProtobufDecoder" {
+			return fmt.Errorf("Parameter 'record_delimiter' requires a 'splitter' and 'decoder' for unframed records, e.g. splitter = \"NullSplitter\"")
+		}
+		if conf.StrictFraming {
+			return fmt.Errorf("Parameter 'strict_framing' can't be used with 'record_delimiter'")
+		}
+	}
 
-	ok := true
-	for ok {
-		select {
-		case s3Key, ok = <-input.listChan:
-			if !ok {
-				// Channel is closed => we're shutting down, exit cleanly.
-				// runner.LogMessage("Fetcher all done! shutting down.")
-				break
-			}
+	if conf.WholeObject {
+		if conf.Splitter == "HekaFramingSplitter" || conf.Decoder == "ProtobufDecoder" {
+			return fmt.Errorf("Parameter 'whole_object' requires a 'splitter' and 'decoder' for unframed records, e.g. splitter = \"NullSplitter\"")
+		}
+		if conf.RecordDelimiter != "" || conf.StrictFraming {
+			return fmt.Errorf("Parameters 'record_delimiter' and 'strict_framing' can't be used with 'whole_object'")
+		}
+		if conf.WholeObjectMaxBytes <= 0 {
+			return fmt.Errorf("Parameter 'whole_object_max_bytes' must be greater than 0")
+		}
+	}
 
-			startTime = time.Now().UTC()
-			err := input.readS3File(runner, &deliverer, &splitterRunner, s3Key)
-			atomic.AddInt64(&input.processFileCount, 1)
-			leftovers := splitterRunner.GetRemainingData()
-			lenLeftovers := len(leftovers)
-			if lenLeftovers > 0 {
-				atomic.AddInt64(&input.processFileDiscardedBytes, int64(lenLeftovers))
-				runner.LogError(fmt.Errorf("Trailing data, possible corruption: %d bytes left in stream at EOF: %s", lenLeftovers, s3Key))
-			}
-			if err != nil && err != io.EOF {
-				runner.LogError(fmt.Errorf("Error reading %s: %s", s3Key, err))
-				atomic.AddInt64(&input.processFileFailures, 1)
-				continue
-			}
-			duration = time.Now().UTC().Sub(startTime).Seconds()
-			runner.LogMessage(fmt.Sprintf("Successfully fetched %s in %.2fs ", s3Key, duration))
-		case <-input.stop:
-			for _ = range input.listChan {
-				// Drain the channel without processing the files.
-				// Technically the S3Iterator can still add one back on to the
-				// channel but this ensures there is room so it won't block.
+	if conf.RecordTrimBytes < 0 {
+		return fmt.Errorf("Parameter 'record_trim_bytes' must not be negative")
+	}
+	input.recordTrim = nil
+	if conf.RecordTrimBytes > 0 || conf.RecordTrimRegex != "" {
+		if conf.RecordDelimiter == "" && !conf.WholeObject {
+			return fmt.Errorf("Parameters 'record_trim_bytes' and 'record_trim_regex' require 'record_delimiter' or 'whole_object', since a trimmed Heka frame can't be decoded")
+		}
+		if conf.RecordTrimRegex != "" {
+			if input.recordTrim, err = regexp.Compile(conf.RecordTrimRegex); err != nil {
+				return fmt.Errorf("Parameter 'record_trim_regex' must be a valid regular expression: %s", err)
 			}
-			ok = false
 		}
 	}
 
-	wg.Done()
-}
+	if len(conf.RequiredFields) > 0 && (conf.RecordDelimiter != "" || conf.WholeObject) {
+		return fmt.Errorf("Parameter 'required_fields' can't be used with 'record_delimiter' or 'whole_object', since only Heka messages are checked")
+	}
 
-func (input *S3SplitFileInput) ReportMsg(msg *message.Message) error {
-	message.NewInt64Field(msg, "ProcessFileCount", atomic.LoadInt64(&input.processFileCount), "count")
-	message.NewInt64Field(msg, "ProcessFileFailures", atomic.LoadInt64(&input.processFileFailures), "count")
-	message.NewInt64Field(msg, "ProcessFileDiscardedBytes", atomic.LoadInt64(&input.processFileDiscardedBytes), "B")
-	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&input.processMessageCount), "count")
-	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&input.processMessageFailures), "count")
-	message.NewInt64Field(msg, "ProcessMessageBytes", atomic.LoadInt64(&input.processMessageBytes), "B")
+	input.replay, input.replayTime = nil, nil
+	if conf.ReplayRate < 0 || conf.ReplaySpeed < 0 {
+		return fmt.Errorf("Parameters 'replay_rate' and 'replay_speed' must not be negative")
+	}
+	if conf.ReplayRate > 0 || conf.ReplaySpeed > 0 {
+		if conf.ReplayRate > 0 && conf.ReplaySpeed > 0 {
+			return fmt.Errorf("Parameters 'replay_rate' and 'replay_speed' can't be used together")
+		}
+		if conf.ValidateOnly || conf.AtomicGroupDepth > 0 {
+			return fmt.Errorf("Parameters 'replay_rate' and 'replay_speed' can't be used with 'validate_only' or 'atomic_group_depth'")
+		}
+		if conf.ReplaySpeed > 0 {
+			if conf.ReplayTimestampRegex != "" {
+				if input.replayTime, err = regexp.Compile(conf.ReplayTimestampRegex); err != nil {
+					return fmt.Errorf("Parameter 'replay_timestamp_regex' must be a valid regular expression: %s", err)
+				}
+			} else if conf.RecordDelimiter != "" || conf.WholeObject {
+				return fmt.Errorf("Parameter 'replay_speed' requires 'replay_timestamp_regex' unless records are Heka frames")
+			}
+		}
+		input.replay = NewReplayPacer(conf.ReplayRate, conf.ReplaySpeed)
+	}
+
+	if conf.Tail && conf.TailInterval < 1 {
+		return fmt.Errorf("Parameter 'tail_interval' must be greater than 0")
+	}
+	if (conf.InProgressRegex != "" || conf.DeferNewestObject) && !conf.Tail {
+		return fmt.Errorf("Parameters 'in_progress_regex' and 'defer_newest_object' require 'tail'")
+	}
+	if conf.ConsistencyRetryAttempts > 0 {
+		if !conf.Tail {
+			return fmt.Errorf("Parameter 'consistency_retry_attempts' requires 'tail'")
+		}
+		if conf.ConsistencyRetryDelay < 1 {
+			return fmt.Errorf("Parameter 'consistency_retry_delay' must be greater than 0")
+		}
+	}
+	if conf.InProgressRegex != "" {
+		if input.inProgress, err = regexp.Compile(conf.InProgressRegex); err != nil {
+			err = fmt.Errorf("S3SplitFileInput: %s", err)
+			return
+		}
+	} else {
+		input.inProgress = nil
+	}
+
+	switch conf.VersionPolicy {
+	case "", "latest", "report":
+	default:
+		return fmt.Errorf("Parameter 'version_policy' must be 'latest', 'report', or empty")
+	}
+	if conf.VersionPolicy != "" && (conf.ManifestFile != "" || conf.ListCacheFile != "") {
+		return fmt.Errorf("Parameter 'version_policy' can't be used with 'manifest_file' or 'list_cache_file'")
+	}
+	if conf.VersionPolicy == "report" && conf.VersionReportThreshold < 1 {
+		return fmt.Errorf("Parameter 'version_report_threshold' must be greater than 0")
+	}
+
+	if conf.ListCacheFile != "" {
+		if conf.ManifestFile != "" {
+			return fmt.Errorf("Parameter 'list_cache_file' can't be used with 'manifest_file'")
+		}
+		input.listCache = &ListCache{
+			Path:    conf.ListCacheFile,
+			TTL:     time.Duration(conf.ListCacheTTL) * time.Second,
+			Refresh: conf.ListCacheRefresh,
+		}
+	} else {
+		input.listCache = nil
+	}
+
+	if conf.AuditManifest != "" {
+		var s *s3.S3
+		if b := input.buckets[0].bucket; b != nil {
+			s = b.S3
+		}
+		if input.audit, err = NewAuditManifest(conf.AuditManifest, s); err != nil {
+			return fmt.Errorf("Parameter 'audit_manifest' must be a writable location: %s", err)
+		}
+	} else {
+		input.audit = nil
+	}
+	input.catalog = nil
+	if conf.CatalogS3Key != "" {
+		if conf.Tail {
+			return fmt.Errorf("Parameter 'catalog_s3_key' can't be used with 'tail', whose runs are never complete")
+		}
+		if input.catalog, err = NewCatalog(conf.CatalogS3Key, input.buckets[0].bucket, conf.RunId); err != nil {
+			return fmt.Errorf("Parameter 'catalog_s3_key' must be a key or \"s3://bucket/key\" location: %s", err)
+		}
+	}
+
+	// Remove any excess path separators from the bucket prefix.
+	conf.S3BucketPrefix = NormalizeBucketPrefix(conf.S3BucketPrefix, PrefixNormalization{
+		KeepLeadingSlash: conf.PrefixKeepLeadingSlash,
+		NoTrailingSlash:  conf.PrefixNoTrailingSlash,
+	})
+	input.schema.Prefix = NormalizeBucketPrefix(input.schema.Prefix, PrefixNormalization{
+		KeepLeadingSlash: conf.PrefixKeepLeadingSlash,
+		NoTrailingSlash:  conf.PrefixNoTrailingSlash,
+	})
+	prefix, mismatch := input.schema.ResolvePrefix(conf.S3BucketPrefix)
+	if mismatch != nil {
+		switch conf.SchemaPrefixPolicy {
+		case "error":
+			return fmt.Errorf("Parameter 's3_bucket_prefix' must match the schema: %s", mismatch)
+		case "schema":
+			prefix = input.schema.Prefix
+			input.warnings = append(input.warnings, fmt.Sprintf("%s, using the schema's", mismatch))
+		default:
+			input.warnings = append(input.warnings, mismatch.Error())
+		}
+	}
+	conf.S3BucketPrefix = prefix
+
+	if err = checkFileCompleteActions(conf); err != nil {
+		return
+	}
+	input.fileCompleteActions = map[string]bool{}
+	for _, action := range conf.OnFileComplete {
+		input.fileCompleteActions[action] = true
+	}
+
+	input.stop = make(chan bool)
+	input.listDone = make(chan struct{})
+	input.listChan = make(chan bucketKey, conf.ListChanBuffer)
+	if conf.SmallObjectBytes > 0 {
+		input.smallChan = make(chan bucketKey, conf.ListChanBuffer)
+	}
+	input.affinityChans = nil
+	if conf.PartitionAffinity {
+		size := conf.ListChanBuffer / int(conf.S3WorkerCount)
+		if size < 1 {
+			size = 1
+		}
+		input.affinityChans = make([]chan bucketKey, conf.S3WorkerCount)
+		for i := range input.affinityChans {
+			input.affinityChans[i] = make(chan bucketKey, size)
+		}
+	}
+
+	return nil
+}
+
+func (input *S3SplitFileInput) Stop() {
+	input.stopOnce.Do(func() {
+		close(input.stop)
+	})
+}
+
+func (input *S3SplitFileInput) Run(runner pipeline.InputRunner, helper pipeline.PluginHelper) error {
+	// Begin listing the files (either straight from S3 or from a cache)
+	// Write matching filenames on a "lister" channel
+	// Read from the lister channel:
+	//   - fetch the filename
+	//   - read records from it
+	//   - write them to a "reader" channel
+
+	var (
+		wg           sync.WaitGroup
+		i            uint32
+		listErr      error
+		listStopped  bool
+		listDuration time.Duration
+	)
+	runStart := time.Now().UTC()
+	atomic.StoreInt64(&input.startTime, runStart.UnixNano())
+	input.touch()
+	atomic.StoreInt32(&input.runState, runRunning)
+	defer atomic.StoreInt32(&input.runState, runComplete)
+
+	for _, w := range input.warnings {
+		runner.LogMessage(fmt.Sprintf("Warning: %s", w))
+	}
+	if input.Lineage {
+		runner.LogMessage(fmt.Sprintf("Run ID: %s", input.RunId))
+	}
+	input.runLock = nil
+	if input.RunLockPath != "" {
+		var s *s3.S3
+		if b := input.buckets[0].bucket; b != nil {
+			s = b.S3
+		}
+		lock, err := AcquireRunLock(input.RunLockPath, s)
+		if err != nil {
+			return fmt.Errorf("Can't take the run lock: %s", err)
+		}
+		input.runLock = lock
+		defer func() {
+			if err := lock.Release(); err != nil {
+				runner.LogError(fmt.Errorf("Error releasing the run lock: %s", err))
+			}
+		}()
+	}
+	if input.ConsistencyRetryAttempts > 0 {
+		input.consistency = NewConsistencyRetries()
+	}
+	if input.Tail {
+		input.tailKeys = map[string]string{}
+	}
+	if input.checkpoint != nil && input.CheckpointFlushInterval > 0 {
+		input.checkpoint.FlushEvery(time.Duration(input.CheckpointFlushInterval) * time.Second)
+	}
+	if input.StartupJitter > 0 {
+		jitter := startupJitter(time.Duration(input.StartupJitter)*time.Second, time.Now().UnixNano())
+		runner.LogMessage(fmt.Sprintf("Waiting %s before listing", jitter))
+		if !input.sleep(jitter) {
+			return nil
+		}
+	}
+	if err := input.checkBucketRegions(runner); err != nil {
+		return err
+	}
+	if input.S3Accelerate {
+		if err := input.checkAcceleration(runner); err != nil {
+			return err
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		var (
+			listed, queued int64
+			stopped        bool
+		)
+		runner.LogMessage("Starting S3 list")
+		minAge := time.Duration(input.MinObjectAge) * time.Second
+		// When shuffling, the keys found by the current listing pass.
+		var (
+			shuffler *rand.Rand
+			found    []bucketKey
+		)
+		if input.Shuffle {
+			seed := input.ShuffleSeed
+			if seed == 0 {
+				seed = time.Now().UnixNano()
+			}
+			shuffler = rand.New(rand.NewSource(seed))
+		}
+		// With atomic_group_depth, the group each bucket's listing is in.
+		// A bucket lists its keys in order, so once it moves on to another
+		// group the last one is closed.
+		var (
+			groupSink  *recordSink
+			lastGroups map[*inputBucket]string
+		)
+		if input.groups != nil {
+			groupSink = newRecordSink(runner, "S3GroupDeliverer")
+			defer groupSink.Done()
+			lastGroups = map[*inputBucket]string{}
+		}
+		closeGroup := func(name string) {
+			if g := input.groups.Close(name); g != nil {
+				input.commitGroup(runner, helper, groupSink, g)
+			}
+		}
+		queue := func(r bucketListResult, name string) {
+			runner.LogMessage(fmt.Sprintf("Found: %s", r.Key.Key))
+			queued++
+			atomic.AddInt64(&input.listKeysQueued, 1)
+			input.countSchemaMatch(r.Key)
+			if input.groups != nil {
+				group := input.objectGroup(r.inputBucket, r.Key)
+				if last, ok := lastGroups[r.inputBucket]; ok && last != group {
+					closeGroup(last)
+				}
+				if input.groups.Get(group) == nil {
+					input.groups.WaitForRoom(int(input.AtomicGroupMaxOpen), input.stop)
+				}
+				input.groups.Add(group)
+				lastGroups[r.inputBucket] = group
+			}
+			if input.Tail {
+				input.tailLock.Lock()
+				input.tailKeys[name] = r.Key.ETag
+				input.tailLock.Unlock()
+			}
+			if shuffler != nil {
+				found = append(found, bucketKey{r.inputBucket, r.Key})
+			} else if !input.sendKey(bucketKey{r.inputBucket, r.Key}) {
+				input.forgetTailKey(name)
+			}
+		}
+	listLoop:
+		for {
+			// The newest object so far in each directory, if we're deferring
+			// those.
+			newest := map[string]bucketListResult{}
+			// In tail mode, every key in this pass's listing, and whether
+			// any of it went missing.
+			var (
+				seen       map[string]bool
+				incomplete bool
+			)
+			if input.Tail {
+				seen = map[string]bool{}
+			}
+			iter := input.listBuckets(runner)
+			for r := range iter {
+				select {
+				case <-input.stop:
+					runner.LogMessage("Stopping S3 list")
+					stopped = true
+					break listLoop
+				default:
+				}
+				input.touch()
+				if r.isFailed() {
+					// Keep draining the bucket's listing, but ignore it.
+					incomplete = true
+					continue
+				}
+				if r.Err != nil {
+					incomplete = true
+					atomic.AddInt64(&input.listErrors, 1)
+					input.checkClockSkew(runner, r.inputBucket, r.Err)
+					if _, tooDeep := r.Err.(*ListDepthError); tooDeep || input.ListErrorPolicy == "stop" {
+						listErr = fmt.Errorf("Error getting S3 list, stopping: %s", r.Err)
+						runner.LogError(listErr)
+						stopped = true
+						input.Stop()
+						break listLoop
+					}
+					runner.LogError(fmt.Errorf("Error getting S3 list, continuing: %s", r.Err))
+					continue
+				}
+				if input.partitionFailures.IsFailed(r.partition(r.Key.Key)) {
+					incomplete = true
+					continue
+				}
+				name := input.qualifiedKey(r.inputBucket, r.Key).Key
+				if input.Tail {
+					seen[name] = true
+					input.tailLock.Lock()
+					queued := input.tailKeys[name] == r.Key.ETag
+					input.tailLock.Unlock()
+					if queued {
+						continue
+					}
+				}
+				listed++
+				atomic.AddInt64(&input.listKeysListed, 1)
+				basename := r.Key.Key[strings.LastIndex(r.Key.Key, "/")+1:]
+				if input.objectMatch != nil && !input.objectMatch.MatchString(basename) {
+					runner.LogMessage(fmt.Sprintf("Skipping: %s", r.Key.Key))
+				} else if input.objectExclude != nil && input.objectExclude.MatchString(basename) {
+					runner.LogMessage(fmt.Sprintf("Skipping (excluded): %s", r.Key.Key))
+				} else if input.allowedETags != nil && !input.allowedETags[normalizeETag(r.Key.ETag)] {
+					runner.LogMessage(fmt.Sprintf("Skipping (ETag %s not allowed): %s", r.Key.ETag, r.Key.Key))
+				} else if input.checkpoint != nil && input.checkpoint.IsDone(input.qualifiedKey(r.inputBucket, r.Key)) {
+					runner.LogMessage(fmt.Sprintf("Skipping (already processed): %s", r.Key.Key))
+				} else if input.snapshot != nil && !input.snapshot.Changed(input.qualifiedKey(r.inputBucket, r.Key)) {
+					runner.LogMessage(fmt.Sprintf("Skipping (unchanged since the last listing): %s", r.Key.Key))
+				} else if input.since != nil && !input.since.IsNew(r.Key) {
+					runner.LogMessage(fmt.Sprintf("Skipping (not modified since %s): %s", input.since.Since().Format(s3TimeFormat), r.Key.Key))
+				} else if age, ok := ObjectAge(r.Key, time.Now()); minAge > 0 && ok && age < minAge {
+					runner.LogMessage(fmt.Sprintf("Skipping (modified %s ago): %s", age, r.Key.Key))
+				} else if input.inProgress != nil && input.inProgress.MatchString(basename) {
+					runner.LogMessage(fmt.Sprintf("Skipping (in progress): %s", r.Key.Key))
+				} else if input.SampleRate < 1 && !sampled(input.SampleSeed, r.inputBucket.name, r.Key.Key, input.SampleRate) {
+					runner.LogMessage(fmt.Sprintf("Skipping (not sampled): %s", r.Key.Key))
+				} else if input.DeferNewestObject {
+					dir := name[:strings.LastIndex(name, "/")+1]
+					held, ok := newest[dir]
+					if !ok || held.Key.LastModified < r.Key.LastModified {
+						newest[dir] = r
+						if ok {
+							queue(held, input.qualifiedKey(held.inputBucket, held.Key).Key)
+						}
+					} else {
+						queue(r, name)
+					}
+				} else {
+					queue(r, name)
+				}
+			}
+			for _, held := range newest {
+				runner.LogMessage(fmt.Sprintf("Skipping (newest, may be in progress): %s", held.Key.Key))
+			}
+			if shuffler != nil {
+				shuffleKeys(found, shuffler)
+				for _, bk := range found {
+					if !input.sendKey(bk) {
+						input.forgetTailKey(input.qualifiedKey(bk.inputBucket, bk.key).Key)
+					}
+				}
+				found = nil
+			}
+			for _, last := range lastGroups {
+				closeGroup(last)
+			}
+			if !input.Tail {
+				break
+			}
+			if !incomplete {
+				// Keys that have gone from the bucket won't be listed again.
+				input.tailLock.Lock()
+				for name := range input.tailKeys {
+					if !seen[name] {
+						delete(input.tailKeys, name)
+					}
+				}
+				input.tailLock.Unlock()
+			}
+			runner.LogMessage(fmt.Sprintf("Listing again in %ds", input.TailInterval))
+			select {
+			case <-input.stop:
+				runner.LogMessage("Stopping S3 list")
+				stopped = true
+				break listLoop
+			case <-time.After(time.Duration(input.TailInterval) * time.Second):
+			}
+		}
+		if queued == 0 && !stopped {
+			listErr = input.emptyListingError(listed)
+			if input.FailOnEmptyListing {
+				runner.LogError(listErr)
+			} else {
+				runner.LogMessage(fmt.Sprintf("Warning: %s", listErr))
+				listErr = nil
+			}
+		}
+		listStopped = stopped
+		listDuration = time.Now().UTC().Sub(runStart)
+		// All done listing, close the channel
+		runner.LogMessage("All done listing. Closing channel")
+		input.requeueLock.Lock()
+		input.listClosed = true
+		input.requeueLock.Unlock()
+		if input.smallChan != nil {
+			close(input.smallChan)
+		}
+		close(input.listChan)
+		for _, c := range input.affinityChans {
+			close(c)
+		}
+		close(input.listDone)
+		wg.Done()
+	}()
+
+	if input.MetricsSink != MetricsSinkNone {
+		metricsDone := make(chan struct{})
+		defer close(metricsDone)
+		go input.exportMetrics(runner.LogError, metricsDone)
+	}
+	if input.MetricsFlushInterval > 0 {
+		flushDone := make(chan struct{})
+		defer close(flushDone)
+		go input.flushMetrics(runner.LogError, runStart, flushDone)
+	}
+
+	if input.credentials != nil {
+		expiry := input.client(input.buckets[0]).Auth.Expiration()
+		refreshDone := make(chan struct{})
+		defer close(refreshDone)
+		go refreshCredentials(input.credentials, expiry, input.setAuth, runner.LogError, input.stop, refreshDone)
+	}
+
+	// Run a pool of concurrent readers. When autoscaling, we start as many as
+	// we might ever need, and only the first `activeWorkers` of them fetch.
+	workerCount := input.S3WorkerCount
+	if input.S3WorkerAutoscale {
+		workerCount = input.S3WorkerCountMax
+		go input.autoscaler(runner)
+	}
+	if input.WorkerRampupDuration > 0 {
+		start := uint32(1)
+		if input.S3WorkerAutoscale {
+			start = input.S3WorkerCountMin
+		}
+		if start < input.S3WorkerCount {
+			atomic.StoreUint32(&input.activeWorkers, start)
+			atomic.StoreInt32(&input.rampingUp, 1)
+			go input.rampUp(runner, start, input.S3WorkerCount)
+		}
+	}
+	input.workerStats = make([]workerStats, workerCount)
+	var deliverWg sync.WaitGroup
+	if input.DeliverWorkerCount > 0 {
+		input.deliverChan = make(chan queuedRecord, 1000)
+		for i = 0; i < input.DeliverWorkerCount; i++ {
+			deliverWg.Add(1)
+			go input.deliverer(runner, &deliverWg, i)
+		}
+	}
+	for i = 0; i < workerCount; i++ {
+		wg.Add(1)
+		go input.fetcher(runner, helper, &wg, i)
+	}
+	wg.Wait()
+	if input.deliverChan != nil {
+		close(input.deliverChan)
+		deliverWg.Wait()
+	}
+	input.logThroughput(runner, time.Now().UTC().Sub(runStart))
+	if listErr == nil {
+		listErr = input.authErr
+	}
+	if listErr == nil && input.StopAfterFirstRecord && atomic.LoadInt32(&input.firstRecord) == 0 {
+		listErr = fmt.Errorf("No records were delivered")
+		runner.LogError(listErr)
+	}
+
+	if input.checkpoint != nil {
+		if err := input.checkpoint.Close(); err != nil {
+			runner.LogError(fmt.Errorf("Error closing checkpoint: %s", err))
+		}
+	}
+	if input.audit != nil {
+		if err := input.audit.Close(); err != nil {
+			runner.LogError(fmt.Errorf("Error writing audit manifest: %s", err))
+		}
+	}
+	// Objects are listed in key order, not by age, so unless everything was
+	// processed there may be older objects left behind.
+	incomplete := listErr != nil || listStopped || atomic.LoadInt64(&input.processFileFailures) > 0 || atomic.LoadInt64(&input.atomicGroupsRolledBack) > 0
+	if input.since != nil {
+		if incomplete {
+			runner.LogMessage(fmt.Sprintf("Run incomplete, leaving %s unchanged", input.SinceFile))
+		} else if err := input.since.Save(); err != nil {
+			runner.LogError(fmt.Errorf("Error writing since file: %s", err))
+		}
+	}
+	if input.snapshot != nil {
+		if incomplete {
+			runner.LogMessage(fmt.Sprintf("Run incomplete, leaving %s unchanged", input.ListingSnapshot))
+		} else if err := input.snapshot.Save(); err != nil {
+			runner.LogError(fmt.Errorf("Error writing listing snapshot: %s", err))
+		}
+	}
+
+	if input.partitions != nil && !input.Tail {
+		input.injectPartitionCounts(runner, helper)
+	}
+	if input.groups != nil && input.groups.Open() > 0 {
+		runner.LogMessage(fmt.Sprintf("Warning: %d groups weren't finished, none of their records were delivered", input.groups.Open()))
+	}
+
+	status := RunComplete
+	if listErr != nil || atomic.LoadInt64(&input.processFileFailures) > 0 || atomic.LoadInt64(&input.atomicGroupsRolledBack) > 0 {
+		status = RunFailed
+	} else if listStopped && !input.maxObjectsReached() && atomic.LoadInt32(&input.firstRecord) == 0 {
+		status = RunIncomplete
+	}
+	if input.catalog != nil {
+		// A partial catalog would pass for a complete one, so the last
+		// complete run's is left in place.
+		if status != RunComplete {
+			runner.LogMessage(fmt.Sprintf("Run %s, not replacing the catalog at %s", status, input.CatalogS3Key))
+		} else if err := input.catalog.Publish(); err != nil {
+			runner.LogError(fmt.Errorf("Error writing catalog: %s", err))
+		} else {
+			runner.LogMessage(fmt.Sprintf("Wrote catalog to %s", input.CatalogS3Key))
+		}
+		if err := input.catalog.Close(); err != nil {
+			runner.LogError(fmt.Errorf("Error removing the local copy of the catalog: %s", err))
+		}
+	}
+
+	if input.SummaryPath != "" {
+		s := input.summary(status, listErr, runStart, listDuration)
+		if err := writeSummary(input.SummaryPath, s); err != nil {
+			runner.LogError(fmt.Errorf("Error writing run summary: %s", err))
+		}
+	}
+
+	return listErr
+}
+
+// Make sure each bucket is in the region we're configured to use, since
+// otherwise every request fails with a redirect. If a bucket is elsewhere,
+// either switch to the right region or fail with an error naming it.
+func (input *S3SplitFileInput) checkBucketRegions(runner pipeline.InputRunner) error {
+	for _, b := range input.buckets {
+		if b.bucket == nil {
+			continue
+		}
+		_, err := b.bucket.List(input.S3BucketPrefix, "/", "", 1)
+		if !isRedirectError(err) {
+			// Any other problem will show up when we list the bucket.
+			continue
+		}
+		name, err := bucketRegion(b.bucket)
+		if err != nil {
+			return fmt.Errorf("Bucket %s is not in region %s, and its location is unknown: %s", b.name, b.region.Name, err)
+		}
+		if !input.FollowRegionRedirects {
+			return fmt.Errorf("Bucket %s is in region %s, not %s. Set aws_region (or the bucket's region in s3_buckets) accordingly, or enable follow_region_redirects", b.name, name, b.region.Name)
+		}
+		region, err := ResolveRegion(name, input.AWSUseFIPS)
+		if err != nil {
+			return fmt.Errorf("Bucket %s is in region %s: %s", b.name, name, err)
+		}
+		runner.LogMessage(fmt.Sprintf("Bucket %s is in region %s, not %s, switching", b.name, name, b.region.Name))
+		signature, setSignature, err := SigningVersion(input.SigningVersion, region, input.AWSUseFIPS)
+		if err != nil {
+			return fmt.Errorf("Bucket %s is in region %s: %s", b.name, name, err)
+		}
+		s := s3.New(b.bucket.Auth, region)
+		if setSignature {
+			s.Signature = signature
+		}
+		s.ConnectTimeout = b.bucket.ConnectTimeout
+		s.ReadTimeout = b.bucket.ReadTimeout
+		b.bucket = s.Bucket(b.name)
+		b.region = region
+	}
+	if len(input.buckets) > 0 {
+		input.region = input.buckets[0].region
+	}
+	return nil
+}
+
+// Set up each bucket's accelerated endpoint, and make sure it works. A bucket
+// without acceleration enabled rejects requests to the endpoint with a 400,
+// which for a HEAD request comes without an error code, so a HEAD of a key
+// that probably doesn't exist should only get a 403 or a 404.
+func (input *S3SplitFileInput) checkAcceleration(runner pipeline.InputRunner) error {
+	for _, b := range input.buckets {
+		if b.bucket == nil {
+			continue
+		}
+		b.accelerated = AccelerateBucket(b.bucket)
+		_, err := b.accelerated.Head(input.S3BucketPrefix+"s3splitfile-accelerate-check", nil)
+		if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == 400 || isAccelerateError(err) {
+			return fmt.Errorf("Bucket %s can't be read through S3 Transfer Acceleration, enable it for the bucket or turn off s3_accelerate: %s", b.name, err)
+		}
+		runner.LogMessage(fmt.Sprintf("Fetching from bucket %s through S3 Transfer Acceleration", b.name))
+	}
+	return nil
+}
+
+// Switch to new credentials, for every request from now on. Requests
+// already under way finish with the old ones.
+func (input *S3SplitFileInput) setAuth(auth aws.Auth) {
+	input.authLock.Lock()
+	for _, b := range input.buckets {
+		if b.bucket == nil {
+			continue
+		}
+		b.bucket = withAuth(b.bucket, auth)
+		if b.accelerated != nil {
+			b.accelerated = withAuth(b.accelerated, auth)
+		}
+	}
+	for _, rc := range input.regionClients {
+		s := *rc.s3
+		s.Auth = auth
+		rc.s3 = &s
+	}
+	input.authLock.Unlock()
+	if input.audit != nil {
+		input.audit.setAuth(auth)
+	}
+	if input.catalog != nil {
+		input.catalog.setAuth(auth)
+	}
+	if lock := input.runLock; lock != nil {
+		lock.setAuth(auth)
+	}
+}
+
+// A listing result, and the bucket it came from.
+type bucketListResult struct {
+	*inputBucket
+	S3ListResult
+}
+
+// List all of our buckets concurrently, merging the results.
+func (input *S3SplitFileInput) listBuckets(runner pipeline.InputRunner) <-chan bucketListResult {
+	results := make(chan bucketListResult, listBatchSize)
+	var listers sync.WaitGroup
+	for _, b := range input.buckets {
+		// Each listing stops on its own once it goes too deep.
+		opts := &ListOptions{Progress: input.progress, UnexpectedDepth: input.UnexpectedDepth, MaxDepth: int(input.MaxListingDepth), Limiter: input.limiter}
+		opts.KeyVersions = input.keyVersions(runner, b)
+		opts.Bucket = func(b *inputBucket) func() *s3.Bucket {
+			return func() *s3.Bucket { return input.client(b) }
+		}(b)
+		bucket := input.client(b)
+		var iter <-chan S3ListResult
+		if input.ManifestFile != "" {
+			iter = S3ManifestIterator(bucket, input.ManifestFile)
+		} else if input.listCache != nil {
+			lc := *input.listCache
+			if len(input.buckets) > 1 {
+				lc.Path = fmt.Sprintf("%s.%s", lc.Path, b.name)
+			}
+			if lc.Fresh(bucket, input.S3BucketPrefix) {
+				runner.LogMessage(fmt.Sprintf("Using cached listing from %s", lc.Path))
+			}
+			iter = lc.Iterator(bucket, input.S3BucketPrefix, input.schema, opts)
+		} else {
+			iter = S3IteratorWithOptions(bucket, input.S3BucketPrefix, input.schema, opts)
+		}
+		iters := []<-chan S3ListResult{iter}
+		if input.ManifestFile == "" && len(input.schemas) > 1 {
+			for _, s := range input.schemas[1:] {
+				// Keys that don't fit are left to the main schema's listing.
+				extraOpts := &ListOptions{UnexpectedDepth: UnexpectedDepthSkip, MaxDepth: int(input.MaxListingDepth), Limiter: input.limiter}
+				extraOpts.KeyVersions = opts.KeyVersions
+				extraOpts.Bucket = opts.Bucket
+				iters = append(iters, S3IteratorWithOptions(bucket, input.S3BucketPrefix, *s, extraOpts))
+			}
+		}
+		for i, iter := range iters {
+			listers.Add(1)
+			go func(b *inputBucket, iter <-chan S3ListResult, i int) {
+				for r := range iter {
+					if input.schemas != nil && r.Err == nil && !input.listedBySchema(r.Key, i) {
+						continue
+					}
+					results <- bucketListResult{b, r}
+				}
+				listers.Done()
+			}(b, iter, i)
+		}
+	}
+	go func() {
+		listers.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// Determine whether a key found by listing with the i'th schema should be
+// kept, since it fits no earlier schema. Keys that fit no schema at all are
+// kept by the main schema's listing.
+func (input *S3SplitFileInput) listedBySchema(key s3.Key, i int) bool {
+	j := MatchSchema(input.schemas, input.S3BucketPrefix, key.Key)
+	return j == i || (j < 0 && i == 0)
+}
+
+// Count a queued key against the schema it's read with, with
+// extra_schema_files. Keys that fit no schema aren't counted.
+func (input *S3SplitFileInput) countSchemaMatch(key s3.Key) {
+	if input.schemas == nil {
+		return
+	}
+	if j := MatchSchema(input.schemas, input.S3BucketPrefix, key.Key); j >= 0 {
+		atomic.AddInt64(&input.schemaMatches[j], 1)
+	}
+}
+
+// Count a request that S3 rejected because our clock is off, and the first
+// time, measure how far off it is and say so, since nothing will work until
+// the host's time is fixed. With tolerate_clock_skew, the skew is measured
+// every time and object GETs are corrected for it; returns true if they have
+// been, so the request is worth retrying.
+func (input *S3SplitFileInput) checkClockSkew(runner pipeline.InputRunner, b *inputBucket, err error) (corrected bool) {
+	if !isClockSkewError(err) {
+		return false
+	}
+	atomic.AddInt64(&input.clockSkewErrors, 1)
+	first := atomic.CompareAndSwapInt32(&input.clockSkewReported, 0, 1)
+	if !first && !input.TolerateClockSkew {
+		return false
+	}
+	skew, e := MeasureClockSkew(b.region.S3Endpoint, time.Duration(input.S3ConnectTimeout)*time.Second)
+	if e != nil {
+		runner.LogError(fmt.Errorf("S3 says this host's clock is wrong (%s), and measuring by how much failed: %s", err, e))
+		return false
+	}
+	if input.TolerateClockSkew {
+		atomic.StoreInt64(&input.clockOffset, int64(skew))
+	}
+	if first {
+		direction, by := "behind", skew
+		if skew < 0 {
+			direction, by = "ahead of", -skew
+		}
+		action := "check its time sync"
+		if input.TolerateClockSkew {
+			action = "correcting for it"
+		}
+		runner.LogError(fmt.Errorf("S3 says this host's clock is wrong (%s): it's %s %s S3's, %s", err, by, direction, action))
+	}
+	return input.TolerateClockSkew
+}
+
+// The ReadOptions.Clock for tolerate_clock_skew, or nil to sign with the
+// host's clock.
+func (input *S3SplitFileInput) requestClock() func() time.Time {
+	if !input.TolerateClockSkew {
+		return nil
+	}
+	return func() time.Time {
+		return time.Now().Add(time.Duration(atomic.LoadInt64(&input.clockOffset)))
+	}
+}
+
+// The ListOptions.KeyVersions callback for version_policy, or nil to list
+// objects rather than versions.
+func (input *S3SplitFileInput) keyVersions(runner pipeline.InputRunner, b *inputBucket) func(key string, versions int) {
+	if input.VersionPolicy == "" {
+		return nil
+	}
+	return func(key string, versions int) {
+		atomic.AddInt64(&input.listOlderVersions, int64(versions-1))
+		if input.VersionPolicy == "report" && versions > int(input.VersionReportThreshold) {
+			atomic.AddInt64(&input.versionAnomalies, 1)
+			runner.LogError(fmt.Errorf("Key s3://%s/%s has %d versions, more than the %d expected", b.name, key, versions, input.VersionReportThreshold))
+		}
+	}
+}
+
+// The schema to read the given key with.
+func (input *S3SplitFileInput) keySchema(key string) *Schema {
+	if j := MatchSchema(input.schemas, input.S3BucketPrefix, key); j > 0 {
+		return input.schemas[j]
+	}
+	return &input.schema
+}
+
+// The names of the buckets we've given up on.
+func (input *S3SplitFileInput) failedBuckets() (names []string) {
+	for _, b := range input.buckets {
+		if b.isFailed() {
+			names = append(names, b.name)
+		}
+	}
+	return
+}
+
+// The key under which the given object is checkpointed and audited. With
+// more than one bucket, the bucket name is included to keep keys distinct.
+func (input *S3SplitFileInput) qualifiedKey(b *inputBucket, key s3.Key) s3.Key {
+	if len(input.buckets) > 1 {
+		key.Key = fmt.Sprintf("%s/%s", b.name, key.Key)
+	}
+	return key
+}
+
+// Explain why a listing produced nothing to process, given how many keys it
+// returned after schema filtering.
+func (input *S3SplitFileInput) emptyListingError(listed int64) error {
+	names := make([]string, len(input.buckets))
+	for i, b := range input.buckets {
+		names[i] = b.name
+	}
+	location := fmt.Sprintf("s3://%s/%s", strings.Join(names, ","), input.S3BucketPrefix)
+	if input.ManifestFile != "" {
+		location = fmt.Sprintf("manifest %s", input.ManifestFile)
+		if listed == 0 {
+			return fmt.Errorf("The %s contains no readable keys", location)
+		}
+	}
+	if listed > 0 {
+		return fmt.Errorf("All %d objects listed under %s were skipped by s3_object_match_regex, s3_object_exclude_regex, sampling, or the checkpoint", listed, location)
+	}
+	if atomic.LoadInt64(&input.progress.Seen) > 0 {
+		return fmt.Errorf("Nothing under %s matched the schema in %s", location, input.SchemaFile)
+	}
+	return fmt.Errorf("Prefix %s matched nothing, check s3_bucket and s3_bucket_prefix", location)
+}
+
+// Read and deliver the records in the given object. If `resume` is past the
+// usual starting point, reading begins there instead. Returns the number of
+// records and bytes of records read, and the offset at which a retry should
+// resume (or -1 if a retry must start over).
+// TODO: handle "no such file"
+func (input *S3SplitFileInput) readS3File(runner pipeline.InputRunner, helper pipeline.PluginHelper, sink *recordSink, pending *sync.WaitGroup, b *inputBucket, key s3.Key, resume int64) (records int64, bytesRead int64, position int64, err error) {
+	s3Key := key.Key
+	runner.LogMessage(fmt.Sprintf("Preparing to read: %s", s3Key))
+	if input.client(b) == nil {
+		runner.LogMessage(fmt.Sprintf("Dude, where's my bucket: %s", s3Key))
+		return
+	}
+
+	start := input.SkipHeaderBytes
+	end := int64(-1)
+	if input.SkipFooterBytes > 0 {
+		end = key.Size - input.SkipFooterBytes
+	}
+	if input.checkpoint != nil {
+		offset, changed := input.checkpoint.Offset(input.qualifiedKey(b, key))
+		if changed {
+			runner.LogMessage(fmt.Sprintf("Object changed since it was checkpointed, reading from the start: %s", s3Key))
+		} else if offset > start {
+			runner.LogMessage(fmt.Sprintf("Resuming at offset %d: %s", offset, s3Key))
+			start = offset
+		}
+	}
+	if resume > start {
+		runner.LogMessage(fmt.Sprintf("Retrying at offset %d: %s", resume, s3Key))
+		start = resume
+	}
+	position = start
+	if end >= 0 && end <= start {
+		runner.LogMessage(fmt.Sprintf("Nothing left to read: %s", s3Key))
+		return
+	}
+
+	objectFields := input.objectFields(runner, b, key)
+	var (
+		contentHash    *countingHash
+		readHash       hash.Hash
+		buffered       [][]byte
+		offsets        []int64
+		objectChecksum uint32
+	)
+	objectChecksums := input.checksumTable != nil && input.ChecksumGranularity == "object"
+	buffering := input.dedupCache != nil || objectChecksums
+	if input.dedupCache != nil || input.audit != nil {
+		contentHash = &countingHash{Hash: sha256.New()}
+		readHash = contentHash
+	}
+	// Deliver records right away, unless we're deduplicating or checksumming
+	// whole objects, in which case we must hold on to everything until we
+	// know whether we've seen this content before, or what its checksum is.
+	var repeats RepeatFilter
+	deliver := func(record []byte, offset int64) {
+		if input.DropRepeatedRecords && repeats.Repeated(record) {
+			atomic.AddInt64(&input.processMessageRepeats, 1)
+			return
+		}
+		if missing, ok := RecordMissingField(record, input.RequiredFields); ok {
+			atomic.AddInt64(&input.processMessageInvalid, 1)
+			input.injectInvalidRecord(runner, helper, b, key, record, offset, missing)
+			return
+		}
+		records++
+		if buffering {
+			if objectChecksums {
+				objectChecksum = crc32.Update(objectChecksum, input.checksumTable, record)
+			}
+			buffered = append(buffered, record)
+			offsets = append(offsets, offset)
+		} else if input.deliverRecord(b, sink, pending, record, input.recordFields(objectFields, record, offset)) {
+			input.firstRecordDelivered(runner, b, s3Key, pending)
+		}
+	}
+
+	// With stop_after_first_record, we stop reading as soon as the run's
+	// stopped, rather than finishing the object.
+	var stop <-chan bool
+	if input.StopAfterFirstRecord {
+		stop = input.stop
+	}
+	bucket, _ := input.fetchBucket(b, s3Key)
+	iter := S3FileIteratorWithOptions(bucket, s3Key, &ReadOptions{
+		Start:                start,
+		End:                  end,
+		Hash:                 readHash,
+		ReadAheadBytes:       input.ReadBufferBytes,
+		DecompressAheadBytes: input.DecompressBufferBytes,
+		DecompressTime:       &input.decompressTime,
+		Decompress:           input.Decompress,
+		Delimiter:            input.RecordDelimiter,
+		WholeObjectMaxBytes:  input.wholeObjectMaxBytes(),
+		Timeout:              input.objectTimeout(key),
+		Stop:                 stop,
+		ContentType:          input.contentTypeChecker(runner, s3Key),
+		CompressionPolicy:    input.CompressionPolicy,
+		IfMatch:              input.ifMatch(key),
+		CheckLength:          input.CheckContentLength,
+		Clock:                input.requestClock(),
+		RangeChunkBytes:      input.RangeChunkBytes,
+		RangeConcurrency:     int(input.RangeConcurrency),
+		Size:                 key.Size,
+		Limiter:              input.limiter,
+		Compression:          input.compression.Add,
+		Transform:            input.transform,
+		CompressionMismatch: func(decompressing bool) {
+			atomic.AddInt64(&input.processFileCompressionMismatch, 1)
+			action := "reading as is"
+			if decompressing {
+				action = "decompressing"
+			}
+			runner.LogMessage(fmt.Sprintf("Name and content disagree about compression, %s: %s", action, s3Key))
+		},
+	})
+
+	// The position just past the last record we read, from where the
+	// splitter says it starts, so anything it skipped over is counted. When
+	// hashing, the hash must cover the whole object, so a retry has to start
+	// over, as it does when the records are held until the object has been
+	// read.
+	if contentHash != nil || buffering {
+		defer func() {
+			if err != nil {
+				position = -1
+			}
+		}()
+	}
+	lastCheckpoint := start
+	malformed := 0
+	defer func() {
+		if malformed > 0 {
+			runner.LogMessage(fmt.Sprintf("Skipped %d malformed line(s): %s", malformed, s3Key))
+		}
+	}()
+	for r := range iter {
+		if stopped(stop) {
+			// The rest stops coming once the connection is closed.
+			go func() {
+				for _ = range iter {
+				}
+			}()
+			return records, bytesRead, position, errStopped
+		}
+		record := r.Record
+		err := r.Err
+
+		if err != nil && err != io.EOF {
+			runner.LogError(fmt.Errorf("Error reading %s: %s", s3Key, err))
+			atomic.AddInt64(&input.processMessageFailures, 1)
+			return records, bytesRead, position, err
+		}
+		if len(record) > 0 {
+			if input.StrictFraming && !ValidHekaFrame(record) {
+				atomic.AddInt64(&input.processFrameResyncs, 1)
+				atomic.AddInt64(&input.processMessageFailures, 1)
+				frames, offsets := ResyncHekaFrames(record)
+				runner.LogError(fmt.Errorf("Invalid frame at offset %d in %s, resynchronized and recovered %d record(s)", r.Offset, s3Key, len(frames)))
+				for i, frame := range frames {
+					deliver(frame, int64(r.Offset)+int64(offsets[i]))
+				}
+			} else if input.NDJSONErrorPolicy != "" && BlankLine(record) {
+				// Nothing to deliver, but nothing wrong either.
+			} else if input.NDJSONErrorPolicy != "" && !ValidJSONLine(record) {
+				atomic.AddInt64(&input.processMessageFailures, 1)
+				if input.NDJSONErrorPolicy == "fail" {
+					return records, bytesRead, position, &MalformedLineError{r.Offset}
+				}
+				atomic.AddInt64(&input.processMessageMalformed, 1)
+				malformed++
+			} else {
+				deliver(record, int64(r.Offset))
+			}
+			position = int64(r.Offset) + int64(len(record))
+			bytesRead += int64(len(record))
+			if input.checkpoint != nil && !buffering && position-lastCheckpoint >= input.CheckpointIntervalBytes {
+				// Records queued for the deliverers aren't delivered yet.
+				pending.Wait()
+				if e := input.checkpoint.SetOffset(input.qualifiedKey(b, key), position); e != nil {
+					runner.LogError(fmt.Errorf("Error checkpointing %s: %s", s3Key, e))
+				}
+				lastCheckpoint = position
+			}
+		}
+	}
+
+	sum := ""
+	if contentHash != nil {
+		sum = fmt.Sprintf("%x", contentHash.Sum(nil))
+	}
+	if buffering {
+		seen := false
+		if input.dedupCache != nil {
+			input.dedupLock.Lock()
+			seen = input.dedupCache.Contains(sum)
+			if !seen {
+				input.dedupCache.Add(sum, struct{}{})
+			}
+			input.dedupLock.Unlock()
+		}
+		if seen {
+			atomic.AddInt64(&input.processFileDuplicates, 1)
+			runner.LogMessage(fmt.Sprintf("Skipping duplicate content (sha256 %s): %s", sum, s3Key))
+			records = 0
+		} else {
+			if objectChecksums {
+				objectFields = withField(objectFields, input.checksumField, fmt.Sprintf("%08x", objectChecksum))
+			}
+			for i, record := range buffered {
+				if stopped(stop) {
+					return records, bytesRead, position, errStopped
+				}
+				if input.deliverRecord(b, sink, pending, record, input.recordFields(objectFields, record, offsets[i])) {
+					input.firstRecordDelivered(runner, b, s3Key, pending)
+				}
+			}
+		}
+	}
+	if input.audit != nil {
+		if e := input.audit.Add(input.qualifiedKey(b, key), contentHash.n, sum, records); e != nil {
+			runner.LogError(fmt.Errorf("Error writing audit manifest entry for %s: %s", s3Key, e))
+		}
+	}
+
+	return
+}
+
+// Hand the given key to the fetchers. With a list_full_policy of "drop",
+// returns false if they're too far behind to take it.
+func (input *S3SplitFileInput) sendKey(bk bucketKey) bool {
+	c := input.keyChan(bk)
+	if input.ListFullPolicy != "drop" {
+		c <- bk
+		return true
+	}
+	select {
+	case c <- bk:
+		return true
+	default:
+		atomic.AddInt64(&input.listDropped, 1)
+		return false
+	}
+}
+
+// The lane the fetchers take the given key from.
+func (input *S3SplitFileInput) keyChan(bk bucketKey) chan bucketKey {
+	if input.affinityChans != nil {
+		partition := bk.partition(bk.key.Key)
+		return input.affinityChans[affinityWorker(partition, len(input.affinityChans))]
+	}
+	if input.smallChan != nil && bk.key.Size < input.SmallObjectBytes {
+		return input.smallChan
+	}
+	return input.listChan
+}
+
+// Hand the given key back to the fetchers after consistency_retry_delay,
+// unless the listing has ended by then.
+func (input *S3SplitFileInput) requeueKey(bk bucketKey) {
+	time.AfterFunc(time.Duration(input.ConsistencyRetryDelay)*time.Second, func() {
+		input.requeueLock.RLock()
+		defer input.requeueLock.RUnlock()
+		if input.listClosed {
+			return
+		}
+		select {
+		case <-input.stop:
+		case input.keyChan(bk) <- bk:
+		}
+	})
+}
+
+// Put the given keys in a random order, in place.
+func shuffleKeys(keys []bucketKey, r *rand.Rand) {
+	for i := len(keys) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+}
+
+// The ETag an object must still have when we fetch it, if we're limited to
+// allowed_etags.
+func (input *S3SplitFileInput) ifMatch(key s3.Key) string {
+	if input.allowedETags == nil {
+		return ""
+	}
+	return key.ETag
+}
+
+// The most an object may hold to be read whole, or 0 if we're splitting
+// objects into records.
+func (input *S3SplitFileInput) wholeObjectMaxBytes() int64 {
+	if !input.WholeObject {
+		return 0
+	}
+	return input.WholeObjectMaxBytes
+}
+
+// Check objects' Content-Types against expected_content_type, if it's set.
+func (input *S3SplitFileInput) contentTypeChecker(runner pipeline.InputRunner, s3Key string) func(string) bool {
+	if input.ExpectedContentType == "" {
+		return nil
+	}
+	return func(contentType string) bool {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err == nil && strings.EqualFold(mediaType, input.ExpectedContentType) {
+			return true
+		}
+		atomic.AddInt64(&input.processFileBadContentType, 1)
+		if input.ContentTypePolicy == "warn" {
+			runner.LogMessage(fmt.Sprintf("Warning: unexpected Content-Type '%s', reading anyway: %s", contentType, s3Key))
+			return true
+		}
+		return false
+	}
+}
+
+// The fields to add to every record from the given object, if any.
+func (input *S3SplitFileInput) objectFields(runner pipeline.InputRunner, b *inputBucket, key s3.Key) (fields []recordField) {
+	if input.Lineage {
+		fields = append(fields,
+			recordField{"SourceBucket", b.name, false},
+			recordField{"SourceKey", key.Key, false},
+			recordField{"SourceETag", strings.Trim(key.ETag, "\""), false},
+			recordField{"RunId", input.RunId, false})
+		if _, region := input.fetchBucket(b, key.Key); region.Name != "" {
+			fields = append(fields, recordField{"SourceRegion", region.Name, false})
+		}
+	}
+	if !input.PartitionFields && input.typeTemplate == nil && input.loggerTemplate == nil {
+		return
+	}
+	schema := input.keySchema(key.Key)
+	values, err := schema.ParseKey(input.S3BucketPrefix, key.Key)
+	if err != nil {
+		runner.LogMessage(fmt.Sprintf("Not using partition values: %s", err))
+		values = nil
+	}
+	if input.PartitionFields {
+		for i, v := range values {
+			fields = append(fields, recordField{schema.Fields[i], v, false})
+		}
+	}
+	if input.typeTemplate == nil && input.loggerTemplate == nil {
+		return
+	}
+	vars := map[string]string{}
+	for _, s := range append([]*Schema{&input.schema}, input.schemas...) {
+		for _, field := range s.Fields {
+			vars[field] = ""
+		}
+	}
+	for i, field := range schema.Fields {
+		if values != nil {
+			vars[field] = values[i]
+		}
+	}
+	vars["Bucket"] = b.name
+	vars["Key"] = key.Key
+	vars["Name"] = key.Key[strings.LastIndex(key.Key, "/")+1:]
+	for _, t := range []struct {
+		name string
+		tmpl *KeyTemplate
+	}{{"Type", input.typeTemplate}, {"Logger", input.loggerTemplate}} {
+		if t.tmpl == nil {
+			continue
+		}
+		if value, err := t.tmpl.Execute(vars); err != nil {
+			runner.LogError(fmt.Errorf("Not setting the message %s for %s: %s", t.name, key.Key, err))
+		} else {
+			fields = append(fields, recordField{t.name, value, true})
+		}
+	}
+	return
+}
+
+// The fields to add to the given record, found at `offset` in its object:
+// those for its object, its checksum if we're checksumming records, and its
+// offset with lineage.
+func (input *S3SplitFileInput) recordFields(objectFields []recordField, record []byte, offset int64) []recordField {
+	fields := objectFields
+	if input.checksumTable != nil && input.ChecksumGranularity == "record" {
+		fields = withField(fields, input.checksumField, fmt.Sprintf("%08x", crc32.Checksum(record, input.checksumTable)))
+	}
+	if input.Lineage {
+		fields = withField(fields, "SourceOffset", offset)
+	}
+	return fields
+}
+
+// Add a field to a copy of the given ones, leaving them untouched since
+// they may be shared between records.
+func withField(fields []recordField, name string, value interface{}) []recordField {
+	return append(append(make([]recordField, 0, len(fields)+1), fields...), recordField{name, value, false})
+}
+
+// Deliver the given record with the given fields, or queue it for the
+// deliverers if there are any, in which case `pending` is done once the
+// record has been delivered. Returns false if the record was held back or
+// left out instead.
+func (input *S3SplitFileInput) deliverRecord(b *inputBucket, sink *recordSink, pending *sync.WaitGroup, record []byte, fields []recordField) bool {
+	atomic.AddInt64(&input.processMessageCount, 1)
+	atomic.AddInt64(&input.processMessageBytes, int64(len(record)))
+	atomic.AddInt64(&b.processMessageCount, 1)
+	atomic.AddInt64(&b.processMessageBytes, int64(len(record)))
+	input.touch()
+	if input.ValidateOnly {
+		// Make sure the record would decode, but don't deliver it.
+		if input.RecordDelimiter == "" && !input.WholeObject && !ValidHekaFrame(record) {
+			atomic.AddInt64(&input.processMessageFailures, 1)
+		}
+		return false
+	}
+	if input.RecordTrimBytes > 0 || input.recordTrim != nil {
+		var ok bool
+		if record, ok = TrimRecord(record, input.RecordTrimBytes, input.recordTrim); !ok {
+			atomic.AddInt64(&input.processMessageTrimMisses, 1)
+			return false
+		}
+	}
+	if input.replay != nil {
+		var ts int64
+		if input.ReplaySpeed > 0 {
+			ts, _ = RecordTimestamp(record, input.replayTime, input.ReplayTimestampLayout)
+		}
+		if d := input.replay.Delay(time.Now(), ts); d > 0 {
+			// If we're stopping, deliver what's left without waiting.
+			input.sleep(d)
+		}
+	}
+	if input.StopAfterFirstRecord && !atomic.CompareAndSwapInt32(&input.firstRecord, 0, 1) {
+		// Another record got there first.
+		return false
+	}
+	if sink.group != nil {
+		sink.group.add(record, fields, input.AtomicGroupMaxBytes)
+		return false
+	}
+	if input.deliverChan != nil {
+		pending.Add(1)
+		input.deliverChan <- queuedRecord{record, fields, pending}
+		return true
+	}
+	sink.deliver(record, fields)
+	return true
+}
+
+// With stop_after_first_record, stop the run once the first record has been
+// delivered (waiting for it if it's queued), and report where it came from.
+func (input *S3SplitFileInput) firstRecordDelivered(runner pipeline.InputRunner, b *inputBucket, key string, pending *sync.WaitGroup) {
+	if !input.StopAfterFirstRecord {
+		// Otherwise deliverRecord only lets the first one through.
+		return
+	}
+	pending.Wait()
+	input.firstRecordKey = fmt.Sprintf("s3://%s/%s", b.name, key)
+	runner.LogMessage(fmt.Sprintf("Delivered the first record, from %s, stopping", input.firstRecordKey))
+	input.Stop()
+}
+
+// Deliver queued records until there are no more.
+func (input *S3SplitFileInput) deliverer(runner pipeline.InputRunner, wg *sync.WaitGroup, workerId uint32) {
+	sink := newRecordSink(runner, fmt.Sprintf("S3Deliverer%d", workerId))
+	defer sink.Done()
+
+	for q := range input.deliverChan {
+		sink.deliver(q.record, q.fields)
+		q.pending.Done()
+	}
+	wg.Done()
+}
+
+// How often the autoscaler reconsiders the number of active fetchers.
+const autoscaleInterval = 10 * time.Second
+
+// Periodically adjust the number of active fetchers: back off sharply if S3
+// has throttled us since the last check, add a fetcher if keys are piling up
+// in the list channel, and drop one if the fetchers are starved for keys.
+func (input *S3SplitFileInput) autoscaler(runner pipeline.InputRunner) {
+	ticker := time.NewTicker(autoscaleInterval)
+	defer ticker.Stop()
+
+	lastThrottles := atomic.LoadInt64(&input.processThrottles)
+	for {
+		select {
+		case <-input.stop:
+			return
+		case <-input.listDone:
+			return
+		case <-ticker.C:
+		}
+		if atomic.LoadInt32(&input.rampingUp) != 0 {
+			continue
+		}
+
+		throttles := atomic.LoadInt64(&input.processThrottles)
+		active := int64(atomic.LoadUint32(&input.activeWorkers))
+		target := active
+		queued := int64(len(input.listChan) + len(input.smallChan))
+		if throttles > lastThrottles {
+			target = active - active/4 - 1
+		} else if queued > int64(cap(input.listChan)/2) {
+			target = active + 1
+		} else if queued < active/2 {
+			target = active - 1
+		}
+		lastThrottles = throttles
+
+		if target < int64(input.S3WorkerCountMin) {
+			target = int64(input.S3WorkerCountMin)
+		} else if target > int64(input.S3WorkerCountMax) {
+			target = int64(input.S3WorkerCountMax)
+		}
+		if target != active {
+			runner.LogMessage(fmt.Sprintf("Scaling fetchers from %d to %d (%d keys queued)", active, target, queued))
+			atomic.StoreUint32(&input.activeWorkers, uint32(target))
+		}
+	}
+}
+
+// Add fetchers evenly over worker_rampup_duration, from `start` to `target`.
+// Once listing is finished and nothing is left waiting for a fetcher, there's
+// no more load to ramp up to, so the rest are let go at once.
+func (input *S3SplitFileInput) rampUp(runner pipeline.InputRunner, start, target uint32) {
+	defer atomic.StoreInt32(&input.rampingUp, 0)
+	duration := time.Duration(input.WorkerRampupDuration) * time.Second
+	runner.LogMessage(fmt.Sprintf("Ramping up from %d to %d fetchers over %s", start, target, duration))
+	rampStart := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	active := start
+	for active < target {
+		select {
+		case <-input.stop:
+			return
+		case <-ticker.C:
+		}
+		n := RampWorkers(start, target, time.Since(rampStart), duration)
+		select {
+		case <-input.listDone:
+			if len(input.listChan)+len(input.smallChan) == 0 {
+				n = target
+			}
+		default:
+		}
+		if n != active {
+			active = n
+			atomic.StoreUint32(&input.activeWorkers, active)
+			runner.LogMessage(fmt.Sprintf("Ramping up: %d of %d fetchers active", active, target))
+		}
+	}
+}
+
+// Block until the given fetcher is one of the active ones. Returns false if
+// the fetcher should exit instead, because listing is finished (the active
+// fetchers will handle whatever is left) or we're stopping. While ramping up,
+// fetchers wait to become active even once listing is finished, so a short
+// listing of big objects still gets them all.
+func (input *S3SplitFileInput) waitUntilActive(workerId uint32) bool {
+	for workerId >= atomic.LoadUint32(&input.activeWorkers) {
+		listDone := input.listDone
+		if atomic.LoadInt32(&input.rampingUp) != 0 {
+			listDone = nil
+		}
+		select {
+		case <-input.stop:
+			return false
+		case <-listDone:
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+	return true
+}
+
+func (input *S3SplitFileInput) fetcher(runner pipeline.InputRunner, helper pipeline.PluginHelper, wg *sync.WaitGroup, workerId uint32) {
+	var (
+		item      bucketKey
+		startTime time.Time
+		duration  float64
+	)
+
+	sink := newRecordSink(runner, fmt.Sprintf("S3Reader%d", workerId))
+	defer sink.Done()
+
+	ok := true
+	for ok {
+		if !input.waitUntilActive(workerId) {
+			break
+		}
+		if item, ok = input.nextKey(workerId); !ok {
+			// The queue is closed or we're stopping, exit cleanly.
+			break
+		}
+		if input.maxObjectsReached() {
+			// We've hit the limit and are stopping, leave the rest.
+			continue
+		}
+		var failed error
+		if item.isFailed() {
+			failed = fmt.Errorf("bucket %s has failed", item.name)
+		} else if partition := item.partition(item.key.Key); input.partitionFailures.IsFailed(partition) {
+			failed = fmt.Errorf("partition %s has failed", partition)
+		}
+		if failed != nil {
+			runner.LogMessage(fmt.Sprintf("Skipping (%s): %s", failed, item.key.Key))
+			if input.groups != nil {
+				name := input.objectGroup(item.inputBucket, item.key)
+				if g := input.groups.Finish(name, groupMember{b: item.inputBucket, key: item.key}, failed); g != nil {
+					input.commitGroup(runner, helper, sink, g)
+				}
+			}
+			continue
+		}
+
+		if input.ListOnlyDeliver {
+			input.injectKeyEvent(runner, helper, item.inputBucket, item.key)
+			continue
+		}
+
+		var group string
+		if input.groups != nil {
+			group = input.objectGroup(item.inputBucket, item.key)
+			sink.group = input.groups.Get(group)
+		}
+		startTime = time.Now().UTC()
+		result, err := input.processObject(runner, helper, sink, item.inputBucket, item.key)
+		elapsed := time.Now().UTC().Sub(startTime)
+		grouped := sink.group != nil
+		if grouped {
+			sink.group = nil
+			m := groupMember{b: item.inputBucket, key: item.key, result: result}
+			groupErr := err
+			if input.isSkipped(err) {
+				// Skipping an object on purpose doesn't spoil its group.
+				m.skipped, groupErr = true, nil
+			}
+			if g := input.groups.Finish(group, m, groupErr); g != nil {
+				input.commitGroup(runner, helper, sink, g)
+			}
+		}
+		atomic.AddInt64(&input.workerStats[workerId].bytes, result.Bytes)
+		atomic.AddInt64(&input.workerStats[workerId].busyTime, int64(elapsed))
+		if err != nil {
+			continue
+		}
+		duration = elapsed.Seconds()
+		runner.LogMessage(fmt.Sprintf("Successfully fetched %s in %.2fs ", item.key.Key, duration))
+		if !grouped {
+			// A group's objects count once it's delivered.
+			input.countSuccess(runner)
+		}
+	}
+
+	wg.Done()
+}
+
+// Count an object whose records have been delivered, stopping once that's
+// max_objects of them.
+func (input *S3SplitFileInput) countSuccess(runner pipeline.InputRunner) {
+	successes := atomic.AddInt64(&input.processFileSuccesses, 1)
+	if input.MaxObjects > 0 && successes == input.MaxObjects {
+		runner.LogMessage(fmt.Sprintf("Processed %d objects, stopping", successes))
+		input.Stop()
+	}
+}
+
+// Determine whether the given error means an object was skipped on purpose,
+// with content_type_policy = "skip".
+func (input *S3SplitFileInput) isSkipped(err error) bool {
+	_, ok := err.(*ContentTypeError)
+	return ok && input.ContentTypePolicy == "skip"
+}
+
+// Take the next object for the given fetcher, from the small object lane if
+// there's anything in it. Returns false once both lanes are closed, or if
+// we're stopping.
+func (input *S3SplitFileInput) nextKey(workerId uint32) (item bucketKey, ok bool) {
+	small, large := input.smallChan, input.fetcherChan(workerId)
+	for small != nil || large != nil {
+		select {
+		case item, ok = <-small:
+			if !ok {
+				small = nil
+				continue
+			}
+			return
+		default:
+		}
+		select {
+		case item, ok = <-small:
+			if !ok {
+				small = nil
+				continue
+			}
+			return
+		case item, ok = <-large:
+			if !ok {
+				large = nil
+				continue
+			}
+			return
+		case <-input.stop:
+			input.drainQueue(workerId)
+			return item, false
+		}
+	}
+	return item, false
+}
+
+// The queue the given fetcher takes objects from, other than small ones.
+func (input *S3SplitFileInput) fetcherChan(workerId uint32) chan bucketKey {
+	if input.affinityChans != nil {
+		return input.affinityChans[workerId]
+	}
+	return input.listChan
+}
+
+// Discard everything queued for the given fetcher, without processing it,
+// until the lister closes the queue. The lister can still add one more object
+// after we stop, and this ensures there is room so it won't block.
+func (input *S3SplitFileInput) drainQueue(workerId uint32) {
+	small, large := input.smallChan, input.fetcherChan(workerId)
+	for small != nil || large != nil {
+		select {
+		case _, ok := <-small:
+			if !ok {
+				small = nil
+			}
+		case _, ok := <-large:
+			if !ok {
+				large = nil
+			}
+		}
+	}
+}
+
+// Log the overall throughput of the run, and that of each fetcher while it
+// was busy, for comparing configurations.
+func (input *S3SplitFileInput) logThroughput(runner pipeline.InputRunner, elapsed time.Duration) {
+	total := atomic.LoadInt64(&input.processMessageBytes)
+	runner.LogMessage(fmt.Sprintf("Read %d bytes in %.2fs: %.2f MB/s", total, elapsed.Seconds(), throughputMBps(total, elapsed)))
+	for i := range input.workerStats {
+		ws := &input.workerStats[i]
+		bytes, busy := atomic.LoadInt64(&ws.bytes), time.Duration(atomic.LoadInt64(&ws.busyTime))
+		if busy > 0 {
+			runner.LogMessage(fmt.Sprintf("Fetcher %d read %d bytes in %.2fs busy: %.2f MB/s", i, bytes, busy.Seconds(), throughputMBps(bytes, busy)))
+		}
+	}
+}
+
+// Wait for the given time, unless we're stopped first. Returns false if we
+// were stopped.
+// Returned when reading an object is given up on because the run's stopping.
+var errStopped = errors.New("stopped")
+
+// Determine whether the given stop channel has been closed. A nil channel
+// never is.
+func stopped(stop <-chan bool) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (input *S3SplitFileInput) sleep(d time.Duration) bool {
+	select {
+	case <-input.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Determine whether we've processed as many objects as max_objects allows.
+func (input *S3SplitFileInput) maxObjectsReached() bool {
+	return input.MaxObjects > 0 && atomic.LoadInt64(&input.processFileSuccesses) >= input.MaxObjects
+}
+
+// What happened when processing an object.
+type ProcessResult struct {
+	// Records (and bytes of records) read from the object, over all attempts.
+	Records int64
+	Bytes   int64
+	// Bytes left over at the end of the object that didn't form a record.
+	DiscardedBytes int64
+	Attempts       uint32
+}
+
+// Read, split, and deliver one object, retrying up to s3_retries times.
+func (input *S3SplitFileInput) processObject(runner pipeline.InputRunner, helper pipeline.PluginHelper, sink *recordSink, b *inputBucket, key s3.Key) (result ProcessResult, err error) {
+	var (
+		records, bytesRead int64
+		position           int64 = -1
+		pending            sync.WaitGroup
+	)
+	input.sizes.Add(key.Size)
+	if parts, ok := MultipartParts(key); ok {
+		// The ETag of a multipart object isn't its MD5, so it can't be used to
+		// verify what we read.
+		atomic.AddInt64(&input.processFileMultipart, 1)
+		runner.LogMessage(fmt.Sprintf("Multipart object (%d parts, %d bytes), ETag is not an MD5: %s", parts, key.Size, key.Key))
+	}
+	for result.Attempts = 1; ; result.Attempts++ {
+		records, bytesRead, position, err = input.readS3File(runner, helper, sink, &pending, b, key, position)
+		result.Records += records
+		result.Bytes += bytesRead
+		if err == nil || err == io.EOF {
+			err = nil
+			break
+		}
+		if _, ok := err.(*ContentTypeError); ok {
+			// Trying again won't change what the object is.
+			break
+		}
+		if _, ok := err.(*MalformedLineError); ok {
+			break
+		}
+		if input.AuthErrorThreshold > 0 && isAuthError(err) {
+			break
+		}
+		if isAccelerateError(err) {
+			break
+		}
+		if isClockSkewError(err) && !input.checkClockSkew(runner, b, err) {
+			// Every retry would be signed with the same clock.
+			break
+		}
+		if isPreconditionFailed(err) {
+			// The object has changed since it was listed.
+			break
+		}
+		if err == errStopped {
+			break
+		}
+		if input.consistency != nil && isNotFound(err) && result.Bytes == 0 {
+			// Probably not gettable yet, rather than gone.
+			break
+		}
+		if _, ok := err.(*TruncatedError); ok {
+			atomic.AddInt64(&input.processFileTruncated, 1)
+		}
+		throttled := isThrottleError(err)
+		if throttled {
+			atomic.AddInt64(&input.processThrottles, 1)
+		}
+		// Whatever is left in the splitter will be read again.
+		sink.splitter.GetRemainingData()
+		if result.Attempts >= input.S3Retries {
+			break
+		}
+		if !throttled {
+			runner.LogMessage(fmt.Sprintf("Error #%d reading %s, retrying: %s", result.Attempts, key.Key, err))
+			continue
+		}
+		delay := throttleBackoff(result.Attempts,
+			time.Duration(input.ThrottleBackoffMs)*time.Millisecond,
+			time.Duration(input.ThrottleBackoffMaxMs)*time.Millisecond)
+		runner.LogMessage(fmt.Sprintf("Throttled (#%d) reading %s, retrying in %s", result.Attempts, key.Key, delay))
+		if !input.sleep(delay) {
+			// Give up on this object rather than holding up the shutdown.
+			break
+		}
+	}
+	// The object isn't finished until all of its records are delivered.
+	pending.Wait()
+	if err == errStopped {
+		runner.LogMessage(fmt.Sprintf("Stopped part way through: %s", key.Key))
+		return
+	}
+	if input.consistency != nil {
+		name := input.qualifiedKey(b, key).Key
+		if err == nil || !isNotFound(err) || result.Bytes > 0 {
+			input.consistency.Forget(name)
+		} else if retry, ok := input.consistency.Retry(name, input.ConsistencyRetryAttempts); ok {
+			atomic.AddInt64(&input.consistencyRetries, 1)
+			runner.LogMessage(fmt.Sprintf("Not found yet (#%d), trying again in %ds: %s", retry, input.ConsistencyRetryDelay, key.Key))
+			input.requeueKey(bucketKey{b, key})
+			return
+		}
+	}
+	if input.regionFetches != nil {
+		_, region := input.fetchBucket(b, key.Key)
+		atomic.AddInt64(input.regionFetches[region.Name], 1)
+	}
+	if input.partitions != nil {
+		if values, e := input.keySchema(key.Key).ParseKey(input.S3BucketPrefix, key.Key); e == nil {
+			input.partitions.Add(values, result.Records)
+		}
+	}
+	if input.AuthErrorThreshold > 0 {
+		if !isAuthError(err) {
+			atomic.StoreInt64(&input.authErrors, 0)
+		} else if atomic.AddInt64(&input.authErrors, 1) == input.AuthErrorThreshold {
+			input.authErr = fmt.Errorf("Access denied for %d objects in a row, stopping (last was %s): %s", input.AuthErrorThreshold, key.Key, err)
+			runner.LogError(input.authErr)
+			input.Stop()
+		}
+	}
+	if input.isSkipped(err) {
+		runner.LogMessage(fmt.Sprintf("Skipping (%s): %s", err, key.Key))
+		return
+	}
+	atomic.AddInt64(&input.processFileCount, 1)
+	atomic.AddInt64(&b.processFileCount, 1)
+	if err != nil {
+		runner.LogError(fmt.Errorf("Error reading %s: %s", key.Key, err))
+		atomic.AddInt64(&input.processFileFailures, 1)
+		failures := atomic.AddInt64(&b.processFileFailures, 1)
+		if input.BucketMaxFileFailures > 0 && failures == input.BucketMaxFileFailures {
+			atomic.StoreInt32(&b.failed, 1)
+			runner.LogError(fmt.Errorf("%d objects in bucket %s have failed, skipping the rest of it", failures, b.name))
+		}
+		partition := b.partition(key.Key)
+		if failures, failed := input.partitionFailures.Add(partition); failed {
+			runner.LogError(fmt.Errorf("%d objects in partition %s have failed, skipping the rest of it", failures, partition))
+		}
+		if input.ErrorEvents {
+			input.injectErrorEvent(runner, helper, b, key, err, result.Attempts, result.Bytes)
+		}
+		// Give it another go on the next listing pass.
+		input.forgetTailKey(input.qualifiedKey(b, key).Key)
+		return
+	}
+	leftovers := sink.splitter.GetRemainingData()
+	lenLeftovers := len(leftovers)
+	if lenLeftovers > 0 {
+		result.DiscardedBytes = int64(lenLeftovers)
+		atomic.AddInt64(&input.processFileDiscardedBytes, int64(lenLeftovers))
+		runner.LogError(fmt.Errorf("Trailing data, possible corruption: %d bytes left in stream at EOF: %s", lenLeftovers, key.Key))
+	}
+	if sink.group == nil {
+		input.objectDone(runner, helper, b, key, result)
+	}
+	return
+}
+
+// In tail mode, forget that the named object was queued, so that the next
+// listing pass picks it up again.
+func (input *S3SplitFileInput) forgetTailKey(name string) {
+	if !input.Tail {
+		return
+	}
+	input.tailLock.Lock()
+	defer input.tailLock.Unlock()
+	delete(input.tailKeys, name)
+}
+
+// Record that an object has been read and its records delivered.
+func (input *S3SplitFileInput) objectDone(runner pipeline.InputRunner, helper pipeline.PluginHelper, b *inputBucket, key s3.Key, result ProcessResult) {
+	if input.checkpoint != nil {
+		if e := input.checkpoint.SetDone(input.qualifiedKey(b, key)); e != nil {
+			runner.LogError(fmt.Errorf("Error checkpointing %s: %s", key.Key, e))
+		}
+	}
+	if input.since != nil {
+		input.since.Processed(key)
+	}
+	if input.snapshot != nil {
+		input.snapshot.Done(input.qualifiedKey(b, key))
+	}
+	if len(input.fileCompleteActions) > 0 {
+		input.fileComplete(runner, helper, b, key, result)
+	}
+	if input.catalog != nil {
+		if e := input.catalog.Add(input.catalogEntry(b, key, result)); e != nil {
+			runner.LogError(fmt.Errorf("Error adding %s to the catalog: %s", key.Key, e))
+		}
+	}
+}
+
+func (input *S3SplitFileInput) catalogEntry(b *inputBucket, key s3.Key, result ProcessResult) CatalogEntry {
+	entry := CatalogEntry{Bucket: b.name, Key: key.Key, Size: key.Size, Records: result.Records}
+	schema := input.keySchema(key.Key)
+	if values, err := schema.ParseKey(input.S3BucketPrefix, key.Key); err == nil {
+		entry.Partition = map[string]string{}
+		for i, v := range values {
+			entry.Partition[schema.Fields[i]] = v
+		}
+	}
+	return entry
+}
+
+// How long an attempt to read the given object may take, or 0 for no limit.
+func (input *S3SplitFileInput) objectTimeout(key s3.Key) time.Duration {
+	if input.AdaptiveTimeout {
+		return AdaptiveTimeout(time.Duration(input.AdaptiveTimeoutBase)*time.Second, key.Size, input.AdaptiveTimeoutThroughput)
+	}
+	return time.Duration(input.PerObjectTimeout) * time.Second
+}
+
+// Process the single named object from s3_bucket, just as if it had been
+// listed, without starting the lister or fetchers. The input must have been
+// initialized first. This is handy in tests, and for tools that reprocess
+// individual objects.
+func (input *S3SplitFileInput) ProcessKey(runner pipeline.InputRunner, helper pipeline.PluginHelper, name string) (result ProcessResult, err error) {
+	b := input.buckets[0]
+	bucket := input.client(b)
+	if bucket == nil {
+		return result, fmt.Errorf("No bucket to read %s from", name)
+	}
+	key, err := headS3Key(bucket, name)
+	if err != nil {
+		return
+	}
+
+	sink := newRecordSink(runner, "S3ProcessKey")
+	defer sink.Done()
+	return input.processObject(runner, helper, sink, b, key)
+}
+
+// Inject a message describing an object we gave up on. This goes straight to
+// the router rather than through the deliverer, since it's already a message
+// and must not be passed to the decoder.
+func (input *S3SplitFileInput) injectErrorEvent(runner pipeline.InputRunner, helper pipeline.PluginHelper, b *inputBucket, key s3.Key, err error, attempts uint32, bytesRead int64) {
+	pack, e := helper.PipelinePack(0)
+	if e != nil {
+		runner.LogError(fmt.Errorf("Unable to get a pack for the error event for %s: %s", key.Key, e))
+		return
+	}
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType(input.ErrorEventType)
+	msg.SetLogger(runner.Name())
+	msg.SetSeverity(3)
+	msg.SetPayload(err.Error())
+	message.NewStringField(msg, "Bucket", b.name)
+	message.NewStringField(msg, "Key", key.Key)
+	message.NewStringField(msg, "ErrorType", errorType(err))
+	message.NewInt64Field(msg, "Attempts", int64(attempts), "count")
+	message.NewInt64Field(msg, "BytesRead", bytesRead, "B")
+	message.NewInt64Field(msg, "Size", key.Size, "B")
+	if e = runner.Inject(pack); e != nil {
+		runner.LogError(fmt.Errorf("Unable to inject the error event for %s: %s", key.Key, e))
+	}
+}
+
+// Inject a record that lacks one of the required_fields, for a dead-letter
+// output to keep.
+func (input *S3SplitFileInput) injectInvalidRecord(runner pipeline.InputRunner, helper pipeline.PluginHelper, b *inputBucket, key s3.Key, record []byte, offset int64, missing string) {
+	pack, e := helper.PipelinePack(0)
+	if e != nil {
+		runner.LogError(fmt.Errorf("Unable to get a pack for an invalid record from %s: %s", key.Key, e))
+		return
+	}
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType(input.RequiredFieldsEventType)
+	msg.SetLogger(runner.Name())
+	msg.SetSeverity(4)
+	msg.SetPayload(fmt.Sprintf("Record at offset %d is missing required field %s", offset, missing))
+	message.NewStringField(msg, "Bucket", b.name)
+	message.NewStringField(msg, "Key", key.Key)
+	message.NewInt64Field(msg, "Offset", offset, "B")
+	message.NewStringField(msg, "MissingField", missing)
+	if f, err := message.NewField("Record", record, ""); err == nil {
+		msg.AddField(f)
+	}
+	if e = runner.Inject(pack); e != nil {
+		runner.LogError(fmt.Errorf("Unable to inject an invalid record from %s: %s", key.Key, e))
+	}
+}
+
+// Inject a message describing an object to be fetched elsewhere, with
+// list_only_deliver.
+func (input *S3SplitFileInput) injectKeyEvent(runner pipeline.InputRunner, helper pipeline.PluginHelper, b *inputBucket, key s3.Key) {
+	pack, e := helper.PipelinePack(0)
+	if e != nil {
+		runner.LogError(fmt.Errorf("Unable to get a pack for %s: %s", key.Key, e))
+		return
+	}
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType(input.ListOnlyEventType)
+	msg.SetLogger(runner.Name())
+	msg.SetSeverity(6)
+	msg.SetPayload(fmt.Sprintf("s3://%s/%s", b.name, key.Key))
+	message.NewStringField(msg, "Bucket", b.name)
+	message.NewStringField(msg, "Key", key.Key)
+	message.NewInt64Field(msg, "Size", key.Size, "B")
+	message.NewStringField(msg, "ETag", normalizeETag(key.ETag))
+	message.NewStringField(msg, "LastModified", key.LastModified)
+	for _, rf := range input.objectFields(runner, b, key) {
+		if rf.header {
+			continue
+		}
+		if f, err := message.NewField(rf.name, rf.value, ""); err == nil {
+			msg.AddField(f)
+		}
+	}
+	if e = runner.Inject(pack); e != nil {
+		runner.LogError(fmt.Errorf("Unable to inject %s: %s", key.Key, e))
+		return
+	}
+	atomic.AddInt64(&input.listDelivered, 1)
+	if input.checkpoint != nil {
+		if e = input.checkpoint.SetDone(input.qualifiedKey(b, key)); e != nil {
+			runner.LogError(fmt.Errorf("Error checkpointing %s: %s", key.Key, e))
+		}
+	}
+}
+
+// Report the record count for each partition.
+func (input *S3SplitFileInput) injectPartitionCounts(runner pipeline.InputRunner, helper pipeline.PluginHelper) {
+	counts := input.partitions.Counts()
+	payload, e := json.Marshal(counts)
+	if e != nil {
+		runner.LogError(fmt.Errorf("Unable to encode the partition counts: %s", e))
+		return
+	}
+	pack, e := helper.PipelinePack(0)
+	if e != nil {
+		runner.LogError(fmt.Errorf("Unable to get a pack for the partition counts: %s", e))
+		return
+	}
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType(input.PartitionCountsEventType)
+	msg.SetLogger(runner.Name())
+	msg.SetSeverity(6)
+	msg.SetPayload(string(payload))
+	message.NewInt64Field(msg, "Partitions", int64(len(counts)), "count")
+	if input.PartitionCoverage {
+		missing := MissingPartitions(input.expectedPartitions, counts)
+		if len(missing) > 0 {
+			runner.LogError(fmt.Errorf("%s", describeMissingPartitions(missing, len(input.expectedPartitions))))
+		}
+		message.NewInt64Field(msg, "MissingPartitions", int64(len(missing)), "count")
+	}
+	if e = runner.Inject(pack); e != nil {
+		runner.LogError(fmt.Errorf("Unable to inject the partition counts: %s", e))
+	}
+}
+
+func (input *S3SplitFileInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessFileCount", atomic.LoadInt64(&input.processFileCount), "count")
+	message.NewInt64Field(msg, "ProcessFileFailures", atomic.LoadInt64(&input.processFileFailures), "count")
+	message.NewInt64Field(msg, "ProcessFileSuccesses", atomic.LoadInt64(&input.processFileSuccesses), "count")
+	message.NewInt64Field(msg, "ProcessFileDuplicates", atomic.LoadInt64(&input.processFileDuplicates), "count")
+	message.NewInt64Field(msg, "ProcessFileDiscardedBytes", atomic.LoadInt64(&input.processFileDiscardedBytes), "B")
+	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&input.processMessageCount), "count")
+	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&input.processMessageFailures), "count")
+	message.NewInt64Field(msg, "ProcessMessageBytes", atomic.LoadInt64(&input.processMessageBytes), "B")
+	message.NewInt64Field(msg, "ProcessMessageTrimMisses", atomic.LoadInt64(&input.processMessageTrimMisses), "count")
+	message.NewInt64Field(msg, "ProcessMessageInvalid", atomic.LoadInt64(&input.processMessageInvalid), "count")
+	message.NewInt64Field(msg, "ProcessFrameResyncs", atomic.LoadInt64(&input.processFrameResyncs), "count")
+	message.NewInt64Field(msg, "ProcessMessageMalformed", atomic.LoadInt64(&input.processMessageMalformed), "count")
+	message.NewInt64Field(msg, "ProcessMessageRepeats", atomic.LoadInt64(&input.processMessageRepeats), "count")
+	message.NewInt64Field(msg, "ProcessThrottles", atomic.LoadInt64(&input.processThrottles), "count")
+	message.NewInt64Field(msg, "ProcessFileMultipart", atomic.LoadInt64(&input.processFileMultipart), "count")
+	message.NewInt64Field(msg, "ProcessFileCompressionMismatch", atomic.LoadInt64(&input.processFileCompressionMismatch), "count")
+	message.NewInt64Field(msg, "DecompressTime", atomic.LoadInt64(&input.decompressTime)/int64(time.Millisecond), "ms")
+	message.NewInt64Field(msg, "ProcessFileBadContentType", atomic.LoadInt64(&input.processFileBadContentType), "count")
+	message.NewInt64Field(msg, "ProcessFileTruncated", atomic.LoadInt64(&input.processFileTruncated), "count")
+	message.NewInt64Field(msg, "ListErrors", atomic.LoadInt64(&input.listErrors), "count")
+	message.NewInt64Field(msg, "ListKeysListed", atomic.LoadInt64(&input.listKeysListed), "count")
+	message.NewInt64Field(msg, "ListKeysQueued", atomic.LoadInt64(&input.listKeysQueued), "count")
+	message.NewStringField(msg, "ListErrorPolicy", input.ListErrorPolicy)
+	message.NewInt64Field(msg, "FailedBuckets", int64(len(input.failedBuckets())), "count")
+	message.NewInt64Field(msg, "FailedPartitions", int64(len(input.partitionFailures.Failed())), "count")
+	message.NewInt64Field(msg, "WorkerCount", int64(atomic.LoadUint32(&input.activeWorkers)), "count")
+	if start := atomic.LoadInt64(&input.startTime); start != 0 {
+		elapsed := time.Since(time.Unix(0, start))
+		bytes := atomic.LoadInt64(&input.processMessageBytes)
+		message.NewInt64Field(msg, "Throughput", int64(throughputMBps(bytes, elapsed)*(1<<20)), "B/s")
+	}
+	if last := atomic.LoadInt64(&input.lastActivity); last != 0 {
+		message.NewInt64Field(msg, "SecondsSinceActivity", int64(time.Since(time.Unix(0, last)).Seconds()), "s")
+	}
+	message.NewStringField(msg, "AWSRegion", input.region.Name)
+	message.NewStringField(msg, "S3Endpoint", input.region.S3Endpoint)
+	// Sizes of the objects processed, according to the listing.
+	input.sizes.Report(msg, "ObjectSize")
+	input.compression.Report(msg)
+	for region, n := range input.regionFetches {
+		message.NewInt64Field(msg, fmt.Sprintf("RegionFetches.%s", region), atomic.LoadInt64(n), "count")
+	}
+	if input.PerBucketMetrics {
+		for _, b := range input.buckets {
+			message.NewInt64Field(msg, fmt.Sprintf("%s.ProcessFileCount", b.name), atomic.LoadInt64(&b.processFileCount), "count")
+			message.NewInt64Field(msg, fmt.Sprintf("%s.ProcessFileFailures", b.name), atomic.LoadInt64(&b.processFileFailures), "count")
+			message.NewInt64Field(msg, fmt.Sprintf("%s.ProcessMessageCount", b.name), atomic.LoadInt64(&b.processMessageCount), "count")
+			message.NewInt64Field(msg, fmt.Sprintf("%s.ProcessMessageBytes", b.name), atomic.LoadInt64(&b.processMessageBytes), "B")
+			message.NewInt64Field(msg, fmt.Sprintf("%s.Failed", b.name), int64(atomic.LoadInt32(&b.failed)), "count")
+		}
+	}
+	message.NewInt64Field(msg, "ListDropped", atomic.LoadInt64(&input.listDropped), "count")
+	message.NewInt64Field(msg, "ListDelivered", atomic.LoadInt64(&input.listDelivered), "count")
+	message.NewInt64Field(msg, "ListOlderVersions", atomic.LoadInt64(&input.listOlderVersions), "count")
+	message.NewInt64Field(msg, "VersionAnomalies", atomic.LoadInt64(&input.versionAnomalies), "count")
+	message.NewInt64Field(msg, "ClockSkewErrors", atomic.LoadInt64(&input.clockSkewErrors), "count")
+	message.NewInt64Field(msg, "ConsistencyRetries", atomic.LoadInt64(&input.consistencyRetries), "count")
+	message.NewInt64Field(msg, "AtomicGroupsDelivered", atomic.LoadInt64(&input.atomicGroupsDelivered), "count")
+	message.NewInt64Field(msg, "AtomicGroupsRolledBack", atomic.LoadInt64(&input.atomicGroupsRolledBack), "count")
+	if input.groups != nil {
+		message.NewInt64Field(msg, "AtomicGroupsOpen", int64(input.groups.Open()), "count")
+	}
+	for i, name := range input.schemaNames {
+		message.NewInt64Field(msg, fmt.Sprintf("SchemaMatches.%s", name), atomic.LoadInt64(&input.schemaMatches[i]), "count")
+	}
+	message.NewInt64Field(msg, "RequestsInProgress", int64(input.limiter.InUse()), "count")
+	message.NewInt64Field(msg, "RequestWaitTime", int64(input.limiter.WaitTime()/time.Millisecond), "ms")
+	message.NewInt64Field(msg, "FileCompleteFailures", atomic.LoadInt64(&input.fileCompleteFailures), "count")
+	message.NewInt64Field(msg, "ListUnexpectedDepth", atomic.LoadInt64(&input.progress.UnexpectedDepth), "count")
+	for i := range input.progress.Total {
+		message.NewInt64Field(msg, fmt.Sprintf("Dim%dCompleted", i), atomic.LoadInt64(&input.progress.Completed[i]), "count")
+		message.NewInt64Field(msg, fmt.Sprintf("Dim%dTotal", i), atomic.LoadInt64(&input.progress.Total[i]), "count")
+	}
 
 	return nil
 }
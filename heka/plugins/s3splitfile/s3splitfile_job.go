@@ -0,0 +1,57 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	"github.com/bbangert/toml"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Merge the settings in the given TOML job file over the config, e.g. a
+// backfill's schema_file, s3_bucket_prefix and s3_worker_count. Anything the
+// job file doesn't mention keeps its value from the main config.
+func applyJobFile(conf *S3SplitFileInputConfig, path string) error {
+	raw := map[string]interface{}{}
+	if _, err := toml.DecodeFile(path, &raw); err != nil {
+		return err
+	}
+	if err := checkJobOverrides(raw, conf); err != nil {
+		return err
+	}
+	_, err := toml.DecodeFile(path, conf)
+	return err
+}
+
+// Make sure every setting in a job file is one the config has, so a typo in
+// a backfill's parameters fails the run instead of being quietly ignored. A
+// job file can't name another job file.
+func checkJobOverrides(raw map[string]interface{}, conf interface{}) error {
+	known := map[string]bool{}
+	t := reflect.TypeOf(conf)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("toml"), ",")[0]; name != "" {
+			known[name] = true
+		}
+	}
+	var unknown []string
+	for key := range raw {
+		if !known[key] || key == "job_file" {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("can't override %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A local copy of the (schema-filtered) listing of a bucket prefix, so that
+// repeated runs over a mostly static prefix don't need to re-list it. The
+// first line identifies the listing ("s3://bucket/prefix"), and each
+// subsequent line is a tab-separated "<size> <etag> <last modified> <key>".
+type ListCache struct {
+	Path string
+	// How long a cached listing remains usable.
+	TTL time.Duration
+	// Ignore any existing cache, and replace it with a fresh listing.
+	Refresh bool
+}
+
+func listCacheId(bucket *s3.Bucket, prefix string) string {
+	name := ""
+	if bucket != nil {
+		name = bucket.Name
+	}
+	return fmt.Sprintf("s3://%s/%s", name, prefix)
+}
+
+// Determine whether the cache holds a usable listing of the given prefix.
+func (lc *ListCache) Fresh(bucket *s3.Bucket, prefix string) bool {
+	if lc.Refresh {
+		return false
+	}
+	fi, err := os.Stat(lc.Path)
+	if err != nil || time.Since(fi.ModTime()) > lc.TTL {
+		return false
+	}
+	f, err := os.Open(lc.Path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	return scanner.Scan() && scanner.Text() == listCacheId(bucket, prefix)
+}
+
+// List the given prefix, from the cache if it is fresh. Otherwise list it
+// from S3, saving the results to the cache if the listing completes without
+// errors.
+func (lc *ListCache) Iterator(bucket *s3.Bucket, prefix string, schema Schema, opts *ListOptions) <-chan S3ListResult {
+	kc := make(chan S3ListResult, listBatchSize)
+	if lc.Fresh(bucket, prefix) {
+		go lc.read(kc)
+	} else {
+		go lc.write(bucket, prefix, S3IteratorWithOptions(bucket, prefix, schema, opts), kc)
+	}
+	return kc
+}
+
+func (lc *ListCache) read(kc chan S3ListResult) {
+	defer close(kc)
+	f, err := os.Open(lc.Path)
+	if err != nil {
+		kc <- S3ListResult{s3.Key{}, err}
+		return
+	}
+	defer f.Close()
+
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		if lineNum == 1 {
+			continue
+		}
+		pieces := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(pieces) != 4 {
+			kc <- S3ListResult{s3.Key{}, fmt.Errorf("Invalid line %d in list cache %s", lineNum, lc.Path)}
+			continue
+		}
+		size, err := strconv.ParseInt(pieces[0], 10, 64)
+		if err != nil {
+			kc <- S3ListResult{s3.Key{}, fmt.Errorf("Invalid line %d in list cache %s: %s", lineNum, lc.Path, err)}
+			continue
+		}
+		kc <- S3ListResult{s3.Key{Key: pieces[3], Size: size, ETag: pieces[1], LastModified: pieces[2]}, nil}
+	}
+	if err = scanner.Err(); err != nil {
+		kc <- S3ListResult{s3.Key{}, err}
+	}
+}
+
+// Pass along the results from `iter`, and save them to the cache. The new
+// cache is written alongside the old one and only replaces it once the
+// listing is complete, so a failed listing leaves the old cache alone.
+func (lc *ListCache) write(bucket *s3.Bucket, prefix string, iter <-chan S3ListResult, kc chan S3ListResult) {
+	defer close(kc)
+	tmpPath := lc.Path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		kc <- S3ListResult{s3.Key{}, fmt.Errorf("Unable to write list cache: %s", err)}
+	}
+	var w *bufio.Writer
+	if f != nil {
+		w = bufio.NewWriter(f)
+		fmt.Fprintln(w, listCacheId(bucket, prefix))
+	}
+
+	complete := true
+	for r := range iter {
+		if r.Err != nil {
+			complete = false
+		} else if w != nil {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", r.Key.Size, r.Key.ETag, r.Key.LastModified, r.Key.Key)
+		}
+		kc <- r
+	}
+
+	if f == nil {
+		return
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil && complete {
+		err = os.Rename(tmpPath, lc.Path)
+	} else {
+		os.Remove(tmpPath)
+	}
+	if err != nil {
+		kc <- S3ListResult{s3.Key{}, fmt.Errorf("Unable to write list cache: %s", err)}
+	}
+}
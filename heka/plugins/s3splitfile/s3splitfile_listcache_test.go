@@ -0,0 +1,78 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"github.com/AdRoll/goamz/s3"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func ListCacheSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "listcache-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	bucket := &s3.Bucket{Name: "test-bucket"}
+	keys := []s3.Key{
+		{Key: "a/b/one", Size: 10, ETag: "\"1\"", LastModified: "2015-01-01T00:00:00.000Z"},
+		{Key: "a/b/two", Size: 20, ETag: "\"2\"", LastModified: "2015-01-02T00:00:00.000Z"},
+	}
+	listing := func(results []S3ListResult) <-chan S3ListResult {
+		iter := make(chan S3ListResult, len(results))
+		for _, r := range results {
+			iter <- r
+		}
+		close(iter)
+		return iter
+	}
+	collect := func(kc <-chan S3ListResult) (found []s3.Key) {
+		for r := range kc {
+			c.Expect(r.Err, gs.IsNil)
+			found = append(found, r.Key)
+		}
+		return
+	}
+	lc := &ListCache{Path: filepath.Join(tmpDir, "list"), TTL: time.Hour}
+
+	c.Specify("A complete listing is cached", func() {
+		c.Expect(lc.Fresh(bucket, "a/"), gs.IsFalse)
+		kc := make(chan S3ListResult)
+		go lc.write(bucket, "a/", listing([]S3ListResult{{keys[0], nil}, {keys[1], nil}}), kc)
+		c.Expect(len(collect(kc)), gs.Equals, 2)
+
+		c.Expect(lc.Fresh(bucket, "a/"), gs.IsTrue)
+		c.Expect(lc.Fresh(bucket, "b/"), gs.IsFalse)
+		kc = make(chan S3ListResult)
+		go lc.read(kc)
+		found := collect(kc)
+		c.Expect(len(found), gs.Equals, 2)
+		c.Expect(found[1], gs.Equals, keys[1])
+
+		c.Specify("but not past its TTL", func() {
+			old := time.Now().Add(-2 * time.Hour)
+			c.Assume(os.Chtimes(lc.Path, old, old), gs.IsNil)
+			c.Expect(lc.Fresh(bucket, "a/"), gs.IsFalse)
+		})
+
+		c.Specify("or when refreshing", func() {
+			lc.Refresh = true
+			c.Expect(lc.Fresh(bucket, "a/"), gs.IsFalse)
+		})
+	})
+
+	c.Specify("An incomplete listing is not cached", func() {
+		kc := make(chan S3ListResult)
+		go lc.write(bucket, "a/", listing([]S3ListResult{{keys[0], nil}, {s3.Key{}, os.ErrInvalid}}), kc)
+		for _ = range kc {
+		}
+		c.Expect(lc.Fresh(bucket, "a/"), gs.IsFalse)
+	})
+}
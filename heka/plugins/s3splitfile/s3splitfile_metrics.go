@@ -0,0 +1,207 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	MetricsSinkNone       = ""
+	MetricsSinkStatsd     = "statsd"
+	MetricsSinkPrometheus = "prometheus"
+)
+
+// Largest statsd packet to send, small enough to avoid fragmentation on
+// typical networks.
+const statsdPacketSize = 1432
+
+// Characters that aren't allowed in Prometheus metric names.
+var prometheusNamePattern = regexp.MustCompile("[^a-zA-Z0-9_:]")
+
+// The numeric counters, in name order, for exporting to other systems.
+func numericCounters(counters map[string]interface{}) (names []string, values map[string]int64) {
+	values = map[string]int64{}
+	for name, v := range counters {
+		switch n := v.(type) {
+		case int64:
+			values[name] = n
+		case int:
+			values[name] = int64(n)
+		default:
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// Format the counters as statsd gauges, and group them into packets.
+func statsdPackets(prefix string, counters map[string]interface{}) (packets [][]byte) {
+	names, values := numericCounters(counters)
+	var packet bytes.Buffer
+	for _, name := range names {
+		line := fmt.Sprintf("%s.%s:%d|g", prefix, name, values[name])
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			packets = append(packets, packet.Bytes())
+			packet = bytes.Buffer{}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		packets = append(packets, packet.Bytes())
+	}
+	return
+}
+
+// Write the counters as Prometheus gauges, in the text exposition format.
+func writePrometheus(w io.Writer, prefix string, counters map[string]interface{}) error {
+	names, values := numericCounters(counters)
+	for _, name := range names {
+		metric := prometheusNamePattern.ReplaceAllString(prefix+"_"+name, "_")
+		if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n%s %d\n", metric, metric, values[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// How a run is getting on, written to metrics_flush_path every
+// metrics_flush_interval seconds.
+type MetricsSnapshot struct {
+	Time           time.Time `json:"time"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	// Whether the listing has finished, so that KeysQueued is final.
+	ListingDone bool `json:"listing_done"`
+	// Keys handed to the fetchers so far, and how many of them are yet to be
+	// processed.
+	KeysQueued    int64 `json:"keys_queued"`
+	KeysRemaining int64 `json:"keys_remaining"`
+	// Objects processed and bytes of records read per second, over the run
+	// so far.
+	ObjectsPerSecond float64                `json:"objects_per_second"`
+	BytesPerSecond   float64                `json:"bytes_per_second"`
+	Counters         map[string]interface{} `json:"counters"`
+}
+
+// Sum up the counters as they stand at `now`.
+func newMetricsSnapshot(counters map[string]interface{}, start time.Time, now time.Time, listingDone bool) MetricsSnapshot {
+	_, values := numericCounters(counters)
+	s := MetricsSnapshot{
+		Time:           now,
+		ElapsedSeconds: now.Sub(start).Seconds(),
+		ListingDone:    listingDone,
+		KeysQueued:     values["ListKeysQueued"],
+		Counters:       counters,
+	}
+	if remaining := s.KeysQueued - values["ProcessFileCount"]; remaining > 0 {
+		s.KeysRemaining = remaining
+	}
+	if s.ElapsedSeconds > 0 {
+		s.ObjectsPerSecond = float64(values["ProcessFileCount"]) / s.ElapsedSeconds
+		s.BytesPerSecond = float64(values["ProcessMessageBytes"]) / s.ElapsedSeconds
+	}
+	return s
+}
+
+// Write a MetricsSnapshot to metrics_flush_path every metrics_flush_interval
+// seconds, and once more when we're done, so there's something to tail when
+// Heka's dashboard isn't to hand.
+func (input *S3SplitFileInput) flushMetrics(logError func(error), start time.Time, done chan struct{}) {
+	flush := func() {
+		listingDone := false
+		select {
+		case <-input.listDone:
+			listingDone = true
+		default:
+		}
+		s := newMetricsSnapshot(input.counters(), start, time.Now().UTC(), listingDone)
+		if err := writeJSONFile(input.MetricsFlushPath, s); err != nil {
+			logError(fmt.Errorf("Error writing metrics to %s: %s", input.MetricsFlushPath, err))
+		}
+	}
+	ticker := time.NewTicker(time.Duration(input.MetricsFlushInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			flush()
+			return
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Export our counters to metrics_sink until `done` is closed.
+func (input *S3SplitFileInput) exportMetrics(logError func(error), done chan struct{}) {
+	switch input.MetricsSink {
+	case MetricsSinkStatsd:
+		input.sendStatsd(logError, done)
+	case MetricsSinkPrometheus:
+		input.servePrometheus(logError, done)
+	}
+}
+
+// Send the counters to statsd every metrics_interval seconds, and once more
+// when we're done.
+func (input *S3SplitFileInput) sendStatsd(logError func(error), done chan struct{}) {
+	conn, err := net.Dial("udp", input.MetricsAddr)
+	if err != nil {
+		logError(fmt.Errorf("Unable to send metrics to statsd: %s", err))
+		return
+	}
+	defer conn.Close()
+
+	send := func() {
+		for _, packet := range statsdPackets(input.MetricsPrefix, input.counters()) {
+			if _, err := conn.Write(packet); err != nil {
+				logError(fmt.Errorf("Error sending metrics to statsd: %s", err))
+				return
+			}
+		}
+	}
+	ticker := time.NewTicker(time.Duration(input.MetricsInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			send()
+			return
+		case <-ticker.C:
+			send()
+		}
+	}
+}
+
+// Serve the counters at http://<metrics_addr>/metrics until we're done.
+func (input *S3SplitFileInput) servePrometheus(logError func(error), done chan struct{}) {
+	listener, err := net.Listen("tcp", input.MetricsAddr)
+	if err != nil {
+		logError(fmt.Errorf("Unable to serve Prometheus metrics: %s", err))
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w, input.MetricsPrefix, input.counters())
+	})
+	go http.Serve(listener, mux)
+	<-done
+	listener.Close()
+}
@@ -7,6 +7,7 @@
 package s3splitfile
 
 import (
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"github.com/AdRoll/goamz/aws"
@@ -14,6 +15,7 @@ import (
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	"github.com/mreid-moz/golang-lru"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -33,6 +35,9 @@ type S3SplitFileOutput struct {
 	processMessageFailures     int64
 	processMessageBytes        int64
 	encodeMessageFailures      int64
+	compactionObjects          int64
+	compactedObjects           int64
+	compactionFailures         int64
 
 	*S3SplitFileOutputConfig
 	perm         os.FileMode
@@ -44,6 +49,7 @@ type S3SplitFileOutput struct {
 	bucket       *s3.Bucket
 	publishChan  chan PublishAttempt
 	shuttingDown bool
+	compactStop  chan struct{}
 }
 
 // ConfigStruct for S3SplitFileOutput plugin.
@@ -96,6 +102,33 @@ type S3SplitFileOutputConfig struct {
 	S3ConnectTimeout uint32 `toml:"s3_connect_timeout"`
 	S3ReadTimeout    uint32 `toml:"s3_read_timeout"`
 	S3WorkerCount    uint32 `toml:"s3_worker_count"`
+	// Use the region's FIPS S3 endpoint (only available in some US regions).
+	AWSUseFIPS bool `toml:"aws_use_fips"`
+
+	// Compress files as they are published to S3. Either "none" (the default)
+	// or "gzip", which is the only codec S3SplitFileInput can decompress.
+	OutputCompression string `toml:"output_compression"`
+
+	// Compression level, from 1 (fastest) to 9 (smallest), or -1 for the
+	// codec's default.
+	OutputCompressionLevel int `toml:"output_compression_level"`
+
+	// Appended to the name of each compressed file (default ".gz", which is
+	// what S3SplitFileInput looks for with `decompress = "auto"`).
+	OutputCompressionSuffix string `toml:"output_compression_suffix"`
+
+	// Every compaction_interval seconds, merge the published objects in each
+	// partition that are smaller than compaction_target_size bytes (and at
+	// least one interval old) into objects of up to that size, so that
+	// readers have fewer objects to list and fetch. Each merged object is
+	// uploaded and checked before the originals are deleted, so a failure
+	// never loses records, though stopping part way through a merge can leave
+	// some records in both. Readers fetching an object while it's merged will
+	// find it gone, so compact outside of the hours they run, and only enable
+	// this on one of the outputs writing to a given prefix. 0 (the default)
+	// disables compaction.
+	CompactionInterval   uint32 `toml:"compaction_interval"`
+	CompactionTargetSize uint32 `toml:"compaction_target_size"`
 }
 
 // Info for a single split file
@@ -125,12 +158,20 @@ func (o *S3SplitFileOutput) ConfigStruct() interface{} {
 		AWSKey:           "",
 		AWSSecretKey:     "",
 		AWSRegion:        "us-west-2",
+		AWSUseFIPS:       false,
 		S3Bucket:         "",
 		S3BucketPrefix:   "",
 		S3Retries:        5,
 		S3ConnectTimeout: 60,
 		S3ReadTimeout:    60,
 		S3WorkerCount:    10,
+
+		OutputCompression:       DecompressNone,
+		OutputCompressionLevel:  gzip.DefaultCompression,
+		OutputCompressionSuffix: GzipSuffix,
+
+		CompactionInterval:   0,
+		CompactionTargetSize: 134217728,
 	}
 }
 
@@ -200,9 +241,9 @@ func (o *S3SplitFileOutput) Init(config interface{}) (err error) {
 		if err != nil {
 			return fmt.Errorf("Authentication error: %s\n", err)
 		}
-		region, ok := aws.Regions[conf.AWSRegion]
-		if !ok {
-			return fmt.Errorf("Parameter 'aws_region' must be a valid AWS Region")
+		region, err := ResolveRegion(conf.AWSRegion, conf.AWSUseFIPS)
+		if err != nil {
+			return fmt.Errorf("Parameter 'aws_region' must be a valid AWS Region: %s", err)
 		}
 		s := s3.New(auth, region)
 		s.ConnectTimeout = time.Duration(conf.S3ConnectTimeout) * time.Second
@@ -213,10 +254,30 @@ func (o *S3SplitFileOutput) Init(config interface{}) (err error) {
 		o.bucket = nil
 	}
 
+	switch conf.OutputCompression {
+	case DecompressNone:
+	case DecompressGzip:
+		if _, err = gzip.NewWriterLevel(nil, conf.OutputCompressionLevel); err != nil {
+			return fmt.Errorf("Parameter 'output_compression_level' must be a valid gzip level: %s", err)
+		}
+	default:
+		return fmt.Errorf("Parameter 'output_compression' must be 'none' or 'gzip'")
+	}
+
+	if conf.CompactionInterval > 0 {
+		if o.bucket == nil {
+			return fmt.Errorf("Parameter 'compaction_interval' requires 's3_bucket'")
+		}
+		if conf.CompactionTargetSize < 1 {
+			return fmt.Errorf("Parameter 'compaction_target_size' must be greater than 0")
+		}
+	}
+
 	// Remove any excess path separators from the bucket prefix.
 	conf.S3BucketPrefix = fmt.Sprintf("/%s", strings.Trim(conf.S3BucketPrefix, "/"))
 
 	o.publishChan = make(chan PublishAttempt, 1000)
+	o.compactStop = make(chan struct{})
 
 	o.shuttingDown = false
 
@@ -380,6 +441,10 @@ func (o *S3SplitFileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 		wg.Add(1)
 		go o.publisher(or, &wg)
 	}
+	if o.CompactionInterval > 0 {
+		wg.Add(1)
+		go o.compactor(or, &wg)
+	}
 	wg.Wait()
 	return
 }
@@ -415,6 +480,7 @@ func (o *S3SplitFileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 				o.finalizeAll()
 				o.shuttingDown = true
 				close(o.publishChan)
+				close(o.compactStop)
 				break
 			}
 			dimPath := o.getDimPath(pack)
@@ -506,23 +572,35 @@ func (o *S3SplitFileOutput) publisher(or OutputRunner, wg *sync.WaitGroup) {
 
 			sourcePath := o.getFinalizedFileName(pubFile)
 			destPath := fmt.Sprintf("%s/%s", o.S3BucketPrefix, pubFile)
-			reader, err := os.Open(sourcePath)
+			uploadPath := sourcePath
+			if o.OutputCompression == DecompressGzip {
+				uploadPath = sourcePath + o.OutputCompressionSuffix
+				destPath = destPath + o.OutputCompressionSuffix
+				if err := o.compressFile(sourcePath, uploadPath); err != nil {
+					atomic.AddInt64(&o.processFilePartialFailures, 1)
+					o.retryPublish(pubAttempt, or, fmt.Errorf("Error compressing %s: %s", sourcePath, err))
+					continue
+				}
+			}
+			reader, err := os.Open(uploadPath)
 			if err != nil {
 				atomic.AddInt64(&o.processFilePartialFailures, 1)
-				o.retryPublish(pubAttempt, or, fmt.Errorf("Error opening %s for reading: %s", sourcePath, err))
+				o.retryPublish(pubAttempt, or, fmt.Errorf("Error opening %s for reading: %s", uploadPath, err))
 				continue
 			}
 
 			fi, err := reader.Stat()
 			if err != nil {
+				reader.Close()
 				atomic.AddInt64(&o.processFilePartialFailures, 1)
-				o.retryPublish(pubAttempt, or, fmt.Errorf("Error Stat'ing %s: %s", sourcePath, err))
+				o.retryPublish(pubAttempt, or, fmt.Errorf("Error Stat'ing %s: %s", uploadPath, err))
 				continue
 			}
 
 			startTime = time.Now().UTC()
 			err = o.bucket.PutReader(destPath, reader, fi.Size(), "binary/octet-stream", s3.BucketOwnerFull, s3.Options{})
 			if err != nil {
+				reader.Close()
 				atomic.AddInt64(&o.processFilePartialFailures, 1)
 				o.retryPublish(pubAttempt, or, fmt.Errorf("Error publishing %s to s3://%s%s: %s", sourcePath, o.S3Bucket, destPath, err))
 				continue
@@ -549,6 +627,11 @@ func (o *S3SplitFileOutput) publisher(or OutputRunner, wg *sync.WaitGroup) {
 			if err != nil {
 				or.LogError(fmt.Errorf("Error removing local file '%s' after publishing: %s", sourcePath, err))
 			}
+			if uploadPath != sourcePath {
+				if err = os.Remove(uploadPath); err != nil {
+					or.LogError(fmt.Errorf("Error removing local file '%s' after publishing: %s", uploadPath, err))
+				}
+			}
 
 			// TODO: inject a "success" message into the pipeline
 		}
@@ -557,6 +640,33 @@ func (o *S3SplitFileOutput) publisher(or OutputRunner, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
+// Write a gzipped copy of the file at `src` to `dst`.
+func (o *S3SplitFileOutput) compressFile(src string, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, o.perm)
+	if err != nil {
+		return
+	}
+	gz, err := gzip.NewWriterLevel(out, o.OutputCompressionLevel)
+	if err == nil {
+		if _, err = io.Copy(gz, in); err == nil {
+			err = gz.Close()
+		}
+	}
+	if e := out.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return
+}
+
 func (o *S3SplitFileOutput) ReportMsg(msg *message.Message) error {
 	// If the OpenFileCount is consistently at or near OpenFileLimit, consider
 	// increasing the max_open_files parameter.
@@ -570,6 +680,9 @@ func (o *S3SplitFileOutput) ReportMsg(msg *message.Message) error {
 	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&o.processMessageFailures), "count")
 	message.NewInt64Field(msg, "ProcessMessageBytes", atomic.LoadInt64(&o.processMessageBytes), "B")
 	message.NewInt64Field(msg, "EncodeMessageFailures", atomic.LoadInt64(&o.encodeMessageFailures), "count")
+	message.NewInt64Field(msg, "CompactionObjects", atomic.LoadInt64(&o.compactionObjects), "count")
+	message.NewInt64Field(msg, "CompactedObjects", atomic.LoadInt64(&o.compactedObjects), "count")
+	message.NewInt64Field(msg, "CompactionFailures", atomic.LoadInt64(&o.compactionFailures), "count")
 
 	return nil
 }
@@ -0,0 +1,141 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Fetches the bytes from `start` up to (but not including) `end` of an
+// object, returning them along with the response headers.
+type rangeFetcher func(start int64, end int64) ([]byte, http.Header, error)
+
+type rangedChunk struct {
+	data   []byte
+	header http.Header
+	err    error
+}
+
+var errRangedReaderClosed = errors.New("read from a closed ranged reader")
+
+// Downloads part of an object as a series of byte ranges, fetching up to
+// `concurrency` of them at once, and reads them back in order. This spreads a
+// single large object over several connections, while whatever reads from it
+// still sees one ordered stream. At most `concurrency` + 1 chunks are held in
+// memory at a time: the one being read, and the fetches of those after it.
+// Every chunk must have the same ETag as the first, so that an object
+// overwritten part way through isn't stitched together from two versions.
+type rangedReader struct {
+	fetch       rangeFetcher
+	next, end   int64
+	chunkBytes  int64
+	concurrency int
+	pending     []chan rangedChunk
+	current     []byte
+	etag        string
+	err         error
+	done        chan struct{}
+	closeOnce   sync.Once
+}
+
+// Start fetching the given range of an object, returning the reader and the
+// headers of the first chunk's response once that has arrived.
+func newRangedReader(fetch rangeFetcher, start int64, end int64, chunkBytes int64, concurrency int) (*rangedReader, http.Header, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	rr := &rangedReader{
+		fetch:       fetch,
+		next:        start,
+		end:         end,
+		chunkBytes:  chunkBytes,
+		concurrency: concurrency,
+		done:        make(chan struct{}),
+	}
+	rr.fill()
+	if len(rr.pending) == 0 {
+		return rr, http.Header{}, nil
+	}
+	first := <-rr.pending[0]
+	rr.pending = rr.pending[1:]
+	if first.err != nil {
+		rr.Close()
+		return nil, nil, first.err
+	}
+	rr.current = first.data
+	rr.etag = first.header.Get("ETag")
+	rr.fill()
+	return rr, first.header, nil
+}
+
+// Start fetching chunks until `concurrency` of them are on their way.
+func (rr *rangedReader) fill() {
+	for len(rr.pending) < rr.concurrency && rr.next < rr.end {
+		select {
+		case <-rr.done:
+			return
+		default:
+		}
+		start, end := rr.next, rr.next+rr.chunkBytes
+		if end > rr.end {
+			end = rr.end
+		}
+		rr.next = end
+		// Buffered, so a fetch that finishes after we've closed doesn't hang
+		// around waiting for us.
+		c := make(chan rangedChunk, 1)
+		rr.pending = append(rr.pending, c)
+		go func() {
+			data, header, err := rr.fetch(start, end)
+			if err == nil && int64(len(data)) != end-start {
+				err = fmt.Errorf("got %d bytes of the range from %d to %d, expected %d", len(data), start, end, end-start)
+			}
+			c <- rangedChunk{data, header, err}
+		}()
+	}
+}
+
+func (rr *rangedReader) Read(p []byte) (n int, err error) {
+	for len(rr.current) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		if len(rr.pending) == 0 {
+			return 0, io.EOF
+		}
+		var chunk rangedChunk
+		select {
+		case chunk = <-rr.pending[0]:
+		case <-rr.done:
+			return 0, errRangedReaderClosed
+		}
+		rr.pending = rr.pending[1:]
+		if chunk.err == nil && chunk.header.Get("ETag") != rr.etag {
+			chunk.err = fmt.Errorf("object changed while being read (ETag %s, was %s)", chunk.header.Get("ETag"), rr.etag)
+		}
+		rr.current, rr.err = chunk.data, chunk.err
+		if rr.err == nil {
+			rr.fill()
+		}
+	}
+	n = copy(p, rr.current)
+	rr.current = rr.current[n:]
+	return n, nil
+}
+
+// Stop reading, making any read in progress return an error. Chunks that
+// are still being fetched are discarded when they arrive.
+func (rr *rangedReader) Close() error {
+	rr.closeOnce.Do(func() {
+		close(rr.done)
+	})
+	return nil
+}
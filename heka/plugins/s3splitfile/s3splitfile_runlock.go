@@ -0,0 +1,146 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/s3"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait after writing a lock to S3 before checking that no other
+// run has overwritten it.
+const runLockSettleTime = 5 * time.Second
+
+// Held for the length of a run, so that two runs sharing a checkpoint (such
+// as the same backfill started twice) can't both go ahead. A local lock is a
+// file that only one run can create. A lock stored in S3 (given as
+// "s3://bucket/key") is an object naming the run that holds it. S3 can't
+// create an object only if it doesn't already exist, so after writing the
+// lock we wait for runLockSettleTime and read it back, giving way if another
+// run has replaced it; only runs starting within that time of each other
+// can both go ahead.
+//
+// A run that dies without releasing its lock leaves it behind, and it must be
+// removed by hand once it's clear that run is gone.
+type RunLock struct {
+	// Guards bucket, which setAuth replaces.
+	lock   sync.Mutex
+	path   string
+	bucket *s3.Bucket
+	owner  string
+}
+
+// Take the lock at the given local path or S3 URL, failing if another run
+// holds it. Locks in S3 use the connection settings of `s`.
+func AcquireRunLock(path string, s *s3.S3) (rl *RunLock, err error) {
+	host, _ := os.Hostname()
+	rl = &RunLock{
+		path:  path,
+		owner: fmt.Sprintf("%s pid %d at %s (%s)\n", host, os.Getpid(), time.Now().UTC().Format(time.RFC3339), uuid.NewRandom()),
+	}
+	if strings.HasPrefix(path, "s3://") {
+		pieces := strings.SplitN(strings.TrimPrefix(path, "s3://"), "/", 2)
+		if len(pieces) != 2 || pieces[0] == "" || pieces[1] == "" {
+			return nil, fmt.Errorf("invalid S3 location %s, expected s3://bucket/key", path)
+		}
+		if s == nil {
+			return nil, fmt.Errorf("can't use %s without an S3 connection", path)
+		}
+		rl.bucket = s.Bucket(pieces[0])
+		rl.path = pieces[1]
+		return rl, rl.acquireS3()
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		held, _ := ioutil.ReadFile(path)
+		return nil, rl.heldError(string(held))
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err = f.WriteString(rl.owner); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return rl, nil
+}
+
+func (rl *RunLock) acquireS3() error {
+	held, err := rl.holder()
+	if err != nil {
+		return err
+	}
+	if held != "" {
+		return rl.heldError(held)
+	}
+	if err = rl.bucket.Put(rl.path, []byte(rl.owner), "text/plain", s3.BucketOwnerFull, s3.Options{}); err != nil {
+		return err
+	}
+	time.Sleep(runLockSettleTime)
+	if held, err = rl.holder(); err != nil {
+		return err
+	}
+	if held != rl.owner {
+		// Another run got there at the same time, and it's theirs now.
+		return rl.heldError(held)
+	}
+	return nil
+}
+
+// Who holds the lock in S3, or "" if nobody does.
+func (rl *RunLock) holder() (string, error) {
+	data, err := rl.bucket.Get(rl.path)
+	if isNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (rl *RunLock) heldError(holder string) error {
+	return fmt.Errorf("%s is held by another run (%s), remove it if that run has ended", rl.path, strings.TrimSpace(holder))
+}
+
+// Switch to new credentials for releasing the lock.
+func (rl *RunLock) setAuth(auth aws.Auth) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.bucket != nil {
+		rl.bucket = withAuth(rl.bucket, auth)
+	}
+}
+
+// Give up the lock. A lock in S3 that another run has since taken over is
+// left alone.
+func (rl *RunLock) Release() error {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.bucket == nil {
+		return os.Remove(rl.path)
+	}
+	held, err := rl.holder()
+	if err != nil {
+		return err
+	}
+	if held != rl.owner {
+		return fmt.Errorf("%s is no longer ours to release (held by %s)", rl.path, strings.TrimSpace(held))
+	}
+	return rl.bucket.Del(rl.path)
+}
@@ -0,0 +1,50 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func RunLockSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "runlock-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "run.lock")
+
+	c.Specify("Only one run holds the lock", func() {
+		lock, err := AcquireRunLock(path, nil)
+		c.Assume(err, gs.IsNil)
+		held, err := ioutil.ReadFile(path)
+		c.Expect(err, gs.IsNil)
+		host, _ := os.Hostname()
+		c.Expect(strings.HasPrefix(string(held), host+" pid "), gs.IsTrue)
+
+		_, err = AcquireRunLock(path, nil)
+		c.Assume(err, gs.Not(gs.IsNil))
+		c.Expect(strings.Contains(err.Error(), "held by another run"), gs.IsTrue)
+
+		c.Expect(lock.Release(), gs.IsNil)
+		_, err = os.Stat(path)
+		c.Expect(os.IsNotExist(err), gs.IsTrue)
+
+		lock, err = AcquireRunLock(path, nil)
+		c.Expect(err, gs.IsNil)
+		c.Expect(lock.Release(), gs.IsNil)
+	})
+
+	c.Specify("S3 locks need a valid location", func() {
+		_, err := AcquireRunLock("s3://bucket-only", nil)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = AcquireRunLock("s3://bucket/run.lock", nil)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
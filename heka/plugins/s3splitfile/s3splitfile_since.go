@@ -0,0 +1,89 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A high-water mark for incremental processing of append-only buckets. The
+// file holds a single S3 timestamp, and only objects modified after it are
+// processed. Unlike a checkpoint, it doesn't track individual keys, so an
+// object modified at exactly the stored time is not picked up later.
+type SinceFile struct {
+	sync.Mutex
+	path   string
+	since  time.Time
+	newest time.Time
+}
+
+// Load the high-water mark from the given file. A missing file means
+// everything is new.
+func LoadSinceFile(path string) (sf *SinceFile, err error) {
+	sf = &SinceFile{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return sf, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if s := strings.TrimSpace(string(data)); s != "" {
+		sf.since, err = time.Parse(s3TimeFormat, s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid timestamp in %s: %s", path, err)
+		}
+	}
+	sf.newest = sf.since
+	return sf, nil
+}
+
+// The stored high-water mark, or the zero time if there isn't one.
+func (sf *SinceFile) Since() time.Time {
+	return sf.since
+}
+
+// Determine whether the given object was modified after the stored mark.
+// Objects without a usable LastModified are treated as new.
+func (sf *SinceFile) IsNew(key s3.Key) bool {
+	lastModified, err := time.Parse(s3TimeFormat, key.LastModified)
+	return err != nil || lastModified.After(sf.since)
+}
+
+// Note that the given object has been processed, so the mark may advance to
+// its LastModified.
+func (sf *SinceFile) Processed(key s3.Key) {
+	lastModified, err := time.Parse(s3TimeFormat, key.LastModified)
+	if err != nil {
+		return
+	}
+	sf.Lock()
+	defer sf.Unlock()
+	if lastModified.After(sf.newest) {
+		sf.newest = lastModified
+	}
+}
+
+// Write the newest LastModified processed so far to the file, replacing it
+// only once the new one is complete.
+func (sf *SinceFile) Save() error {
+	sf.Lock()
+	defer sf.Unlock()
+	if sf.newest.IsZero() {
+		return nil
+	}
+	tmpPath := sf.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(sf.newest.UTC().Format(s3TimeFormat)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, sf.path)
+}
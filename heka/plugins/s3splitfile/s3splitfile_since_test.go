@@ -0,0 +1,59 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"github.com/AdRoll/goamz/s3"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func SinceFileSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "since-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "since")
+	older := s3.Key{Key: "a/one", LastModified: "2015-01-01T00:00:00.000Z"}
+	newer := s3.Key{Key: "a/two", LastModified: "2015-01-02T00:00:00.000Z"}
+
+	c.Specify("Everything is new without a since file", func() {
+		sf, err := LoadSinceFile(path)
+		c.Expect(err, gs.IsNil)
+		c.Expect(sf.IsNew(older), gs.IsTrue)
+		c.Expect(sf.IsNew(s3.Key{Key: "a/unknown"}), gs.IsTrue)
+
+		c.Specify("and nothing is saved until something is processed", func() {
+			c.Expect(sf.Save(), gs.IsNil)
+			_, err := os.Stat(path)
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+		})
+	})
+
+	c.Specify("The newest processed object is saved", func() {
+		sf, err := LoadSinceFile(path)
+		c.Assume(err, gs.IsNil)
+		sf.Processed(newer)
+		sf.Processed(older)
+		c.Expect(sf.Save(), gs.IsNil)
+
+		sf, err = LoadSinceFile(path)
+		c.Expect(err, gs.IsNil)
+		c.Expect(sf.Since().Format(s3TimeFormat), gs.Equals, newer.LastModified)
+		c.Expect(sf.IsNew(older), gs.IsFalse)
+		c.Expect(sf.IsNew(newer), gs.IsFalse)
+		c.Expect(sf.IsNew(s3.Key{Key: "a/three", LastModified: "2015-01-03T00:00:00.000Z"}), gs.IsTrue)
+	})
+
+	c.Specify("An invalid since file is an error", func() {
+		c.Assume(ioutil.WriteFile(path, []byte("yesterday\n"), 0644), gs.IsNil)
+		_, err := LoadSinceFile(path)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,115 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/AdRoll/goamz/s3"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A saved listing, so that a later run can process only the objects that are
+// new or have changed (by ETag) since. Each line is a tab-separated
+// "<etag> <key>". Unlike since_file, this catches objects that are re-uploaded
+// with an old timestamp, and objects modified at the same time as the newest
+// one seen by the previous run.
+type ListingSnapshot struct {
+	sync.Mutex
+	path     string
+	previous map[string]string
+	current  map[string]string
+}
+
+// Load the previous listing from the given file, if there is one.
+func LoadListingSnapshot(path string) (ls *ListingSnapshot, err error) {
+	ls = &ListingSnapshot{
+		path:     path,
+		previous: map[string]string{},
+		current:  map[string]string{},
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ls, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		pieces := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(pieces) != 2 {
+			return nil, fmt.Errorf("Invalid line %d in listing snapshot %s", lineNum, path)
+		}
+		ls.previous[pieces[1]] = pieces[0]
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// Record the given object as part of the current listing, and determine
+// whether it's new or changed since the previous one.
+func (ls *ListingSnapshot) Add(key s3.Key) (changed bool) {
+	changed = ls.Changed(key)
+	ls.Done(key)
+	return
+}
+
+// Determine whether the given object is new or changed since the previous
+// listing. An unchanged object stays part of the current listing; a new or
+// changed one only becomes part of it once it's Done, so one that's skipped
+// or fails is still new to the next run.
+func (ls *ListingSnapshot) Changed(key s3.Key) bool {
+	ls.Lock()
+	defer ls.Unlock()
+	etag, ok := ls.previous[key.Key]
+	if ok && etag == key.ETag {
+		ls.current[key.Key] = key.ETag
+		return false
+	}
+	return true
+}
+
+// Record that the given object has been processed, as part of the current
+// listing.
+func (ls *ListingSnapshot) Done(key s3.Key) {
+	ls.Lock()
+	defer ls.Unlock()
+	ls.current[key.Key] = key.ETag
+}
+
+// Replace the saved listing with the current one.
+func (ls *ListingSnapshot) Save() error {
+	ls.Lock()
+	defer ls.Unlock()
+	tmpPath := ls.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for key, etag := range ls.current {
+		fmt.Fprintf(w, "%s\t%s\n", etag, key)
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, ls.path)
+}
@@ -0,0 +1,71 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"github.com/AdRoll/goamz/s3"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func ListingSnapshotSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "snapshot-tests")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	path := filepath.Join(tmpDir, "snapshot")
+	one := s3.Key{Key: "a/one", ETag: "\"1\""}
+	two := s3.Key{Key: "a/two", ETag: "\"2\""}
+
+	c.Specify("Everything is new without a snapshot", func() {
+		ls, err := LoadListingSnapshot(path)
+		c.Expect(err, gs.IsNil)
+		c.Expect(ls.Add(one), gs.IsTrue)
+		c.Expect(ls.Add(two), gs.IsTrue)
+
+		c.Specify("and only changes are new after saving", func() {
+			c.Expect(ls.Save(), gs.IsNil)
+			ls, err := LoadListingSnapshot(path)
+			c.Expect(err, gs.IsNil)
+			c.Expect(ls.Add(one), gs.IsFalse)
+			c.Expect(ls.Add(s3.Key{Key: "a/two", ETag: "\"2b\""}), gs.IsTrue)
+			c.Expect(ls.Add(s3.Key{Key: "a/three", ETag: "\"3\""}), gs.IsTrue)
+		})
+	})
+
+	c.Specify("Objects that aren't done stay new", func() {
+		ls, err := LoadListingSnapshot(path)
+		c.Assume(err, gs.IsNil)
+		ls.Add(one)
+		c.Assume(ls.Save(), gs.IsNil)
+
+		ls, err = LoadListingSnapshot(path)
+		c.Assume(err, gs.IsNil)
+		c.Expect(ls.Changed(one), gs.IsFalse)
+		c.Expect(ls.Changed(two), gs.IsTrue)
+		c.Expect(ls.Save(), gs.IsNil)
+
+		ls, err = LoadListingSnapshot(path)
+		c.Assume(err, gs.IsNil)
+		c.Expect(ls.Changed(one), gs.IsFalse)
+		c.Expect(ls.Changed(two), gs.IsTrue)
+		ls.Done(two)
+		c.Expect(ls.Save(), gs.IsNil)
+
+		ls, err = LoadListingSnapshot(path)
+		c.Assume(err, gs.IsNil)
+		c.Expect(ls.Changed(two), gs.IsFalse)
+	})
+
+	c.Specify("An invalid snapshot is an error", func() {
+		c.Assume(ioutil.WriteFile(path, []byte("no tab here\n"), 0644), gs.IsNil)
+		_, err := LoadListingSnapshot(path)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,81 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Initialized, but not running yet.
+	StateIdle = "idle"
+	// Listing and fetching objects.
+	StateRunning = "running"
+	// Stop has been called, and the input is finishing what it was doing.
+	StateStopping = "stopping"
+	// Run has returned.
+	StateComplete = "complete"
+)
+
+// Values of S3SplitFileInput.runState.
+const (
+	runIdle int32 = iota
+	runRunning
+	runComplete
+)
+
+// A snapshot of what an S3SplitFileInput is up to, for supervisors that need
+// to tell whether it's healthy. An input whose LastActivity stops advancing
+// while it's running is probably stuck (e.g. on a GET that never completes).
+type InputStatus struct {
+	State     string    `json:"state"`
+	StartTime time.Time `json:"start_time"`
+	// When we last listed an object or delivered a record.
+	LastActivity time.Time              `json:"last_activity"`
+	Counters     map[string]interface{} `json:"counters"`
+	// Buckets whose remaining objects are being skipped, having reached
+	// bucket_max_file_failures.
+	FailedBuckets []string `json:"failed_buckets,omitempty"`
+	// Partitions whose remaining objects are being skipped, having reached
+	// partition_max_file_failures.
+	FailedPartitions []string `json:"failed_partitions,omitempty"`
+}
+
+// Get the current status of the input. This is safe to call at any time
+// after Init, from any goroutine.
+func (input *S3SplitFileInput) Status() InputStatus {
+	s := InputStatus{
+		State:            StateIdle,
+		Counters:         input.counters(),
+		FailedBuckets:    input.failedBuckets(),
+		FailedPartitions: input.partitionFailures.Failed(),
+	}
+	switch atomic.LoadInt32(&input.runState) {
+	case runRunning:
+		s.State = StateRunning
+		select {
+		case <-input.stop:
+			s.State = StateStopping
+		default:
+		}
+	case runComplete:
+		s.State = StateComplete
+	}
+	if start := atomic.LoadInt64(&input.startTime); start != 0 {
+		s.StartTime = time.Unix(0, start).UTC()
+	}
+	if last := atomic.LoadInt64(&input.lastActivity); last != 0 {
+		s.LastActivity = time.Unix(0, last).UTC()
+	}
+	return s
+}
+
+// Note that the input is making progress.
+func (input *S3SplitFileInput) touch() {
+	atomic.StoreInt64(&input.lastActivity, time.Now().UnixNano())
+}
@@ -0,0 +1,108 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	// Every listed object was processed successfully.
+	RunComplete = "complete"
+	// The input was stopped before it had processed everything.
+	RunIncomplete = "incomplete"
+	// Some objects couldn't be processed, or the run ended with an error.
+	RunFailed = "failed"
+)
+
+// A machine-readable account of an S3SplitFileInput run, written to
+// summary_path at the end of Run.
+type RunSummary struct {
+	Status              string                 `json:"status"`
+	Error               string                 `json:"error,omitempty"`
+	StartTime           time.Time              `json:"start_time"`
+	EndTime             time.Time              `json:"end_time"`
+	DurationSeconds     float64                `json:"duration_seconds"`
+	ListDurationSeconds float64                `json:"list_duration_seconds"`
+	Counters            map[string]interface{} `json:"counters"`
+	// Records read from each partition, with partition_counts.
+	PartitionRecords map[string]int64 `json:"partition_records,omitempty"`
+	// The expected partitions that yielded no records, with
+	// partition_coverage.
+	MissingPartitions []string `json:"missing_partitions,omitempty"`
+	// The object the first record came from, with stop_after_first_record.
+	FirstRecordKey string `json:"first_record_key,omitempty"`
+	// The configuration in effect, after defaults and adjustments, with
+	// credentials removed.
+	Config S3SplitFileInputConfig `json:"config"`
+}
+
+// Build a summary of the run so far.
+func (input *S3SplitFileInput) summary(status string, err error, start time.Time, listDuration time.Duration) RunSummary {
+	end := time.Now().UTC()
+	s := RunSummary{
+		Status:              status,
+		StartTime:           start,
+		EndTime:             end,
+		DurationSeconds:     end.Sub(start).Seconds(),
+		ListDurationSeconds: listDuration.Seconds(),
+		Config:              *input.S3SplitFileInputConfig,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if s.Config.AWSKey != "" {
+		s.Config.AWSKey = "REDACTED"
+	}
+	if s.Config.AWSSecretKey != "" {
+		s.Config.AWSSecretKey = "REDACTED"
+	}
+
+	s.Counters = input.counters()
+	s.FirstRecordKey = input.firstRecordKey
+	if input.partitions != nil {
+		s.PartitionRecords = input.partitions.Counts()
+		if input.PartitionCoverage {
+			s.MissingPartitions = MissingPartitions(input.expectedPartitions, s.PartitionRecords)
+		}
+	}
+	return s
+}
+
+// Everything we'd report to Heka, by name.
+func (input *S3SplitFileInput) counters() map[string]interface{} {
+	counters := map[string]interface{}{}
+	msg := &message.Message{}
+	input.ReportMsg(msg)
+	for _, f := range msg.Fields {
+		counters[f.GetName()] = f.GetValue()
+	}
+	return counters
+}
+
+// Write the summary to the given path.
+func writeSummary(path string, s RunSummary) error {
+	return writeJSONFile(path, s)
+}
+
+// Write `v` as JSON to the given path. It's written to a temporary file
+// first, so that anything watching the file never sees a partial one.
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
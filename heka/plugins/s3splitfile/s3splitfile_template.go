@@ -0,0 +1,105 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"text/template/parse"
+)
+
+// A text/template that derives a string (such as a message Type) from an
+// object's key. Templates may only refer to the variables they'll be given,
+// e.g. "s3.{{.appUpdateChannel}}", so that a typo is caught when the
+// template is parsed rather than producing "<no value>" for every message.
+type KeyTemplate struct {
+	tmpl *template.Template
+}
+
+// Parse the given template, which may only use the given variables.
+func ParseKeyTemplate(name string, text string, vars []string) (*KeyTemplate, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	allowed := map[string]bool{}
+	for _, v := range vars {
+		allowed[v] = true
+	}
+	if err = checkTemplateNode(tmpl.Tree.Root, allowed); err != nil {
+		return nil, fmt.Errorf("template: %s: %s", name, err)
+	}
+	return &KeyTemplate{tmpl}, nil
+}
+
+// Fill in the template with the given variables.
+func (kt *KeyTemplate) Execute(vars map[string]string) (string, error) {
+	var buf bytes.Buffer
+	if err := kt.tmpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Make sure the given node only refers to allowed variables.
+func checkTemplateNode(node parse.Node, allowed map[string]bool) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := checkTemplateNode(child, allowed); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		return checkTemplateNode(n.Pipe, allowed)
+	case *parse.IfNode:
+		return checkTemplateBranch(&n.BranchNode, allowed)
+	case *parse.RangeNode:
+		return checkTemplateBranch(&n.BranchNode, allowed)
+	case *parse.WithNode:
+		return checkTemplateBranch(&n.BranchNode, allowed)
+	case *parse.TemplateNode:
+		return fmt.Errorf("can't include other templates")
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				if err := checkTemplateNode(arg, allowed); err != nil {
+					return err
+				}
+			}
+		}
+	case *parse.ChainNode:
+		return checkTemplateNode(n.Node, allowed)
+	case *parse.FieldNode:
+		if !allowed[n.Ident[0]] {
+			return fmt.Errorf("unknown variable '%s'", n.Ident[0])
+		}
+	case *parse.VariableNode:
+		// "$" is the data, as "." is outside of range and with.
+		if n.Ident[0] == "$" && len(n.Ident) > 1 && !allowed[n.Ident[1]] {
+			return fmt.Errorf("unknown variable '%s'", n.Ident[1])
+		}
+	}
+	return nil
+}
+
+func checkTemplateBranch(n *parse.BranchNode, allowed map[string]bool) error {
+	if err := checkTemplateNode(n.Pipe, allowed); err != nil {
+		return err
+	}
+	if err := checkTemplateNode(n.List, allowed); err != nil {
+		return err
+	}
+	return checkTemplateNode(n.ElseList, allowed)
+}
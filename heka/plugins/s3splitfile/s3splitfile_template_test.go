@@ -0,0 +1,45 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func KeyTemplateSpec(c gs.Context) {
+	vars := []string{"Bucket", "Key", "channel"}
+
+	c.Specify("Templates are filled in from the key's variables", func() {
+		kt, err := ParseKeyTemplate("type", "s3.{{.channel}}", vars)
+		c.Assume(err, gs.IsNil)
+		value, err := kt.Execute(map[string]string{"Bucket": "b", "Key": "k", "channel": "release"})
+		c.Expect(err, gs.IsNil)
+		c.Expect(value, gs.Equals, "s3.release")
+
+		kt, err = ParseKeyTemplate("type", "{{if .channel}}{{$.Bucket}}.{{.channel}}{{else}}{{printf \"%s-none\" .Bucket}}{{end}}", vars)
+		c.Assume(err, gs.IsNil)
+		value, err = kt.Execute(map[string]string{"Bucket": "b", "Key": "k", "channel": ""})
+		c.Expect(err, gs.IsNil)
+		c.Expect(value, gs.Equals, "b-none")
+	})
+
+	c.Specify("Unknown variables are rejected", func() {
+		_, err := ParseKeyTemplate("type", "s3.{{.chanel}}", vars)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = ParseKeyTemplate("type", "{{if .channel}}{{$.Buckets}}{{end}}", vars)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = ParseKeyTemplate("type", "{{printf \"%s\" .Other}}", vars)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("Invalid templates are rejected", func() {
+		_, err := ParseKeyTemplate("type", "s3.{{.channel", vars)
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = ParseKeyTemplate("type", "{{template \"other\"}}", vars)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
@@ -0,0 +1,113 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+# ***** END LICENSE BLOCK *****/
+
+package s3splitfile
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Undoes an encoding some producer applied to whole objects (say, base64 or
+// a fixed XOR), given the object's stream after any decompression. The
+// splitter reads whatever the returned reader yields.
+type StreamTransform func(r io.Reader) (io.Reader, error)
+
+var (
+	streamTransformsLock sync.Mutex
+	streamTransforms     = map[string]StreamTransform{
+		"base64": func(r io.Reader) (io.Reader, error) {
+			// Line breaks are ignored.
+			return base64.NewDecoder(base64.StdEncoding, r), nil
+		},
+		"hex": func(r io.Reader) (io.Reader, error) {
+			return &hexDecoder{r: r}, nil
+		},
+	}
+)
+
+// Make a transform available by name, for use with the `transforms` setting.
+// Call this from an init function in the package that implements the
+// transform.
+func RegisterStreamTransform(name string, transform StreamTransform) {
+	streamTransformsLock.Lock()
+	defer streamTransformsLock.Unlock()
+	streamTransforms[name] = transform
+}
+
+func getStreamTransform(name string) (transform StreamTransform, ok bool) {
+	streamTransformsLock.Lock()
+	defer streamTransformsLock.Unlock()
+	transform, ok = streamTransforms[name]
+	return
+}
+
+// Chain the named transforms into one, applied in the given order.
+func chainStreamTransforms(names []string) (StreamTransform, error) {
+	var chain []StreamTransform
+	for _, name := range names {
+		t, ok := getStreamTransform(name)
+		if !ok {
+			return nil, fmt.Errorf("no transform named '%s'", name)
+		}
+		chain = append(chain, t)
+	}
+	return func(r io.Reader) (io.Reader, error) {
+		var err error
+		for _, t := range chain {
+			if r, err = t(r); err != nil {
+				return nil, err
+			}
+		}
+		return r, nil
+	}, nil
+}
+
+// Decodes a stream of hex digits, ignoring whitespace (such as line breaks
+// in a hex dump).
+type hexDecoder struct {
+	r       io.Reader
+	raw     [4096]byte
+	pending []byte
+	err     error
+}
+
+func (d *hexDecoder) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		n := len(d.pending) / 2
+		if n > len(p) {
+			n = len(p)
+		}
+		if n > 0 {
+			if _, err := hex.Decode(p[:n], d.pending[:2*n]); err != nil {
+				return 0, err
+			}
+			d.pending = d.pending[2*n:]
+			return n, nil
+		}
+		if d.err != nil {
+			if d.err == io.EOF && len(d.pending) > 0 {
+				return 0, fmt.Errorf("odd number of hex digits")
+			}
+			return 0, d.err
+		}
+		var m int
+		m, d.err = d.r.Read(d.raw[:])
+		for _, c := range d.raw[:m] {
+			switch c {
+			case ' ', '\t', '\r', '\n':
+			default:
+				d.pending = append(d.pending, c)
+			}
+		}
+	}
+}